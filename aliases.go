@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// maxAliasDepth is how many aliases a name may pass through on its way to a
+// model; an alias still unresolved after that is taken to be a cycle.
+const maxAliasDepth = 3
+
+// ModelAliases maps short names, from the -model-alias-file, to models in
+// the form of the models list, or to other aliases.
+type ModelAliases map[string]string
+
+// loadModelAliases reads the JSON object of aliases at path.
+func loadModelAliases(path string) (ModelAliases, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model aliases %s: %w", path, err)
+	}
+	var aliases ModelAliases
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("failed to parse model aliases %s: %w", path, err)
+	}
+	return aliases, nil
+}
+
+// Resolve returns the model name stands for, following aliases of aliases
+// up to maxAliasDepth. A name that is not an alias is returned as is.
+func (a ModelAliases) Resolve(name string) (string, error) {
+	model := name
+	for range maxAliasDepth {
+		next, ok := a[model]
+		if !ok {
+			return model, nil
+		}
+		model = next
+	}
+	if _, ok := a[model]; ok {
+		return "", fmt.Errorf("model alias %q is still an alias after %d expansions; check the aliases for a cycle", name, maxAliasDepth)
+	}
+	return model, nil
+}
+
+// Expand resolves each of names, preserving order.
+func (a ModelAliases) Expand(names []string) ([]string, error) {
+	expanded := make([]string, 0, len(names))
+	for _, name := range names {
+		model, err := a.Resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, model)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestModelAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	writeFile(t, path, `{
+  "grok-fast": "x-ai/grok-code-fast-1",
+  "grok": "grok-fast",
+  "fast": "grok",
+  "fastest": "fast",
+  "ping": "pong",
+  "pong": "ping"
+}`)
+	aliases, err := loadModelAliases(path)
+	if err != nil {
+		t.Fatalf("loadModelAliases: %v", err)
+	}
+
+	got, err := aliases.Expand([]string{"fast", "openai/gpt-5", "grok-fast"})
+	if err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	want := []string{"x-ai/grok-code-fast-1", "openai/gpt-5", "x-ai/grok-code-fast-1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expand = %q, want %q", got, want)
+	}
+
+	// Four aliases deep is past the limit, as is any cycle.
+	for _, name := range []string{"fastest", "ping"} {
+		if model, err := aliases.Resolve(name); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("Resolve(%q) = %q, %v, want a cycle error", name, model, err)
+		}
+	}
+	if _, err := aliases.Expand([]string{"openai/gpt-5", "ping"}); err == nil {
+		t.Error("Expand with a cyclic alias succeeded")
+	}
+
+	writeFile(t, path, `["grok-fast"]`)
+	if _, err := loadModelAliases(path); err == nil {
+		t.Error("loadModelAliases of a JSON array succeeded")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+const (
+	// referenceComplexity is the complexity, in Rust source files plus
+	// Cargo dependencies, of a crate that gets the base number of attempts.
+	referenceComplexity = 15
+	// minScaledAttempts is the fewest attempts -scale-attempts gives a
+	// target, so that a single slip does not fail a trivial crate.
+	minScaledAttempts = 2
+)
+
+// targetComplexity estimates how hard target is to migrate by the number of
+// Rust source files in its package, not counting nested crates, plus the
+// dependencies its Cargo.toml declares.
+func targetComplexity(worktreePath, target string) (int, error) {
+	pkg, _, err := migrate.ParseTargetPackage(target)
+	if err != nil {
+		return 0, err
+	}
+	root := filepath.Join(worktreePath, pkg)
+	sources := 0
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == root {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") || d.Name() == "target" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "Cargo.toml")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), ".rs") {
+			sources++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count sources of %s: %w", target, err)
+	}
+	deps := 0
+	cargo, err := os.ReadFile(filepath.Join(root, "Cargo.toml"))
+	if err == nil {
+		_, deps = cargoPackageInfo(string(cargo))
+	} else if !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read Cargo.toml of %s: %w", target, err)
+	}
+	return sources + deps, nil
+}
+
+// attemptsForTarget scales base, the attempts given to a crate of
+// referenceComplexity, by target's complexity, so that large crates get more
+// attempts and trivial ones fewer. The result is at least minScaledAttempts
+// (or base, if smaller) and at most -max-target-attempts. If the complexity
+// cannot be estimated, base is returned.
+func attemptsForTarget(worktreePath, target string, base int) int {
+	complexity, err := targetComplexity(worktreePath, target)
+	if err != nil {
+		slog.Warn("Could not estimate target complexity; using the base number of attempts", "target", target, "err", err)
+		return base
+	}
+	attempts := int(math.Round(float64(base) * float64(complexity) / referenceComplexity))
+	attempts = max(attempts, min(minScaledAttempts, base))
+	if *maxTargetAttempts > 0 {
+		attempts = min(attempts, *maxTargetAttempts)
+	}
+	slog.Info("Scaled attempts to target complexity", "target", target, "complexity", complexity, "attempts", attempts)
+	return attempts
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+func TestAttemptsForTarget(t *testing.T) {
+	useTestLogger(t)
+	prev := *maxTargetAttempts
+	t.Cleanup(func() { *maxTargetAttempts = prev })
+	*maxTargetAttempts = 7
+
+	wt := t.TempDir()
+	writeFile(t, filepath.Join(wt, "Cargo.toml"), "[package]\nname = \"ripgrep\"\n\n[dependencies]\n"+
+		"grep = { path = \"crates/grep\" }\nignore = { path = \"crates/ignore\" }\nlog = \"0.4\"\n\n[dependencies.serde]\nversion = \"1\"\n")
+	for i := range 20 {
+		writeFile(t, filepath.Join(wt, "crates/core", fmt.Sprintf("f%d.rs", i)), "")
+	}
+	writeFile(t, filepath.Join(wt, "crates/matcher/Cargo.toml"), "[package]\nname = \"grep-matcher\"\n\n[dependencies]\nmemchr = \"2\"\n")
+	writeFile(t, filepath.Join(wt, "crates/matcher/src/lib.rs"), "")
+	writeFile(t, filepath.Join(wt, "crates/matcher/src/interpolate.rs"), "")
+	writeFile(t, filepath.Join(wt, "crates/globset/Cargo.toml"), "[package]\nname = \"globset\"\n\n[dependencies]\naho-corasick = \"1\"\nbstr = \"1\"\nlog = \"0.4\"\nregex-automata = \"0.4\"\nregex-syntax = \"0.8\"\n")
+	for i := range 10 {
+		writeFile(t, filepath.Join(wt, "crates/globset/src", fmt.Sprintf("f%d.rs", i)), "")
+	}
+
+	tests := []struct {
+		target string
+		base   int
+		want   int
+	}{
+		// 20 sources (nested crates excluded) and 4 dependencies: capped.
+		{target: "//:ripgrep", base: 5, want: 7},
+		// 2 sources and 1 dependency: floored.
+		{target: "//crates/matcher:grep_matcher", base: 5, want: minScaledAttempts},
+		{target: "//crates/matcher:grep_matcher", base: 1, want: 1},
+		// 10 sources and 5 dependencies: the reference complexity.
+		{target: "//crates/globset", base: 5, want: 5},
+		{target: "//crates/missing", base: 5, want: 5},
+	}
+	for _, tt := range tests {
+		if got := attemptsForTarget(wt, tt.target, tt.base); got != tt.want {
+			t.Errorf("attemptsForTarget(%s, %d) = %d, want %d", tt.target, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestTargetAttemptLimit(t *testing.T) {
+	useTestLogger(t)
+	errBuild := errors.New("ERROR: build failed")
+	git := migratetest.NewFakeGitManager()
+	llm := &migratetest.FakeLLMRunner{Git: git}
+	m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errBuild, errBuild, errBuild}}, llm)
+	run := migrate.Run{WorktreePath: t.TempDir(), Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard, MaxAttempts: 2}
+
+	result, err := m.MigrateTarget(context.Background(), run)
+	if err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	if result.Success || result.Attempts != 2 || llm.Calls != 2 {
+		t.Errorf("result = %+v after %d aider calls, want failure after 2 attempts", result, llm.Calls)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// auditOutputLimit is how much of a command's output an audit entry keeps,
+// unless replay needs all of it.
+const auditOutputLimit = 1000
+
+// AuditEntry is one command recorded by AuditLogger, written as a JSON line.
+type AuditEntry struct {
+	Time     string   `json:"time"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Dir      string   `json:"dir"`
+	ExitCode int      `json:"exitCode"`
+	Duration string   `json:"duration"`
+	// Output is the first auditOutputLimit bytes of the command's output, or
+	// all of it for the aider runs and attempt diffs that replay uses.
+	Output string `json:"output"`
+}
+
+// AuditLogger records every subprocess the run executes as JSON lines, for
+// debugging and cost analysis after the fact. The git, bazel and aider
+// commands behind the migrate.Migrator's dependencies, and every other
+// command, are run through auditOutput, auditCombinedOutput, auditRun or
+// wrapCommandWithTimeout, which record to commandAudit. A nil *AuditLogger records nothing.
+type AuditLogger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets []string
+}
+
+// NewAuditLogger returns an AuditLogger writing to w.
+func NewAuditLogger(w io.Writer) *AuditLogger {
+	return &AuditLogger{w: w}
+}
+
+// attemptDiffCommand is the Command of the entries RecordDiff writes.
+const attemptDiffCommand = "attempt-diff"
+
+// commandAudit is set from -audit-log.
+var commandAudit *AuditLogger
+
+// Redact replaces secret with *** in everything recorded from now on.
+func (a *AuditLogger) Redact(secret string) {
+	if a == nil || secret == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.secrets = append(a.secrets, secret)
+}
+
+// Record writes an entry for cmd, which started at start and produced output
+// and err.
+func (a *AuditLogger) Record(cmd *exec.Cmd, start time.Time, output []byte, err error) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := AuditEntry{
+		Time:     start.Format(time.RFC3339Nano),
+		Command:  a.redact(cmd.Path),
+		Dir:      cmd.Dir,
+		ExitCode: exitCodeOf(err),
+		Duration: time.Since(start).String(),
+	}
+	for _, arg := range cmd.Args[1:] {
+		entry.Args = append(entry.Args, a.redact(arg))
+	}
+	if _, ok := aiderInvocation(entry); !ok && len(output) > auditOutputLimit {
+		output = output[:auditOutputLimit]
+	}
+	entry.Output = a.redact(string(output))
+	return a.write(entry)
+}
+
+// RecordDiff writes an entry holding diff, the changes the last aider run in
+// dir made, for replay to apply in its place.
+func (a *AuditLogger) RecordDiff(dir, diff string) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.write(AuditEntry{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Command: attemptDiffCommand,
+		Dir:     dir,
+		Output:  a.redact(diff),
+	})
+}
+
+// redact replaces the secrets passed to Redact in s. a.mu must be held.
+func (a *AuditLogger) redact(s string) string {
+	for _, secret := range a.secrets {
+		s = strings.ReplaceAll(s, secret, "***")
+	}
+	return s
+}
+
+// write writes entry as a JSON line. a.mu must be held.
+func (a *AuditLogger) write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+	return nil
+}
+
+// exitCodeOf returns the exit code of a command that returned err: 0 on
+// success and -1 if it did not exit normally (e.g. it was not found).
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// record logs cmd to commandAudit; a failure to write the audit log is
+// reported but does not fail the command.
+func record(cmd *exec.Cmd, start time.Time, output []byte, err error) {
+	if auditErr := commandAudit.Record(cmd, start, output, err); auditErr != nil {
+		fmt.Fprintln(os.Stderr, auditErr)
+	}
+}
+
+// auditOutput is cmd.Output, recorded to the audit log. Like auditCombinedOutput
+// and auditRun, it marks a missing git with migrate.ErrGitNotFound.
+func auditOutput(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.Output()
+	record(cmd, start, out, err)
+	return out, migrate.CommandError(cmd, err)
+}
+
+// auditCombinedOutput is cmd.CombinedOutput, recorded to the audit log.
+func auditCombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	record(cmd, start, out, err)
+	return out, migrate.CommandError(cmd, err)
+}
+
+// auditRun is cmd.Run, recorded to the audit log along with whatever the
+// command wrote to its Stdout and Stderr.
+func auditRun(cmd *exec.Cmd) error {
+	var output cappedBuffer
+	if cmd.Stdout != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, &output)
+	}
+	if cmd.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, &output)
+	}
+	start := time.Now()
+	err := cmd.Run()
+	record(cmd, start, output.Bytes(), err)
+	return migrate.CommandError(cmd, err)
+}
+
+// auditedCommands runs the git commands of package migrate through
+// auditOutput, auditCombinedOutput and auditRun, so that they are recorded
+// like bld's own.
+type auditedCommands struct{}
+
+func (auditedCommands) Output(cmd *exec.Cmd) ([]byte, error)         { return auditOutput(cmd) }
+func (auditedCommands) CombinedOutput(cmd *exec.Cmd) ([]byte, error) { return auditCombinedOutput(cmd) }
+func (auditedCommands) Run(cmd *exec.Cmd) error                      { return auditRun(cmd) }
+
+func init() {
+	migrate.Commands = auditedCommands{}
+}
+
+// cappedBuffer keeps the first auditOutputLimit bytes written to it.
+type cappedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := auditOutputLimit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+// readAuditLog loads the entries of an audit log, e.g. to replay a run.
+func readAuditLog(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	// Aider runs and attempt diffs are recorded whole, so lines can be long.
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse audit log line %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
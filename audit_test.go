@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prev := commandAudit
+	commandAudit = NewAuditLogger(f)
+	t.Cleanup(func() { commandAudit = prev })
+	commandAudit.Redact("s3cret")
+
+	dir := t.TempDir()
+	cmd := exec.Command("sh", "-c", `head -c 2000 /dev/zero | tr '\0' x`, "token=s3cret")
+	cmd.Dir = dir
+	if _, err := auditCombinedOutput(cmd); err != nil {
+		t.Fatalf("auditCombinedOutput: %v", err)
+	}
+	if err := auditRun(exec.Command("sh", "-c", "exit 3")); err == nil {
+		t.Fatal("auditRun of exit 3 succeeded")
+	}
+	if _, err := auditOutput(exec.Command("bld-no-such-command")); err == nil {
+		t.Fatal("auditOutput of a missing command succeeded")
+	}
+
+	entries, err := readAuditLog(path)
+	if err != nil {
+		t.Fatalf("readAuditLog: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d audit entries, want 3", len(entries))
+	}
+	first := entries[0]
+	if !strings.HasSuffix(first.Command, "sh") || first.Dir != dir || first.ExitCode != 0 || first.Time == "" || first.Duration == "" {
+		t.Errorf("first entry = %+v", first)
+	}
+	if len(first.Output) != auditOutputLimit {
+		t.Errorf("output recorded %d bytes, want %d", len(first.Output), auditOutputLimit)
+	}
+	if got := first.Args[len(first.Args)-1]; got != "token=***" {
+		t.Errorf("secret not redacted from args %q", first.Args)
+	}
+	if entries[1].ExitCode != 3 {
+		t.Errorf("exit 3 recorded as %d", entries[1].ExitCode)
+	}
+	if entries[2].ExitCode != -1 {
+		t.Errorf("missing command recorded exit code %d, want -1", entries[2].ExitCode)
+	}
+}
@@ -1,14 +1,127 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+var (
+	fallbackModel           = flag.String("fallback-model", "", "model to retry a target with when the primary model keeps failing with transient provider errors (same form as the models list)")
+	cherryPickFromBest      = flag.Bool("cherry-pick-from-best", false, "after all models run, cherry-pick the first successful commit for each target into the branches of models that failed it")
+	logDir                  = flag.String("log-dir", "logs", "directory for per model/target logs of aider and bazel output")
+	reposDir                = flag.String("repos-dir", "repos", "directory to clone the repos listed in the config into, reusing existing clones")
+	repoRef                 = flag.String("repo-ref", "", "branch, tag or commit SHA to check out in each repo cloned from the config, instead of the default branch")
+	targetsFile             = flag.String("targets-file", "", "read target labels from this file (one per line, # comments) instead of the built-in list")
+	discoverTargets         = flag.Bool("discover-targets", false, "run the Rust targets bazel query finds in each repo instead of the configured list, falling back to the list if the query fails")
+	targetRegex             = flag.String("target-regex", "", "only run targets whose label matches this regular expression")
+	targetFilter            = flag.String("target-filter", "", "alias for -target-regex")
+	modelRegex              = flag.String("model-regex", "", "only run models whose name matches this regular expression")
+	deadline                = flag.Duration("deadline", 0, "stop starting new attempts after this long, write the partial report and exit non-zero unless everything succeeded (0 means no deadline)")
+	repeat                  = flag.Int("repeat", 1, "run each model against each target this many times, each in its own branch and worktree")
+	includeStashInContext   = flag.Bool("include-stash-in-context", false, "show the model the diff of its previous, stashed attempt so it does not repeat it")
+	commitEveryAttempt      = flag.Bool("commit-every-attempt", false, "commit each failed attempt, tagged as failed, and revert it before the next, so model branches keep every attempt")
+	commitOnPartial         = flag.Bool("commit-on-partial", false, "after a model's targets, commit whatever it left uncommitted in its worktree, such as failed attempts kept by -no-stash, so its branch holds all of its work")
+	squashCommits           = flag.Bool("squash-commits", false, "once a model has built every target, squash its branch into a single commit since its base")
+	maxCommits              = flag.Int("max-commits", 0, "squash the oldest commits on each model branch so it has at most this many commits since its base (0 means unlimited)")
+	logFormat               = flag.String("log-format", "text", "log output format: text or json")
+	logLevel                = flag.String("log-level", "info", "minimum log level: debug, info, warn, or error")
+	verifyCleanBuild        = flag.Bool("verify-clean-build", false, "confirm each successful build with a bazel clean and a build that accepts no cache hits before recording success, so cached outputs from earlier attempts cannot pass a broken target (slow)")
+	requireHermetic         = flag.Bool("require-hermetic", false, "reject and re-prompt attempts whose BUILD files reference absolute paths or host tools")
+	includeCrateDocs        = flag.Bool("include-crate-docs", false, "pass each crate's README.md and crate-level lib.rs/main.rs docs to aider as read-only context")
+	maxContextBytes         = flag.Int("max-context-bytes", 16000, "maximum total size of extra read-only context passed to aider per target")
+	maxContextTokens        = flag.Int("max-context-tokens", 8000, "approximate token budget for all read-only context passed to aider per target; the largest files are dropped first (0 means unlimited)")
+	reportPath              = flag.String("report", "", "write a JSON report of all model/target results to this path")
+	cacheDir                = flag.String("cache-dir", "", "reuse BUILD.bazel files that built before for crates whose Cargo.toml and file list are unchanged, storing them under this directory (empty disables)")
+	budget                  = flag.Float64("budget", 0, "stop starting new model/target pairs once the estimated aider spend reaches this many USD (0 means no budget)")
+	skippedPolicy           = flag.String("skipped-policy", "fail", "how model/target pairs skipped by the circuit breaker affect the exit code: fail or ignore")
+	aiderEditFormat         = flag.String("aider-edit-format", "diff", "aider --edit-format: diff, whole, udiff, architect, or auto to pick per model; with diff, an attempt whose BUILD file does not parse is retried once with whole")
+	editFormatAlias         = flag.String("edit-format", "", "alias for -aider-edit-format")
+	scaleAttempts           = flag.Bool("scale-attempts", false, "scale the attempts per target with its complexity (Rust source files plus Cargo dependencies) instead of giving every target the same number")
+	maxTargetAttempts       = flag.Int("max-target-attempts", 10, "most attempts -scale-attempts gives any target (0 means no cap)")
+	keepGoing               = flag.Bool("keep-going", false, "when a target fails all attempts, record the failure and continue with the model's next target instead of stopping")
+	worktreeDir             = flag.String("worktree-dir", "", "directory to create model worktrees in, created if missing (default a new directory under the system temp dir, removed at exit)")
+	keepWorktrees           = flag.Bool("keep-worktrees", false, "do not remove the default temporary worktree directory at exit")
+	seedFromSiblings        = flag.Bool("seed-from-siblings", false, "before invoking aider, try the BUILD.bazel of the most similar already-migrated crate with the crate name substituted")
+	skipCargoGen            = flag.Bool("skip-cargo-gen", false, "do not try a BUILD.bazel generated by -cargo-gen-tool before invoking aider")
+	cargoGenTool            = flag.String("cargo-gen-tool", "cargo2bazel", "command run as `tool <package dir>` in the worktree to generate a BUILD.bazel from Cargo metadata, printing it or writing it in place")
+	noBuildExamples         = flag.Bool("no-build-examples", false, "do not show aider the BUILD.bazel files of targets that already built in the model's worktree as examples")
+	noChatHistory           = flag.Bool("no-chat-history", false, "start every aider invocation with a fresh chat instead of restoring the model's history from earlier targets")
+	noProgressDisplay       = flag.Bool("no-progress-display", false, "do not draw the model/target status matrix on a terminal; log to stderr instead")
+	verify                  = flag.Bool("verify", false, "run no aider; instead build //... in each selected model's existing worktree and report which migrations build as a whole")
+	compareDiffs            = flag.Bool("compare-diffs", false, "run no aider; instead compare the BUILD.bazel each selected model's existing worktree has for each target and print which models converged on the same solution")
+	runTests                = flag.Bool("run-tests", false, "when verifying model worktrees, also run bazel test //...")
+	requestsPerMinute       = flag.Int("requests-per-minute", 0, "limit aider invocations across all models to this many a minute, waiting when over the limit (0 disables)")
+	rateLimitMaxWait        = flag.Duration("rate-limit-max-wait", 300*time.Second, "longest total time to wait out provider rate limits (HTTP 429) within one attempt before giving up")
+	auditLogPath            = flag.String("audit-log", "", "append a JSON line for every command run (time, command, args, dir, exit code, duration, start of output) to this file")
+	strictBazelOnly         = flag.Bool("strict-bazel-only", false, "after each aider attempt, revert changes to files other than BUILD.bazel and MODULE.bazel before building")
+	eventsOut               = flag.String("events-out", "", "write a JSON line for each run, model, target, attempt, build and commit event to this file, or - for stdout")
+	maxBazelCacheGB         = flag.Float64("max-bazel-cache-gb", 0, "before each model, remove the least recently used worktrees, expunging their bazel output first, until the worktrees' bazel output totals at most this many GB (0 means unlimited)")
+	minDiskGB               = flag.Float64("min-disk-gb", 2, "refuse to create a worktree with less than this many GB free, and warn between targets below twice this (0 disables)")
+	bazelExpungeOnCrash     = flag.Bool("bazel-expunge-on-crash", false, "after restarting a crashed bazel server, also run bazel clean --expunge before retrying")
+	bazelCleanOnQueryFail   = flag.Bool("bazel-clean-on-query-fail", false, "run bazel clean whenever a target's pre-check bazel query fails, in case the analysis cache is corrupt")
+	bestOfN                 = flag.Bool("best-of-n", false, "run every model on the first target, then only the -best-of-n-keep models that needed the fewest attempts on the remaining targets")
+	bestOfNKeep             = flag.Int("best-of-n-keep", 3, "how many models -best-of-n keeps after the first target")
+	mode                    = flag.String("mode", "compare", "compare runs every model on every target; select-best races every model on the first target and runs only the first to build it on the rest")
+	concurrency             = flag.Int("concurrency", 1, "how many models -mode select-best races at once on the first target")
+	noStash                 = flag.Bool("no-stash", false, "do not stash a failed attempt's changes before the next aider round, for callers that guarantee the worktree stays clean")
+	aiderExtraArgs          = flag.String("aider-extra-args", "", "flags appended to every aider invocation, separated by commas or spaces with shell-style quoting, e.g. --no-verify,--map-tokens=0; an escape hatch for aider features bld has no flag for, placed after bld's own flags so they can override its defaults")
+	aiderTimeout            = flag.Duration("aider-timeout", 300*time.Second, "stop an aider invocation that runs longer than this, with SIGTERM and then SIGKILL (0 disables)")
+	bazelMinVersion         = flag.String("bazel-min-version", "6.0.0", "warn when bazel is older than this release, the oldest assumed to support bzlmod")
+	bazelTimeout            = flag.Duration("bazel-timeout", 180*time.Second, "stop a bazel invocation that runs longer than this, with SIGTERM and then SIGKILL (0 disables)")
+	branchPrefix            = flag.String("branch-prefix", "", "prepend this to the model part of each model branch name, e.g. bazel/ for <branch>-bazel-openrouter-<model>")
+	promptTemplatePath      = flag.String("prompt-template", "", "text/template file for the aider message, with .Target, .BuildBazelPath, .BazelOutput and .Feedback (default a built-in prompt)")
+	escalate                = flag.Bool("escalate", false, "instead of running every model on every target, give each target to the cheapest model first and to the next cheapest only when a model exhausts its attempts, all in one worktree; models are ranked by the model_ranking config setting, then list price")
+	htmlReportPath          = flag.String("html-report", "", "write an HTML page with a pass/fail grid of all model/target results to this path")
+	notifyWebhook           = flag.String("notify-webhook", "", "POST a JSON summary of the run to this URL when it completes; failures are logged and do not fail the run")
+	lockfileMode            = flag.String("lockfile-mode", "update", "bazel --lockfile_mode for every build, query and test: update, or off so bazel neither reads nor writes MODULE.bazel.lock")
+	maxDiffLines            = flag.Int("max-diff-lines", 0, "reject an attempt that changes more than this many lines, untracked files included, and ask the model for a smaller change (0 disables)")
+	commitLockfile          = flag.Bool("commit-lockfile", false, "commit bazel's changes to MODULE.bazel.lock; by default they are discarded before each commit so model branches differ only in the models' edits")
+	leaderboardPath         = flag.String("leaderboard", "", "JSON file of per-model results accumulated across runs; the run is merged into it at the end, and the leaderboard subcommand prints it")
+	modelStatsPath          = flag.String("model-stats", "", "JSON file of historical per-model results, off by default; if set, models run in order of past success rate and the file is updated after the run")
+	configPath              = flag.String("config", "", "JSON config file for settings such as buildozer_commands")
+	modelAliasFile          = flag.String("model-alias-file", "", "JSON object mapping short names to models, e.g. {\"grok-fast\": \"x-ai/grok-code-fast-1\"}; aliases in the model list, -skip-model and -fallback-model are expanded")
+	circuitBreakerThreshold = flag.Int("circuit-breaker-threshold", 3, "skip a model's remaining targets after this many consecutive failed targets (0 disables)")
 )
 
+// skipModelNames holds the -skip-model values.
+var skipModelNames stringsFlag
+
+// bazelFlagValues holds the -bazel-flags values; use bazelFlags to read them.
+var bazelFlagValues stringsFlag
+
+func init() {
+	flag.Var(&skipModelNames, "skip-model", "exclude this model, as named in the model list without the openrouter/ prefix; may be repeated")
+	flag.Var(&bazelFlagValues, "bazel-flags", "space-separated flags, e.g. --config=remote, added to every bazel build, query and test; may be repeated")
+}
+
+// stringsFlag is a flag.Value collecting every value of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 var models = []string{
 	// openrouter top 10 programming weekly as of 2025-09-08
 	"x-ai/grok-code-fast-1",
@@ -23,6 +136,28 @@ var models = []string{
 	"x-ai/grok-4",
 }
 
+// autoEditFormats is the -aider-edit-format=auto choice for models that do
+// better with something other than diff. Smaller models often fail to
+// produce search/replace blocks that apply, so they rewrite whole files.
+var autoEditFormats = map[string]string{
+	"google/gemini-2.5-flash": "whole",
+	"openai/gpt-4.1-mini":     "whole",
+	"x-ai/grok-code-fast-1":   "whole",
+}
+
+// resolveEditFormat returns the aider edit format to use for llmModel: format
+// itself, or with "auto" the model's entry in autoEditFormats, defaulting to
+// diff.
+func resolveEditFormat(format, llmModel string) string {
+	if format != "auto" {
+		return format
+	}
+	if f, ok := autoEditFormats[strings.TrimPrefix(llmModel, "openrouter/")]; ok {
+		return f
+	}
+	return "diff"
+}
+
 var targets = []string{
 	"//crates/matcher:grep_matcher",
 	"//crates/matcher:integration_test",
@@ -38,352 +173,1371 @@ var targets = []string{
 	"//:integration_test",
 }
 
-// sanitizePath replaces characters that are unsafe in file paths with hyphens.
-func sanitizePath(s string) string {
-	s = strings.ReplaceAll(s, "/", "-")
-	s = strings.ReplaceAll(s, ":", "-")
-	return s
+// deadlineGrace is how long in-flight commands may keep running after the
+// -deadline before they are killed.
+const deadlineGrace = 5 * time.Minute
+
+// runDeadline is when the run stops starting new work; zero means never.
+var runDeadline time.Time
+
+// pastDeadline reports whether the -deadline has been reached, or the run
+// was interrupted, so no new work should start.
+func pastDeadline() bool {
+	return interrupted.Load() || !runDeadline.IsZero() && time.Now().After(runDeadline)
 }
 
-// getGitBranch returns the current git branch name for a given directory.
-func getGitBranch(dir string) (string, error) {
-	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
-	cmd.Dir = dir
-	output, err := cmd.Output()
+// Result records the outcome of migrating one target with one model.
+type Result = migrate.Result
+
+func runLLM(model, targetDir string, stdin string) (string, error) {
+	prompt := fmt.Sprintf(
+		"Please write the minimal BUILD.bazel file with a single target for the crate under %s. Output just the BUILD.bazel contents. Including MODULE.bazel and the Cargo.toml for the crate.",
+		targetDir,
+	)
+	cmd := exec.Command("llm", "-x", "-m", model, "-s", prompt)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := auditOutput(cmd)
 	if err != nil {
-		return "", fmt.Errorf("failed to get git branch: %w", err)
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("llm failed: %w\n%s", err, string(ee.Stderr))
+		}
+		return "", fmt.Errorf("llm failed: %w", err)
 	}
-	return strings.TrimSpace(string(output)), nil
+	return strings.TrimSpace(string(out)), nil
 }
 
-// gitBranchExists checks if a git branch exists.
-func gitBranchExists(dir, branchName string) (bool, error) {
-	cmd := exec.Command("git", "show-ref", "--verify", "--quiet", "refs/heads/"+branchName)
-	cmd.Dir = dir
-	err := cmd.Run()
+func runFilesToPrompt(worktreePath, targetDir string) (string, error) {
+	cmd := exec.Command("files-to-prompt", "MODULE.bazel", filepath.Join(targetDir, "Cargo.toml"))
+	cmd.Dir = worktreePath
+	out, err := auditOutput(cmd)
 	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
-			return false, nil // Branch does not exist
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("files-to-prompt failed: %w\n%s", err, string(ee.Stderr))
 		}
-		return false, fmt.Errorf("failed to check if branch %s exists: %w", branchName, err)
+		return "", fmt.Errorf("files-to-prompt failed: %w", err)
 	}
-	return true, nil // Branch exists
+	return string(out), nil
 }
 
-// createGitBranch creates a new git branch.
-func createGitBranch(dir, branchName string) error {
-	cmd := exec.Command("git", "branch", branchName)
-	cmd.Dir = dir
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create branch %s: %w", branchName, err)
+// gitStashAll stashes tracked and untracked changes and reports whether a
+// stash entry was pushed, which it is not for a clean worktree.
+func gitStashAll(worktreePath string) (bool, error) {
+	// A clean worktree has nothing to stash, so skip the slower git stash.
+	clean, err := gitWorktreeClean(worktreePath)
+	if err != nil {
+		return false, err
+	}
+	if clean {
+		return false, nil
+	}
+	// Stash untracked and dirty files so the next aider invocation starts clean.
+	stashCmd := exec.Command("git", "stash", "push", "-u", "-m", "aider-temp-stash")
+	stashCmd.Dir = worktreePath
+	out, err := auditCombinedOutput(stashCmd)
+	if err != nil {
+		return false, fmt.Errorf("git stash failed in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	// git stash prints a message even when there is nothing to stash.
+	output := strings.TrimSpace(string(out))
+	if strings.Contains(output, "No local changes to save") {
+		return false, nil
+	}
+	slog.Debug("git stash output", "worktree", worktreePath, "output", output)
+	return true, nil
+}
+
+// gitStashDrop deletes the stash entry at index, 0 being the most recent.
+func gitStashDrop(worktreePath string, index int) error {
+	cmd := exec.Command("git", "stash", "drop", fmt.Sprintf("stash@{%d}", index))
+	cmd.Dir = worktreePath
+	if out, err := auditCombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git stash drop failed in %s: %v\n%s", worktreePath, err, string(out))
 	}
 	return nil
 }
 
-// createGitBranchIfNotExists ensures the given branch exists in the repo at dir.
-// If the branch does not exist it will be created. The function logs progress
-// similarly to the previous inline behavior.
-func createGitBranchIfNotExists(dir, branchName string) error {
-	exists, err := gitBranchExists(dir, branchName)
+// getStashedDiff returns the most recent stash entry, untracked files
+// included, as a patch.
+func getStashedDiff(worktreePath string) (string, error) {
+	cmd := exec.Command("git", "stash", "show", "-p", "--include-untracked", "stash@{0}")
+	cmd.Dir = worktreePath
+	out, err := auditOutput(cmd)
 	if err != nil {
-		return fmt.Errorf("failed to check if branch %s exists: %w", branchName, err)
+		return "", fmt.Errorf("git stash show failed in %s: %w", worktreePath, err)
 	}
-	if exists {
-		log.Printf("Branch %s already exists.", branchName)
-		return nil
+	return string(out), nil
+}
+
+// gitWorktreeClean reports whether worktreePath has no modified or untracked
+// files.
+func gitWorktreeClean(worktreePath string) (bool, error) {
+	cmd := exec.Command("git", "status", "--porcelain", "--untracked-files=all")
+	cmd.Dir = worktreePath
+	out, err := auditOutput(cmd)
+	if err != nil {
+		return false, fmt.Errorf("git status failed in %s: %w", worktreePath, err)
+	}
+	return strings.TrimSpace(string(out)) == "", nil
+}
+
+// gitChangedLines returns how many lines differ between worktreePath and HEAD:
+// lines added and deleted in tracked files, as git diff --numstat counts
+// them, plus every line of untracked files. Binary files count as nothing.
+func gitChangedLines(worktreePath string) (int, error) {
+	diffCmd := exec.Command("git", "diff", "--numstat", "HEAD")
+	diffCmd.Dir = worktreePath
+	out, err := auditOutput(diffCmd)
+	if err != nil {
+		return 0, fmt.Errorf("git diff --numstat failed in %s: %w", worktreePath, err)
+	}
+	lines := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		added, _ := strconv.Atoi(fields[0])
+		deleted, _ := strconv.Atoi(fields[1])
+		lines += added + deleted
+	}
+	lsCmd := exec.Command("git", "ls-files", "--others", "--exclude-standard", "-z")
+	lsCmd.Dir = worktreePath
+	out, err = auditOutput(lsCmd)
+	if err != nil {
+		return 0, fmt.Errorf("git ls-files failed in %s: %w", worktreePath, err)
+	}
+	for _, path := range strings.Split(string(out), "\x00") {
+		if path == "" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(worktreePath, path))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read untracked file: %w", err)
+		}
+		if bytes.IndexByte(content, 0) != -1 {
+			continue
+		}
+		lines += bytes.Count(content, []byte("\n"))
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			lines++
+		}
+	}
+	return lines, nil
+}
+
+// bazelFlags returns the -bazel-flags, split on whitespace, followed by
+// --lockfile_mode from -lockfile-mode unless -bazel-flags already sets it, so
+// every worktree treats MODULE.bazel.lock the same way.
+func bazelFlags() []string {
+	var flags []string
+	for _, value := range bazelFlagValues {
+		flags = append(flags, strings.Fields(value)...)
 	}
+	if *lockfileMode == "" {
+		return flags
+	}
+	for _, f := range flags {
+		if strings.HasPrefix(f, "--lockfile_mode") {
+			return flags
+		}
+	}
+	return append(flags, "--lockfile_mode="+*lockfileMode)
+}
 
-	log.Printf("Branch %s does not exist, creating...", branchName)
-	if err := createGitBranch(dir, branchName); err != nil {
-		return fmt.Errorf("failed to create branch %s: %w", branchName, err)
+// validateBazelFlags rejects -bazel-flags values that are not flags, such as
+// a target passed by mistake.
+func validateBazelFlags(flags []string) error {
+	for _, f := range flags {
+		if !strings.HasPrefix(f, "-") {
+			return fmt.Errorf("bazel flag %q does not start with -", f)
+		}
 	}
-	log.Printf("Branch %s created.", branchName)
 	return nil
 }
 
-// gitWorktreeExists checks if a git worktree exists at the given path.
-func gitWorktreeExists(worktreePath string) (bool, error) {
-	_, err := os.Stat(worktreePath)
-	if err == nil {
-		return true, nil
+// bazelCommand returns the bazel arguments for command with the -bazel-flags
+// placed before args.
+func bazelCommand(command string, args ...string) []string {
+	return append(append([]string{command}, bazelFlags()...), args...)
+}
+
+// runBazel runs bazel with args in worktreePath and returns its combined
+// output, which is also appended to targetLog.
+func runBazel(ctx context.Context, worktreePath string, targetLog io.Writer, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "bazel", args...)
+	cmd.Dir = worktreePath
+	out, err := wrapCommandWithTimeout(cmd, *bazelTimeout)
+	fmt.Fprintf(targetLog, "$ bazel %s\n%s", strings.Join(args, " "), out)
+	if err != nil {
+		fmt.Fprintf(targetLog, "bazel exited with error: %v\n", err)
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	return out, err
+}
+
+// bazelBuildLabel matches the release in `bazel version` output, e.g.
+// "Build label: 7.4.1" or "Build label: 8.0.0rc1".
+var bazelBuildLabel = regexp.MustCompile(`(?m)^Build label: (\d+\.\d+(?:\.\d+)?)`)
+
+// parseBazelVersion returns the release, e.g. "7.4.1", from `bazel version`
+// output. ok is false for development builds without a release label.
+func parseBazelVersion(output string) (version string, ok bool) {
+	m := bazelBuildLabel.FindStringSubmatch(output)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// detectBazelVersion runs `bazel version` in dir, where a .bazelversion file
+// may select the release, and returns the release, or "" for a development
+// build.
+func detectBazelVersion(dir string) (string, error) {
+	cmd := exec.Command("bazel", "version")
+	cmd.Dir = dir
+	out, err := wrapCommandWithTimeout(cmd, *bazelTimeout)
+	if err != nil {
+		return "", fmt.Errorf("bazel version failed in %s: %v\n%s", dir, err, string(out))
+	}
+	version, _ := parseBazelVersion(string(out))
+	return version, nil
+}
+
+// versionAtLeast reports whether the dotted release version is at least min,
+// comparing numerically with missing components as zero. An empty or
+// unparsable version is not.
+func versionAtLeast(version, min string) bool {
+	parse := func(v string) ([3]int, bool) {
+		var parts [3]int
+		fields := strings.Split(v, ".")
+		if v == "" || len(fields) > 3 {
+			return parts, false
+		}
+		for i, f := range fields {
+			n, err := strconv.Atoi(f)
+			if err != nil {
+				return parts, false
+			}
+			parts[i] = n
+		}
+		return parts, true
+	}
+	v, ok := parse(version)
+	if !ok {
+		return false
+	}
+	m, _ := parse(min)
+	for i := range v {
+		if v[i] != m[i] {
+			return v[i] > m[i]
+		}
+	}
+	return true
+}
+
+// bazelSyncArgs returns the command that fetches a fresh worktree's external
+// dependencies for the given bazel release: `bazel mod tidy` where available
+// (Bazel 7.1+), otherwise `bazel fetch //...`.
+func bazelSyncArgs(version string) []string {
+	if versionAtLeast(version, "7.1") {
+		return []string{"mod", "tidy"}
 	}
-	return false, fmt.Errorf("failed to check worktree existence at %s: %w", worktreePath, err)
+	return []string{"fetch", "//..."}
 }
 
-// addGitWorktree adds a new git worktree.
-func addGitWorktree(repoDir, worktreePath, branchName string) error {
-	cmd := exec.Command("git", "worktree", "add", worktreePath, branchName)
-	cmd.Dir = repoDir
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add worktree at %s for branch %s: %w", worktreePath, branchName, err)
+// bazelSync refreshes the MODULE.bazel lockfile and module cache in
+// worktreePath with the command bazelSyncArgs picks for version, so that the
+// first build attempt fails on real rule errors rather than on fetching
+// dependencies.
+func bazelSync(worktreePath, version string) error {
+	args := bazelSyncArgs(version)
+	cmd := exec.Command("bazel", args...)
+	cmd.Dir = worktreePath
+	if out, err := wrapCommandWithTimeout(cmd, *bazelTimeout); err != nil {
+		return fmt.Errorf("bazel %s failed in %s: %v\n%s", strings.Join(args, " "), worktreePath, err, string(out))
 	}
+	slog.Info("Synced bazel dependencies", "worktree", worktreePath, "command", "bazel "+strings.Join(args, " "))
 	return nil
 }
 
-// createGitWorktreeIfNotExists ensures the given worktree exists at worktreePath.
-// If the worktree does not exist it will be created. The function logs progress
-// similarly to the previous inline behavior.
-func createGitWorktreeIfNotExists(repoDir, worktreePath, branchName string) error {
-	exists, err := gitWorktreeExists(worktreePath)
+// checkBazelVersion warns when the bazel release used in dir is older than
+// -bazel-min-version, below which bzlmod, and so MODULE.bazel, is not
+// supported, and returns the release for execBuildRunner.
+func checkBazelVersion(dir string) string {
+	version, err := detectBazelVersion(dir)
+	switch {
+	case err != nil:
+		slog.Warn("Could not detect bazel version", "dir", dir, "err", err)
+	case version == "":
+		slog.Info("Using a development build of bazel; not checking its version", "dir", dir)
+	case !versionAtLeast(version, *bazelMinVersion):
+		slog.Warn("Bazel is older than -bazel-min-version and may not support bzlmod", "dir", dir, "version", version, "minVersion", *bazelMinVersion)
+	default:
+		slog.Info("Bazel version", "dir", dir, "version", version)
+	}
+	return version
+}
+
+// bazelClean runs `bazel clean` in dir, or `bazel clean --expunge` if expunge
+// is set.
+func bazelClean(dir string, expunge bool) error {
+	args := []string{"clean"}
+	if expunge {
+		args = append(args, "--expunge")
+	}
+	cmd := exec.Command("bazel", args...)
+	cmd.Dir = dir
+	if out, err := wrapCommandWithTimeout(cmd, *bazelTimeout); err != nil {
+		return fmt.Errorf("bazel %s failed in %s: %v\n%s", strings.Join(args, " "), dir, err, string(out))
+	}
+	return nil
+}
+
+// bazelShutdown stops the bazel server for the workspace in dir.
+func bazelShutdown(dir string) error {
+	cmd := exec.Command("bazel", "shutdown")
+	cmd.Dir = dir
+	if out, err := wrapCommandWithTimeout(cmd, *bazelTimeout); err != nil {
+		return fmt.Errorf("bazel shutdown failed in %s: %v\n%s", dir, err, string(out))
+	}
+	return nil
+}
+
+// execBuildRunner implements migrate.BuildRunner by running the bazel binary.
+type execBuildRunner struct {
+	// version is the bazel release, as returned by detectBazelVersion,
+	// which selects the commands that differ between releases.
+	version string
+}
+
+func (execBuildRunner) Query(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	return runBazel(ctx, worktreePath, targetLog, bazelCommand("query", target)...)
+}
+
+func (execBuildRunner) Build(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	out, err := runBazel(ctx, worktreePath, targetLog, bazelCommand("build", target)...)
 	if err != nil {
-		return fmt.Errorf("failed to check if worktree %s exists: %w", worktreePath, err)
+		return out, &BazelBuildError{Target: target, Output: string(out), Err: err}
 	}
-	if exists {
-		log.Printf("Worktree already exists at: %s", worktreePath)
-		return nil
+	return out, nil
+}
+
+func (execBuildRunner) CleanBuild(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	if err := bazelClean(worktreePath, false); err != nil {
+		return nil, err
+	}
+	out, err := runBazel(ctx, worktreePath, targetLog, bazelCommand("build", "--noremote_accept_cached", target)...)
+	if err != nil {
+		return out, &BazelBuildError{Target: target, Output: string(out), Err: err}
 	}
+	return out, nil
+}
+
+func (execBuildRunner) Test(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	return runBazel(ctx, worktreePath, targetLog, bazelCommand("test", target)...)
+}
+
+func (execBuildRunner) Clean(worktreePath string, expunge bool) error {
+	return bazelClean(worktreePath, expunge)
+}
+
+func (execBuildRunner) Shutdown(worktreePath string) error {
+	return bazelShutdown(worktreePath)
+}
+
+func (r execBuildRunner) Sync(worktreePath string) error {
+	return bazelSync(worktreePath, r.version)
+}
 
-	log.Printf("Worktree at %s does not exist, creating...", worktreePath)
-	if err := addGitWorktree(repoDir, worktreePath, branchName); err != nil {
-		return fmt.Errorf("failed to add worktree at %s for branch %s: %w", worktreePath, branchName, err)
+func (execBuildRunner) RuleKind(worktreePath, target string) (string, error) {
+	return ruleKind(worktreePath, target)
+}
+
+func (execBuildRunner) CheckSyntax(name, content string) error {
+	return validateStarlark(name, content)
+}
+
+func (execBuildRunner) Buildozer(ctx context.Context, worktreePath string, targetLog io.Writer, commands []string, target string) error {
+	return runBuildozer(ctx, worktreePath, targetLog, commands, target)
+}
+
+// runBuildozer applies commands to target with buildozer in worktreePath,
+// appending its output to targetLog.
+func runBuildozer(ctx context.Context, worktreePath string, targetLog io.Writer, commands []string, target string) error {
+	args := append(append([]string{}, commands...), target)
+	cmd := exec.CommandContext(ctx, "buildozer", args...)
+	cmd.Dir = worktreePath
+	out, err := auditCombinedOutput(cmd)
+	fmt.Fprintf(targetLog, "$ buildozer %s\n%s", strings.Join(args, " "), out)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		// Exit code 3 means the commands succeeded but changed nothing.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("buildozer failed on %s: %v\n%s", target, err, string(out))
 	}
-	log.Printf("Worktree created at: %s", worktreePath)
 	return nil
 }
 
-func runLLM(model, targetDir string, stdin string) (string, error) {
-	prompt := fmt.Sprintf(
-		"Please write the minimal BUILD.bazel file with a single target for the crate under %s. Output just the BUILD.bazel contents. Including MODULE.bazel and the Cargo.toml for the crate.",
-		targetDir,
-	)
-	cmd := exec.Command("llm", "-x", "-m", model, "-s", prompt)
-	cmd.Stdin = strings.NewReader(stdin)
-	out, err := cmd.Output()
+// filterByRegex returns the items matching pattern, preserving order. An empty
+// pattern matches everything; a pattern that matches nothing is an error.
+func filterByRegex(items []string, pattern string) ([]string, error) {
+	if pattern == "" {
+		return items, nil
+	}
+	re, err := regexp.Compile(pattern)
 	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("llm failed: %w\n%s", err, string(ee.Stderr))
+		return nil, fmt.Errorf("invalid regexp %q: %w", pattern, err)
+	}
+	var matched []string
+	for _, item := range items {
+		if re.MatchString(item) {
+			matched = append(matched, item)
 		}
-		return "", fmt.Errorf("llm failed: %w", err)
 	}
-	return strings.TrimSpace(string(out)), nil
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("regexp %q matched none of %q", pattern, items)
+	}
+	return matched, nil
 }
 
-func runFilesToPrompt(worktreePath, targetDir string) (string, error) {
-	cmd := exec.Command("files-to-prompt", "MODULE.bazel", filepath.Join(targetDir, "Cargo.toml"))
+// skipModels returns models without those named in skip, preserving order.
+// Names in skip that match no model are logged and otherwise ignored.
+func skipModels(models, skip []string) []string {
+	for _, name := range skip {
+		if !slices.Contains(models, name) {
+			slog.Warn("-skip-model matches no model", "model", name)
+		}
+	}
+	var kept []string
+	for _, model := range models {
+		if !slices.Contains(skip, model) {
+			kept = append(kept, model)
+		}
+	}
+	return kept
+}
+
+// targetPattern returns the target filter set with -target-regex or its alias
+// -target-filter. Setting both to different patterns is an error.
+func targetPattern(regex, filter string) (string, error) {
+	if regex != "" && filter != "" && regex != filter {
+		return "", fmt.Errorf("-target-regex %q and -target-filter %q disagree; set only one", regex, filter)
+	}
+	if regex != "" {
+		return regex, nil
+	}
+	return filter, nil
+}
+
+// execLLMRunner implements migrate.LLMRunner by running the aider binary.
+type execLLMRunner struct{}
+
+func (execLLMRunner) RunAider(ctx context.Context, run migrate.Run) (string, error) {
+	if err := aiderLimiter.Wait(ctx, "model", run.Model, "target", run.Target); err != nil {
+		return "", err
+	}
+	if commandAudit == nil {
+		return runAider(ctx, run)
+	}
+	// Record what aider changes, so that replay can make the same edits.
+	before, err := snapshotWorktree(run.WorktreePath)
+	output, aiderErr := runAider(ctx, run)
+	if err == nil {
+		err = recordAttemptDiff(run.WorktreePath, before)
+	}
+	if err != nil {
+		slog.Warn("Error recording aider's changes to the audit log", "model", run.Model, "target", run.Target, "err", err)
+	}
+	return output, aiderErr
+}
+
+// recordAttemptDiff records to the audit log the changes made in worktreePath
+// since the snapshotWorktree tree before.
+func recordAttemptDiff(worktreePath, before string) error {
+	after, err := snapshotWorktree(worktreePath)
+	if err != nil {
+		return err
+	}
+	diff, err := attemptDiff(worktreePath, before, after)
+	if err != nil {
+		return err
+	}
+	return commandAudit.RecordDiff(worktreePath, diff)
+}
+
+func (execLLMRunner) CommitAll(worktreePath, model string) error {
+	if err := aiderLimiter.Wait(context.Background(), "model", model, "worktree", worktreePath); err != nil {
+		return err
+	}
+	return aiderCommitAll(worktreePath, "aider", "", model)
+}
+
+// aiderCommitAll runs aiderBin --commit in worktreePath, which commits all
+// pending changes with a message model writes from the diff. aiderHome, if
+// set, is used as HOME so aider reads its config from there.
+func aiderCommitAll(worktreePath, aiderBin, aiderHome, model string) error {
+	extraArgs, err := splitArgs(*aiderExtraArgs)
+	if err != nil {
+		return fmt.Errorf("failed to parse -aider-extra-args: %w", err)
+	}
+	cmd := exec.Command(aiderBin, append([]string{"--commit", "--model", model}, extraArgs...)...)
 	cmd.Dir = worktreePath
-	out, err := cmd.Output()
+	if aiderHome != "" {
+		cmd.Env = append(os.Environ(), "HOME="+aiderHome)
+	}
+	if out, err := wrapCommandWithTimeout(cmd, *aiderTimeout); err != nil {
+		return fmt.Errorf("aider --commit failed in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	return nil
+}
+
+// AiderOptions describes a single aider invocation.
+type AiderOptions struct {
+	// Dir is the worktree aider runs in; file paths are relative to it.
+	Dir   string
+	Model string
+	// EditFormat is how the model returns edits, e.g. "diff" or "whole".
+	EditFormat string
+	Message    string
+	// TestCmd is run by aider after each edit so it can fix failures itself.
+	TestCmd string
+	// EditFiles are the files aider may change.
+	EditFiles []string
+	// ReadFiles are passed as repeated --read flags: context aider sees but
+	// may not change.
+	ReadFiles []string
+	// Log receives aider's output in addition to stdout/stderr.
+	Log io.Writer
+	// OutputPrefix, if set, tags each line aider writes to stdout/stderr.
+	OutputPrefix string
+	// ChatHistoryFile, if set, is where aider keeps its chat history; the
+	// history is restored at startup so earlier sessions carry over.
+	ChatHistoryFile string
+	// SystemPrompt, if set, is passed as --system-prompt.
+	SystemPrompt string
+	// ExtraArgs come from -aider-extra-args and follow the other flags.
+	ExtraArgs []string
+}
+
+// runAiderWithContext invokes aider once with opts. Output is echoed to
+// stdout/stderr and also returned so callers can inspect it on failure. A
+// failure is returned as an *AiderError.
+func runAiderWithContext(ctx context.Context, opts AiderOptions) (string, error) {
+	// exec copies stdout and stderr in separate goroutines, so the combined
+	// output comes from wrapCommandWithTimeout, which guards its buffer.
+	var errOutput syncBuffer
+	aiderCmd := exec.CommandContext(ctx, "aider", aiderArgs(opts)...)
+	aiderCmd.Dir = opts.Dir
+	stdout := newPrefixWriter(consoleOut, opts.OutputPrefix)
+	stderr := newPrefixWriter(consoleErr, opts.OutputPrefix)
+	aiderCmd.Stdout = io.MultiWriter(stdout, opts.Log)
+	aiderCmd.Stderr = io.MultiWriter(stderr, opts.Log, &errOutput)
+	output, err := wrapCommandWithTimeout(aiderCmd, *aiderTimeout)
+	stdout.Flush()
+	stderr.Flush()
 	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("files-to-prompt failed: %w\n%s", err, string(ee.Stderr))
+		return string(output), &AiderError{Model: opts.Model, Stderr: string(errOutput.Bytes()), Err: err}
+	}
+	return string(output), nil
+}
+
+// aiderArgs returns the aider command line for opts.
+func aiderArgs(opts AiderOptions) []string {
+	args := []string{
+		"--disable-playwright",
+		"--yes-always",
+		// The build-edit loop checks each attempt's uncommitted changes
+		// and commits, stashes or reverts them itself.
+		"--no-auto-commits",
+		"--no-dirty-commits",
+		"--model", opts.Model,
+		"--edit-format", opts.EditFormat,
+		"--auto-test",
+		"--test-cmd", opts.TestCmd,
+		"--message", opts.Message,
+	}
+	for _, f := range opts.ReadFiles {
+		args = append(args, "--read", f)
+	}
+	if opts.ChatHistoryFile != "" {
+		args = append(args, "--chat-history-file", opts.ChatHistoryFile, "--restore-chat-history")
+	}
+	if opts.SystemPrompt != "" {
+		args = append(args, "--system-prompt", opts.SystemPrompt)
+	}
+	args = append(args, opts.ExtraArgs...)
+	return append(args, opts.EditFiles...)
+}
+
+// splitArgs splits s, the value of -aider-extra-args, into arguments at
+// unquoted commas and whitespace. As in a shell, single quotes preserve
+// everything up to the closing quote, double quotes everything but a
+// backslash escape, and a backslash outside quotes escapes the next
+// character.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ',' || unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
 		}
-		return "", fmt.Errorf("files-to-prompt failed: %w", err)
 	}
-	return string(out), nil
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("unterminated quote or trailing backslash in %q", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
 }
 
-func ensureBuildBazelExists(worktreePath, target string) error {
-	// Parse target like //path/to/pkg:target or //:target
-	if !strings.HasPrefix(target, "//") {
-		// not a package-style target; nothing to do
-		return nil
+// runAider asks run.llmModel, via aider, to make the Bazel changes needed to
+// build run.target.
+func runAider(ctx context.Context, run migrate.Run) (string, error) {
+	opts, err := aiderOptions(run)
+	if err != nil {
+		return "", err
 	}
-	s := strings.TrimPrefix(target, "//")
-	pkg := s
-	if idx := strings.Index(s, ":"); idx != -1 {
-		pkg = s[:idx]
+	return runAiderWithContext(ctx, opts)
+}
+
+// aiderOptions returns the aider invocation for one attempt of run.
+func aiderOptions(run migrate.Run) (AiderOptions, error) {
+	message, err := renderPrompt(PromptData{Target: run.Target, BuildBazelPath: run.BuildFile, Feedback: run.Feedback, PreviousAttempt: run.PreviousAttempt, Examples: run.Examples, BuiltTargets: run.BuiltTargets})
+	if err != nil {
+		return AiderOptions{}, err
 	}
-	var pkgPath string
-	if pkg == "" {
-		pkgPath = ""
-	} else {
-		pkgPath = pkg
+	extraArgs, err := splitArgs(*aiderExtraArgs)
+	if err != nil {
+		return AiderOptions{}, fmt.Errorf("failed to parse -aider-extra-args: %w", err)
 	}
-	buildPath := filepath.Join(worktreePath, pkgPath, "BUILD.bazel")
-	if _, err := os.Stat(buildPath); err == nil {
-		return nil
-	} else if !os.IsNotExist(err) {
-		return fmt.Errorf("failed to stat %s: %w", buildPath, err)
+	return AiderOptions{
+		Dir:             run.WorktreePath,
+		Model:           run.Model,
+		EditFormat:      run.EditFormat,
+		Message:         message,
+		TestCmd:         "bazel " + strings.Join(bazelCommand("build", run.Target), " "),
+		EditFiles:       []string{"MODULE.bazel", run.BuildFile},
+		ReadFiles:       run.ReadFiles,
+		Log:             run.Log,
+		OutputPrefix:    fmt.Sprintf("[%s %s] ", run.Model, run.Target),
+		ChatHistoryFile: run.ChatHistoryFile,
+		SystemPrompt:    systemPromptFor(run.Model),
+		ExtraArgs:       extraArgs,
+	}, nil
+}
+
+// ruleKind returns the rule kind of target (e.g. "rust_library") as reported
+// by bazel query.
+func ruleKind(worktreePath, target string) (string, error) {
+	cmd := exec.Command("bazel", bazelCommand("query", "--output=label_kind", target)...)
+	cmd.Dir = worktreePath
+	out, err := wrapCommandWithTimeout(cmd, *bazelTimeout)
+	if err != nil {
+		return "", fmt.Errorf("bazel query --output=label_kind %s failed: %w", target, err)
 	}
-	dir := filepath.Dir(buildPath)
-	if dir != "" && dir != "." {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create dir %s: %w", dir, err)
+	// The result looks like "rust_library rule //crates/matcher:grep_matcher",
+	// among bazel's progress messages on stderr.
+	for _, line := range strings.Split(string(out), "\n") {
+		if kind, _, ok := strings.Cut(strings.TrimSpace(line), " rule "); ok {
+			return kind, nil
 		}
 	}
-	if err := os.WriteFile(buildPath, []byte("# created by bld.go\n"), 0644); err != nil {
-		return fmt.Errorf("failed to write %s: %w", buildPath, err)
+	return "", fmt.Errorf("unexpected label_kind output for %s: %q", target, out)
+}
+
+// bytesPerGB converts -min-disk-gb and -max-bazel-cache-gb to bytes.
+const bytesPerGB = 1 << 30
+
+// migratorOptions returns the migrate.Options set by the flags and -config
+// for the repo with the given repoRun.ID, whose worktrees go in worktreeDir.
+func migratorOptions(repo, worktreeDir string) migrate.Options {
+	opts := migrate.Options{
+		MaxDiffLines:          *maxDiffLines,
+		StrictBazelOnly:       *strictBazelOnly,
+		VerifyCleanBuild:      *verifyCleanBuild,
+		RequireHermetic:       *requireHermetic,
+		BuildozerCommands:     config.BuildozerCommands,
+		CommitEveryAttempt:    *commitEveryAttempt,
+		NoStash:               *noStash,
+		IncludeStashInContext: *includeStashInContext,
+		CommitLockfile:        *commitLockfile,
+		MaxCommits:            *maxCommits,
+		BazelExpungeOnCrash:   *bazelExpungeOnCrash,
+		RateLimitMaxWait:      *rateLimitMaxWait,
+		PastDeadline:          pastDeadline,
+		Emit: func(ev migrate.Event) {
+			showProgress(ev)
+			emit(ev)
+		},
+		AiderOutput: recordAiderUsage,
+
+		Repo:         repo,
+		WorktreeDir:  worktreeDir,
+		LogDir:       *logDir,
+		BranchPrefix: *branchPrefix,
+		EditFormat: func(llmModel string) string {
+			return resolveEditFormat(*aiderEditFormat, llmModel)
+		},
+		NoChatHistory:         *noChatHistory,
+		NoBuildExamples:       *noBuildExamples,
+		BazelCleanOnQueryFail: *bazelCleanOnQueryFail,
+		ReadFiles: func(run migrate.Run, pkg string) ([]string, error) {
+			return contextFiles(repo, run, pkg)
+		},
+		ExpectedKind:       expectedKindFor,
+		OverBudget:         overBudget,
+		Interrupted:        interrupted.Load,
+		MinFreeBytes:       int64(*minDiskGB * bytesPerGB),
+		MaxBazelCacheBytes: int64(*maxBazelCacheGB * bytesPerGB),
+
+		CircuitBreakerThreshold: *circuitBreakerThreshold,
+		KeepGoing:               *keepGoing,
+		CommitOnPartial:         *commitOnPartial,
+		SquashCommits:           *squashCommits,
+		Repeat:                  *repeat,
+		BestOfN:                 *bestOfN,
+		BestOfNKeep:             *bestOfNKeep,
+		Escalate:                *escalate,
+		SelectBest:              *mode == "select-best",
+		Concurrency:             *concurrency,
+		CherryPickFromBest:      *cherryPickFromBest,
+		RunTests:                *runTests,
 	}
-	log.Printf("Created %s", buildPath)
-	return nil
+	if *fallbackModel != "" {
+		opts.FallbackModel = "openrouter/" + *fallbackModel
+	}
+	if *scaleAttempts {
+		opts.MaxAttemptsFor = func(worktreePath, target string) int {
+			return attemptsForTarget(worktreePath, target, migrate.MaxAttempts)
+		}
+	}
+	if *cacheDir != "" {
+		opts.Cache = buildFileCache(*cacheDir)
+	}
+	if *seedFromSiblings {
+		opts.Seeds = append(opts.Seeds, siblingSeedFor)
+	}
+	if !*skipCargoGen {
+		opts.Seeds = append(opts.Seeds, cargoGenSeed)
+	}
+	return opts
 }
 
-func gitStashAll(worktreePath string) error {
-	// Stash untracked and dirty files so the next aider invocation starts clean.
-	stashCmd := exec.Command("git", "stash", "push", "-u", "-m", "aider-temp-stash")
-	stashCmd.Dir = worktreePath
-	out, err := stashCmd.CombinedOutput()
+// logResults prints one line per model/target result at the end of a run.
+func logResults(results []Result) {
+	for _, r := range results {
+		if r.Skipped {
+			slog.Info("Result", "model", r.Model, "target", r.Target, "status", "skipped (circuit breaker open)")
+			continue
+		}
+		status := "failed"
+		if r.Success {
+			status = "succeeded"
+		}
+		if r.FallbackModel != "" {
+			slog.Info("Result", "model", r.Model, "target", r.Target, "status", status, "attempts", r.Attempts, "fallbackModel", r.FallbackModel)
+			continue
+		}
+		slog.Info("Result", "model", r.Model, "target", r.Target, "status", status, "attempts", r.Attempts)
+	}
+}
+
+// newTempDir creates a unique directory under the system temp dir. cleanup
+// removes it unless keep is set.
+func newTempDir(pattern string, keep bool) (dir string, cleanup func(), err error) {
+	dir, err = os.MkdirTemp("", pattern)
 	if err != nil {
-		return fmt.Errorf("git stash failed in %s: %v\n%s", worktreePath, err, string(out))
+		return "", nil, fmt.Errorf("failed to create temp dir for %q: %w", pattern, err)
 	}
-	// git stash prints a message even when there is nothing to stash;
-	// log the output for debugging but don't treat it as fatal.
-	log.Printf("git stash output in %s: %s", worktreePath, strings.TrimSpace(string(out)))
-	return nil
+	return dir, func() {
+		if keep {
+			slog.Info("Keeping temp dir", "dir", dir)
+			return
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("Could not remove temp dir", "dir", dir, "err", err)
+		}
+	}, nil
+}
+
+// resolveWorktreeBaseDir returns dir, creating it if needed, or if dir is
+// empty a new temp dir for this run. cleanup removes the temp dir unless keep
+// is set; a dir given explicitly is never removed.
+func resolveWorktreeBaseDir(dir string, keep bool) (baseDir string, cleanup func(), err error) {
+	if dir == "" {
+		return newTempDir("bld-worktrees-", keep)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create worktree directory %s: %w", dir, err)
+	}
+	return dir, func() {}, nil
+}
+
+// newLogger returns a slog.Logger writing to w in the given format ("text" or
+// "json") at the given minimum level ("debug", "info", "warn" or "error").
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: want text or json", format)
+	}
+}
+
+// Process exit codes, so scripts and CI can tell failed targets apart from a
+// run that could not proceed.
+const (
+	exitSuccess     = 0   // every planned model/target pair succeeded
+	exitFailure     = 1   // some pair failed or never ran
+	exitError       = 2   // setup, precondition or internal error
+	exitInterrupted = 130 // a second SIGINT or SIGTERM forced an exit
+)
+
+// fatal logs msg and args at error level and exits with exitError.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitError)
+}
+
+// exitCode returns exitSuccess if all planned model/target pairs succeeded
+// and exitFailure otherwise. Pairs that never ran (deadline or budget) count
+// as failures; pairs skipped by the circuit breaker do too unless
+// skippedPolicy is "ignore".
+func exitCode(results []Result, planned int, skippedPolicy string) int {
+	succeeded := 0
+	for _, r := range results {
+		switch {
+		case r.Success:
+			succeeded++
+		case r.Skipped && skippedPolicy == "ignore":
+			planned--
+		}
+	}
+	if succeeded < planned {
+		return exitFailure
+	}
+	return exitSuccess
 }
 
 func main() {
-	wd, err := os.Getwd()
+	flag.Parse()
+	runStart := time.Now()
+
+	logger, err := newLogger(os.Stderr, *logFormat, *logLevel)
 	if err != nil {
-		log.Fatalf("Error getting working directory: %s", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
 	}
+	slog.SetDefault(logger)
 
-	branch, err := getGitBranch(wd)
+	llm, done := runSubcommand()
+	if done {
+		return
+	}
+	validateFlags()
+	loadConfigFiles()
+
+	if *auditLogPath != "" {
+		auditLog, err := os.OpenFile(*auditLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatal("Error opening -audit-log", "err", err)
+		}
+		defer auditLog.Close()
+		commandAudit = NewAuditLogger(auditLog)
+	}
+
+	notifier, err := newNotifier(*notifyWebhook)
 	if err != nil {
-		log.Printf("Error getting git branch: %v", err)
-		os.Exit(1)
+		fatal("Invalid -notify-webhook", "err", err)
+	}
+
+	costs = NewCostEstimator(config.ModelPrices)
+	aiderLimiter = NewRateLimiter(*requestsPerMinute)
+
+	if err := preflight(); err != nil {
+		fatal("Preflight check failed", "err", err)
 	}
-	log.Printf("Current git branch: %s\n", branch)
 
-	homeDir, err := os.UserHomeDir()
+	wd, err := os.Getwd()
 	if err != nil {
-		log.Fatalf("Error getting user home directory: %s", err)
+		fatal("Error getting working directory", "err", err)
 	}
-	worktreeBaseDir := filepath.Join(homeDir, "worktree")
 
-	for _, model := range models {
-		sanitizedModelName := sanitizePath("openrouter/" + model)
-		modelBranch := branch + "-" + sanitizedModelName
-		worktreePath := filepath.Join(worktreeBaseDir, modelBranch)
+	branch, err := migrate.Branch(wd)
+	if errors.Is(err, migrate.ErrGitNotFound) {
+		fatal("git is not installed or not on PATH", "err", err)
+	}
+	if err != nil {
+		fatal("Error getting git branch", "err", err)
+	}
+	slog.Info("Current git branch", "branch", branch)
 
-		// Ensure branch exists (create if needed)
-		if err := createGitBranchIfNotExists(wd, modelBranch); err != nil {
-			log.Fatalf("Error ensuring branch %s exists: %s", modelBranch, err)
+	runModels, err := filterByRegex(skipModels(models, skipModelNames), *modelRegex)
+	if err != nil {
+		fatal("Error applying -model-regex", "err", err)
+	}
+	var modelStats map[string]ModelStats
+	if *modelStatsPath != "" {
+		modelStats, err = loadModelStats(*modelStatsPath)
+		if err != nil {
+			fatal("Error loading -model-stats", "err", err)
 		}
+		runModels = orderModelsByHistoricalSuccess(runModels, modelStats)
+		slog.Info("Ordered models by historical success rate", "models", runModels)
+	}
 
-		// Ensure worktree exists (create if needed)
-		if err := createGitWorktreeIfNotExists(wd, worktreePath, modelBranch); err != nil {
-			log.Fatalf("Error ensuring worktree at %s exists: %s", worktreePath, err)
+	ctx := context.Background()
+	repos := planRepos(ctx, wd, branch)
+	var runTargetCount int
+	var displayTargets []string
+	for _, repo := range repos {
+		runTargetCount += len(repo.Targets)
+		for _, target := range repo.Targets {
+			displayTargets = append(displayTargets, repoTarget(repo.ID, target))
 		}
+	}
 
-		// Bazel query removed: no longer verifying //... in the worktree.
+	logCostEstimate(runModels, runTargetCount, max(*repeat, 1))
 
-		// For each target, invoke aider in the worktree so the model can make
-		// minimal Bazel changes to build the target.
-		llmModel := "openrouter/" + model
-		for _, target := range targets {
-			if err := ensureBuildBazelExists(worktreePath, target); err != nil {
-				log.Fatalf("Error ensuring BUILD.bazel for target %s: %v", target, err)
-			}
-			// determine the BUILD.bazel path for the target to pass to aider
-			pkg := strings.TrimPrefix(target, "//")
-			if idx := strings.Index(pkg, ":"); idx != -1 {
-				pkg = pkg[:idx]
-			}
-			var buildArg string
-			if pkg == "" {
-				buildArg = "BUILD.bazel"
-			} else {
-				buildArg = filepath.Join(pkg, "BUILD.bazel")
+	worktreeBaseDir, removeWorktreeBaseDir, err := resolveWorktreeBaseDir(*worktreeDir, *keepWorktrees)
+	if err != nil {
+		fatal("Error preparing worktree directory", "err", err)
+	}
+	slog.Info("Worktree directory", "dir", worktreeBaseDir)
+	// The model branches keep the results; only the checkouts go away.
+	cleanupWorktrees := func() {
+		removeWorktreeBaseDir()
+		for _, repo := range repos {
+			if err := migrate.PruneWorktrees(repo.Dir); err != nil {
+				slog.Warn("Could not prune worktrees", "repo", repo.Dir, "err", err)
 			}
-			// Pre-check: If bazel query then bazel build succeed without changes, skip aider.
-			queryCmd := exec.Command("bazel", "query", target)
-			queryCmd.Dir = worktreePath
-			queryOut, queryErr := queryCmd.CombinedOutput()
-			if queryErr == nil {
-				// Query succeeded; try building directly.
-				bazelCmd := exec.Command("bazel", "build", target)
-				bazelCmd.Dir = worktreePath
-				bazelOut, bazelErr := bazelCmd.CombinedOutput()
-				if bazelErr == nil {
-					log.Printf("bazel query and build succeeded for model %s target %s; skipping aider", llmModel, target)
-					continue // move to next target
-				}
-				log.Printf("Pre-check bazel build failed for model %s target %s: %v\n%s", llmModel, target, bazelErr, string(bazelOut))
-				// Fall through to aider loop to attempt fixes.
-			} else {
-				log.Printf("Pre-check bazel query failed for model %s target %s: %v\n%s", llmModel, target, queryErr, string(queryOut))
-				// Fall through to aider loop to attempt fixes.
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer handleSignals(cancel)()
+
+	if *deadline > 0 {
+		runDeadline = time.Now().Add(*deadline)
+		// Commands get a grace period past the deadline so an attempt that
+		// is nearly done can finish; no new work starts after the deadline.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, runDeadline.Add(deadlineGrace))
+		defer cancel()
+		slog.Info("Run deadline set", "deadline", runDeadline.Format(time.RFC3339))
+	}
+
+	// newRepoMigrator returns a Migrator for repo, whose worktrees go in
+	// their own directory.
+	newRepoMigrator := func(repo repoRun) *migrate.Migrator {
+		build := execBuildRunner{version: checkBazelVersion(repo.Dir)}
+		return migrate.New(execGitManager{}, build, llm, migratorOptions(repo.ID, filepath.Join(worktreeBaseDir, repo.ID)))
+	}
+
+	if *verify {
+		verifications := verifyRepos(ctx, repos, runModels, newRepoMigrator)
+		cleanupWorktrees()
+		for _, v := range verifications {
+			if !v.FullBuildOK {
+				os.Exit(exitFailure)
 			}
+		}
+		os.Exit(exitSuccess)
+	}
+
+	if *compareDiffs {
+		comparisons := compareRepos(repos, runModels, newRepoMigrator)
+		cleanupWorktrees()
+		if err := printComparisons(os.Stdout, comparisons); err != nil {
+			fatal("Error printing comparisons", "err", err)
+		}
+		os.Exit(exitSuccess)
+	}
+
+	if *eventsOut != "" {
+		closeEvents, err := openEventStream(*eventsOut)
+		if err != nil {
+			fatal("Error opening -events-out", "err", err)
+		}
+		defer closeEvents()
+	}
 
-			// Try up to N attempts per model/target using aider to produce Bazel changes.
-			const maxAttempts = 5
-			success := false
-			for attempt := 1; attempt <= maxAttempts; attempt++ {
-				aiderCmd := exec.Command(
-					"aider",
-					"--disable-playwright",
-					"--yes-always",
-					"--model", llmModel,
-					"--edit-format", "diff",
-					"--auto-test",
-					"--test-cmd", "bazel build "+target,
-					"--message", "Please make the minimal Bazel file changes necessary to build "+target+". Do not touch non-Bazel files.",
-					"MODULE.bazel",
-					buildArg,
-				)
-				aiderCmd.Dir = worktreePath
-				aiderCmd.Stdout = os.Stdout
-				aiderCmd.Stderr = os.Stderr
-				if err := aiderCmd.Run(); err != nil {
-					log.Fatalf("aider failed for model %s target %s: %v", llmModel, target, err)
-				}
-				log.Printf("aider completed for model %s target %s (attempt %d/%d)", llmModel, target, attempt, maxAttempts)
-
-				// After aider, first run 'bazel query' to check target visibility/resolution.
-				queryCmd := exec.Command("bazel", "query", target)
-				queryCmd.Dir = worktreePath
-				queryOut, queryErr := queryCmd.CombinedOutput()
-				if queryErr != nil {
-					log.Printf("bazel query failed for model %s target %s: %v\n%s", llmModel, target, queryErr, string(queryOut))
-					// Stash any untracked or dirty files and retry with aider.
-					if err := gitStashAll(worktreePath); err != nil {
-						log.Fatalf("git stash failed in %s: %v", worktreePath, err)
-					}
-					log.Printf("Re-invoking aider for model %s target %s after failed bazel query (attempt %d/%d)", llmModel, target, attempt, maxAttempts)
-					continue
-				}
-
-				// Query succeeded; attempt to build the target.
-				bazelCmd := exec.Command("bazel", "build", target)
-				bazelCmd.Dir = worktreePath
-				bazelOut, bazelErr := bazelCmd.CombinedOutput()
-				if bazelErr != nil {
-					log.Printf("bazel build failed for model %s target %s: %v\n%s", llmModel, target, bazelErr, string(bazelOut))
-					// Stash any untracked or dirty files and retry with aider.
-					if err := gitStashAll(worktreePath); err != nil {
-						log.Fatalf("git stash failed in %s: %v", worktreePath, err)
-					}
-					log.Printf("Re-invoking aider for model %s target %s after failed bazel build (attempt %d/%d)", llmModel, target, attempt, maxAttempts)
-					continue
-				}
-
-				// Bazel build succeeded. Commit any untracked or dirty files and move on.
-				addCmd := exec.Command("git", "add", "-A")
-				addCmd.Dir = worktreePath
-				if out, err := addCmd.CombinedOutput(); err != nil {
-					log.Fatalf("git add failed in %s: %v\n%s", worktreePath, err, string(out))
-				}
-
-				statusCmd := exec.Command("git", "status", "--porcelain")
-				statusCmd.Dir = worktreePath
-				statusOut, err := statusCmd.Output()
-				if err != nil {
-					log.Fatalf("git status failed in %s: %v", worktreePath, err)
-				}
-				if strings.TrimSpace(string(statusOut)) == "" {
-					log.Printf("No changes to commit in %s for model %s target %s", worktreePath, llmModel, target)
-				} else {
-					commitMsg := fmt.Sprintf("aider: model %s target %s", llmModel, target)
-					commitCmd := exec.Command("git", "commit", "-m", commitMsg)
-					commitCmd.Dir = worktreePath
-					commitCmd.Stdout = os.Stdout
-					commitCmd.Stderr = os.Stderr
-					if err := commitCmd.Run(); err != nil {
-						log.Fatalf("git commit failed in %s: %v", worktreePath, err)
-					}
-					log.Printf("Committed changes in %s: %s", worktreePath, commitMsg)
-				}
-
-				log.Printf("bazel build succeeded for model %s target %s", llmModel, target)
-				success = true
-				break // move to next target
+	stopProgress := func() {}
+	// Events written to stdout would be drawn over by the display.
+	if !*noProgressDisplay && *eventsOut != "-" && isTerminal(os.Stdout) {
+		stopProgress, err = startProgressDisplay(runModels, displayTargets)
+		if err != nil {
+			fatal("Error starting progress display", "err", err)
+		}
+	}
+	emit(migrate.Event{Type: migrate.EventRunStart, Models: runModels, Targets: displayTargets})
+
+	results, verifications, planned := migrateRepos(ctx, repos, runModels, newRepoMigrator)
+	stopProgress()
+	writeRunOutputs(runStart, repos, results, verifications, modelStats)
+	emit(migrate.Event{Type: migrate.EventRunDone, Succeeded: migrate.CountSucceeded(results), Total: planned})
+	code := exitCode(results, planned, *skippedPolicy)
+	if code != exitSuccess {
+		if pastDeadline() {
+			slog.Error("Deadline reached before all targets succeeded", "planned", planned)
+		}
+		slog.Error("Not every model/target pair succeeded", "planned", planned, "exitCode", code)
+	}
+	// The run may have been interrupted, so do not use its context.
+	notifyCtx, cancelNotify := context.WithTimeout(context.Background(), notifyTimeout)
+	if err := notifier.Notify(notifyCtx, newRunSummary(results, planned, code)); err != nil {
+		slog.Warn("Could not send run notification", "err", err)
+	}
+	cancelNotify()
+	cleanupWorktrees()
+	os.Exit(code)
+}
+
+// runSubcommand runs the subcommand named by the first argument, if it is one
+// that does not migrate, and reports done. Otherwise it returns the LLMRunner
+// the run should use: aider itself, or with "replay" the outputs recorded in
+// an audit log.
+func runSubcommand() (llm migrate.LLMRunner, done bool) {
+	switch flag.Arg(0) {
+	case "diff-reports":
+		if flag.NArg() != 3 {
+			fatal("usage: bld diff-reports OLD.json NEW.json")
+		}
+		if err := runDiffReports(os.Stdout, flag.Arg(1), flag.Arg(2)); err != nil {
+			fatal("Error diffing reports", "err", err)
+		}
+		return nil, true
+	case "leaderboard":
+		path := *leaderboardPath
+		if flag.NArg() == 2 {
+			path = flag.Arg(1)
+		}
+		if path == "" || flag.NArg() > 2 {
+			fatal("usage: bld [-leaderboard LEADERBOARD.json] leaderboard [LEADERBOARD.json]")
+		}
+		if err := runLeaderboard(os.Stdout, path); err != nil {
+			fatal("Error printing leaderboard", "err", err)
+		}
+		return nil, true
+	case "replay":
+		// Re-run with the aider outputs and edits recorded by -audit-log;
+		// bazel and git still run for real.
+		if flag.NArg() != 2 {
+			fatal("usage: bld [flags] replay AUDIT.jsonl")
+		}
+		llm, err := NewReplayLLMRunner(flag.Arg(1), execGitManager{})
+		if err != nil {
+			fatal("Error loading audit log for replay", "err", err)
+		}
+		slog.Info("Replaying recorded aider outputs", "auditLog", flag.Arg(1))
+		return llm, false
+	}
+	return execLLMRunner{}, false
+}
+
+// validateFlags exits with exitError if any flag, or combination of flags,
+// is invalid. It resolves -edit-format to -aider-edit-format.
+func validateFlags() {
+	if *lockfileMode != "update" && *lockfileMode != "off" {
+		fatal("Invalid -lockfile-mode: want update or off", "lockfileMode", *lockfileMode)
+	}
+	if !versionAtLeast(*bazelMinVersion, "0") {
+		fatal("Invalid -bazel-min-version: want a release such as 6.0.0", "bazelMinVersion", *bazelMinVersion)
+	}
+	if err := validateBazelFlags(bazelFlags()); err != nil {
+		fatal("Invalid -bazel-flags", "err", err)
+	}
+	if _, err := splitArgs(*aiderExtraArgs); err != nil {
+		fatal("Invalid -aider-extra-args", "err", err)
+	}
+
+	if *skippedPolicy != "fail" && *skippedPolicy != "ignore" {
+		fatal("Invalid -skipped-policy: want fail or ignore", "skippedPolicy", *skippedPolicy)
+	}
+
+	if *commitEveryAttempt && *maxCommits > 0 {
+		fatal("-commit-every-attempt cannot be combined with -max-commits")
+	}
+	if *bestOfN && *repeat > 1 {
+		fatal("-best-of-n cannot be combined with -repeat")
+	}
+	if *verify && *compareDiffs {
+		fatal("-verify cannot be combined with -compare-diffs")
+	}
+	if *escalate && (*bestOfN || *repeat > 1 || *cherryPickFromBest) {
+		fatal("-escalate cannot be combined with -best-of-n, -repeat or -cherry-pick-from-best")
+	}
+	switch *mode {
+	case "compare":
+	case "select-best":
+		if *escalate || *bestOfN || *repeat > 1 {
+			fatal("-mode select-best cannot be combined with -escalate, -best-of-n or -repeat")
+		}
+	default:
+		fatal("Invalid -mode: want compare or select-best", "mode", *mode)
+	}
+	if *concurrency < 1 {
+		fatal("Invalid -concurrency: want at least 1", "concurrency", *concurrency)
+	}
+
+	if *editFormatAlias != "" {
+		*aiderEditFormat = *editFormatAlias
+	}
+	switch *aiderEditFormat {
+	case "diff", "whole", "udiff", "architect", "auto":
+	default:
+		fatal("Invalid -aider-edit-format: want diff, whole, udiff, architect or auto", "aiderEditFormat", *aiderEditFormat)
+	}
+}
+
+// loadConfigFiles loads -prompt-template, -config and -model-alias-file,
+// expanding the aliases in -models, -skip-model and -fallback-model.
+func loadConfigFiles() {
+	if err := setPromptTemplate(*promptTemplatePath); err != nil {
+		fatal("Error loading -prompt-template", "err", err)
+	}
+
+	if *configPath != "" {
+		var err error
+		config, err = loadConfig(*configPath)
+		if err != nil {
+			fatal("Error loading -config", "err", err)
+		}
+	}
+
+	if *modelAliasFile != "" {
+		aliases, err := loadModelAliases(*modelAliasFile)
+		if err != nil {
+			fatal("Error loading -model-alias-file", "err", err)
+		}
+		if models, err = aliases.Expand(models); err != nil {
+			fatal("Error expanding model aliases", "err", err)
+		}
+		if skipModelNames, err = aliases.Expand(skipModelNames); err != nil {
+			fatal("Error expanding -skip-model aliases", "err", err)
+		}
+		if *fallbackModel, err = aliases.Resolve(*fallbackModel); err != nil {
+			fatal("Error expanding -fallback-model alias", "err", err)
+		}
+	}
+}
+
+// planRepos returns the repos to migrate: the current checkout at wd on
+// branch, or the repos in -config cloned under -repos-dir, each with its
+// targets filtered, discovered with -discover-targets and ordered by
+// dependency.
+func planRepos(ctx context.Context, wd, branch string) []repoRun {
+	allTargets := targets
+	if *targetsFile != "" {
+		var err error
+		allTargets, err = loadTargetsFile(*targetsFile)
+		if err != nil {
+			fatal("Error loading -targets-file", "err", err)
+		}
+	}
+	pattern, err := targetPattern(*targetRegex, *targetFilter)
+	if err != nil {
+		fatal("Invalid target filter", "err", err)
+	}
+	runTargets, err := filterByRegex(allTargets, pattern)
+	if err != nil {
+		fatal("Error applying target filter", "err", err)
+	}
+
+	repos := []repoRun{{Dir: wd, Branch: branch, Targets: runTargets}}
+	if len(config.Repos) > 0 {
+		repos, err = prepareRepos(ctx, config.Repos, *reposDir, pattern, *repoRef)
+		if err != nil {
+			fatal("Error preparing repos", "err", err)
+		}
+	} else {
+		if *repoRef != "" {
+			slog.Warn("-repo-ref only applies to repos cloned from the config; migrating the current checkout", "ref", *repoRef)
+		}
+		if repos[0].SHA, err = migrate.HeadSHA(wd); err != nil {
+			slog.Warn("Could not resolve HEAD of the current repo", "err", err)
+		}
+	}
+	if *discoverTargets {
+		for i, repo := range repos {
+			discovered, err := bazelQueryRustTargets(repo.Dir)
+			if err != nil {
+				slog.Warn("Could not discover targets; using the configured list", "repo", repo.ID, "err", err)
+				continue
 			}
-			if !success {
-				log.Printf("Maximum attempts (%d) reached for model %s target %s; moving on to next target/worktree", maxAttempts, llmModel, target)
+			if repos[i].Targets, err = filterByRegex(discovered, pattern); err != nil {
+				fatal("Error applying target filter", "err", err)
 			}
+			slog.Info("Discovered targets", "repo", repo.ID, "targets", repos[i].Targets)
+		}
+	}
+	for i, repo := range repos {
+		if len(repo.Targets) < 2 {
+			continue
+		}
+		ordered, err := bazelQueryDependencyOrder(repo.Dir, repo.Targets)
+		if err != nil {
+			slog.Warn("Could not order targets by dependency; keeping the given order", "repo", repo.ID, "err", err)
+			continue
+		}
+		if !slices.Equal(ordered, repo.Targets) {
+			slog.Info("Ordered targets by dependency", "repo", repo.ID, "targets", ordered)
+		}
+		repos[i].Targets = ordered
+	}
+	return repos
+}
+
+// migrateRepos has models migrate the targets of each of repos in turn, and
+// returns the results, whether each model's worktree builds as a whole, and
+// how many model/target pairs were planned.
+func migrateRepos(ctx context.Context, repos []repoRun, models []string, newMigrator func(repoRun) *migrate.Migrator) ([]Result, []migrate.ModelVerification, int) {
+	var results []Result
+	var verifications []migrate.ModelVerification
+	planned := 0
+	for _, repo := range repos {
+		if pastDeadline() || overBudget() {
+			slog.Warn("Not starting remaining repos", "next", repo.ID, "pastDeadline", pastDeadline(), "overBudget", overBudget())
+			break
+		}
+		if repo.ID != "" {
+			slog.Info("Migrating repo", "repo", repo.ID, "dir", repo.Dir, "targets", len(repo.Targets))
+		}
+		repoModels := models
+		if *escalate {
+			repoModels = rankModelsByCost(models, config.ModelRanking, costs)
+		}
+		result, err := newMigrator(repo).MigrateRepo(ctx, repo.Dir, repo.Branch, repoModels, repo.Targets)
+		if err != nil {
+			fatal("Error migrating repo", "repo", repo.ID, "err", err)
+		}
+		results = append(results, result.Results...)
+		verifications = append(verifications, result.Verifications...)
+		planned += result.Planned
+	}
+	return results, verifications, planned
+}
+
+// verifyRepos builds each model's existing worktree of each of repos as a
+// whole for -verify, and writes -report.
+func verifyRepos(ctx context.Context, repos []repoRun, models []string, newMigrator func(repoRun) *migrate.Migrator) []migrate.ModelVerification {
+	var verifications []migrate.ModelVerification
+	for _, repo := range repos {
+		migrator := newMigrator(repo)
+		tracker, err := migrator.TrackExistingModels(repo.Dir, repo.Branch, models)
+		if err != nil {
+			fatal("Error finding model worktrees", "repo", repo.ID, "err", err)
+		}
+		repoVerifications, err := migrator.VerifyModels(ctx, tracker)
+		if err != nil {
+			fatal("Error verifying models", "repo", repo.ID, "err", err)
+		}
+		verifications = append(verifications, repoVerifications...)
+	}
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, nil, verifications, repoRevisions(repos)); err != nil {
+			fatal("Error writing report", "err", err)
+		}
+		slog.Info("Wrote report", "path", *reportPath)
+	}
+	return verifications
+}
+
+// compareRepos compares the BUILD files each model's existing worktree of
+// each of repos has for its targets, for -compare-diffs.
+func compareRepos(repos []repoRun, models []string, newMigrator func(repoRun) *migrate.Migrator) []TargetComparison {
+	var comparisons []TargetComparison
+	for _, repo := range repos {
+		tracker, err := newMigrator(repo).TrackExistingModels(repo.Dir, repo.Branch, models)
+		if err != nil {
+			fatal("Error finding model worktrees", "repo", repo.ID, "err", err)
+		}
+		repoComparisons, err := compareModels(repo.ID, tracker, repo.Targets)
+		if err != nil {
+			fatal("Error comparing models", "repo", repo.ID, "err", err)
+		}
+		comparisons = append(comparisons, repoComparisons...)
+	}
+	return comparisons
+}
+
+// writeRunOutputs logs and prints the results of a run and writes the
+// reports, model stats and leaderboard its flags ask for.
+func writeRunOutputs(runStart time.Time, repos []repoRun, results []Result, verifications []migrate.ModelVerification, modelStats map[string]ModelStats) {
+	logResults(results)
+	if err := printSummary(os.Stdout, results); err != nil {
+		slog.Error("Error printing summary", "err", err)
+	}
+	slog.Info("Estimated aider spend", "usd", round2(costs.TotalCost()))
+	if overBudget() {
+		fmt.Fprintf(os.Stderr, "Budget exceeded: spent an estimated $%.2f of the $%.2f budget; remaining model/target pairs were skipped.\n", costs.TotalCost(), *budget)
+	}
+	if *repeat > 1 {
+		logRepetitionSummaries(summarizeRepetitions(results))
+	}
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, results, verifications, repoRevisions(repos)); err != nil {
+			fatal("Error writing report", "err", err)
+		}
+		slog.Info("Wrote report", "path", *reportPath)
+	}
+	if *htmlReportPath != "" {
+		if err := generateHTMLReport(results, *htmlReportPath); err != nil {
+			fatal("Error writing HTML report", "err", err)
+		}
+		slog.Info("Wrote HTML report", "path", *htmlReportPath)
+	}
+	if *modelStatsPath != "" {
+		updateModelStats(modelStats, results)
+		if err := saveModelStats(*modelStatsPath, modelStats); err != nil {
+			slog.Error("Error updating model stats", "err", err)
+		}
+	}
+	if *leaderboardPath != "" {
+		var shas []string
+		for _, repo := range repos {
+			shas = append(shas, repo.SHA)
+		}
+		if err := updateLeaderboard(*leaderboardPath, leaderboardRunKey(runStart, shas), results); err != nil {
+			slog.Error("Error updating leaderboard", "err", err)
+		} else {
+			slog.Info("Updated leaderboard", "path", *leaderboardPath)
 		}
 	}
 }
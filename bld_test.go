@@ -0,0 +1,863 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+func TestBuildEditLoop(t *testing.T) {
+	errBuild := errors.New("ERROR: build failed")
+	tests := []struct {
+		name        string
+		buildErrs   []error
+		wantSuccess bool
+		wantCalls   int
+		wantStashes int
+		wantCommits int
+	}{
+		{
+			name:        "builds first time",
+			wantSuccess: true,
+			wantCalls:   1,
+			wantCommits: 1,
+		},
+		{
+			name:        "builds after failures",
+			buildErrs:   []error{errBuild, errBuild},
+			wantSuccess: true,
+			wantCalls:   3,
+			wantCommits: 1,
+		},
+		{
+			name:        "never builds",
+			buildErrs:   []error{errBuild, errBuild, errBuild, errBuild, errBuild},
+			wantCalls:   migrate.MaxAttempts,
+			wantStashes: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestLogger(t)
+			git := migratetest.NewFakeGitManager()
+			build := &migratetest.FakeBuildRunner{BuildErrs: tt.buildErrs}
+			llm := &migratetest.FakeLLMRunner{Git: git}
+			m := newMigrator(git, build, llm)
+			worktreePath := t.TempDir()
+			run := migrate.Run{
+				WorktreePath: worktreePath,
+				Model:        "openrouter/test/model",
+				Target:       "//crates/matcher:grep_matcher",
+				BuildFile:    "crates/matcher/BUILD.bazel",
+				Log:          io.Discard,
+			}
+
+			result, err := m.MigrateTarget(context.Background(), run)
+			if err != nil {
+				t.Fatalf("MigrateTarget: %v", err)
+			}
+			if result.Success != tt.wantSuccess {
+				t.Errorf("Success = %v, want %v", result.Success, tt.wantSuccess)
+			}
+			if result.Attempts != tt.wantCalls || llm.Calls != tt.wantCalls {
+				t.Errorf("Attempts = %d, aider calls = %d, want %d", result.Attempts, llm.Calls, tt.wantCalls)
+			}
+			if got := len(git.Stashes[worktreePath]); got != tt.wantStashes {
+				t.Errorf("stash entries = %d, want %d", got, tt.wantStashes)
+			}
+			commits := git.Commits[worktreePath]
+			if len(commits) != tt.wantCommits {
+				t.Fatalf("commits = %d, want %d", len(commits), tt.wantCommits)
+			}
+			if changed, _ := git.ChangedFiles(worktreePath); len(changed) != 0 {
+				t.Errorf("worktree left dirty: %q", changed)
+			}
+			if tt.wantCommits == 0 {
+				return
+			}
+			if result.CommitSHA != commits[0].SHA {
+				t.Errorf("CommitSHA = %q, want %q", result.CommitSHA, commits[0].SHA)
+			}
+			if !strings.HasPrefix(commits[0].Message, "aider: build //crates/matcher:grep_matcher\n") {
+				t.Errorf("commit message subject wrong:\n%s", commits[0].Message)
+			}
+			if !strings.Contains(commits[0].Message, "crates/matcher/BUILD.bazel") {
+				t.Errorf("commit message missing diffstat:\n%s", commits[0].Message)
+			}
+		})
+	}
+}
+
+func TestBuildEditLoopRetry(t *testing.T) {
+	useTestLogger(t)
+	errBuild := &BazelBuildError{Target: "//crates/grep", Output: "ERROR: build failed", Err: errors.New("exit status 1")}
+	tests := []struct {
+		name         string
+		buildErrs    []error
+		wantBuilt    bool
+		wantCalls    int
+		wantAttempts int
+	}{
+		{
+			name:         "builds on third attempt",
+			buildErrs:    []error{errBuild, errBuild},
+			wantBuilt:    true,
+			wantCalls:    2,
+			wantAttempts: 3,
+		},
+		{
+			name:         "never builds",
+			buildErrs:    []error{errBuild, errBuild, errBuild, errBuild},
+			wantCalls:    3,
+			wantAttempts: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := *attempts
+			*attempts = 3
+			t.Cleanup(func() { *attempts = old })
+
+			build := &migratetest.FakeBuildRunner{BuildErrs: tt.buildErrs}
+			llm := &migratetest.FakeLLMRunner{Git: migratetest.NewFakeGitManager()}
+			run := migrate.Run{WorktreePath: "wt", Model: "m", Target: "//crates/grep", BuildFile: "crates/grep/BUILD.bazel", Log: io.Discard}
+
+			start := time.Now()
+			built, gotAttempts := buildEditLoop(t, build, llm, run)
+			if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+				t.Errorf("buildEditLoop took %s, want under 100ms", elapsed)
+			}
+			if built != tt.wantBuilt {
+				t.Errorf("built = %v, want %v", built, tt.wantBuilt)
+			}
+			if llm.Calls != tt.wantCalls {
+				t.Errorf("RunAider calls = %d, want %d", llm.Calls, tt.wantCalls)
+			}
+			if gotAttempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", gotAttempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestCommitTarget(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		commitMessage string
+		wantPrefix    string
+	}{
+		{name: "aider commit", commitMessage: "Add rust_library for grep_matcher", wantPrefix: "Add rust_library"},
+		{name: "git fallback", wantPrefix: "aider: build //crates/matcher:grep_matcher\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestLogger(t)
+			git := migratetest.NewFakeGitManager()
+			m := newMigrator(git, &migratetest.FakeBuildRunner{}, &migratetest.FakeLLMRunner{Git: git, CommitMessage: tt.commitMessage})
+			worktreePath := t.TempDir()
+			git.Touch(worktreePath, "crates/matcher/BUILD.bazel")
+
+			sha, err := m.CommitTarget(migrate.Run{WorktreePath: worktreePath, Model: "openrouter/test/model", Target: "//crates/matcher:grep_matcher"}, 1)
+			if err != nil {
+				t.Fatalf("commitTarget: %v", err)
+			}
+			commits := git.Commits[worktreePath]
+			if len(commits) != 1 || commits[0].SHA != sha {
+				t.Fatalf("commits = %+v, want one with SHA %q", commits, sha)
+			}
+			if !strings.HasPrefix(commits[0].Message, tt.wantPrefix) {
+				t.Errorf("commit message = %q, want prefix %q", commits[0].Message, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestMigrateTargetTiming(t *testing.T) {
+	useTestLogger(t)
+	git := migratetest.NewFakeGitManager()
+	const aiderTime = 20 * time.Millisecond
+	llm := &migratetest.FakeLLMRunner{Git: git, Edit: func(migrate.Run) error {
+		time.Sleep(aiderTime)
+		return nil
+	}}
+	m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errors.New("ERROR: build failed")}}, llm)
+	run := migrate.Run{WorktreePath: t.TempDir(), Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+	result, err := m.MigrateTarget(context.Background(), run)
+	if err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	if result.AiderDuration < 2*aiderTime {
+		t.Errorf("AiderDuration = %v, want at least %v for two attempts", result.AiderDuration, 2*aiderTime)
+	}
+	if result.BazelDuration <= 0 || result.BazelDuration >= result.AiderDuration {
+		t.Errorf("BazelDuration = %v, want positive and less than AiderDuration %v", result.BazelDuration, result.AiderDuration)
+	}
+}
+
+func TestAttemptStashLifecycle(t *testing.T) {
+	useTestLogger(t)
+	errBuild := errors.New("ERROR: build failed")
+	git := migratetest.NewFakeGitManager()
+	worktreePath := t.TempDir()
+	git.Stashes[worktreePath] = [][]string{{"interrupted"}}
+	m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errBuild, errBuild, errBuild}}, &migratetest.FakeLLMRunner{Git: git})
+	run := migrate.Run{WorktreePath: worktreePath, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard, MaxAttempts: 2}
+
+	if _, err := m.MigrateTarget(context.Background(), run); err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	// The failed target keeps only its last attempt.
+	if stashes := git.Stashes[worktreePath]; len(stashes) != 2 || !slices.Equal(stashes[0], []string{"interrupted"}) {
+		t.Errorf("stashes after failed target = %q, want the earlier entry and the last attempt", stashes)
+	}
+
+	run.Target, run.MaxAttempts = "//crates/cli", 3
+	if result, err := m.MigrateTarget(context.Background(), run); err != nil || !result.Success {
+		t.Fatalf("migrateTarget = %+v, %v; want success", result, err)
+	}
+	// The built target's failed attempt is dropped; the earlier entries stay.
+	if n := len(git.Stashes[worktreePath]); n != 2 {
+		t.Errorf("stash entries after built target = %d, want 2", n)
+	}
+}
+
+func TestMaxDiffLines(t *testing.T) {
+	useTestLogger(t)
+	prev := *maxDiffLines
+	*maxDiffLines = 50
+	t.Cleanup(func() { *maxDiffLines = prev })
+	// The attempt is measured from the commit before it, whether or not
+	// aider committed it.
+	for _, autoCommit := range []bool{false, true} {
+		t.Run(fmt.Sprintf("autoCommit=%t", autoCommit), func(t *testing.T) {
+			git := migratetest.NewFakeGitManager()
+			worktreePath := t.TempDir()
+			git.Touch(worktreePath, "Cargo.toml")
+			if err := git.Commit(worktreePath, "base"); err != nil {
+				t.Fatal(err)
+			}
+			var prompts []string
+			llm := &migratetest.FakeLLMRunner{Git: git, AutoCommit: autoCommit, Edit: func(run migrate.Run) error {
+				opts, err := aiderOptions(run)
+				prompts = append(prompts, opts.Message)
+				// The first attempt rewrites far more than the BUILD file.
+				git.Lines[worktreePath] = 400
+				if len(prompts) > 1 {
+					git.Lines[worktreePath] = 12
+				}
+				return err
+			}}
+			build := &migratetest.FakeBuildRunner{}
+			m := newMigrator(git, build, llm)
+			run := migrate.Run{WorktreePath: worktreePath, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+			result, err := m.MigrateTarget(context.Background(), run)
+			if err != nil {
+				t.Fatalf("MigrateTarget: %v", err)
+			}
+			if !result.Success || result.Attempts != 2 || result.OversizedAttempts != 1 {
+				t.Errorf("result = %+v, want success on attempt 2 after one oversized attempt", result)
+			}
+			if build.Builds != 1 {
+				t.Errorf("bazel builds = %d, want only the second attempt built", build.Builds)
+			}
+			if len(prompts) != 2 || !strings.Contains(prompts[1], "changed 400 lines, more than the 50 allowed") {
+				t.Errorf("second prompt does not ask for a smaller change:\n%s", prompts[len(prompts)-1])
+			}
+		})
+	}
+}
+
+func TestVerifyCleanBuild(t *testing.T) {
+	useTestLogger(t)
+	prev := *verifyCleanBuild
+	t.Cleanup(func() { *verifyCleanBuild = prev })
+	run := migrate.Run{Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+	*verifyCleanBuild = false
+	git := migratetest.NewFakeGitManager()
+	build := &migratetest.FakeBuildRunner{}
+	run.WorktreePath = t.TempDir()
+	if _, err := newMigrator(git, build, &migratetest.FakeLLMRunner{Git: git}).MigrateTarget(context.Background(), run); err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	if build.CleanBuilds != 0 {
+		t.Errorf("clean builds without -verify-clean-build = %d, want 0", build.CleanBuilds)
+	}
+
+	// The first attempt builds only from cache; the second from source too.
+	*verifyCleanBuild = true
+	git = migratetest.NewFakeGitManager()
+	build = &migratetest.FakeBuildRunner{CleanBuildErrs: []error{errors.New("ERROR: no such target")}}
+	var prompts []string
+	llm := &migratetest.FakeLLMRunner{Git: git, Edit: func(run migrate.Run) error {
+		opts, err := aiderOptions(run)
+		prompts = append(prompts, opts.Message)
+		return err
+	}}
+	run.WorktreePath = t.TempDir()
+	result, err := newMigrator(git, build, llm).MigrateTarget(context.Background(), run)
+	if err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	if !result.Success || result.Attempts != 2 {
+		t.Errorf("result = %+v, want success on attempt 2", result)
+	}
+	if build.Builds != 2 || build.CleanBuilds != 2 {
+		t.Errorf("builds = %d, clean builds = %d; want a clean build confirming each passing build", build.Builds, build.CleanBuilds)
+	}
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "building the target from a clean slate failed") {
+		t.Errorf("second prompt does not explain the rejection:\n%s", prompts[len(prompts)-1])
+	}
+	if len(git.Commits[run.WorktreePath]) != 1 {
+		t.Errorf("commits = %+v, want only the attempt that built from source", git.Commits[run.WorktreePath])
+	}
+}
+
+func TestExecCleanBuild(t *testing.T) {
+	useTestLogger(t)
+	calls := filepath.Join(t.TempDir(), "calls")
+	fakeBazel(t, `echo "$@" >> `+calls+"\n")
+
+	if _, err := (execBuildRunner{}).CleanBuild(context.Background(), t.TempDir(), io.Discard, "//:ripgrep"); err != nil {
+		t.Fatalf("CleanBuild: %v", err)
+	}
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(got) != 2 || got[0] != "clean" || !strings.HasPrefix(got[1], "build ") || !strings.Contains(got[1], "--noremote_accept_cached") || !strings.HasSuffix(got[1], " //:ripgrep") {
+		t.Errorf("bazel calls = %q, want a clean then a build accepting no cache hits", got)
+	}
+}
+
+func TestNoStash(t *testing.T) {
+	useTestLogger(t)
+	prev := *noStash
+	*noStash = true
+	t.Cleanup(func() { *noStash = prev })
+	git := migratetest.NewFakeGitManager()
+	m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errors.New("ERROR: build failed")}}, &migratetest.FakeLLMRunner{Git: git})
+	worktreePath := t.TempDir()
+	run := migrate.Run{WorktreePath: worktreePath, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+	result, err := m.MigrateTarget(context.Background(), run)
+	if err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	if !result.Success || result.Attempts != 2 {
+		t.Errorf("result = %+v, want success on attempt 2", result)
+	}
+	if n := len(git.Stashes[worktreePath]); n != 0 {
+		t.Errorf("stash entries = %d, want none with -no-stash", n)
+	}
+}
+
+func TestCommitEveryAttempt(t *testing.T) {
+	useTestLogger(t)
+	prev := *commitEveryAttempt
+	*commitEveryAttempt = true
+	t.Cleanup(func() { *commitEveryAttempt = prev })
+	errBuild := errors.New("ERROR: build failed")
+	git := migratetest.NewFakeGitManager()
+	llm := &migratetest.FakeLLMRunner{Git: git, CommitMessage: "message from aider"}
+	m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errBuild, errBuild}}, llm)
+	worktreePath := t.TempDir()
+	run := migrate.Run{WorktreePath: worktreePath, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+	result, err := m.MigrateTarget(context.Background(), run)
+	if err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	if !result.Success || result.Attempts != 3 {
+		t.Errorf("result = %+v, want success on attempt 3", result)
+	}
+	if n := len(git.Stashes[worktreePath]); n != 0 {
+		t.Errorf("stash entries = %d, want none with -commit-every-attempt", n)
+	}
+	var subjects []string
+	for _, c := range git.Commits[worktreePath] {
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		subjects = append(subjects, subject)
+	}
+	want := []string{
+		"aider: FAILED attempt 1 at //:ripgrep",
+		`Revert "aider: FAILED attempt 1 at //:ripgrep"`,
+		"aider: FAILED attempt 2 at //:ripgrep",
+		`Revert "aider: FAILED attempt 2 at //:ripgrep"`,
+		"aider: build //:ripgrep",
+	}
+	if !slices.Equal(subjects, want) {
+		t.Errorf("commit subjects = %q, want %q", subjects, want)
+	}
+	if commits := git.Commits[worktreePath]; !strings.Contains(commits[0].Message, "Reason: bazel build failed") {
+		t.Errorf("failed attempt message lacks its reason:\n%s", commits[0].Message)
+	}
+}
+
+func TestMaxCommits(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxCommits   int
+		wantSubjects []string
+	}{
+		{
+			name: "unlimited by default",
+			wantSubjects: []string{
+				"base",
+				"aider: FAILED attempt 1 at //:ripgrep",
+				`Revert "aider: FAILED attempt 1 at //:ripgrep"`,
+				"aider: FAILED attempt 2 at //:ripgrep",
+				`Revert "aider: FAILED attempt 2 at //:ripgrep"`,
+				"aider: build //:ripgrep",
+			},
+		},
+		{
+			name:         "squashed to two",
+			maxCommits:   2,
+			wantSubjects: []string{"base", "aider: squash 4 earlier commits", "aider: build //:ripgrep"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestLogger(t)
+			prevEvery, prevMax := *commitEveryAttempt, *maxCommits
+			*commitEveryAttempt, *maxCommits = true, tt.maxCommits
+			t.Cleanup(func() { *commitEveryAttempt, *maxCommits = prevEvery, prevMax })
+			worktreePath := t.TempDir()
+			git := migratetest.NewFakeGitManager()
+			git.Touch(worktreePath, "Cargo.toml")
+			if err := git.Commit(worktreePath, "base"); err != nil {
+				t.Fatal(err)
+			}
+			base, _ := git.HeadSHA(worktreePath)
+			errBuild := errors.New("ERROR: build failed")
+			llm := &migratetest.FakeLLMRunner{Git: git, CommitMessage: "message from aider"}
+			m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errBuild, errBuild}}, llm)
+			run := migrate.Run{WorktreePath: worktreePath, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", BaseCommit: base, Log: io.Discard}
+
+			result, err := m.MigrateTarget(context.Background(), run)
+			if err != nil || !result.Success {
+				t.Fatalf("migrateTarget = %+v, %v; want success", result, err)
+			}
+			var subjects []string
+			for _, c := range git.Commits[worktreePath] {
+				subject, _, _ := strings.Cut(c.Message, "\n")
+				subjects = append(subjects, subject)
+			}
+			if !slices.Equal(subjects, tt.wantSubjects) {
+				t.Errorf("commit subjects = %q, want %q", subjects, tt.wantSubjects)
+			}
+			if head, _ := git.HeadSHA(worktreePath); result.CommitSHA != head {
+				t.Errorf("CommitSHA = %s, want HEAD %s after squashing", result.CommitSHA, head)
+			}
+		})
+	}
+}
+
+func TestIncludeStashInContext(t *testing.T) {
+	useTestLogger(t)
+	prev := *includeStashInContext
+	*includeStashInContext = true
+	t.Cleanup(func() { *includeStashInContext = prev })
+	git := migratetest.NewFakeGitManager()
+	var prompts []string
+	llm := &migratetest.FakeLLMRunner{Git: git, Edit: func(run migrate.Run) error {
+		opts, err := aiderOptions(run)
+		prompts = append(prompts, opts.Message)
+		return err
+	}}
+	m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errors.New("ERROR: build failed")}}, llm)
+	run := migrate.Run{WorktreePath: t.TempDir(), Model: "openrouter/test/model", Target: "//crates/cli:grep_cli", BuildFile: "crates/cli/BUILD.bazel", Log: io.Discard}
+
+	if _, err := m.MigrateTarget(context.Background(), run); err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+	if len(prompts) != 2 {
+		t.Fatalf("aider ran %d times, want 2", len(prompts))
+	}
+	if strings.Contains(prompts[0], "Previous attempt") {
+		t.Errorf("first prompt mentions a previous attempt:\n%s", prompts[0])
+	}
+	want := "Previous attempt that did not produce a working build:\n\ndiff --git a/crates/cli/BUILD.bazel b/crates/cli/BUILD.bazel"
+	if !strings.Contains(prompts[1], want) {
+		t.Errorf("second prompt lacks the stashed diff %q:\n%s", want, prompts[1])
+	}
+}
+
+func TestBazelCommand(t *testing.T) {
+	prev, prevMode := bazelFlagValues, *lockfileMode
+	t.Cleanup(func() { bazelFlagValues, *lockfileMode = prev, prevMode })
+
+	bazelFlagValues, *lockfileMode = nil, ""
+
+	if got, want := bazelCommand("build", "//:ripgrep"), []string{"build", "//:ripgrep"}; !slices.Equal(got, want) {
+		t.Errorf("bazelCommand without flags = %q, want %q", got, want)
+	}
+	bazelFlagValues = stringsFlag{"--config=remote  --remote_cache=grpc://cache:9092", "-k"}
+	want := []string{"query", "--config=remote", "--remote_cache=grpc://cache:9092", "-k", "--output=label_kind", "//:ripgrep"}
+	if got := bazelCommand("query", "--output=label_kind", "//:ripgrep"); !slices.Equal(got, want) {
+		t.Errorf("bazelCommand = %q, want %q", got, want)
+	}
+
+	*lockfileMode = "off"
+	want = []string{"build", "--config=remote", "--remote_cache=grpc://cache:9092", "-k", "--lockfile_mode=off", "//:ripgrep"}
+	if got := bazelCommand("build", "//:ripgrep"); !slices.Equal(got, want) {
+		t.Errorf("bazelCommand with -lockfile-mode = %q, want %q", got, want)
+	}
+	bazelFlagValues = stringsFlag{"--lockfile_mode=refresh"}
+	want = []string{"build", "--lockfile_mode=refresh", "//:ripgrep"}
+	if got := bazelCommand("build", "//:ripgrep"); !slices.Equal(got, want) {
+		t.Errorf("bazelCommand with --lockfile_mode in -bazel-flags = %q, want %q", got, want)
+	}
+}
+
+func TestCommitLockfile(t *testing.T) {
+	for _, commit := range []bool{false, true} {
+		useTestLogger(t)
+		prev := *commitLockfile
+		*commitLockfile = commit
+		t.Cleanup(func() { *commitLockfile = prev })
+		git := migratetest.NewFakeGitManager()
+		m := newMigrator(git, &migratetest.FakeBuildRunner{}, &migratetest.FakeLLMRunner{Git: git})
+		worktreePath := t.TempDir()
+		git.Touch(worktreePath, "crates/cli/BUILD.bazel")
+		git.Touch(worktreePath, "MODULE.bazel.lock")
+
+		if _, err := m.CommitTarget(migrate.Run{WorktreePath: worktreePath, Model: "openrouter/test/model", Target: "//crates/cli:cli"}, 1); err != nil {
+			t.Fatalf("commitTarget: %v", err)
+		}
+		want := []string{"crates/cli/BUILD.bazel"}
+		if commit {
+			want = append(want, "MODULE.bazel.lock")
+		}
+		if commits := git.Commits[worktreePath]; len(commits) != 1 || !slices.Equal(commits[0].Files, want) {
+			t.Errorf("with -commit-lockfile=%t, commits = %+v, want one of %q", commit, commits, want)
+		}
+	}
+}
+
+func TestValidateBazelFlags(t *testing.T) {
+	tests := []struct {
+		flags   []string
+		wantErr bool
+	}{
+		{flags: nil},
+		{flags: []string{"--config=remote", "-k"}},
+		{flags: []string{"--config", "remote"}, wantErr: true},
+		{flags: []string{"//:ripgrep"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateBazelFlags(tt.flags); (err != nil) != tt.wantErr {
+			t.Errorf("validateBazelFlags(%q) = %v, want error %v", tt.flags, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAiderExtraArgs(t *testing.T) {
+	prev := *aiderExtraArgs
+	t.Cleanup(func() { *aiderExtraArgs = prev })
+	*aiderExtraArgs = `--no-verify,--edit-format whole, --lint-cmd "cargo check" --commit-prompt='it'"'"'s done',\,`
+
+	opts, err := aiderOptions(migrate.Run{Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", EditFormat: "diff"})
+	if err != nil {
+		t.Fatalf("aiderOptions: %v", err)
+	}
+	args := aiderArgs(opts)
+	extra := []string{"--no-verify", "--edit-format", "whole", "--lint-cmd", "cargo check", "--commit-prompt=it's done", ","}
+	// The extra args follow bld's own flags, so aider's last --edit-format
+	// wins, and precede the files to edit.
+	want := append(slices.Clone(extra), opts.EditFiles...)
+	if got := args[len(args)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("command ends with %q, want %q", got, want)
+	}
+	if i := slices.Index(args, "--edit-format"); i == -1 || args[i+1] != "diff" || i >= len(args)-len(want) {
+		t.Errorf("command %q lacks bld's --edit-format diff before the extra args", args)
+	}
+	if !slices.Contains(args, "--no-auto-commits") || !slices.Contains(args, "--no-dirty-commits") {
+		t.Errorf("command %q lets aider commit", args)
+	}
+
+	for _, value := range []string{`--lint-cmd "cargo check`, `--no-verify\`} {
+		if got, err := splitArgs(value); err == nil {
+			t.Errorf("splitArgs(%q) = %q, want an error", value, got)
+		}
+	}
+	if got, err := splitArgs(" , "); err != nil || len(got) != 0 {
+		t.Errorf("splitArgs of separators only = %q, %v, want no args", got, err)
+	}
+}
+
+func TestFilterByRegex(t *testing.T) {
+	targets := []string{
+		"//crates/matcher:grep_matcher",
+		"//crates/regex:grep_regex",
+		"//crates/searcher:grep_searcher",
+		"//:ripgrep",
+	}
+	tests := []struct {
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{pattern: "", want: targets},
+		{pattern: "grep_regex$", want: []string{"//crates/regex:grep_regex"}},
+		{pattern: "^//crates/(matcher|searcher):", want: []string{"//crates/matcher:grep_matcher", "//crates/searcher:grep_searcher"}},
+		{pattern: "pcre2", wantErr: true},
+		{pattern: "(", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := filterByRegex(targets, tt.pattern)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("filterByRegex(%q) = %q, want error", tt.pattern, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("filterByRegex(%q): %v", tt.pattern, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("filterByRegex(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestSkipModel(t *testing.T) {
+	useTestLogger(t)
+	prev := skipModelNames
+	t.Cleanup(func() { skipModelNames = prev })
+	skipModelNames = nil
+	for _, model := range append(slices.Clone(models), "example/not-a-model") {
+		if err := flag.Set("skip-model", model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runModels, err := filterByRegex(skipModels(models, skipModelNames), "")
+	if err != nil {
+		t.Fatalf("filterByRegex: %v", err)
+	}
+	if len(runModels) != 0 {
+		t.Fatalf("models left after skipping all = %q, want none", runModels)
+	}
+	// With no models to run, the run plans nothing and succeeds.
+	if code := exitCode(nil, len(runModels)*len(targets), "fail"); code != exitSuccess {
+		t.Errorf("exit code = %d, want %d", code, exitSuccess)
+	}
+
+	if got := skipModels([]string{"a", "b", "c"}, []string{"b"}); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("skipModels = %q, want [a c]", got)
+	}
+}
+
+func TestTargetPattern(t *testing.T) {
+	tests := []struct {
+		regex, filter string
+		want          string
+		wantErr       bool
+	}{
+		{},
+		{regex: "grep_regex", want: "grep_regex"},
+		{filter: "grep_regex", want: "grep_regex"},
+		{regex: "grep_regex", filter: "grep_regex", want: "grep_regex"},
+		{regex: "grep_regex", filter: "globset", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := targetPattern(tt.regex, tt.filter)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("targetPattern(%q, %q) = %q, %v; want %q, error %v", tt.regex, tt.filter, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	ok := Result{Success: true}
+	failed := Result{}
+	skipped := Result{Skipped: true}
+	tests := []struct {
+		name    string
+		results []Result
+		planned int
+		policy  string
+		want    int
+	}{
+		{name: "all succeeded", results: []Result{ok, ok}, planned: 2, policy: "fail", want: exitSuccess},
+		{name: "one failed", results: []Result{ok, failed}, planned: 2, policy: "fail", want: exitFailure},
+		{name: "did not finish", results: []Result{ok}, planned: 2, policy: "fail", want: exitFailure},
+		{name: "skipped fails", results: []Result{ok, skipped}, planned: 2, policy: "fail", want: exitFailure},
+		{name: "skipped ignored", results: []Result{ok, skipped}, planned: 2, policy: "ignore", want: exitSuccess},
+		{name: "skipped ignored but failed", results: []Result{failed, skipped}, planned: 2, policy: "ignore", want: exitFailure},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.results, tt.planned, tt.policy); got != tt.want {
+			t.Errorf("%s: exitCode = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBazelSyncArgs(t *testing.T) {
+	tests := []struct {
+		version string
+		want    []string
+	}{
+		{version: "Bazelisk version: v1.25.0\nBuild label: 8.0.1\nBuild target: @@//src/main/java/com/google/devtools/build/lib/bazel:BazelServer\n", want: []string{"mod", "tidy"}},
+		{version: "Build label: 7.1.0\n", want: []string{"mod", "tidy"}},
+		{version: "Build label: 7.0.2\n", want: []string{"fetch", "//..."}},
+		{version: "Build label: 6.5.0\n", want: []string{"fetch", "//..."}},
+		{version: "Build label: \nBuild time: Thu Jan 01 00:00:00 1970\n", want: []string{"fetch", "//..."}},
+	}
+	for _, tt := range tests {
+		version, _ := parseBazelVersion(tt.version)
+		if got := bazelSyncArgs(version); !slices.Equal(got, tt.want) {
+			t.Errorf("bazelSyncArgs for %q = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+// fakeBazel puts a bazel that runs script first on PATH for the test.
+func fakeBazel(t *testing.T, script string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bazel"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDetectBazelVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    string
+		wantErr bool
+	}{
+		{name: "bazelisk", script: "printf 'Bazelisk version: v1.25.0\\nBuild label: 8.0.1\\nBuild time: Mon Jan 13 2025\\n'\n", want: "8.0.1"},
+		{name: "release candidate", script: "printf 'Build label: 7.0.0rc2\\n'\n", want: "7.0.0"},
+		{name: "development build", script: "printf 'Build label: \\nBuild time: Thu Jan 01 00:00:00 1970\\n'\n", want: ""},
+		{name: "fails", script: "echo 'no .bazelversion' >&2; exit 1\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeBazel(t, tt.script)
+			got, err := detectBazelVersion(t.TempDir())
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("detectBazelVersion = %q, %v; want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version, min string
+		want         bool
+	}{
+		{version: "6.0.0", min: "6.0.0", want: true},
+		{version: "7.1", min: "6.0.0", want: true},
+		{version: "10.0.0", min: "9.2.1", want: true},
+		{version: "5.4.1", min: "6.0.0", want: false},
+		{version: "7.0.2", min: "7.1", want: false},
+		{version: "", min: "6.0.0", want: false},
+		{version: "7.x", min: "6.0.0", want: false},
+	}
+	for _, tt := range tests {
+		if got := versionAtLeast(tt.version, tt.min); got != tt.want {
+			t.Errorf("versionAtLeast(%q, %q) = %t, want %t", tt.version, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestResolveEditFormat(t *testing.T) {
+	tests := []struct {
+		format, model, want string
+	}{
+		{format: "udiff", model: "openrouter/openai/gpt-4.1-mini", want: "udiff"},
+		{format: "auto", model: "openrouter/openai/gpt-4.1-mini", want: "whole"},
+		{format: "auto", model: "openrouter/anthropic/claude-sonnet-4", want: "diff"},
+		{format: "auto", model: "google/gemini-2.5-flash", want: "whole"},
+	}
+	for _, tt := range tests {
+		if got := resolveEditFormat(tt.format, tt.model); got != tt.want {
+			t.Errorf("resolveEditFormat(%q, %q) = %q, want %q", tt.format, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestEditFormatFallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		editFormat  string
+		wantFormats []string
+		wantSuccess bool
+	}{
+		{name: "diff falls back to whole", editFormat: "diff", wantFormats: []string{"diff", "whole"}, wantSuccess: true},
+		{name: "udiff does not fall back", editFormat: "udiff", wantFormats: []string{"udiff", "udiff", "udiff", "udiff", "udiff"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestLogger(t)
+			worktreePath := t.TempDir()
+			git := migratetest.NewFakeGitManager()
+			build := &migratetest.FakeBuildRunner{
+				CheckSyntaxFunc: func(name, content string) error {
+					if content != "rust_library(name = \"grep_matcher\")\n" {
+						return errors.New(name + ":1:1: syntax error")
+					}
+					return nil
+				},
+			}
+			// Only whole-file edits come out valid.
+			llm := &migratetest.FakeLLMRunner{Git: git, Edit: func(run migrate.Run) error {
+				content := "rust_library(name = \"grep_matcher\"\n"
+				if run.EditFormat == "whole" {
+					content = "rust_library(name = \"grep_matcher\")\n"
+				}
+				writeFile(t, filepath.Join(run.WorktreePath, run.BuildFile), content)
+				return nil
+			}}
+			m := newMigrator(git, build, llm)
+			run := migrate.Run{
+				WorktreePath: worktreePath,
+				Model:        "openrouter/test/model",
+				Target:       "//crates/matcher:grep_matcher",
+				BuildFile:    "crates/matcher/BUILD.bazel",
+				EditFormat:   tt.editFormat,
+				Log:          io.Discard,
+			}
+			result, err := m.MigrateTarget(context.Background(), run)
+			if err != nil {
+				t.Fatalf("MigrateTarget: %v", err)
+			}
+			if result.Success != tt.wantSuccess {
+				t.Errorf("Success = %v, want %v", result.Success, tt.wantSuccess)
+			}
+			if !slices.Equal(llm.EditFormats, tt.wantFormats) {
+				t.Errorf("edit formats = %q, want %q", llm.EditFormats, tt.wantFormats)
+			}
+			if want := tt.wantFormats[len(tt.wantFormats)-1]; result.EditFormat != want {
+				t.Errorf("Result.EditFormat = %q, want %q", result.EditFormat, want)
+			}
+			if tt.wantSuccess && result.Attempts != 1 {
+				t.Errorf("Attempts = %d, want the fallback to reuse attempt 1", result.Attempts)
+			}
+		})
+	}
+}
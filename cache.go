@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// crateHash identifies the contents of the crate in package pkg of
+// worktreePath: its Cargo.toml plus the list of files in the package, not
+// counting BUILD files or build output. Unchanged crates hash the same across
+// runs, so a BUILD file that worked before can be reused.
+func crateHash(worktreePath, pkg string) (string, error) {
+	dir := filepath.Join(worktreePath, pkg)
+	cargo, err := os.ReadFile(filepath.Join(dir, "Cargo.toml"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read Cargo.toml for %s: %w", pkg, err)
+	}
+	h := sha256.New()
+	h.Write(cargo)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != dir && (name == ".git" || name == "target" || strings.HasPrefix(name, "bazel-")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if name == "BUILD" || name == "BUILD.bazel" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\n", filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list files for %s: %w", pkg, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildFileCache is the -cache-dir directory, holding a BUILD.bazel for each
+// crateHash that built.
+type buildFileCache string
+
+// Key returns the crateHash of the crate in package pkg of worktreePath.
+func (cacheDir buildFileCache) Key(worktreePath, pkg string) (string, error) {
+	return crateHash(worktreePath, pkg)
+}
+
+// Get returns the BUILD.bazel stored in cacheDir for hash, or nil if there is
+// none.
+func (cacheDir buildFileCache) Get(hash string) ([]byte, error) {
+	content, err := os.ReadFile(filepath.Join(string(cacheDir), hash, "BUILD.bazel"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached BUILD.bazel for %s: %w", hash, err)
+	}
+	return content, nil
+}
+
+// Put saves content in cacheDir as the BUILD.bazel for hash.
+func (cacheDir buildFileCache) Put(hash string, content []byte) error {
+	dir := filepath.Join(string(cacheDir), hash)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache dir %s: %w", dir, err)
+	}
+	// Write then rename so a concurrent reader never sees a partial file.
+	tmp, err := os.CreateTemp(dir, "BUILD.bazel.*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file in %s: %w", dir, err)
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write cache file %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write cache file %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, "BUILD.bazel")); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to store cached BUILD.bazel for %s: %w", hash, err)
+	}
+	return nil
+}
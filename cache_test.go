@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrateHash(t *testing.T) {
+	root := t.TempDir()
+	crate := filepath.Join(root, "crates", "matcher")
+	writeFile(t, filepath.Join(crate, "Cargo.toml"), "[package]\nname = \"grep-matcher\"\n")
+	writeFile(t, filepath.Join(crate, "src", "lib.rs"), "pub fn f() {}\n")
+
+	hash := func() string {
+		t.Helper()
+		h, err := crateHash(root, "crates/matcher")
+		if err != nil {
+			t.Fatalf("crateHash: %v", err)
+		}
+		return h
+	}
+	base := hash()
+
+	writeFile(t, filepath.Join(crate, "BUILD.bazel"), "rust_library(name = \"grep_matcher\")\n")
+	writeFile(t, filepath.Join(crate, "target", "debug", "out"), "")
+	writeFile(t, filepath.Join(crate, "src", "lib.rs"), "pub fn g() {}\n")
+	if got := hash(); got != base {
+		t.Errorf("hash changed after editing BUILD, build output and file contents: %s != %s", got, base)
+	}
+
+	writeFile(t, filepath.Join(crate, "src", "util.rs"), "")
+	added := hash()
+	if added == base {
+		t.Error("hash unchanged after adding a source file")
+	}
+
+	writeFile(t, filepath.Join(crate, "Cargo.toml"), "[package]\nname = \"grep-matcher\"\nversion = \"0.2.0\"\n")
+	if got := hash(); got == added {
+		t.Error("hash unchanged after editing Cargo.toml")
+	}
+
+	if _, err := crateHash(root, "crates/missing"); err == nil {
+		t.Error("crateHash of a package without Cargo.toml succeeded, want error")
+	}
+}
+
+func TestBuildFileCache(t *testing.T) {
+	cache := buildFileCache(t.TempDir())
+	got, err := cache.Get("abc")
+	if err != nil || got != nil {
+		t.Fatalf("Get on empty cache = %q, %v; want nil, nil", got, err)
+	}
+	want := "rust_library(name = \"grep_matcher\")\n"
+	if err := cache.Put("abc", []byte(want)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	got, err = cache.Get("abc")
+	if err != nil || string(got) != want {
+		t.Fatalf("Get = %q, %v; want %q", got, err, want)
+	}
+}
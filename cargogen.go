@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// warnNoCargoGenTool logs once that BUILD file generation is being skipped.
+var warnNoCargoGenTool sync.Once
+
+// errNoCargoGenTool is returned when -cargo-gen-tool is not installed.
+var errNoCargoGenTool = errors.New("BUILD file generator not found")
+
+// generateBuildFileFromCargo runs -cargo-gen-tool on the crate in targetDir
+// and returns the BUILD.bazel it produces. The tool is run in worktreePath
+// with targetDir as its only argument and may either print the file or write
+// it in place, as gazelle does; in the latter case the original file is put
+// back so the caller decides what to keep.
+func generateBuildFileFromCargo(worktreePath, targetDir string) (string, error) {
+	tool, err := exec.LookPath(*cargoGenTool)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errNoCargoGenTool, *cargoGenTool)
+	}
+	buildPath := filepath.Join(worktreePath, targetDir, "BUILD.bazel")
+	original, err := os.ReadFile(buildPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read %s: %w", buildPath, err)
+	}
+	cmd := exec.Command(tool, targetDir)
+	cmd.Dir = worktreePath
+	out, err := auditOutput(cmd)
+	if err != nil {
+		var stderr []byte
+		if ee, ok := err.(*exec.ExitError); ok {
+			stderr = ee.Stderr
+		}
+		return "", fmt.Errorf("%s %s failed: %w\n%s", *cargoGenTool, targetDir, err, string(stderr))
+	}
+	if strings.TrimSpace(string(out)) != "" {
+		return string(out), nil
+	}
+	generated, err := os.ReadFile(buildPath)
+	if err != nil {
+		return "", fmt.Errorf("%s produced no BUILD.bazel for %s: %w", *cargoGenTool, targetDir, err)
+	}
+	if original != nil {
+		if err := os.WriteFile(buildPath, original, 0644); err != nil {
+			return "", fmt.Errorf("failed to restore %s: %w", buildPath, err)
+		}
+	}
+	if strings.TrimSpace(string(generated)) == strings.TrimSpace(string(original)) {
+		return "", fmt.Errorf("%s did not change %s", *cargoGenTool, buildPath)
+	}
+	return string(generated), nil
+}
+
+// cargoGenSeed is the seed generated from Cargo metadata for run.Target, in
+// package pkg, or nil if it could not be generated. If it does not build, it
+// is aider's starting point.
+func cargoGenSeed(run migrate.Run, pkg string) (*migrate.Seed, error) {
+	generated, err := generateBuildFileFromCargo(run.WorktreePath, pkg)
+	if err != nil {
+		if errors.Is(err, errNoCargoGenTool) {
+			warnNoCargoGenTool.Do(func() {
+				slog.Warn("BUILD file generator not found; skipping generation (use -skip-cargo-gen to silence)", "tool", *cargoGenTool)
+			})
+			return nil, nil
+		}
+		slog.Warn("Could not generate BUILD.bazel from Cargo metadata", "target", run.Target, "err", err)
+		return nil, nil
+	}
+	return &migrate.Seed{Content: []byte(generated), Source: "generated by " + *cargoGenTool, Start: true}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// fakeCargoGenTool installs script as -cargo-gen-tool for the test.
+func fakeCargoGenTool(t *testing.T, script string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	tool := filepath.Join(t.TempDir(), "fake-cargo-gen")
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	prev := *cargoGenTool
+	*cargoGenTool = tool
+	t.Cleanup(func() { *cargoGenTool = prev })
+}
+
+func TestGenerateBuildFileFromCargo(t *testing.T) {
+	const generated = "rust_library(name = \"grep_matcher\")\n"
+	tests := []struct {
+		name    string
+		script  string
+		wantErr bool
+	}{
+		{name: "prints", script: "printf 'rust_library(name = \"grep_matcher\")\\n'\n"},
+		{name: "writes in place", script: "printf 'rust_library(name = \"grep_matcher\")\\n' > \"$1/BUILD.bazel\"\n"},
+		{name: "fails", script: "echo boom >&2; exit 1\n", wantErr: true},
+		{name: "no output", script: "true\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCargoGenTool(t, tt.script)
+			root := t.TempDir()
+			buildPath := filepath.Join(root, "crates/matcher/BUILD.bazel")
+			writeFile(t, buildPath, migrate.PlaceholderBuildFile)
+
+			got, err := generateBuildFileFromCargo(root, "crates/matcher")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("generateBuildFileFromCargo = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateBuildFileFromCargo: %v", err)
+			}
+			if got != generated {
+				t.Errorf("generated %q, want %q", got, generated)
+			}
+			if content, _ := os.ReadFile(buildPath); string(content) != migrate.PlaceholderBuildFile {
+				t.Errorf("BUILD.bazel left as %q, want it restored", content)
+			}
+		})
+	}
+}
+
+func TestCargoGenSeed(t *testing.T) {
+	run := migrate.Run{WorktreePath: t.TempDir(), Model: "openrouter/test/model", Target: "//crates/matcher:grep_matcher", BuildFile: "crates/matcher/BUILD.bazel"}
+	writeFile(t, filepath.Join(run.WorktreePath, run.BuildFile), migrate.PlaceholderBuildFile)
+
+	fakeCargoGenTool(t, "printf 'rust_library(name = \"grep_matcher\")\\n'\n")
+	seed, err := cargoGenSeed(run, "crates/matcher")
+	if err != nil {
+		t.Fatalf("cargoGenSeed: %v", err)
+	}
+	if want := "rust_library(name = \"grep_matcher\")\n"; seed == nil || string(seed.Content) != want || !seed.Start {
+		t.Errorf("cargoGenSeed = %+v, want %q as a starting point", seed, want)
+	}
+
+	fakeCargoGenTool(t, "echo boom >&2; exit 1\n")
+	if seed, err := cargoGenSeed(run, "crates/matcher"); seed != nil || err != nil {
+		t.Errorf("cargoGenSeed with a failing tool = %+v, %v; want nil, nil", seed, err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// sameSolutionSimilarity is the similarity at or above which two models'
+// BUILD files count as the same solution when clustering.
+const sameSolutionSimilarity = 0.9
+
+// warnNoBuildifierFormat logs once that BUILD files are compared unformatted.
+var warnNoBuildifierFormat sync.Once
+
+// TargetComparison records how similar the BUILD files different models
+// wrote for one target are.
+type TargetComparison struct {
+	Repo   string
+	Target string
+	// Models are the models with a BUILD file for the target, in run order;
+	// models that never wrote one are left out.
+	Models []string
+	// Similarity[i][j] is lineSimilarity of the BUILD files of Models[i]
+	// and Models[j].
+	Similarity [][]float64
+	// Clusters groups Models into solutions: models are in the same cluster
+	// when a chain of pairs at least sameSolutionSimilarity links them.
+	Clusters [][]string
+}
+
+// formatBuildFile runs content through buildifier so that formatting does not
+// count as a difference, returning content unchanged if buildifier is
+// missing or fails.
+func formatBuildFile(content string) string {
+	if _, err := exec.LookPath("buildifier"); err != nil {
+		warnNoBuildifierFormat.Do(func() {
+			slog.Warn("buildifier not found on PATH; comparing BUILD files unformatted")
+		})
+		return content
+	}
+	cmd := exec.Command("buildifier", "--type=build")
+	cmd.Stdin = strings.NewReader(content)
+	out, err := auditOutput(cmd)
+	if err != nil {
+		slog.Debug("buildifier could not format BUILD file; comparing it unformatted", "err", err)
+		return content
+	}
+	return string(out)
+}
+
+// normalizeBuildFile returns the lines of a formatted BUILD file that matter
+// for comparison: trimmed, without blank and comment lines.
+func normalizeBuildFile(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(formatBuildFile(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// lineSimilarity returns 2*M/T, where M is the length of the longest common
+// subsequence of lines a and b and T their total length: 1 for identical
+// files and 0 for files with no line in common.
+func lineSimilarity(a, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 1
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return 2 * float64(prev[len(b)]) / float64(len(a)+len(b))
+}
+
+// compareBuildFiles compares the BUILD files in files, keyed by model, for
+// target. models gives the order of the result.
+func compareBuildFiles(repo, target string, models []string, files map[string]string) TargetComparison {
+	c := TargetComparison{Repo: repo, Target: target}
+	var normalized [][]string
+	for _, model := range models {
+		content, ok := files[model]
+		if !ok {
+			continue
+		}
+		c.Models = append(c.Models, model)
+		normalized = append(normalized, normalizeBuildFile(content))
+	}
+	c.Similarity = make([][]float64, len(c.Models))
+	for i := range c.Models {
+		c.Similarity[i] = make([]float64, len(c.Models))
+		for j := range c.Models {
+			if j < i {
+				c.Similarity[i][j] = c.Similarity[j][i]
+			} else {
+				c.Similarity[i][j] = lineSimilarity(normalized[i], normalized[j])
+			}
+		}
+	}
+
+	// Single-linkage clustering: each model joins the cluster of the first
+	// earlier model it is similar enough to, merging clusters it bridges.
+	cluster := make([]int, len(c.Models))
+	for i := range cluster {
+		cluster[i] = i
+		for j := 0; j < i; j++ {
+			if c.Similarity[i][j] < sameSolutionSimilarity || cluster[j] == cluster[i] {
+				continue
+			}
+			from, to := cluster[i], cluster[j]
+			for k := 0; k <= i; k++ {
+				if cluster[k] == from {
+					cluster[k] = to
+				}
+			}
+		}
+	}
+	index := make(map[int]int)
+	for i, model := range c.Models {
+		n, ok := index[cluster[i]]
+		if !ok {
+			n = len(c.Clusters)
+			index[cluster[i]] = n
+			c.Clusters = append(c.Clusters, nil)
+		}
+		c.Clusters[n] = append(c.Clusters[n], model)
+	}
+	return c
+}
+
+// compareModels compares, for each target of repo, the BUILD files in the
+// worktrees of the models recorded on tracker. Models whose worktree has no BUILD file
+// for a target, or only the placeholder, are left out of that comparison.
+func compareModels(repo string, tracker *migrate.AttemptTracker, targets []string) ([]TargetComparison, error) {
+	var comparisons []TargetComparison
+	for _, target := range targets {
+		pkg, _, err := migrate.ParseTargetPackage(target)
+		if err != nil {
+			return nil, err
+		}
+		files := make(map[string]string)
+		for _, model := range tracker.Models() {
+			content, err := os.ReadFile(filepath.Join(tracker.Worktree(model), pkg, "BUILD.bazel"))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read BUILD file of %s for %s: %w", model, target, err)
+			}
+			if string(content) == migrate.PlaceholderBuildFile {
+				continue
+			}
+			files[model] = string(content)
+		}
+		comparisons = append(comparisons, compareBuildFiles(repo, target, tracker.Models(), files))
+	}
+	return comparisons, nil
+}
+
+// printComparisons writes, for each target, its clusters of models followed
+// by the pairwise similarity matrix.
+func printComparisons(w io.Writer, comparisons []TargetComparison) error {
+	for i, c := range comparisons {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s: %d models, %d distinct solutions\n", repoTarget(c.Repo, c.Target), len(c.Models), len(c.Clusters))
+		for n, cluster := range c.Clusters {
+			fmt.Fprintf(w, "  solution %d: %s\n", n+1, strings.Join(cluster, ", "))
+		}
+		if len(c.Models) < 2 {
+			continue
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprint(tw, "\t")
+		for n := range c.Models {
+			fmt.Fprintf(tw, "%d\t", n+1)
+		}
+		fmt.Fprintln(tw)
+		for n, model := range c.Models {
+			fmt.Fprintf(tw, "%d %s\t", n+1, model)
+			for _, s := range c.Similarity[n] {
+				fmt.Fprintf(tw, "%.2f\t", s)
+			}
+			fmt.Fprintln(tw)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+func TestLineSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want float64
+	}{
+		{a: nil, b: nil, want: 1},
+		{a: []string{"x", "y"}, b: []string{"x", "y"}, want: 1},
+		{a: []string{"x", "y"}, b: []string{"z"}, want: 0},
+		{a: []string{"x", "y", "z"}, b: []string{"x", "z"}, want: 0.8},
+		{a: []string{"x"}, b: nil, want: 0},
+	}
+	for _, tt := range tests {
+		if got := lineSimilarity(tt.a, tt.b); got != tt.want {
+			t.Errorf("lineSimilarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCompareBuildFiles(t *testing.T) {
+	const lib = `load("@rules_rust//rust:defs.bzl", "rust_library")
+
+rust_library(
+    name = "grep_matcher",
+    srcs = glob(["src/**/*.rs"]),
+    edition = "2021",
+    deps = ["@crates//:memchr"],
+    visibility = ["//visibility:public"],
+)
+`
+	files := map[string]string{
+		"a": lib,
+		// Only comments and blank lines differ.
+		"b": "# generated\n" + strings.ReplaceAll(lib, "\n\n", "\n\n\n"),
+		"c": `rust_library(name = "grep_matcher", srcs = ["src/lib.rs"])` + "\n",
+		"d": lib,
+	}
+	got := compareBuildFiles("", "//crates/matcher:grep_matcher", []string{"a", "missing", "c", "b", "d"}, files)
+	if want := []string{"a", "c", "b", "d"}; !slices.Equal(got.Models, want) {
+		t.Errorf("Models = %q, want %q", got.Models, want)
+	}
+	if len(got.Clusters) != 2 || !slices.Equal(got.Clusters[0], []string{"a", "b", "d"}) || !slices.Equal(got.Clusters[1], []string{"c"}) {
+		t.Errorf("Clusters = %q, want [[a b d] [c]]", got.Clusters)
+	}
+	if got.Similarity[0][2] != 1 || got.Similarity[1][0] != got.Similarity[0][1] || got.Similarity[0][1] >= sameSolutionSimilarity {
+		t.Errorf("Similarity = %v, want a symmetric matrix with a and b identical and c apart", got.Similarity)
+	}
+}
+
+func TestCompareModels(t *testing.T) {
+	tracker := migrate.NewAttemptTracker()
+	for model, content := range map[string]string{"a": "rust_library(name = \"cli\")\n", "b": migrate.PlaceholderBuildFile, "c": ""} {
+		worktree := t.TempDir()
+		tracker.AddModel(model, worktree, "")
+		if content == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(worktree, "crates/cli"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(worktree, "crates/cli/BUILD.bazel"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comparisons, err := compareModels("", tracker, []string{"//crates/cli"})
+	if err != nil {
+		t.Fatalf("compareModels: %v", err)
+	}
+	if len(comparisons) != 1 || !slices.Equal(comparisons[0].Models, []string{"a"}) {
+		t.Errorf("comparisons = %+v, want only model a for //crates/cli", comparisons)
+	}
+
+	var out strings.Builder
+	if err := printComparisons(&out, comparisons); err != nil {
+		t.Fatal(err)
+	}
+	if want := "//crates/cli: 1 models, 1 distinct solutions\n  solution 1: a\n"; out.String() != want {
+		t.Errorf("printComparisons = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// Config holds settings too structured for flags. It is read from the JSON
+// file named by -config; every field is optional.
+type Config struct {
+	// BuildozerCommands are applied, in order, to each target after it first
+	// builds, e.g. "set visibility //visibility:public". The target must still
+	// build afterwards or the changes are reverted.
+	BuildozerCommands []string `json:"buildozer_commands"`
+	// ModelPrices overrides or adds to defaultModelPrices, keyed by model
+	// name as in the models list.
+	ModelPrices map[string]ModelPrice `json:"model_prices"`
+	// SystemPrompts are passed to aider as --system-prompt, keyed by model
+	// name or a prefix of one (e.g. "openai/"); the longest match wins. An
+	// empty prompt turns off defaultSystemPrompt for matching models.
+	SystemPrompts map[string]string `json:"system_prompts"`
+	// Repos, if set, are cloned and migrated in turn instead of the
+	// repository in the current directory.
+	Repos []RepoConfig `json:"repos"`
+	// ExpectedKinds overrides the rule kind expectedKindFor infers, keyed by
+	// target label. An empty kind turns off the check for that target.
+	ExpectedKinds map[string]string `json:"expected_kinds"`
+	// ModelRanking lists models, as in the models list, cheapest first for
+	// -escalate. Unlisted models follow, ordered by list price.
+	ModelRanking []string `json:"model_ranking"`
+}
+
+// RepoConfig is one repository to migrate and the targets to build in it.
+type RepoConfig struct {
+	URL     string   `json:"repo_url"`
+	Targets []string `json:"targets"`
+}
+
+// defaultSystemPrompt is used for models without a SystemPrompts entry.
+const defaultSystemPrompt = `You are helping migrate a Rust Cargo workspace to build with Bazel, one target at a time. ` +
+	`The workspace uses bzlmod: external dependencies are declared in MODULE.bazel, with crate_universe's crate.from_cargo extension for crates.io dependencies. ` +
+	`Rust targets use rules_rust (load rust_library, rust_binary and rust_test from @rules_rust//rust:defs.bzl), ` +
+	`and third-party crates are referenced as @crates//:<name>. ` +
+	`Only edit BUILD.bazel and MODULE.bazel files.`
+
+// systemPromptFor returns the system prompt for model, which may carry the
+// openrouter/ prefix.
+func systemPromptFor(model string) string {
+	model = strings.TrimPrefix(model, "openrouter/")
+	prompt, matched := defaultSystemPrompt, ""
+	for key, p := range config.SystemPrompts {
+		if strings.HasPrefix(model, key) && len(key) > len(matched) {
+			prompt, matched = p, key
+		}
+	}
+	return prompt
+}
+
+// expectedKindFor returns the rule kind target should have once migrated.
+// Unless ExpectedKinds says otherwise, targets in the root package are taken
+// to be binaries, targets named like tests to be tests, and the rest to be
+// libraries.
+func expectedKindFor(target string) string {
+	if kind, ok := config.ExpectedKinds[target]; ok {
+		return kind
+	}
+	pkg, name, err := migrate.ParseTargetPackage(target)
+	switch {
+	case err != nil:
+		return ""
+	case pkg == "":
+		return "rust_binary"
+	case strings.HasSuffix(name, "_test") || strings.HasSuffix(name, "-test"):
+		return "rust_test"
+	default:
+		return "rust_library"
+	}
+}
+
+// config is the loaded -config file, or the zero Config if none was given.
+var config Config
+
+// loadConfig reads a Config from the JSON file at path. Unknown fields are an
+// error so typos do not silently disable a setting.
+func loadConfig(path string) (Config, error) {
+	var c Config
+	f, err := os.Open(path)
+	if err != nil {
+		return c, fmt.Errorf("failed to open config %s: %w", path, err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return c, nil
+}
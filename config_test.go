@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	writeFile(t, path, `{"buildozer_commands": ["set visibility //visibility:public", "fix unusedLoads"]}`)
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	want := []string{"set visibility //visibility:public", "fix unusedLoads"}
+	if !slices.Equal(c.BuildozerCommands, want) {
+		t.Errorf("BuildozerCommands = %q, want %q", c.BuildozerCommands, want)
+	}
+
+	for name, content := range map[string]string{
+		"unknown field": `{"buildozer_command": []}`,
+		"bad json":      `{"buildozer_commands": [`,
+	} {
+		path := filepath.Join(dir, "bad.json")
+		writeFile(t, path, content)
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("%s: loadConfig succeeded, want error", name)
+		}
+	}
+	if _, err := loadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("loadConfig of missing file succeeded, want error")
+	}
+}
+
+func TestSystemPrompt(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	config = Config{SystemPrompts: map[string]string{
+		"openai/":                 "openai prompt",
+		"openai/gpt-5":            "gpt-5 prompt",
+		"google/gemini-2.5-flash": "",
+	}}
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{model: "openrouter/openai/gpt-5", want: "gpt-5 prompt"},
+		{model: "openrouter/openai/gpt-4.1-mini", want: "openai prompt"},
+		{model: "openrouter/anthropic/claude-sonnet-4", want: defaultSystemPrompt},
+		{model: "openrouter/google/gemini-2.5-flash", want: ""},
+	}
+	for _, tt := range tests {
+		opts, err := aiderOptions(migrate.Run{Model: tt.model, Target: "//:ripgrep", BuildFile: "BUILD.bazel"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := aiderArgs(opts)
+		i := slices.Index(args, "--system-prompt")
+		switch {
+		case tt.want == "" && i != -1:
+			t.Errorf("%s: command has --system-prompt %q, want none", tt.model, args[i+1])
+		case tt.want != "" && (i == -1 || args[i+1] != tt.want):
+			t.Errorf("%s: command %q lacks --system-prompt %q", tt.model, args, tt.want)
+		}
+	}
+}
+
+func TestExpectedKindFor(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	config = Config{ExpectedKinds: map[string]string{
+		"//crates/core:core": "rust_binary",
+		"//crates/pcre2":     "",
+	}}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "//:ripgrep", want: "rust_binary"},
+		{target: "//crates/grep:grep", want: "rust_library"},
+		{target: "//crates/grep", want: "rust_library"},
+		{target: "//crates/grep:grep_test", want: "rust_test"},
+		{target: "//crates/core:core", want: "rust_binary"},
+		{target: "//crates/pcre2", want: ""},
+		{target: "crates/grep", want: ""},
+	}
+	for _, tt := range tests {
+		if got := expectedKindFor(tt.target); got != tt.want {
+			t.Errorf("expectedKindFor(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
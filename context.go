@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// crateDocBlock returns the crate-level "//!" doc comment at the top of a Rust
+// source file, with the comment markers removed.
+func crateDocBlock(source string) string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" && len(lines) == 0 {
+			continue
+		}
+		doc, ok := strings.CutPrefix(line, "//!")
+		if !ok {
+			break
+		}
+		lines = append(lines, strings.TrimPrefix(doc, " "))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// crateDocFiles returns files to pass to aider as read-only context describing
+// the crate in pkg: its README.md and the crate-level docs of src/lib.rs or
+// src/main.rs. Doc blocks are extracted into docsPath since aider can only
+// read whole files. Files are added in that order until maxBytes is reached.
+func crateDocFiles(worktreePath, pkg, docsPath string, maxBytes int) ([]string, error) {
+	var files []string
+	budget := maxBytes
+
+	readme := filepath.Join(pkg, "README.md")
+	if info, err := os.Stat(filepath.Join(worktreePath, readme)); err == nil {
+		if int(info.Size()) <= budget {
+			files = append(files, readme)
+			budget -= int(info.Size())
+		} else {
+			slog.Debug("Skipping crate README over context budget", "path", readme, "size", info.Size(), "budget", budget)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to stat %s: %w", readme, err)
+	}
+
+	for _, src := range []string{"src/lib.rs", "src/main.rs"} {
+		source, err := os.ReadFile(filepath.Join(worktreePath, pkg, src))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filepath.Join(pkg, src), err)
+		}
+		doc := crateDocBlock(string(source))
+		if doc == "" {
+			continue
+		}
+		if len(doc) > budget {
+			slog.Debug("Skipping crate docs over context budget", "path", filepath.Join(pkg, src), "size", len(doc), "budget", budget)
+			break
+		}
+		if err := os.MkdirAll(filepath.Dir(docsPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create dir for %s: %w", docsPath, err)
+		}
+		content := fmt.Sprintf("Crate documentation from %s:\n\n%s\n", filepath.Join(pkg, src), doc)
+		if err := os.WriteFile(docsPath, []byte(content), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", docsPath, err)
+		}
+		files = append(files, docsPath)
+		break
+	}
+	return files, nil
+}
+
+// cargoSection matches a TOML table header such as [dependencies] or
+// [target.'cfg(windows)'.dev-dependencies].
+var cargoSection = regexp.MustCompile(`^\[+([^\]]+)\]+`)
+
+// cargoPathDep matches the path of a path dependency, either inline
+// (foo = { path = "../foo" }) or in a [dependencies.foo] table.
+var cargoPathDep = regexp.MustCompile(`\bpath\s*=\s*"([^"]+)"`)
+
+// cargoPathDeps returns the package-relative paths of the path dependencies
+// declared in a Cargo.toml.
+func cargoPathDeps(cargoToml string) []string {
+	var deps []string
+	inDeps := false
+	for _, line := range strings.Split(cargoToml, "\n") {
+		line = strings.TrimSpace(line)
+		if m := cargoSection.FindStringSubmatch(line); m != nil {
+			inDeps = strings.Contains(m[1], "dependencies")
+			continue
+		}
+		if !inDeps {
+			continue
+		}
+		if m := cargoPathDep.FindStringSubmatch(line); m != nil {
+			deps = append(deps, m[1])
+		}
+	}
+	return deps
+}
+
+// cargoContextFiles returns the Cargo metadata aider needs to write rules for
+// the crate in pkg: its Cargo.toml, the workspace Cargo.toml, and the
+// Cargo.toml and BUILD.bazel of each crate it depends on by path. Paths are
+// relative to worktreePath and only existing files are returned.
+func cargoContextFiles(worktreePath, pkg string) ([]string, error) {
+	cargoPath := filepath.Join(pkg, "Cargo.toml")
+	cargo, err := os.ReadFile(filepath.Join(worktreePath, cargoPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", cargoPath, err)
+	}
+	files := []string{cargoPath}
+	candidates := []string{"Cargo.toml"}
+	for _, dep := range cargoPathDeps(string(cargo)) {
+		depDir := filepath.Join(pkg, dep)
+		candidates = append(candidates, filepath.Join(depDir, "Cargo.toml"), filepath.Join(depDir, "BUILD.bazel"))
+	}
+	for _, f := range candidates {
+		if slices.Contains(files, f) || strings.HasPrefix(f, "..") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(worktreePath, f)); err == nil {
+			files = append(files, f)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to stat %s: %w", f, err)
+		}
+	}
+	return files, nil
+}
+
+// contextFiles returns the read-only files aider gets for run, in package
+// pkg: the crate's Cargo metadata and, with -include-crate-docs, its docs,
+// capped at -max-context-tokens. The docs are extracted under -log-dir for
+// repo.
+func contextFiles(repo string, run migrate.Run, pkg string) ([]string, error) {
+	files, err := cargoContextFiles(run.WorktreePath, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if *includeCrateDocs {
+		docsPath := filepath.Join(*logDir, repo, migrate.SanitizePath(run.Model), migrate.SanitizePath(strings.TrimPrefix(run.Target, "//"))+".docs.md")
+		docsPath, err = filepath.Abs(docsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve crate docs path: %w", err)
+		}
+		docFiles, err := crateDocFiles(run.WorktreePath, pkg, docsPath, *maxContextBytes)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, docFiles...)
+	}
+	return capContextFiles(run.WorktreePath, files, *maxContextTokens)
+}
+
+// bytesPerToken is a rough average for source code and TOML.
+const bytesPerToken = 4
+
+// capContextFiles drops files until their estimated token count fits in
+// maxTokens, removing the largest files first and, among files of equal
+// size, the least recently modified. Relative paths are resolved against
+// worktreePath. The order of the remaining files is preserved. A maxTokens of
+// zero or less disables the cap.
+func capContextFiles(worktreePath string, files []string, maxTokens int) ([]string, error) {
+	if maxTokens <= 0 {
+		return files, nil
+	}
+	type contextFile struct {
+		path   string
+		tokens int
+		mtime  time.Time
+	}
+	var all []contextFile
+	total := 0
+	for _, f := range files {
+		path := f
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(worktreePath, f)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat context file %s: %w", f, err)
+		}
+		tokens := int(info.Size()+bytesPerToken-1) / bytesPerToken
+		all = append(all, contextFile{path: f, tokens: tokens, mtime: info.ModTime()})
+		total += tokens
+	}
+	dropOrder := slices.Clone(all)
+	slices.SortStableFunc(dropOrder, func(a, b contextFile) int {
+		if a.tokens != b.tokens {
+			return b.tokens - a.tokens
+		}
+		return a.mtime.Compare(b.mtime)
+	})
+	dropped := make(map[string]bool)
+	for _, f := range dropOrder {
+		if total <= maxTokens {
+			break
+		}
+		dropped[f.path] = true
+		total -= f.tokens
+		slog.Debug("Dropping context file over token budget", "path", f.path, "tokens", f.tokens, "maxTokens", maxTokens)
+	}
+	var kept []string
+	for _, f := range all {
+		if !dropped[f.path] {
+			kept = append(kept, f.path)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCargoPathDeps(t *testing.T) {
+	cargo := `[package]
+name = "grep-searcher"
+path = "not/a/dep"
+
+[dependencies]
+bstr = { version = "1.6.2", default-features = false }
+grep-matcher = { version = "0.1.7", path = "../matcher" }
+
+[dependencies.memchr]
+version = "2.6.3"
+
+[dev-dependencies.grep-regex]
+version = "0.1.12"
+path = "../regex"
+
+[target.'cfg(windows)'.dependencies]
+winapi-util = { path = "../winapi" }
+
+[features]
+simd-accel = []
+`
+	got := cargoPathDeps(cargo)
+	want := []string{"../matcher", "../regex", "../winapi"}
+	if !slices.Equal(got, want) {
+		t.Errorf("cargoPathDeps = %q, want %q", got, want)
+	}
+}
+
+func TestCargoContextFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "Cargo.toml"), "[workspace]\n")
+	writeFile(t, filepath.Join(root, "crates/searcher/Cargo.toml"), "[dependencies]\ngrep-matcher = { path = \"../matcher\" }\ngrep-regex = { path = \"../regex\" }\n")
+	writeFile(t, filepath.Join(root, "crates/matcher/Cargo.toml"), "[package]\n")
+	writeFile(t, filepath.Join(root, "crates/matcher/BUILD.bazel"), "rust_library(name = \"grep_matcher\")\n")
+	writeFile(t, filepath.Join(root, "crates/regex/Cargo.toml"), "[package]\n")
+
+	got, err := cargoContextFiles(root, "crates/searcher")
+	if err != nil {
+		t.Fatalf("cargoContextFiles: %v", err)
+	}
+	want := []string{
+		"crates/searcher/Cargo.toml",
+		"Cargo.toml",
+		"crates/matcher/Cargo.toml",
+		"crates/matcher/BUILD.bazel",
+		"crates/regex/Cargo.toml",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("cargoContextFiles = %q, want %q", got, want)
+	}
+
+	got, err = cargoContextFiles(root, "crates/missing")
+	if err != nil || got != nil {
+		t.Errorf("cargoContextFiles without Cargo.toml = %q, %v; want nil, nil", got, err)
+	}
+}
+
+func TestCrateDocFiles(t *testing.T) {
+	const (
+		readme  = "# grep-matcher\n\nAn interface for regular expressions.\n"
+		libDocs = "//! This crate provides an interface for regular expressions, with a focus\n//! on line oriented search.\n\npub trait Matcher {}\n"
+		mainRs  = "\n//! ripgrep, a line-oriented search tool.\nfn main() {}\n"
+	)
+	tests := []struct {
+		name     string
+		files    map[string]string
+		maxBytes int
+		want     []string
+		wantDocs string
+	}{
+		{
+			name:     "readme and lib docs",
+			files:    map[string]string{"README.md": readme, "src/lib.rs": libDocs},
+			maxBytes: 1000,
+			want:     []string{"crates/matcher/README.md", "docs.md"},
+			wantDocs: "Crate documentation from crates/matcher/src/lib.rs:\n\nThis crate provides an interface for regular expressions, with a focus\non line oriented search.\n",
+		},
+		{
+			name:     "main docs when lib has none",
+			files:    map[string]string{"src/lib.rs": "pub trait Matcher {}\n", "src/main.rs": mainRs},
+			maxBytes: 1000,
+			want:     []string{"docs.md"},
+			wantDocs: "Crate documentation from crates/matcher/src/main.rs:\n\nripgrep, a line-oriented search tool.\n",
+		},
+		{
+			name:     "readme over budget",
+			files:    map[string]string{"README.md": readme + strings.Repeat("More about matchers.\n", 20), "src/lib.rs": libDocs},
+			maxBytes: 200,
+			want:     []string{"docs.md"},
+			wantDocs: "Crate documentation from crates/matcher/src/lib.rs:\n\nThis crate provides an interface for regular expressions, with a focus\non line oriented search.\n",
+		},
+		{
+			name:     "docs over what the readme leaves",
+			files:    map[string]string{"README.md": readme, "src/lib.rs": libDocs},
+			maxBytes: len(readme) + 10,
+			want:     []string{"crates/matcher/README.md"},
+		},
+		{
+			name:     "no docs",
+			files:    map[string]string{"Cargo.toml": "[package]\n", "src/lib.rs": "// Not a doc comment.\npub trait Matcher {}\n"},
+			maxBytes: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range tt.files {
+				writeFile(t, filepath.Join(root, "crates/matcher", name), content)
+			}
+			docsPath := filepath.Join(t.TempDir(), "docs.md")
+			got, err := crateDocFiles(root, "crates/matcher", docsPath, tt.maxBytes)
+			if err != nil {
+				t.Fatalf("crateDocFiles: %v", err)
+			}
+			var want []string
+			for _, f := range tt.want {
+				if f == "docs.md" {
+					f = docsPath
+				}
+				want = append(want, f)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("crateDocFiles = %q, want %q", got, want)
+			}
+			content, err := os.ReadFile(docsPath)
+			if tt.wantDocs == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("docs file written with %q, want none", content)
+				}
+			} else if string(content) != tt.wantDocs {
+				t.Errorf("docs file = %q, want %q", content, tt.wantDocs)
+			}
+		})
+	}
+}
+
+func TestCapContextFiles(t *testing.T) {
+	root := t.TempDir()
+	sizes := map[string]int{"a": 400, "big": 4000, "old": 800, "new": 800}
+	for name, size := range sizes {
+		writeFile(t, filepath.Join(root, name), strings.Repeat("x", size))
+	}
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(root, "old"), now.Add(-time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"a", "big", "old", "new"}
+
+	tests := []struct {
+		maxTokens int
+		want      []string
+	}{
+		{maxTokens: 0, want: files},
+		{maxTokens: 1500, want: files},
+		{maxTokens: 1000, want: []string{"a", "old", "new"}},
+		{maxTokens: 400, want: []string{"a", "new"}},
+		{maxTokens: 100, want: []string{"a"}},
+		{maxTokens: 50, want: nil},
+	}
+	for _, tt := range tests {
+		got, err := capContextFiles(root, files, tt.maxTokens)
+		if err != nil {
+			t.Fatalf("capContextFiles(%d): %v", tt.maxTokens, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("capContextFiles(%d) = %q, want %q", tt.maxTokens, got, tt.want)
+		}
+	}
+}
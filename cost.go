@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// ModelPrice is what a model charges in USD per million tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// defaultModelPrices are openrouter list prices for the models list as of
+// 2025-09-08. The model_prices config setting overrides or extends them.
+var defaultModelPrices = map[string]ModelPrice{
+	"x-ai/grok-code-fast-1":       {Input: 0.20, Output: 1.50},
+	"anthropic/claude-sonnet-4":   {Input: 3.00, Output: 15.00},
+	"google/gemini-2.5-flash":     {Input: 0.30, Output: 2.50},
+	"openai/gpt-4.1-mini":         {Input: 0.40, Output: 1.60},
+	"google/gemini-2.5-pro":       {Input: 1.25, Output: 10.00},
+	"openai/gpt-5":                {Input: 1.25, Output: 10.00},
+	"openai/gpt-5-mini":           {Input: 0.25, Output: 2.00},
+	"qwen/qwen3-coder":            {Input: 0.20, Output: 0.80},
+	"openrouter/sonoma-sky-alpha": {Input: 0, Output: 0},
+	"deepseek/deepseek-chat-v3.1": {Input: 0.20, Output: 0.80},
+	"x-ai/grok-4":                 {Input: 3.00, Output: 15.00},
+}
+
+// Estimated tokens per aider call, used for the startup cost estimate. A
+// call sends the repo map, MODULE.bazel, the BUILD file and read-only
+// context, and usually gets back a short diff.
+const (
+	estimatedInputTokensPerCall  = 20000
+	estimatedOutputTokensPerCall = 2000
+)
+
+// CostEstimator prices aider calls by model and keeps a running total, overall
+// and per model. It is safe for concurrent use, as by -mode select-best.
+type CostEstimator struct {
+	prices     map[string]ModelPrice
+	mu         sync.Mutex
+	totalCost  float64
+	modelCosts map[string]float64
+}
+
+// NewCostEstimator returns a CostEstimator using defaultModelPrices with
+// overrides applied on top.
+func NewCostEstimator(overrides map[string]ModelPrice) *CostEstimator {
+	prices := make(map[string]ModelPrice, len(defaultModelPrices)+len(overrides))
+	for model, price := range defaultModelPrices {
+		prices[model] = price
+	}
+	for model, price := range overrides {
+		prices[model] = price
+	}
+	return &CostEstimator{prices: prices, modelCosts: make(map[string]float64)}
+}
+
+// Price returns the price of model, which may carry the "openrouter/" prefix
+// aider is given.
+func (c *CostEstimator) Price(model string) (ModelPrice, bool) {
+	price, ok := c.prices[strings.TrimPrefix(model, "openrouter/")]
+	return price, ok
+}
+
+// Cost returns the price of sending inputTokens to model and receiving
+// outputTokens back. Models without a known price cost nothing.
+func (c *CostEstimator) Cost(model string, inputTokens, outputTokens int) float64 {
+	price, _ := c.Price(model)
+	return (float64(inputTokens)*price.Input + float64(outputTokens)*price.Output) / 1e6
+}
+
+// Record adds the cost of one call to the running total and returns it.
+func (c *CostEstimator) Record(model string, inputTokens, outputTokens int) float64 {
+	cost := c.Cost(model, inputTokens, outputTokens)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.totalCost += cost
+	c.modelCosts[strings.TrimPrefix(model, "openrouter/")] += cost
+	return cost
+}
+
+// TotalCost returns the cost of every call recorded so far.
+func (c *CostEstimator) TotalCost() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totalCost
+}
+
+// ModelCost returns the cost of the calls to model recorded so far. model may
+// carry the "openrouter/" prefix aider is given.
+func (c *CostEstimator) ModelCost(model string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.modelCosts[strings.TrimPrefix(model, "openrouter/")]
+}
+
+// Estimate returns what the given number of aider calls to model would cost
+// at the estimated tokens per call.
+func (c *CostEstimator) Estimate(model string, calls int) float64 {
+	return float64(calls) * c.Cost(model, estimatedInputTokensPerCall, estimatedOutputTokensPerCall)
+}
+
+// costs accumulates the cost of every aider call in this run.
+var costs = NewCostEstimator(nil)
+
+// overBudget reports whether -budget is set and has been spent.
+func overBudget() bool {
+	return *budget > 0 && costs.TotalCost() >= *budget
+}
+
+// aiderTokens matches aider's per-message usage line, e.g.
+// "Tokens: 4.9k sent, 2.5k cache write, 123 received. Cost: ...".
+var aiderTokens = regexp.MustCompile(`Tokens: ([\d.]+[kM]?) sent,(?: [\d.]+[kM]? cache [a-z]+,)* ([\d.]+[kM]?) received`)
+
+// parseAiderTokens sums the tokens sent and received over every usage line in
+// aider's output.
+func parseAiderTokens(output string) (sent, received int) {
+	for _, m := range aiderTokens.FindAllStringSubmatch(output, -1) {
+		sent += parseTokenCount(m[1])
+		received += parseTokenCount(m[2])
+	}
+	return sent, received
+}
+
+// recordAiderUsage adds the tokens aider reports in output to costs.
+func recordAiderUsage(run migrate.Run, output string) {
+	if sent, received := parseAiderTokens(output); sent+received > 0 {
+		cost := costs.Record(run.Model, sent, received)
+		slog.Debug("aider usage", "model", run.Model, "target", run.Target, "sent", sent, "received", received, "usd", cost, "totalUSD", costs.TotalCost())
+	}
+}
+
+// parseTokenCount parses counts like "86", "2.5k" or "1.1M".
+func parseTokenCount(s string) int {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier, s = 1e3, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "M"):
+		multiplier, s = 1e6, strings.TrimSuffix(s, "M")
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return int(n * multiplier)
+}
+
+// logCostEstimate logs an upper bound on what the run will cost if every
+// target uses every attempt, so it can be aborted before spending anything.
+func logCostEstimate(models []string, targetCount, repetitions int) {
+	calls := targetCount * repetitions * migrate.MaxAttempts
+	total := 0.0
+	for _, model := range models {
+		if _, ok := costs.Price(model); !ok {
+			slog.Warn("No price known for model; its cost is not estimated or tracked", "model", model)
+			continue
+		}
+		estimate := costs.Estimate(model, calls)
+		total += estimate
+		slog.Info("Estimated model cost", "model", model, "maxCalls", calls, "usd", round2(estimate))
+	}
+	slog.Info("Estimated maximum run cost", "usd", round2(total), "budget", *budget)
+}
+
+// round2 rounds usd to cents for logging.
+func round2(usd float64) float64 {
+	return float64(int(usd*100+0.5)) / 100
+}
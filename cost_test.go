@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseAiderTokens(t *testing.T) {
+	tests := []struct {
+		output       string
+		wantSent     int
+		wantReceived int
+	}{
+		{output: "no usage here"},
+		{output: "Tokens: 2.5k sent, 86 received. Cost: $0.0088 message, $0.0088 session.", wantSent: 2500, wantReceived: 86},
+		{output: "Tokens: 4.9k sent, 2.5k cache write, 1.1k cache hit, 123 received. Cost: $0.02 message", wantSent: 4900, wantReceived: 123},
+		{
+			output:       "Tokens: 1.2M sent, 3k received.\nRunning bazel build //:ripgrep\nTokens: 10k sent, 500 received.\n",
+			wantSent:     1210000,
+			wantReceived: 3500,
+		},
+	}
+	for _, tt := range tests {
+		sent, received := parseAiderTokens(tt.output)
+		if sent != tt.wantSent || received != tt.wantReceived {
+			t.Errorf("parseAiderTokens(%q) = %d, %d; want %d, %d", tt.output, sent, received, tt.wantSent, tt.wantReceived)
+		}
+	}
+}
+
+func TestCostEstimator(t *testing.T) {
+	c := NewCostEstimator(map[string]ModelPrice{
+		"openai/gpt-5":   {Input: 2, Output: 20},
+		"example/custom": {Input: 1, Output: 1},
+	})
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+	if got := c.Record("openrouter/openai/gpt-5", 1_000_000, 100_000); !near(got, 4) {
+		t.Errorf("gpt-5 override cost = %v, want 4", got)
+	}
+	if got := c.Record("anthropic/claude-sonnet-4", 1_000_000, 0); !near(got, 3) {
+		t.Errorf("default claude-sonnet-4 cost = %v, want 3", got)
+	}
+	if got := c.Record("example/custom", 500_000, 500_000); !near(got, 1) {
+		t.Errorf("custom model cost = %v, want 1", got)
+	}
+	if _, ok := c.Price("example/unknown"); ok {
+		t.Error("unknown model has a price")
+	}
+	if got := c.Record("example/unknown", 1_000_000, 1_000_000); got != 0 {
+		t.Errorf("unknown model cost = %v, want 0", got)
+	}
+	if got := c.TotalCost(); !near(got, 8) {
+		t.Errorf("TotalCost = %v, want 8", got)
+	}
+	c.Record("openai/gpt-5", 0, 50_000)
+	if got := c.ModelCost("openrouter/openai/gpt-5"); !near(got, 5) {
+		t.Errorf("ModelCost(gpt-5) = %v, want 5", got)
+	}
+}
+
+func TestOverBudget(t *testing.T) {
+	prevCosts, prevBudget := costs, *budget
+	costs = NewCostEstimator(map[string]ModelPrice{"example/model": {Input: 1}})
+	t.Cleanup(func() { costs, *budget = prevCosts, prevBudget })
+
+	*budget = 0
+	costs.Record("example/model", 1_000_000, 0)
+	if overBudget() {
+		t.Error("overBudget without -budget = true, want false")
+	}
+	*budget = 2
+	if overBudget() {
+		t.Errorf("overBudget after spending $1 of $2 = true, want false")
+	}
+	costs.Record("example/model", 1_000_000, 0)
+	if !overBudget() {
+		t.Errorf("overBudget after spending $2 of $2 = false, want true")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+)
+
+// BazelBuildError is returned by execBuildRunner.Build when a target fails to
+// build. It carries bazel's output so callers need not run the build again
+// to see why.
+type BazelBuildError struct {
+	Target string
+	// Output is bazel's combined stdout and stderr.
+	Output string
+	Err    error
+}
+
+func (e *BazelBuildError) Error() string {
+	return fmt.Sprintf("bazel build %s failed: %v", e.Target, e.Err)
+}
+
+func (e *BazelBuildError) Unwrap() error { return e.Err }
+
+// AiderError is returned by runAiderWithContext when aider exits with an
+// error. Stderr is what aider wrote to stderr, where provider errors appear.
+type AiderError struct {
+	Model  string
+	Stderr string
+	Err    error
+}
+
+func (e *AiderError) Error() string {
+	return fmt.Sprintf("aider with model %s failed: %v", e.Model, e.Err)
+}
+
+func (e *AiderError) Unwrap() error { return e.Err }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBazelBuildError(t *testing.T) {
+	useTestLogger(t)
+	fakeBazel(t, "echo 'ERROR: no such package crates/grep'\nexit 1\n")
+
+	_, err := execBuildRunner{}.Build(context.Background(), t.TempDir(), io.Discard, "//crates/grep")
+	var buildErr *BazelBuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("Build = %v, want a *BazelBuildError", err)
+	}
+	if buildErr.Target != "//crates/grep" || !strings.Contains(buildErr.Output, "no such package crates/grep") {
+		t.Errorf("BazelBuildError = %+v, want target //crates/grep with bazel's output", buildErr)
+	}
+}
+
+func TestAiderError(t *testing.T) {
+	useTestLogger(t)
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "aider"), []byte("#!/bin/sh\necho 'editing'\necho 'RateLimitError: slow down' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	prevOut, prevErr := consoleOut, consoleErr
+	t.Cleanup(func() { consoleOut, consoleErr = prevOut, prevErr })
+	consoleOut, consoleErr = io.Discard, io.Discard
+
+	_, err := runAiderWithContext(context.Background(), AiderOptions{Dir: t.TempDir(), Model: "openrouter/test/model", Log: io.Discard})
+	var aiderErr *AiderError
+	if !errors.As(err, &aiderErr) {
+		t.Fatalf("runAiderWithContext = %v, want an *AiderError", err)
+	}
+	if aiderErr.Model != "openrouter/test/model" || aiderErr.Stderr != "RateLimitError: slow down\n" {
+		t.Errorf("AiderError = %+v, want the model and only aider's stderr", aiderErr)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"slices"
+	"sort"
+)
+
+// rankModelsByCost orders models cheapest first for -escalate. Models listed
+// in ranking come first, in its order; the rest follow by list price (input
+// plus output per million tokens), with unpriced models last. Ties keep their
+// original order.
+func rankModelsByCost(models, ranking []string, costs *CostEstimator) []string {
+	rank := func(model string) (int, float64) {
+		if i := slices.Index(ranking, model); i != -1 {
+			return i, 0
+		}
+		price, ok := costs.Price(model)
+		if !ok {
+			return len(ranking) + 1, 0
+		}
+		return len(ranking), price.Input + price.Output
+	}
+	ranked := slices.Clone(models)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ri, pi := rank(ranked[i])
+		rj, pj := rank(ranked[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return pi < pj
+	})
+	return ranked
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRankModelsByCost(t *testing.T) {
+	costs := NewCostEstimator(map[string]ModelPrice{"acme/unlisted": {Input: 0.01, Output: 0.01}})
+	models := []string{"x-ai/grok-4", "unknown/model", "openai/gpt-5", "qwen/qwen3-coder", "acme/unlisted", "deepseek/deepseek-chat-v3.1"}
+	tests := []struct {
+		name    string
+		ranking []string
+		want    []string
+	}{
+		{
+			name: "by price",
+			want: []string{"acme/unlisted", "qwen/qwen3-coder", "deepseek/deepseek-chat-v3.1", "openai/gpt-5", "x-ai/grok-4", "unknown/model"},
+		},
+		{
+			name:    "ranking first",
+			ranking: []string{"x-ai/grok-4", "unknown/model"},
+			want:    []string{"x-ai/grok-4", "unknown/model", "acme/unlisted", "qwen/qwen3-coder", "deepseek/deepseek-chat-v3.1", "openai/gpt-5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rankModelsByCost(models, tt.ranking, costs); !slices.Equal(got, tt.want) {
+				t.Errorf("rankModelsByCost = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// eventStream is where emit writes; nil disables events.
+var (
+	eventMu     sync.Mutex
+	eventStream io.Writer
+)
+
+// openEventStream directs events to path, or to stdout if path is "-". The
+// returned func closes the stream.
+func openEventStream(path string) (func(), error) {
+	if path == "-" {
+		eventStream = os.Stdout
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events file: %w", err)
+	}
+	eventStream = f
+	return func() { f.Close() }, nil
+}
+
+// emit writes ev as a JSON line, stamping it with the current time. It is
+// safe to call from concurrent goroutines.
+func emit(ev migrate.Event) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	if eventStream == nil {
+		return
+	}
+	ev.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to encode event:", err)
+		return
+	}
+	if _, err := eventStream.Write(append(line, '\n')); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to write event:", err)
+	}
+}
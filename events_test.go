@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+// captureEvents directs emit to a buffer for the rest of the test.
+func captureEvents(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prev := eventStream
+	eventStream = &buf
+	t.Cleanup(func() { eventStream = prev })
+	return &buf
+}
+
+func parseEvents(t *testing.T, buf *bytes.Buffer) []migrate.Event {
+	t.Helper()
+	var events []migrate.Event
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var ev migrate.Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("invalid event line %q: %v", line, err)
+		}
+		if ev.Time == "" {
+			t.Errorf("event %q has no time", line)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestMigrateTargetEvents(t *testing.T) {
+	useTestLogger(t)
+	buf := captureEvents(t)
+	git := migratetest.NewFakeGitManager()
+	m := newMigrator(git, &migratetest.FakeBuildRunner{BuildErrs: []error{errors.New("ERROR: build failed")}}, &migratetest.FakeLLMRunner{Git: git})
+	run := migrate.Run{
+		WorktreePath: t.TempDir(),
+		Model:        "openrouter/test/model",
+		Target:       "//crates/matcher:grep_matcher",
+		BuildFile:    "crates/matcher/BUILD.bazel",
+		Log:          io.Discard,
+	}
+	if _, err := m.MigrateTarget(context.Background(), run); err != nil {
+		t.Fatalf("MigrateTarget: %v", err)
+	}
+
+	var got []string
+	for _, ev := range parseEvents(t, buf) {
+		got = append(got, ev.Type+":"+ev.Status)
+		if ev.Model != run.Model || ev.Target != run.Target {
+			t.Errorf("event %+v is missing the model or target", ev)
+		}
+	}
+	want := []string{"attempt:", "bazel_build:failed", "attempt:", "bazel_build:succeeded", "commit:"}
+	if !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestEmitConcurrent(t *testing.T) {
+	buf := captureEvents(t)
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			emit(migrate.Event{Type: migrate.EventAttempt, Attempt: i + 1})
+		}()
+	}
+	wg.Wait()
+	if n := len(parseEvents(t, buf)); n != 20 {
+		t.Errorf("got %d events, want 20", n)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// execGitManager implements migrate.GitManager by running the git binary.
+type execGitManager struct{}
+
+func (execGitManager) BranchExists(dir, branchName string) (bool, error) {
+	return migrate.BranchExists(dir, branchName)
+}
+
+func (execGitManager) CreateBranch(dir, branchName string) error {
+	return migrate.CreateBranch(dir, branchName)
+}
+
+func (execGitManager) AddWorktree(repoDir, worktreePath, branchName string) error {
+	return migrate.AddWorktree(repoDir, worktreePath, branchName)
+}
+
+func (execGitManager) WorktreeBranch(repoDir, worktreePath string) (string, bool, error) {
+	return migrate.WorktreeBranch(repoDir, worktreePath)
+}
+
+func (execGitManager) PruneWorktrees(repoDir string) error {
+	return migrate.PruneWorktrees(repoDir)
+}
+
+func (execGitManager) HealthCheck(repoDir, worktreePath, branchName string) error {
+	return migrate.WorktreeHealthCheck(repoDir, worktreePath, branchName)
+}
+
+func (execGitManager) ChangedFiles(worktreePath string) ([]string, error) {
+	cmd := exec.Command("git", "status", "--porcelain", "-z", "--untracked-files=all")
+	cmd.Dir = worktreePath
+	out, err := auditOutput(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("git status failed in %s: %w", worktreePath, err)
+	}
+	var files []string
+	entries := strings.Split(string(out), "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		files = append(files, entry[3:])
+		// A rename or copy is followed by the path it came from.
+		if strings.ContainsAny(entry[:2], "RC") {
+			i++
+		}
+	}
+	return files, nil
+}
+
+func (execGitManager) ChangedLines(worktreePath string) (int, error) {
+	return gitChangedLines(worktreePath)
+}
+
+func (execGitManager) StashAll(worktreePath string) (bool, error) {
+	return gitStashAll(worktreePath)
+}
+
+func (execGitManager) StashDiff(worktreePath string) (string, error) {
+	return getStashedDiff(worktreePath)
+}
+
+func (execGitManager) StashPop(worktreePath string) error {
+	cmd := exec.Command("git", "stash", "pop")
+	cmd.Dir = worktreePath
+	if out, err := auditCombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git stash pop failed in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	return nil
+}
+
+func (execGitManager) StashDrop(worktreePath string, index int) error {
+	return gitStashDrop(worktreePath, index)
+}
+
+func (execGitManager) StageAll(worktreePath string) (bool, error) {
+	addCmd := exec.Command("git", "add", "-A")
+	addCmd.Dir = worktreePath
+	if out, err := auditCombinedOutput(addCmd); err != nil {
+		return false, fmt.Errorf("git add failed in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	statusCmd := exec.Command("git", "status", "--porcelain")
+	statusCmd.Dir = worktreePath
+	statusOut, err := auditOutput(statusCmd)
+	if err != nil {
+		return false, fmt.Errorf("git status failed in %s: %w", worktreePath, err)
+	}
+	return strings.TrimSpace(string(statusOut)) != "", nil
+}
+
+func (execGitManager) DiffStat(worktreePath string) (string, error) {
+	cmd := exec.Command("git", "diff", "--cached", "--stat")
+	cmd.Dir = worktreePath
+	out, err := auditOutput(cmd)
+	if err != nil {
+		return "", fmt.Errorf("git diff --stat failed in %s: %w", worktreePath, err)
+	}
+	return string(out), nil
+}
+
+func (execGitManager) Commit(worktreePath, message string) error {
+	cmd := exec.Command("git", "commit", "-m", message)
+	cmd.Dir = worktreePath
+	cmd.Stdout = consoleOut
+	cmd.Stderr = consoleErr
+	if err := auditRun(cmd); err != nil {
+		return fmt.Errorf("git commit failed in %s: %w", worktreePath, err)
+	}
+	return nil
+}
+
+func (execGitManager) RevertHead(worktreePath string) error {
+	cmd := exec.Command("git", "revert", "--no-edit", "HEAD")
+	cmd.Dir = worktreePath
+	if out, err := auditCombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git revert HEAD failed in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	return nil
+}
+
+func (execGitManager) ResetSoft(worktreePath, commit string) error {
+	cmd := exec.Command("git", "reset", "--soft", commit)
+	cmd.Dir = worktreePath
+	if out, err := auditCombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git reset --soft %s failed in %s: %v\n%s", commit, worktreePath, err, string(out))
+	}
+	return nil
+}
+
+// SquashOldest squashes the oldest commits in base..HEAD into a single commit
+// so that at most maxCommits remain. The newer commits are replayed on top of
+// the squashed one unchanged.
+func (execGitManager) SquashOldest(worktreePath, base string, maxCommits int) error {
+	if base == "" {
+		return fmt.Errorf("cannot squash commits in %s without a base commit", worktreePath)
+	}
+	count, err := migrate.CommitCount(worktreePath, base)
+	if err != nil {
+		return err
+	}
+	if count <= maxCommits {
+		return nil
+	}
+	squashCount := count - maxCommits + 1
+
+	revListCmd := exec.Command("git", "rev-list", "--reverse", base+"..HEAD")
+	revListCmd.Dir = worktreePath
+	revListOut, err := auditOutput(revListCmd)
+	if err != nil {
+		return fmt.Errorf("failed to list commits since %s: %w", base, err)
+	}
+	commits := strings.Fields(string(revListOut))
+	squashTip := commits[squashCount-1]
+
+	logCmd := exec.Command("git", "log", "--reverse", "--format=- %s", base+".."+squashTip)
+	logCmd.Dir = worktreePath
+	subjects, err := auditOutput(logCmd)
+	if err != nil {
+		return fmt.Errorf("failed to read commit subjects: %w", err)
+	}
+	message := fmt.Sprintf("aider: squash %d earlier commits\n\n%s", squashCount, subjects)
+
+	commitTreeCmd := exec.Command("git", "commit-tree", squashTip+"^{tree}", "-p", base, "-m", message)
+	commitTreeCmd.Dir = worktreePath
+	squashedOut, err := auditOutput(commitTreeCmd)
+	if err != nil {
+		return fmt.Errorf("failed to create squashed commit: %w", err)
+	}
+	squashed := strings.TrimSpace(string(squashedOut))
+
+	rebaseCmd := exec.Command("git", "rebase", "--onto", squashed, squashTip)
+	rebaseCmd.Dir = worktreePath
+	if out, err := auditCombinedOutput(rebaseCmd); err != nil {
+		return fmt.Errorf("failed to replay commits onto squashed commit in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	slog.Info("Squashed oldest commits", "worktree", worktreePath, "squashed", squashCount, "maxCommits", maxCommits)
+	return nil
+}
+
+func (execGitManager) HeadSHA(dir string) (string, error) {
+	return migrate.HeadSHA(dir)
+}
+
+func (execGitManager) DiffNames(dir, from, to string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", "--no-renames", "-z", from, to)
+	cmd.Dir = dir
+	out, err := auditOutput(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("git diff --name-only %s %s failed in %s: %w", from, to, dir, err)
+	}
+	var files []string
+	for _, path := range strings.Split(string(out), "\x00") {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+func (execGitManager) Revert(worktreePath string, paths []string) error {
+	lsCmd := exec.Command("git", append([]string{"ls-tree", "-r", "-z", "--name-only", "HEAD", "--"}, paths...)...)
+	lsCmd.Dir = worktreePath
+	out, err := auditOutput(lsCmd)
+	if err != nil {
+		return fmt.Errorf("git ls-tree failed in %s: %w", worktreePath, err)
+	}
+	tracked := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if len(out) > 0 {
+		checkoutCmd := exec.Command("git", append([]string{"checkout", "HEAD", "--"}, tracked...)...)
+		checkoutCmd.Dir = worktreePath
+		if out, err := auditCombinedOutput(checkoutCmd); err != nil {
+			return fmt.Errorf("git checkout failed in %s: %v\n%s", worktreePath, err, string(out))
+		}
+	}
+	for _, path := range paths {
+		if slices.Contains(tracked, path) {
+			continue
+		}
+		// A file new since HEAD may be staged, e.g. by ResetSoft.
+		rmCmd := exec.Command("git", "rm", "-r", "-q", "--cached", "--ignore-unmatch", "--", path)
+		rmCmd.Dir = worktreePath
+		if out, err := auditCombinedOutput(rmCmd); err != nil {
+			return fmt.Errorf("git rm --cached %s failed in %s: %v\n%s", path, worktreePath, err, string(out))
+		}
+		if err := os.RemoveAll(filepath.Join(worktreePath, path)); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// snapshotWorktree writes the files in worktreePath, untracked ones included,
+// to a git tree and returns its SHA. It stages them in a throwaway index, so
+// the worktree's own index is left alone.
+func snapshotWorktree(worktreePath string) (string, error) {
+	tmp, err := os.MkdirTemp("", "bld-snapshot-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot index: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	env := append(os.Environ(), "GIT_INDEX_FILE="+filepath.Join(tmp, "index"))
+	var tree []byte
+	for _, args := range [][]string{{"read-tree", "HEAD"}, {"add", "-A"}, {"write-tree"}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = worktreePath
+		cmd.Env = env
+		out, err := auditCombinedOutput(cmd)
+		if err != nil {
+			return "", fmt.Errorf("git %s failed in %s: %v\n%s", args[0], worktreePath, err, string(out))
+		}
+		tree = out
+	}
+	return strings.TrimSpace(string(tree)), nil
+}
+
+// attemptDiff returns the binary patch from tree from to tree to, both
+// written by snapshotWorktree in worktreePath.
+func attemptDiff(worktreePath, from, to string) (string, error) {
+	cmd := exec.Command("git", "diff", "--binary", "--no-color", "--no-ext-diff", from, to)
+	cmd.Dir = worktreePath
+	out, err := auditOutput(cmd)
+	if err != nil {
+		return "", fmt.Errorf("git diff %s %s failed in %s: %w", from, to, worktreePath, err)
+	}
+	return string(out), nil
+}
+
+// applyDiff applies a patch returned by attemptDiff to the files in
+// worktreePath.
+func applyDiff(worktreePath, diff string) error {
+	cmd := exec.Command("git", "apply", "--binary", "--whitespace=nowarn", "-")
+	cmd.Dir = worktreePath
+	cmd.Stdin = strings.NewReader(diff)
+	if out, err := auditCombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git apply failed in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	return nil
+}
+
+// AuthConfig holds credentials for cloning private repositories over HTTPS.
+type AuthConfig struct {
+	Username string
+	Token    string
+}
+
+// authFromEnv returns credentials from GITHUB_USERNAME and GITHUB_TOKEN, which
+// may be unset.
+func authFromEnv() AuthConfig {
+	return AuthConfig{
+		Username: os.Getenv("GITHUB_USERNAME"),
+		Token:    os.Getenv("GITHUB_TOKEN"),
+	}
+}
+
+// scpLikeURL matches scp-style SSH remotes such as git@github.com:owner/repo.git.
+var scpLikeURL = regexp.MustCompile(`^[\w.-]+@[\w.-]+:`)
+
+// repoURLScheme returns "https", "ssh", or "other" (local paths, file:// and
+// plain http) for a git remote.
+func repoURLScheme(repoURL string) string {
+	switch {
+	case strings.HasPrefix(repoURL, "https://"):
+		return "https"
+	case strings.HasPrefix(repoURL, "ssh://"), strings.HasPrefix(repoURL, "git+ssh://"), scpLikeURL.MatchString(repoURL):
+		return "ssh"
+	default:
+		return "other"
+	}
+}
+
+// authenticatedURL returns repoURL with auth's credentials embedded.
+func authenticatedURL(repoURL string, auth AuthConfig) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse repo URL %q: %w", repoURL, err)
+	}
+	username := auth.Username
+	if username == "" {
+		// GitHub accepts any username alongside a token.
+		username = "x-access-token"
+	}
+	u.User = url.UserPassword(username, auth.Token)
+	return u.String(), nil
+}
+
+// commitSHA matches a -repo-ref that names a commit rather than a branch or
+// tag.
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// cloneRepo makes a shallow clone of repoURL into dest and checks out ref, or
+// the default branch if ref is empty. A branch or tag is cloned alone with
+// --branch; a commit SHA cannot be, so all branches are cloned and the
+// commit fetched by checkoutRef. SSH and local remotes are cloned as is.
+// HTTPS remotes are first cloned anonymously; only if that fails, as it does
+// for private repositories, is the clone retried with auth's token.
+func cloneRepo(ctx context.Context, repoURL, dest, ref string, auth AuthConfig) error {
+	args := []string{"clone", "--depth", "1"}
+	if ref == "" || !commitSHA.MatchString(ref) {
+		args = append(args, "--single-branch")
+		if ref != "" {
+			args = append(args, "--branch", ref)
+		}
+	}
+	clone := func(u string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "git", append(args, u, dest)...)
+		// Fail instead of prompting for a password on a private repo.
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		return auditCombinedOutput(cmd)
+	}
+	out, err := clone(repoURL)
+	if err == nil {
+		return checkoutRef(ctx, dest, ref)
+	}
+	if repoURLScheme(repoURL) != "https" {
+		return fmt.Errorf("git clone %s failed: %v\n%s", repoURL, err, string(out))
+	}
+	if auth.Token == "" {
+		return fmt.Errorf("anonymous git clone %s failed and no token is configured (set GITHUB_TOKEN for private repos): %v\n%s", repoURL, err, string(out))
+	}
+	slog.Info("Anonymous clone failed; retrying with credentials", "repo", repoURL)
+	if err := os.RemoveAll(dest); err != nil {
+		return fmt.Errorf("failed to clean up %s after failed clone: %w", dest, err)
+	}
+	commandAudit.Redact(auth.Token)
+	authURL, err := authenticatedURL(repoURL, auth)
+	if err != nil {
+		return err
+	}
+	if out, err := clone(authURL); err != nil {
+		// Keep the token out of logs and error messages.
+		redacted := strings.ReplaceAll(string(out), auth.Token, "***")
+		return fmt.Errorf("authenticated git clone %s failed: %v\n%s", repoURL, err, redacted)
+	}
+	return checkoutRef(ctx, dest, ref)
+}
+
+// checkoutRef fetches ref, a branch, tag or commit SHA, from origin into the
+// clone in dir and checks it out on a local branch named after it, so that
+// model branches have a base branch even when ref is not one. Servers only
+// fetch a commit by its full SHA, so for an abbreviated one the clone is
+// deepened until it has the commit. An empty ref leaves dir as it is.
+func checkoutRef(ctx context.Context, dir, ref string) error {
+	if ref == "" {
+		return nil
+	}
+	commit := "FETCH_HEAD"
+	fetch := exec.CommandContext(ctx, "git", "fetch", "--depth", "1", "origin", ref)
+	fetch.Dir = dir
+	fetch.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := auditCombinedOutput(fetch); err != nil {
+		if !commitSHA.MatchString(ref) {
+			return fmt.Errorf("git fetch %s failed in %s: %v\n%s", ref, dir, err, string(out))
+		}
+		slog.Info("Could not fetch commit by SHA; fetching full history", "ref", ref, "dir", dir)
+		unshallow := exec.CommandContext(ctx, "git", "fetch", "--unshallow", "origin")
+		unshallow.Dir = dir
+		unshallow.Env = fetch.Env
+		if out, err := auditCombinedOutput(unshallow); err != nil {
+			return fmt.Errorf("git fetch --unshallow failed in %s: %v\n%s", dir, err, string(out))
+		}
+		commit = ref
+	}
+	// A local tag named like the branch would make the branch name
+	// ambiguous, and rev-parse --abbrev-ref would no longer print it.
+	untag := exec.CommandContext(ctx, "git", "update-ref", "-d", "refs/tags/"+migrate.SanitizePath(ref))
+	untag.Dir = dir
+	if out, err := auditCombinedOutput(untag); err != nil {
+		return fmt.Errorf("git update-ref -d failed in %s: %v\n%s", dir, err, string(out))
+	}
+	checkout := exec.CommandContext(ctx, "git", "checkout", "-q", "-B", migrate.SanitizePath(ref), commit)
+	checkout.Dir = dir
+	if out, err := auditCombinedOutput(checkout); err != nil {
+		return fmt.Errorf("git checkout %s failed in %s: %v\n%s", ref, dir, err, string(out))
+	}
+	return nil
+}
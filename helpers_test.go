@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+var attempts = flag.Int("attempts", 3, "number of attempts to build a target")
+
+// testLogWriter forwards writes to t.Log so that slog output from the code
+// under test shows up with the test that produced it instead of on stderr.
+type testLogWriter struct {
+	t testing.TB
+}
+
+func (w testLogWriter) Write(p []byte) (int, error) {
+	w.t.Helper()
+	w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// useTestLogger routes the default slog logger through t.Log until the test
+// finishes.
+func useTestLogger(t testing.TB) {
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(testLogWriter{t}, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+}
+
+// newMigrator returns a Migrator with the options set by the flags, as main
+// gives each repo.
+func newMigrator(git migrate.GitManager, build migrate.BuildRunner, llm migrate.LLMRunner) *migrate.Migrator {
+	return migrate.New(git, build, llm, migratorOptions("", ""))
+}
+
+// buildEditLoop builds run.target and, while it fails, asks llm to fix it
+// with the bazel output, for up to *attempts rounds and a final build. It
+// reports whether the target built and the round it built in, or *attempts
+// if it built only after the last round or never did.
+func buildEditLoop(t *testing.T, build migrate.BuildRunner, llm migrate.LLMRunner, run migrate.Run) (bool, int) {
+	ctx := context.Background()
+	for attempt := 1; attempt <= *attempts; attempt++ {
+		t.Logf("building target %q, attempt %d", run.Target, attempt)
+		_, err := build.Build(ctx, run.WorktreePath, run.Log, run.Target)
+		if err == nil {
+			t.Logf("bazel build %q succeeded, continuing to next target", run.Target)
+			return true, attempt
+		}
+		var buildErr *BazelBuildError
+		if !errors.As(err, &buildErr) {
+			t.Fatalf("Could not build %q: %s", run.Target, err)
+		}
+		t.Logf("bazel build %q did not succeed, invoking aider", run.Target)
+		prompt, err := renderPrompt(PromptData{Target: run.Target, BuildBazelPath: run.BuildFile, BazelOutput: buildErr.Output})
+		if err != nil {
+			t.Fatal(err)
+		}
+		promptRun := run
+		promptRun.Feedback = prompt
+		if aiderOutput, err := llm.RunAider(ctx, promptRun); err != nil {
+			t.Fatalf("Error running aider (%s):\n%s", err, aiderOutput)
+		}
+	}
+
+	bazelBuildOutput, err := build.Build(ctx, run.WorktreePath, run.Log, run.Target)
+	if err == nil {
+		t.Logf("bazel build %q succeeded, continuing to next target", run.Target)
+		return true, *attempts
+	}
+	t.Logf("last bazel build %q failed, output:\n%s", run.Target, bazelBuildOutput)
+	return false, *attempts
+}
+
+func commitSha(t *testing.T, dir string) string {
+	cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Could not find commit sha: %s", err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func diff(t *testing.T, dir, left, right string) []byte {
+	cmd := exec.Command("git", "diff", left, right)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Error during git diff %q %q: %s", left, right, err)
+	}
+	return output
+}
+
+func isRepoClean(t *testing.T, dir string) bool {
+	t.Log("checking if repo is clean")
+	cmd := exec.Command("git", "status", "--porcelain")
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Error during git status check (%s):\n%s", err, output)
+	}
+	isClean := len(output) == 0
+	t.Logf("checked if repo is clean: %t", isClean)
+	return isClean
+}
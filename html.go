@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// maxHTMLLogBytes caps how much of a failed cell's target log the HTML report
+// embeds; the end of the log, where the last bazel error is, is kept.
+const maxHTMLLogBytes = 64 << 10
+
+// htmlBarWidth is the width in pixels of a full success-rate bar.
+const htmlBarWidth = 300
+
+// htmlCell is one model/target cell of the HTML report, over all of its
+// repetitions.
+type htmlCell struct {
+	// Status is "success", "failed", "partial" (some repetitions succeeded),
+	// "skipped" (the circuit breaker tripped) or "" if the pair never ran.
+	Status    string
+	Runs      int
+	Successes int
+	Attempts  int
+	Duration  time.Duration
+	// LogPath is the target log of a cell with a failure.
+	LogPath string
+	Output  string
+}
+
+// htmlRow is one model's cells, in the order of htmlReport.Targets.
+type htmlRow struct {
+	Model     string
+	Cells     []htmlCell
+	Succeeded int
+	Attempted int
+}
+
+// Rate returns the percentage of attempted cells that fully succeeded.
+func (r htmlRow) Rate() int {
+	if r.Attempted == 0 {
+		return 0
+	}
+	return r.Succeeded * 100 / r.Attempted
+}
+
+// BarWidth returns the width of r's success-rate bar.
+func (r htmlRow) BarWidth() int {
+	return r.Rate() * htmlBarWidth / 100
+}
+
+// htmlReport is the data behind htmlReportTemplate.
+type htmlReport struct {
+	Generated string
+	// Targets are qualified with the repo, as by repoTarget.
+	Targets  []string
+	Rows     []htmlRow
+	BarWidth int
+}
+
+// buildHTMLReport arranges results into a grid with a row per model and a
+// column per target, each in the order they first appear.
+func buildHTMLReport(results []Result) htmlReport {
+	report := htmlReport{Generated: time.Now().Format(time.RFC1123), BarWidth: htmlBarWidth}
+	targetIndex := make(map[string]int)
+	modelIndex := make(map[string]int)
+	for _, r := range results {
+		target := repoTarget(r.Repo, r.Target)
+		if _, ok := targetIndex[target]; !ok {
+			targetIndex[target] = len(report.Targets)
+			report.Targets = append(report.Targets, target)
+		}
+		if _, ok := modelIndex[r.Model]; !ok {
+			modelIndex[r.Model] = len(report.Rows)
+			report.Rows = append(report.Rows, htmlRow{Model: r.Model})
+		}
+	}
+	for i := range report.Rows {
+		report.Rows[i].Cells = make([]htmlCell, len(report.Targets))
+	}
+	for _, r := range results {
+		cell := &report.Rows[modelIndex[r.Model]].Cells[targetIndex[repoTarget(r.Repo, r.Target)]]
+		if r.Skipped {
+			if cell.Status == "" {
+				cell.Status = "skipped"
+			}
+			continue
+		}
+		cell.Runs++
+		cell.Attempts += r.Attempts
+		cell.Duration += r.Duration
+		if r.Success {
+			cell.Successes++
+		} else {
+			cell.LogPath = migrate.TargetLogPath(filepath.Join(*logDir, r.Repo), r.Model, r.Target)
+		}
+	}
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		for j := range row.Cells {
+			cell := &row.Cells[j]
+			if cell.Runs == 0 {
+				continue
+			}
+			row.Attempted++
+			switch cell.Successes {
+			case cell.Runs:
+				cell.Status = "success"
+				row.Succeeded++
+			case 0:
+				cell.Status = "failed"
+			default:
+				cell.Status = "partial"
+			}
+		}
+	}
+	return report
+}
+
+// readLogTail returns up to the last maxHTMLLogBytes of the file at path.
+func readLogTail(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read log %s: %w", path, err)
+	}
+	if len(data) > maxHTMLLogBytes {
+		data = append([]byte("[... earlier output omitted ...]\n"), data[len(data)-maxHTMLLogBytes:]...)
+	}
+	return string(data), nil
+}
+
+// generateHTMLReport writes a self-contained HTML page to outputPath with a
+// pass/fail grid of results, a success-rate chart per model and the target
+// log of every cell with a failure.
+func generateHTMLReport(results []Result, outputPath string) error {
+	report := buildHTMLReport(results)
+	for i := range report.Rows {
+		for j := range report.Rows[i].Cells {
+			cell := &report.Rows[i].Cells[j]
+			if cell.LogPath == "" {
+				continue
+			}
+			output, err := readLogTail(cell.LogPath)
+			if err != nil {
+				output = err.Error()
+			}
+			cell.Output = output
+		}
+	}
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create HTML report %s: %w", outputPath, err)
+	}
+	if err := htmlReportTemplate.Execute(f, report); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to render HTML report: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write HTML report %s: %w", outputPath, err)
+	}
+	return nil
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"round": func(d time.Duration) time.Duration { return d.Round(time.Second) },
+	"add":   func(a, b int) int { return a + b },
+	"mul":   func(a, b int) int { return a * b },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Bazel migration results</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+th.target { writing-mode: vertical-rl; transform: rotate(180deg); font-weight: normal; }
+td.cell { width: 2em; height: 2em; text-align: center; }
+.success { background: #4caf50; }
+.failed { background: #e53935; }
+.partial { background: #fdd835; }
+.skipped { background: #bdbdbd; }
+pre { background: #f5f5f5; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Bazel migration results</h1>
+<p>Generated {{.Generated}}.</p>
+
+<h2>Results</h2>
+<table>
+<tr><th>Model</th>{{range .Targets}}<th class="target">{{.}}</th>{{end}}</tr>
+{{range .Rows}}{{$model := .Model}}<tr><th>{{$model}}</th>{{range $i, $cell := .Cells}}<td class="cell {{$cell.Status}}" title="{{index $.Targets $i}}{{if $cell.Runs}}: {{$cell.Successes}}/{{$cell.Runs}} succeeded, {{$cell.Attempts}} attempts, {{round $cell.Duration}}{{else if $cell.Status}}: {{$cell.Status}}{{end}}"></td>{{end}}</tr>
+{{end}}</table>
+
+<h2>Success rate</h2>
+<svg xmlns="http://www.w3.org/2000/svg" width="{{add .BarWidth 400}}" height="{{mul (len .Rows) 24}}">
+{{range $i, $row := .Rows}}<text x="0" y="{{add (mul $i 24) 16}}" font-size="12">{{$row.Model}}</text>
+<rect x="300" y="{{add (mul $i 24) 4}}" width="{{$.BarWidth}}" height="16" fill="#eee"/>
+<rect x="300" y="{{add (mul $i 24) 4}}" width="{{$row.BarWidth}}" height="16" fill="#4caf50"/>
+<text x="{{add $.BarWidth 308}}" y="{{add (mul $i 24) 16}}" font-size="12">{{$row.Rate}}% ({{$row.Succeeded}}/{{$row.Attempted}})</text>
+{{end}}</svg>
+
+<h2>Failures</h2>
+{{range .Rows}}{{$model := .Model}}{{range $i, $cell := .Cells}}{{if $cell.LogPath}}<details>
+<summary>{{$model}} {{index $.Targets $i}}</summary>
+<pre>{{$cell.Output}}</pre>
+</details>
+{{end}}{{end}}{{end}}</body>
+</html>
+`))
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+func TestBuildHTMLReport(t *testing.T) {
+	results := []Result{
+		{Model: "a", Target: "//x:x", Success: true, Attempts: 1, Duration: time.Second},
+		{Model: "a", Target: "//y:y", Attempts: 3},
+		{Model: "b", Target: "//x:x", Success: true, Attempts: 2, Repetition: 1},
+		{Model: "b", Target: "//x:x", Attempts: 3, Repetition: 2},
+		{Model: "b", Target: "//y:y", Skipped: true},
+		{Repo: "r", Model: "a", Target: "//x:x", Success: true, Attempts: 1},
+	}
+	report := buildHTMLReport(results)
+	if got, want := strings.Join(report.Targets, " "), "//x:x //y:y @r//x:x"; got != want {
+		t.Errorf("Targets = %q, want %q", got, want)
+	}
+	var statuses []string
+	for _, row := range report.Rows {
+		for _, cell := range row.Cells {
+			statuses = append(statuses, cell.Status)
+		}
+	}
+	if got, want := strings.Join(statuses, ","), "success,failed,success,partial,skipped,"; got != want {
+		t.Errorf("statuses = %q, want %q", got, want)
+	}
+	if a := report.Rows[0]; a.Succeeded != 2 || a.Attempted != 3 || a.Rate() != 66 {
+		t.Errorf("model a: %d/%d succeeded, rate %d%%, want 2/3, 66%%", a.Succeeded, a.Attempted, a.Rate())
+	}
+	if cell := report.Rows[1].Cells[0]; cell.Runs != 2 || cell.Attempts != 5 || cell.LogPath == "" {
+		t.Errorf("model b //x:x = %+v, want 2 runs, 5 attempts and a log", cell)
+	}
+}
+
+func TestGenerateHTMLReport(t *testing.T) {
+	prev := *logDir
+	*logDir = t.TempDir()
+	t.Cleanup(func() { *logDir = prev })
+	f, err := migrate.OpenTargetLog(*logDir, "openrouter/a", "//y:y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("ERROR: <missing> dependency\n")
+	f.Close()
+
+	path := filepath.Join(t.TempDir(), "report.html")
+	results := []Result{
+		{Model: "openrouter/a", Target: "//x:x", Success: true, Attempts: 1},
+		{Model: "openrouter/a", Target: "//y:y", Attempts: 3},
+	}
+	if err := generateHTMLReport(results, path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(data)
+	for _, want := range []string{
+		`class="cell success"`,
+		`class="cell failed"`,
+		"<svg",
+		"50% (1/2)",
+		"<details>",
+		"ERROR: &lt;missing&gt; dependency",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML report lacks %q:\n%s", want, html)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Leaderboard accumulates per-model results across runs in the -leaderboard
+// file, keyed by model name as in the models list. Runs holds the keys of the
+// runs merged so far, so that no run is counted twice.
+type Leaderboard struct {
+	Runs   []string                    `json:"runs"`
+	Models map[string]LeaderboardEntry `json:"models"`
+}
+
+// LeaderboardEntry is a model's lifetime totals. Targets counts the targets
+// it attempted, not those skipped by the circuit breaker, and Attempts the
+// aider attempts it took on them.
+type LeaderboardEntry struct {
+	Runs      int     `json:"runs"`
+	Targets   int     `json:"targets"`
+	Successes int     `json:"successes"`
+	Attempts  int     `json:"attempts"`
+	CostUSD   float64 `json:"costUSD"`
+}
+
+// SuccessRate returns the fraction of attempted targets the model built, or
+// zero if it has attempted none.
+func (e LeaderboardEntry) SuccessRate() float64 {
+	if e.Targets == 0 {
+		return 0
+	}
+	return float64(e.Successes) / float64(e.Targets)
+}
+
+// AverageAttempts returns the aider attempts per attempted target.
+func (e LeaderboardEntry) AverageAttempts() float64 {
+	if e.Targets == 0 {
+		return 0
+	}
+	return float64(e.Attempts) / float64(e.Targets)
+}
+
+// AverageCostUSD returns the estimated spend per run.
+func (e LeaderboardEntry) AverageCostUSD() float64 {
+	if e.Runs == 0 {
+		return 0
+	}
+	return e.CostUSD / float64(e.Runs)
+}
+
+// leaderboardRunKey identifies a run by when it started and the HEAD commits
+// of the repos it migrated.
+func leaderboardRunKey(start time.Time, shas []string) string {
+	return start.UTC().Format(time.RFC3339) + "@" + strings.Join(shas, ",")
+}
+
+// loadLeaderboard reads the -leaderboard file at path. A missing file is an
+// empty leaderboard.
+func loadLeaderboard(path string) (*Leaderboard, error) {
+	lb := &Leaderboard{Models: make(map[string]LeaderboardEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lb, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read leaderboard %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, lb); err != nil {
+		return nil, fmt.Errorf("failed to parse leaderboard %s: %w", path, err)
+	}
+	if lb.Models == nil {
+		lb.Models = make(map[string]LeaderboardEntry)
+	}
+	return lb, nil
+}
+
+// saveLeaderboard writes lb to path as indented JSON.
+func saveLeaderboard(path string, lb *Leaderboard) error {
+	data, err := json.MarshalIndent(lb, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode leaderboard: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write leaderboard %s: %w", path, err)
+	}
+	return nil
+}
+
+// Merge adds the results of the run with key to lb, pricing each model with
+// modelCost. It returns false, leaving lb unchanged, if the run was merged
+// before.
+func (lb *Leaderboard) Merge(key string, results []Result, modelCost func(model string) float64) bool {
+	if slices.Contains(lb.Runs, key) {
+		return false
+	}
+	lb.Runs = append(lb.Runs, key)
+	seen := make(map[string]bool)
+	for _, r := range results {
+		model := strings.TrimPrefix(r.Model, "openrouter/")
+		e := lb.Models[model]
+		if !seen[model] {
+			seen[model] = true
+			e.Runs++
+			e.CostUSD += modelCost(model)
+		}
+		if !r.Skipped {
+			e.Targets++
+			e.Attempts += r.Attempts
+			if r.Success {
+				e.Successes++
+			}
+		}
+		lb.Models[model] = e
+	}
+	return true
+}
+
+// updateLeaderboard merges results into the leaderboard at path under key.
+func updateLeaderboard(path, key string, results []Result) error {
+	lb, err := loadLeaderboard(path)
+	if err != nil {
+		return err
+	}
+	if !lb.Merge(key, results, costs.ModelCost) {
+		return fmt.Errorf("run %s is already on leaderboard %s", key, path)
+	}
+	return saveLeaderboard(path, lb)
+}
+
+// printLeaderboard writes the standings, best success rate first, then
+// fewest average attempts.
+func printLeaderboard(w io.Writer, lb *Leaderboard) error {
+	models := make([]string, 0, len(lb.Models))
+	for model := range lb.Models {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		a, b := lb.Models[models[i]], lb.Models[models[j]]
+		if a.SuccessRate() != b.SuccessRate() {
+			return a.SuccessRate() > b.SuccessRate()
+		}
+		if a.AverageAttempts() != b.AverageAttempts() {
+			return a.AverageAttempts() < b.AverageAttempts()
+		}
+		return models[i] < models[j]
+	})
+	fmt.Fprintf(w, "%d runs\n", len(lb.Runs))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tMODEL\tRUNS\tTARGETS\tSUCCESS\tAVG ATTEMPTS\tAVG COST")
+	for i, model := range models {
+		e := lb.Models[model]
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%.0f%%\t%.2f\t$%.2f\n", i+1, model, e.Runs, e.Targets, 100*e.SuccessRate(), e.AverageAttempts(), e.AverageCostUSD())
+	}
+	return tw.Flush()
+}
+
+// runLeaderboard prints the standings of the leaderboard at path.
+func runLeaderboard(w io.Writer, path string) error {
+	lb, err := loadLeaderboard(path)
+	if err != nil {
+		return err
+	}
+	return printLeaderboard(w, lb)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeaderboardMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leaderboard.json")
+	runCosts := map[string]float64{"openai/gpt-5": 1.5, "x-ai/grok-4": 0.5}
+	modelCost := func(model string) float64 { return runCosts[model] }
+	results := []Result{
+		{Model: "openrouter/openai/gpt-5", Target: "//:ripgrep", Success: true, Attempts: 1},
+		{Model: "openrouter/openai/gpt-5", Target: "//crates/cli", Attempts: 3},
+		{Model: "openrouter/x-ai/grok-4", Target: "//:ripgrep", Success: true, Attempts: 2},
+		{Model: "openrouter/x-ai/grok-4", Target: "//crates/cli", Skipped: true},
+	}
+	start := time.Date(2025, 9, 8, 12, 0, 0, 0, time.UTC)
+	first := leaderboardRunKey(start, []string{"abc123"})
+	if first != "2025-09-08T12:00:00Z@abc123" {
+		t.Errorf("leaderboardRunKey = %q", first)
+	}
+
+	lb, err := loadLeaderboard(path)
+	if err != nil {
+		t.Fatalf("loadLeaderboard of a missing file: %v", err)
+	}
+	if !lb.Merge(first, results, modelCost) {
+		t.Fatal("Merge of a new run = false, want true")
+	}
+	if lb.Merge(first, results, modelCost) {
+		t.Error("Merge of the same run again = true, want false")
+	}
+	if err := saveLeaderboard(path, lb); err != nil {
+		t.Fatal(err)
+	}
+	lb, err = loadLeaderboard(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.Merge(leaderboardRunKey(start.Add(24*time.Hour), []string{"abc123"}), results[:2], modelCost)
+
+	gpt5 := lb.Models["openai/gpt-5"]
+	if want := (LeaderboardEntry{Runs: 2, Targets: 4, Successes: 2, Attempts: 8, CostUSD: 3}); gpt5 != want {
+		t.Errorf("gpt-5 entry = %+v, want %+v", gpt5, want)
+	}
+	if gpt5.SuccessRate() != 0.5 || gpt5.AverageAttempts() != 2 || gpt5.AverageCostUSD() != 1.5 {
+		t.Errorf("gpt-5 averages = %v, %v, %v; want 0.5, 2, 1.5", gpt5.SuccessRate(), gpt5.AverageAttempts(), gpt5.AverageCostUSD())
+	}
+	if want := (LeaderboardEntry{Runs: 1, Targets: 1, Successes: 1, Attempts: 2, CostUSD: 0.5}); lb.Models["x-ai/grok-4"] != want {
+		t.Errorf("grok-4 entry = %+v, want %+v", lb.Models["x-ai/grok-4"], want)
+	}
+
+	var out strings.Builder
+	if err := printLeaderboard(&out, lb); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if lines[0] != "2 runs" || !strings.HasPrefix(lines[2], "1     x-ai/grok-4") || !strings.HasPrefix(lines[3], "2     openai/gpt-5") {
+		t.Errorf("printLeaderboard =\n%s\nwant grok-4 ranked above gpt-5", out.String())
+	}
+}
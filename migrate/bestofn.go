@@ -0,0 +1,40 @@
+package migrate
+
+import (
+	"sort"
+)
+
+// attemptResult is how one model fared on the Options.BestOfN probe target.
+type attemptResult struct {
+	// Model is the model name as passed to MigrateRepo, without the
+	// openrouter/ prefix.
+	Model    string
+	Attempts int
+	Success  bool
+}
+
+// probeResult summarizes model's results on the probe target. A model that
+// produced no result, e.g. because the deadline passed, counts as failed.
+func probeResult(model string, results []Result) attemptResult {
+	if len(results) == 0 {
+		return attemptResult{Model: model}
+	}
+	return attemptResult{Model: model, Attempts: results[0].Attempts, Success: results[0].Success}
+}
+
+// selectTopModels returns the models of the keep best results: successes in
+// order of fewest attempts, then failures. Ties keep their original order.
+func selectTopModels(results []attemptResult, keep int) []string {
+	sorted := append([]attemptResult(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Success != sorted[j].Success {
+			return sorted[i].Success
+		}
+		return sorted[i].Success && sorted[i].Attempts < sorted[j].Attempts
+	})
+	var top []string
+	for _, r := range sorted[:min(keep, len(sorted))] {
+		top = append(top, r.Model)
+	}
+	return top
+}
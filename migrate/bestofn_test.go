@@ -0,0 +1,41 @@
+package migrate
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSelectTopModels(t *testing.T) {
+	results := []attemptResult{
+		{Model: "a", Attempts: 3, Success: false},
+		{Model: "b", Attempts: 2, Success: true},
+		{Model: "c", Attempts: 1, Success: true},
+		{Model: "d", Attempts: 0, Success: false},
+		{Model: "e", Attempts: 2, Success: true},
+	}
+	tests := []struct {
+		keep int
+		want []string
+	}{
+		{keep: 0, want: nil},
+		{keep: 1, want: []string{"c"}},
+		{keep: 3, want: []string{"c", "b", "e"}},
+		{keep: 4, want: []string{"c", "b", "e", "a"}},
+		{keep: 10, want: []string{"c", "b", "e", "a", "d"}},
+	}
+	for _, tt := range tests {
+		if got := selectTopModels(results, tt.keep); !slices.Equal(got, tt.want) {
+			t.Errorf("selectTopModels(keep=%d) = %q, want %q", tt.keep, got, tt.want)
+		}
+	}
+}
+
+func TestProbeResult(t *testing.T) {
+	if got := probeResult("a", nil); got != (attemptResult{Model: "a"}) {
+		t.Errorf("probeResult with no results = %+v, want a failure", got)
+	}
+	got := probeResult("a", []Result{{Model: "openrouter/a", Attempts: 2, Success: true}})
+	if want := (attemptResult{Model: "a", Attempts: 2, Success: true}); got != want {
+		t.Errorf("probeResult = %+v, want %+v", got, want)
+	}
+}
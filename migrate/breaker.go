@@ -0,0 +1,34 @@
+package migrate
+
+// CircuitBreaker tracks consecutive failed targets for a single model and
+// trips once the count reaches a threshold, so the remaining targets are not
+// spent on a model that cannot make progress. A successful build resets it.
+type CircuitBreaker struct {
+	threshold           int
+	consecutiveFailures int
+}
+
+// NewCircuitBreaker returns a breaker that trips after threshold consecutive
+// failures. A threshold of zero or less disables the breaker.
+func NewCircuitBreaker(threshold int) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold}
+}
+
+// Record updates the breaker with the outcome of one target.
+func (b *CircuitBreaker) Record(success bool) {
+	if success {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+}
+
+// Tripped reports whether the breaker has seen threshold consecutive failures.
+func (b *CircuitBreaker) Tripped() bool {
+	return b.threshold > 0 && b.consecutiveFailures >= b.threshold
+}
+
+// ConsecutiveFailures returns the current run of failed targets.
+func (b *CircuitBreaker) ConsecutiveFailures() int {
+	return b.consecutiveFailures
+}
@@ -0,0 +1,61 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCircuitBreakerTripsAndSkipsTargets(t *testing.T) {
+	targets := []string{"//a:a", "//b:b", "//c:c", "//d:d", "//e:e"}
+	breaker := NewCircuitBreaker(3)
+	m := &Migrator{opts: Options{KeepGoing: true}}
+	var migrated []string
+	results, err := m.migrateTargets("model", targets, breaker, func(target string) (Result, error) {
+		migrated = append(migrated, target)
+		return Result{Model: "model", Target: target, Attempts: MaxAttempts}, nil
+	})
+	if err != nil {
+		t.Fatalf("migrateTargets returned error: %s", err)
+	}
+	if want := targets[:3]; !reflect.DeepEqual(migrated, want) {
+		t.Fatalf("migrated targets = %q, want %q", migrated, want)
+	}
+	if !breaker.Tripped() {
+		t.Fatal("breaker did not trip after three consecutive failures")
+	}
+	if len(results) != len(targets) {
+		t.Fatalf("got %d results, want %d", len(results), len(targets))
+	}
+	for i, r := range results {
+		if wantSkipped := i >= 3; r.Skipped != wantSkipped {
+			t.Errorf("result for %s: Skipped = %t, want %t", r.Target, r.Skipped, wantSkipped)
+		}
+	}
+}
+
+func TestCircuitBreakerResetsOnSuccess(t *testing.T) {
+	breaker := NewCircuitBreaker(3)
+	for _, success := range []bool{false, false, true, false, false} {
+		breaker.Record(success)
+	}
+	if breaker.Tripped() {
+		t.Fatal("breaker tripped even though a success reset the failure count")
+	}
+	if got := breaker.ConsecutiveFailures(); got != 2 {
+		t.Fatalf("ConsecutiveFailures() = %d, want 2", got)
+	}
+	breaker.Record(false)
+	if !breaker.Tripped() {
+		t.Fatal("breaker did not trip on the third consecutive failure")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := NewCircuitBreaker(0)
+	for i := 0; i < 10; i++ {
+		breaker.Record(false)
+	}
+	if breaker.Tripped() {
+		t.Fatal("breaker with threshold 0 should never trip")
+	}
+}
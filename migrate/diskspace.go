@@ -0,0 +1,153 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// bytesPerGB converts byte counts to GB for messages.
+const bytesPerGB = 1 << 30
+
+// freeBytes returns the bytes available to unprivileged users on the
+// filesystem containing path.
+func freeBytes(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("failed to stat filesystem of %s: %w", path, err)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// checkDiskSpace returns an error if the filesystem containing path has less
+// than minFreeBytes available. A threshold of zero or less disables the check.
+func checkDiskSpace(path string, minFreeBytes int64) error {
+	if minFreeBytes <= 0 {
+		return nil
+	}
+	free, err := freeBytes(path)
+	if err != nil {
+		return err
+	}
+	if free < minFreeBytes {
+		return fmt.Errorf("only %.1f GB free on the filesystem of %s; need at least %.1f GB", float64(free)/bytesPerGB, path, float64(minFreeBytes)/bytesPerGB)
+	}
+	return nil
+}
+
+// warnLowDiskSpace logs a warning when the filesystem containing path has
+// less than twice minFreeBytes available, ahead of checkDiskSpace failing.
+func warnLowDiskSpace(path string, minFreeBytes int64) {
+	if minFreeBytes <= 0 {
+		return
+	}
+	free, err := freeBytes(path)
+	if err != nil {
+		slog.Warn("Could not check free disk space", "path", path, "err", err)
+		return
+	}
+	if free < 2*minFreeBytes {
+		slog.Warn("Disk space is running low", "path", path, "freeGB", round2(float64(free)/bytesPerGB), "minGB", round2(float64(minFreeBytes)/bytesPerGB))
+	}
+}
+
+// worktreeDiskUsage is the size of a worktree's bazel output and when it was
+// last written.
+type worktreeDiskUsage struct {
+	path     string
+	bytes    int64
+	lastUsed time.Time
+}
+
+// bazelOutputUsage sums the sizes of the files under worktreePath/bazel-out,
+// following the convenience symlink into the output base, and returns the
+// newest modification time among them. A worktree without bazel-out has no
+// usage.
+func bazelOutputUsage(worktreePath string) (worktreeDiskUsage, error) {
+	usage := worktreeDiskUsage{path: worktreePath}
+	root, err := filepath.EvalSymlinks(filepath.Join(worktreePath, "bazel-out"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return usage, fmt.Errorf("failed to resolve bazel-out of %s: %w", worktreePath, err)
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(usage.lastUsed) {
+			usage.lastUsed = info.ModTime()
+		}
+		if info.Mode().IsRegular() {
+			usage.bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return usage, fmt.Errorf("failed to measure bazel-out of %s: %w", worktreePath, err)
+	}
+	return usage, nil
+}
+
+// monitorWorktreeDiskUsage measures the bazel output of every worktree under
+// baseDir and returns the worktrees to evict, least recently used first, so
+// that the output of those left totals at most maxTotalBytes. A limit of zero
+// or less disables the check.
+func monitorWorktreeDiskUsage(baseDir string, maxTotalBytes int64) ([]string, error) {
+	if maxTotalBytes <= 0 {
+		return nil, nil
+	}
+	var usages []worktreeDiskUsage
+	var total int64
+	err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		// A worktree has a .git file; nothing below it is another worktree.
+		if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+			return nil
+		}
+		usage, err := bazelOutputUsage(path)
+		if err != nil {
+			return err
+		}
+		// Evicting a worktree without bazel output would free nothing.
+		if usage.bytes > 0 {
+			usages = append(usages, usage)
+		}
+		total += usage.bytes
+		return filepath.SkipDir
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].lastUsed.Before(usages[j].lastUsed)
+	})
+	var evict []string
+	for _, usage := range usages {
+		if total <= maxTotalBytes {
+			break
+		}
+		evict = append(evict, usage.path)
+		total -= usage.bytes
+	}
+	return evict, nil
+}
@@ -0,0 +1,88 @@
+package migrate
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeBytes(dir)
+	if err != nil {
+		t.Fatalf("freeBytes: %v", err)
+	}
+	if free <= 0 {
+		t.Fatalf("freeBytes = %d, want > 0", free)
+	}
+	if err := checkDiskSpace(dir, 0); err != nil {
+		t.Errorf("disabled check failed: %v", err)
+	}
+	if err := checkDiskSpace(dir, 1); err != nil {
+		t.Errorf("check for 1 byte failed: %v", err)
+	}
+	if err := checkDiskSpace(dir, math.MaxInt64); err == nil {
+		t.Error("check for more space than any disk has succeeded")
+	}
+	if err := checkDiskSpace(dir+"/missing", 1); err == nil {
+		t.Error("check of a missing path succeeded")
+	}
+}
+
+func TestMonitorWorktreeDiskUsage(t *testing.T) {
+	base := t.TempDir()
+	outputBases := t.TempDir()
+	now := time.Now()
+	// Each worktree's bazel-out links to its own output base, as bazel's
+	// convenience symlink does.
+	addWorktree := func(name string, size int, age time.Duration) string {
+		t.Helper()
+		worktree := filepath.Join(base, name)
+		writeFile(t, filepath.Join(worktree, ".git"), "gitdir: elsewhere\n")
+		out := filepath.Join(outputBases, name)
+		writeFile(t, filepath.Join(out, "bin/lib.rlib"), strings.Repeat("x", size))
+		for _, path := range []string{filepath.Join(out, "bin/lib.rlib"), filepath.Join(out, "bin"), out} {
+			if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink(out, filepath.Join(worktree, "bazel-out")); err != nil {
+			t.Fatal(err)
+		}
+		return worktree
+	}
+	recent := addWorktree("main-recent", 300, time.Minute)
+	oldest := addWorktree("main-oldest", 200, 3*time.Hour)
+	old := addWorktree("main-old", 400, 2*time.Hour)
+	writeFile(t, filepath.Join(base, "main-unbuilt/.git"), "gitdir: elsewhere\n")
+
+	if usage, err := bazelOutputUsage(recent); err != nil || usage.bytes != 300 {
+		t.Errorf("bazelOutputUsage = %+v, %v; want 300 bytes", usage, err)
+	}
+	tests := []struct {
+		max  int64
+		want []string
+	}{
+		{max: 0, want: nil},
+		{max: 900, want: nil},
+		{max: 800, want: []string{oldest}},
+		{max: 300, want: []string{oldest, old}},
+		{max: 1, want: []string{oldest, old, recent}},
+	}
+	for _, tt := range tests {
+		got, err := monitorWorktreeDiskUsage(base, tt.max)
+		if err != nil {
+			t.Fatalf("monitorWorktreeDiskUsage(%d): %v", tt.max, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("monitorWorktreeDiskUsage(%d) = %q, want %q", tt.max, got, tt.want)
+		}
+	}
+	if got, err := monitorWorktreeDiskUsage(filepath.Join(base, "missing"), 1); err != nil || got != nil {
+		t.Errorf("monitorWorktreeDiskUsage of a missing dir = %q, %v; want nothing", got, err)
+	}
+}
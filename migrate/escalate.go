@@ -0,0 +1,75 @@
+package migrate
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+// escalationKey registers the Options.Escalate worktree on the
+// AttemptTracker, in place of a model.
+const escalationKey = "escalation"
+
+// escalationBranchName returns the branch Options.Escalate works on for repo,
+// off of branch. prefix goes before "escalate".
+func escalationBranchName(branch, repo, prefix string) string {
+	escalationBranch := branch + "-"
+	if repo != "" {
+		escalationBranch += repo + "-"
+	}
+	return escalationBranch + SanitizePath(prefix+"escalate")
+}
+
+// escalateRepo migrates targets in a single worktree, giving each target to
+// the first of models and to the next only when a model exhausts its
+// attempts. It returns the results, one per target, how many were planned,
+// and a tracker with the worktree registered under escalationKey.
+func (m *Migrator) escalateRepo(ctx context.Context, repoDir, branch string, models, targets []string) ([]Result, int, *AttemptTracker, error) {
+	tracker := NewAttemptTracker()
+	slog.Info("Escalating through models, cheapest first", "repo", m.opts.Repo, "models", models)
+	worktreePath, err := m.openWorktree(repoDir, escalationBranchName(branch, m.opts.Repo, m.opts.BranchPrefix))
+	if err != nil {
+		return nil, len(targets), tracker, err
+	}
+	baseCommit, err := MergeBase(worktreePath, branch, "HEAD")
+	if err != nil {
+		slog.Warn("Error finding base commit", "worktree", worktreePath, "err", err)
+	}
+	// Each target already gets every model, so there is no breaker.
+	results, err := m.migrateTargets(escalationKey, targets, NewCircuitBreaker(0), func(target string) (Result, error) {
+		return m.escalateTarget(ctx, worktreePath, baseCommit, target, models)
+	})
+	for i := range results {
+		results[i].Repo = m.opts.Repo
+	}
+	tracker.AddModel(escalationKey, worktreePath, baseCommit)
+	return results, len(targets), tracker, err
+}
+
+// escalateTarget tries models on target in order until one builds it. The
+// result is that model's, or the last model's if none did, with EscalatedFrom
+// listing the models that failed before it.
+func (m *Migrator) escalateTarget(ctx context.Context, worktreePath, baseCommit, target string, models []string) (Result, error) {
+	var result Result
+	var escalatedFrom []string
+	for i, model := range models {
+		if i > 0 {
+			if m.pastDeadline() || m.overBudget() {
+				break
+			}
+			slog.Info("Escalating target", "target", target, "from", result.Model, "to", "openrouter/"+model)
+		}
+		var err error
+		result, err = m.runTarget(ctx, worktreePath, model, baseCommit, target)
+		if err != nil {
+			return result, err
+		}
+		result.EscalatedFrom = slices.Clone(escalatedFrom)
+		if result.Success {
+			slog.Info("Target solved", "target", target, "model", result.Model, "escalations", len(escalatedFrom))
+			return result, nil
+		}
+		escalatedFrom = append(escalatedFrom, result.Model)
+	}
+	return result, nil
+}
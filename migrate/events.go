@@ -0,0 +1,39 @@
+package migrate
+
+// Event types. A Migrator emits attempt, bazel_build and commit events; the
+// others describe the run around it.
+const (
+	EventRunStart    = "run_start"
+	EventModelStart  = "model_start"
+	EventTargetStart = "target_start"
+	EventAttempt     = "attempt"
+	EventBazelBuild  = "bazel_build"
+	EventCommit      = "commit"
+	EventTargetDone  = "target_done"
+	EventModelDone   = "model_done"
+	EventRunDone     = "run_done"
+)
+
+// Event is one line of bld's -events-out stream, a machine interface for
+// external tooling that is kept stable independently of the human log.
+// Fields that do not apply to an event's type are omitted.
+type Event struct {
+	Time   string `json:"time"`
+	Type   string `json:"type"`
+	Repo   string `json:"repo,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Attempt is the 1-based build-edit attempt, for attempt and
+	// bazel_build events, and the attempts used, for target_done.
+	Attempt int `json:"attempt,omitempty"`
+	// Status is "succeeded", "failed" or "skipped".
+	Status    string `json:"status,omitempty"`
+	CommitSHA string `json:"commitSHA,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Models and Targets are the run's plan, for run_start.
+	Models  []string `json:"models,omitempty"`
+	Targets []string `json:"targets,omitempty"`
+	// Succeeded and Total count targets, for model_done and run_done.
+	Succeeded int `json:"succeeded,omitempty"`
+	Total     int `json:"total,omitempty"`
+}
@@ -0,0 +1,88 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+// Example gives a model its own branch and worktree of a repository, as bld
+// does before migrating targets with it.
+func Example() {
+	repo, err := os.MkdirTemp("", "repo")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=example", "-c", "user.email=example@example.com", "commit", "-q", "--allow-empty", "-m", "base"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Fatalf("git %s: %v\n%s", args[0], err, out)
+		}
+	}
+
+	base, err := migrate.Branch(repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	branch := base + "-openrouter-openai-gpt-5"
+	if err := migrate.CreateBranch(repo, branch); err != nil {
+		log.Fatal(err)
+	}
+	worktree := filepath.Join(repo, ".worktrees", branch)
+	if err := migrate.AddWorktree(repo, worktree, branch); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrate.WorktreeHealthCheck(repo, worktree, branch); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(migrate.Branch(worktree))
+
+	if err := migrate.RemoveWorktree(repo, worktree); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(migrate.WorktreeExists(worktree))
+	// Output:
+	// main-openrouter-openai-gpt-5 <nil>
+	// false <nil>
+}
+
+// ExampleMigrator_MigrateTarget drives one migration through the fakes of
+// package migratetest: the first build fails, so the attempt is stashed and
+// the model asked again, and the second attempt builds and is committed.
+func ExampleMigrator_MigrateTarget() {
+	git := migratetest.NewFakeGitManager()
+	build := &migratetest.FakeBuildRunner{BuildErrs: []error{errors.New("ERROR: no such package '@crates//'")}}
+	llm := &migratetest.FakeLLMRunner{Git: git, CommitMessage: "Add BUILD.bazel for grep_matcher"}
+	m := migrate.New(git, build, llm, migrate.Options{})
+
+	result, err := m.MigrateTarget(context.Background(), migrate.Run{
+		WorktreePath: "worktree",
+		Model:        "openrouter/openai/gpt-5",
+		Target:       "//crates/matcher:grep_matcher",
+		BuildFile:    "crates/matcher/BUILD.bazel",
+		Log:          io.Discard,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(result.Success, result.Attempts, llm.Calls)
+	for _, c := range git.Commits["worktree"] {
+		fmt.Println(c.Message, c.Files)
+	}
+	// Output:
+	// true 2 2
+	// Add BUILD.bazel for grep_matcher [crates/matcher/BUILD.bazel]
+}
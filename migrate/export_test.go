@@ -0,0 +1,68 @@
+package migrate
+
+import (
+	"context"
+	"io"
+)
+
+// The build-edit loop's steps, exported for the tests in package
+// migrate_test, which drive them with the fakes of package migratetest.
+
+func (m *Migrator) NormalizeTarget(ctx context.Context, run Run) error {
+	return m.normalizeTarget(ctx, run)
+}
+
+func (m *Migrator) RunAiderWithRetries(ctx context.Context, run Run) error {
+	return m.runAiderWithRetries(ctx, run)
+}
+
+func (m *Migrator) RevertStrayEdits(run Run) error {
+	return m.revertStrayEdits(run)
+}
+
+// The steps of a run around the loop, likewise.
+
+var (
+	CreateGitBranchIfNotExists   = createGitBranchIfNotExists
+	CreateGitWorktreeIfNotExists = createGitWorktreeIfNotExists
+)
+
+func (m *Migrator) EvictWorktrees(repoDir string) {
+	m.evictWorktrees(repoDir)
+}
+
+func (m *Migrator) PreCheck(ctx context.Context, worktreePath, llmModel, target string, targetLog io.Writer) bool {
+	return m.preCheck(ctx, worktreePath, llmModel, target, targetLog)
+}
+
+func (m *Migrator) ProcessTarget(ctx context.Context, worktreePath, llmModel, baseCommit, target string) (Result, error) {
+	return m.processTarget(ctx, worktreePath, llmModel, baseCommit, target)
+}
+
+func (m *Migrator) BuildFromCache(ctx context.Context, run Run, key string) (string, bool, error) {
+	return m.buildFromCache(ctx, run, key)
+}
+
+func (m *Migrator) BuildFromSeed(ctx context.Context, run Run, pkg string, seed func(run Run, pkg string) (*Seed, error)) (string, bool, error) {
+	return m.buildFromSeed(ctx, run, pkg, seed)
+}
+
+func (m *Migrator) RecordChangedFiles(result *Result, worktreePath, before string) error {
+	return m.recordChangedFiles(result, worktreePath, before)
+}
+
+func (m *Migrator) CheckRuleKind(result *Result, worktreePath string) error {
+	return m.checkRuleKind(result, worktreePath)
+}
+
+func (m *Migrator) SaveInterruptedWork(worktreePath, llmModel, target string) {
+	m.saveInterruptedWork(worktreePath, llmModel, target)
+}
+
+func (m *Migrator) MigrateModel(ctx context.Context, repoDir, branch, model string, repetition int, targets []string, tracker *AttemptTracker) ([]Result, error) {
+	return m.migrateModel(ctx, repoDir, branch, model, repetition, targets, tracker)
+}
+
+func (m *Migrator) EscalateTarget(ctx context.Context, worktreePath, baseCommit, target string, models []string) (Result, error) {
+	return m.escalateTarget(ctx, worktreePath, baseCommit, target, models)
+}
@@ -0,0 +1,294 @@
+package migrate
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Branch returns the current git branch name for a given directory.
+func Branch(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	cmd.Dir = dir
+	output, err := Commands.Output(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to get git branch: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// BranchExists checks if a git branch exists.
+func BranchExists(dir, branchName string) (bool, error) {
+	cmd := exec.Command("git", "show-ref", "--verify", "--quiet", "refs/heads/"+branchName)
+	cmd.Dir = dir
+	err := Commands.Run(cmd)
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+			return false, nil // Branch does not exist
+		}
+		return false, fmt.Errorf("failed to check if branch %s exists: %w", branchName, err)
+	}
+	return true, nil // Branch exists
+}
+
+// CreateBranch creates a new git branch.
+func CreateBranch(dir, branchName string) error {
+	cmd := exec.Command("git", "branch", branchName)
+	cmd.Dir = dir
+	if err := Commands.Run(cmd); err != nil {
+		return fmt.Errorf("failed to create branch %s: %w", branchName, err)
+	}
+	return nil
+}
+
+// HeadSHA returns the full commit SHA of HEAD in dir.
+func HeadSHA(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	output, err := Commands.Output(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve HEAD in %s: %w", dir, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// CommitCount returns the number of commits in base..HEAD in dir.
+func CommitCount(dir, base string) (int, error) {
+	cmd := exec.Command("git", "rev-list", "--count", base+"..HEAD")
+	cmd.Dir = dir
+	output, err := Commands.Output(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count commits since %s: %w", base, err)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse commit count %q: %w", output, err)
+	}
+	return count, nil
+}
+
+// MergeBase returns the best common ancestor of commits a and b in dir.
+func MergeBase(dir, a, b string) (string, error) {
+	cmd := exec.Command("git", "merge-base", a, b)
+	cmd.Dir = dir
+	output, err := Commands.Output(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to find merge base of %s and %s: %w", a, b, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// CherryPick applies commitSHA on top of the branch checked out in
+// worktreePath. If the pick does not apply cleanly it is aborted so the
+// worktree is left as it was.
+func CherryPick(worktreePath, commitSHA string) error {
+	cmd := exec.Command("git", "cherry-pick", commitSHA)
+	cmd.Dir = worktreePath
+	out, err := Commands.CombinedOutput(cmd)
+	if err != nil {
+		abortCmd := exec.Command("git", "cherry-pick", "--abort")
+		abortCmd.Dir = worktreePath
+		if abortOut, abortErr := Commands.CombinedOutput(abortCmd); abortErr != nil {
+			slog.Error("git cherry-pick --abort failed", "worktree", worktreePath, "err", abortErr, "output", string(abortOut))
+		}
+		return fmt.Errorf("git cherry-pick %s failed in %s: %v\n%s", commitSHA, worktreePath, err, string(out))
+	}
+	return nil
+}
+
+// SquashCommits replaces the commits in base..HEAD with a single commit of the
+// same tree with message. It does nothing if there are no such commits.
+func SquashCommits(worktreePath, base, message string) error {
+	if base == "" {
+		return fmt.Errorf("cannot squash commits in %s without a base commit", worktreePath)
+	}
+	count, err := CommitCount(worktreePath, base)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	resetCmd := exec.Command("git", "reset", "--soft", base)
+	resetCmd.Dir = worktreePath
+	if out, err := Commands.CombinedOutput(resetCmd); err != nil {
+		return fmt.Errorf("git reset --soft %s failed in %s: %v\n%s", base, worktreePath, err, string(out))
+	}
+	commitCmd := exec.Command("git", "commit", "-q", "-m", message)
+	commitCmd.Dir = worktreePath
+	if out, err := Commands.CombinedOutput(commitCmd); err != nil {
+		return fmt.Errorf("failed to commit squashed changes in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	slog.Info("Squashed model branch", "worktree", worktreePath, "squashed", count)
+	return nil
+}
+
+// WorktreeExists checks if a git worktree exists at the given path.
+func WorktreeExists(worktreePath string) (bool, error) {
+	_, err := os.Stat(worktreePath)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check worktree existence at %s: %w", worktreePath, err)
+}
+
+// AddWorktree adds a new git worktree.
+func AddWorktree(repoDir, worktreePath, branchName string) error {
+	cmd := exec.Command("git", "worktree", "add", worktreePath, branchName)
+	cmd.Dir = repoDir
+	if err := Commands.Run(cmd); err != nil {
+		return fmt.Errorf("failed to add worktree at %s for branch %s: %w", worktreePath, branchName, err)
+	}
+	return nil
+}
+
+// RemoveWorktree removes the worktree at worktreePath from the repo at
+// repoDir, deleting its directory even if it has uncommitted changes.
+func RemoveWorktree(repoDir, worktreePath string) error {
+	cmd := exec.Command("git", "worktree", "remove", "--force", worktreePath)
+	cmd.Dir = repoDir
+	if out, err := Commands.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git worktree remove %s failed in %s: %v\n%s", worktreePath, repoDir, err, string(out))
+	}
+	return nil
+}
+
+// PruneWorktrees forgets worktrees of the repo at repoDir whose directories
+// have been removed.
+func PruneWorktrees(repoDir string) error {
+	cmd := exec.Command("git", "worktree", "prune")
+	cmd.Dir = repoDir
+	if out, err := Commands.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("git worktree prune failed in %s: %v\n%s", repoDir, err, string(out))
+	}
+	return nil
+}
+
+// ParseWorktreeList maps the paths in `git worktree list --porcelain` output
+// to the branches they have checked out, or "" for a detached HEAD.
+func ParseWorktreeList(out string) map[string]string {
+	worktrees := make(map[string]string)
+	var path string
+	for _, line := range strings.Split(out, "\n") {
+		switch key, value, _ := strings.Cut(line, " "); key {
+		case "worktree":
+			path = value
+			worktrees[path] = ""
+		case "branch":
+			worktrees[path] = strings.TrimPrefix(value, "refs/heads/")
+		}
+	}
+	return worktrees
+}
+
+// WorktreeBranch reports whether worktreePath is one of the worktrees git
+// lists for repoDir and, if so, the branch it has checked out.
+func WorktreeBranch(repoDir, worktreePath string) (string, bool, error) {
+	cmd := exec.Command("git", "worktree", "list", "--porcelain")
+	cmd.Dir = repoDir
+	out, err := Commands.Output(cmd)
+	if err != nil {
+		return "", false, fmt.Errorf("git worktree list failed in %s: %w", repoDir, err)
+	}
+	want, err := os.Stat(worktreePath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to stat worktree %s: %w", worktreePath, err)
+	}
+	// git lists absolute, symlink-free paths, so compare files rather than
+	// strings.
+	for path, branch := range ParseWorktreeList(string(out)) {
+		if info, err := os.Stat(path); err == nil && os.SameFile(info, want) {
+			return branch, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// CommonDir returns the absolute path of the git directory shared by the
+// repository at dir and all its worktrees.
+func CommonDir(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--git-common-dir")
+	cmd.Dir = dir
+	out, err := Commands.Output(cmd)
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse --git-common-dir failed in %s: %w", dir, err)
+	}
+	common := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(dir, common)
+	}
+	return common, nil
+}
+
+// sameFile reports whether paths a and b name the same existing file.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// WorktreeHealthCheck returns an error describing why the worktree at
+// worktreePath is unusable: its directory is missing, its .git file does not
+// point at a git directory, another git process holds its index lock, git
+// status fails in it, it is not a worktree of the repo at repoDir, or
+// branchName is not checked out.
+func WorktreeHealthCheck(repoDir, worktreePath, branchName string) error {
+	info, err := os.Stat(worktreePath)
+	if err != nil {
+		return fmt.Errorf("worktree directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("worktree %s is not a directory", worktreePath)
+	}
+	dotGit, err := os.ReadFile(filepath.Join(worktreePath, ".git"))
+	if err != nil {
+		return fmt.Errorf("worktree .git file: %w", err)
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(dotGit)), "gitdir: ")
+	if !ok {
+		return fmt.Errorf("worktree .git file in %s does not start with gitdir:", worktreePath)
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(worktreePath, gitDir)
+	}
+	if info, err := os.Stat(gitDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("worktree .git file in %s points at %s, which is not a git directory", worktreePath, gitDir)
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "index.lock")); err == nil {
+		return fmt.Errorf("worktree %s is locked: %s exists, so another git process may be using it", worktreePath, filepath.Join(gitDir, "index.lock"))
+	}
+	statusCmd := exec.Command("git", "status", "--porcelain")
+	statusCmd.Dir = worktreePath
+	if out, err := Commands.CombinedOutput(statusCmd); err != nil {
+		return fmt.Errorf("git status failed in %s: %v\n%s", worktreePath, err, string(out))
+	}
+	repoCommon, err := CommonDir(repoDir)
+	if err != nil {
+		return err
+	}
+	worktreeCommon, err := CommonDir(worktreePath)
+	if err != nil {
+		return err
+	}
+	if !sameFile(repoCommon, worktreeCommon) {
+		return fmt.Errorf("worktree %s belongs to the repository at %s, not %s", worktreePath, worktreeCommon, repoCommon)
+	}
+	branch, err := Branch(worktreePath)
+	if err != nil {
+		return err
+	}
+	if branch != branchName {
+		return fmt.Errorf("worktree %s has %q checked out, want %s", worktreePath, branch, branchName)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package migrate
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRepo returns a new git repository and a func running git in it,
+// skipping the test if git is not installed.
+func newTestRepo(t *testing.T) (string, func(args ...string) string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	return dir, git
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrGitNotFound(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	_, err := Branch(t.TempDir())
+	if !errors.Is(err, ErrGitNotFound) {
+		t.Errorf("Branch without git = %v, want ErrGitNotFound", err)
+	}
+}
+
+func TestParseWorktreeList(t *testing.T) {
+	out := `worktree /src/ripgrep
+HEAD 1111111111111111111111111111111111111111
+branch refs/heads/main
+
+worktree /src/worktrees/main-model
+HEAD 2222222222222222222222222222222222222222
+branch refs/heads/main-model
+
+worktree /src/worktrees/detached
+HEAD 3333333333333333333333333333333333333333
+detached
+
+`
+	got := ParseWorktreeList(out)
+	want := map[string]string{
+		"/src/ripgrep":              "main",
+		"/src/worktrees/main-model": "main-model",
+		"/src/worktrees/detached":   "",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("ParseWorktreeList = %q, want %q", got, want)
+	}
+}
+
+func TestSquashCommits(t *testing.T) {
+	dir, git := newTestRepo(t)
+	writeFile(t, filepath.Join(dir, "Cargo.toml"), "")
+	git("add", "-A")
+	git("commit", "-q", "-m", "base")
+	base := git("rev-parse", "HEAD")
+
+	if err := SquashCommits(dir, base, "bazel: migrate all targets"); err != nil {
+		t.Fatalf("SquashCommits with no commits: %v", err)
+	}
+	if head := git("rev-parse", "HEAD"); head != base {
+		t.Errorf("HEAD after squashing no commits = %s, want base %s", head, base)
+	}
+
+	for _, pkg := range []string{"crates/cli", "crates/matcher", ""} {
+		writeFile(t, filepath.Join(dir, pkg, "BUILD.bazel"), "# "+pkg+"\n")
+		git("add", "-A")
+		git("commit", "-q", "-m", "aider: build //"+pkg)
+	}
+	tree := git("rev-parse", "HEAD^{tree}")
+	if err := SquashCommits(dir, base, "bazel: migrate all targets"); err != nil {
+		t.Fatalf("SquashCommits: %v", err)
+	}
+	if count, err := CommitCount(dir, base); err != nil || count != 1 {
+		t.Errorf("commits since base = %d, %v; want 1", count, err)
+	}
+	if got := git("rev-parse", "HEAD^{tree}"); got != tree {
+		t.Errorf("squashed tree = %s, want %s", got, tree)
+	}
+	if got := git("log", "-1", "--format=%s"); got != "bazel: migrate all targets" {
+		t.Errorf("squashed commit message = %q", got)
+	}
+}
@@ -0,0 +1,168 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// absolutePathLiteral matches string literals that start with a single slash
+// (or ~/), which is an absolute filesystem path rather than a "//" label.
+var absolutePathLiteral = regexp.MustCompile(`"(/[^/"][^"]*|~/[^"]*)"`)
+
+// absoluteGlob matches glob() calls whose patterns start at the filesystem root.
+var absoluteGlob = regexp.MustCompile(`glob\(\s*\[\s*"/[^/"]`)
+
+// systemTools are commands that, when run from a genrule without tools or
+// toolchains, depend on whatever happens to be installed on the host.
+var systemTools = []string{
+	"bash", "cargo", "cc", "clang", "curl", "g++", "gcc", "git", "make",
+	"perl", "pkg-config", "python", "python3", "rustc", "wget",
+}
+
+// systemToolPattern matches any of systemTools as a standalone command word.
+var systemToolPattern = func() *regexp.Regexp {
+	quoted := make([]string, len(systemTools))
+	for i, tool := range systemTools {
+		quoted[i] = regexp.QuoteMeta(tool)
+	}
+	return regexp.MustCompile(`(?:^|[^\w./$-])(` + strings.Join(quoted, "|") + `)(?:$|[^\w.+-])`)
+}()
+
+// toolsAttr matches a tools or toolchains attribute inside a rule call.
+var toolsAttr = regexp.MustCompile(`\b(tools|toolchains)\s*=`)
+
+// lintHermeticity returns human-readable findings for constructs in a BUILD
+// file that make the build depend on host state. name is used to prefix
+// findings with their location.
+func lintHermeticity(name, content string) []string {
+	var findings []string
+	for i, line := range strings.Split(content, "\n") {
+		code := stripComment(line)
+		if absoluteGlob.MatchString(code) {
+			findings = append(findings, fmt.Sprintf("%s:%d: glob over an absolute path", name, i+1))
+			continue
+		}
+		for _, m := range absolutePathLiteral.FindAllStringSubmatch(code, -1) {
+			findings = append(findings, fmt.Sprintf("%s:%d: absolute path %q", name, i+1, m[1]))
+		}
+	}
+	for _, rule := range ruleCalls(content, "genrule") {
+		if toolsAttr.MatchString(rule.body) {
+			continue
+		}
+		for _, m := range systemToolPattern.FindAllStringSubmatch(rule.cmd, -1) {
+			findings = append(findings, fmt.Sprintf("%s:%d: genrule cmd runs host tool %q without tools or toolchains", name, rule.line, m[1]))
+		}
+	}
+	return findings
+}
+
+// stripComment returns line without its trailing comment, leaving a # inside
+// a string literal alone.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// ruleCall is a single call to a rule in a BUILD file.
+type ruleCall struct {
+	// line is the 1-based line the call starts on.
+	line int
+	// body is the text between the call's parentheses.
+	body string
+	// cmd is the value of the cmd attribute, if any.
+	cmd string
+}
+
+var cmdAttr = regexp.MustCompile(`(?s)\bcmd\s*=\s*("""(.*?)"""|"((?:[^"\\]|\\.)*)")`)
+
+// ruleCalls finds every call to kind in content by matching parentheses,
+// skipping over string literals.
+func ruleCalls(content, kind string) []ruleCall {
+	var calls []ruleCall
+	re := regexp.MustCompile(`\b` + regexp.QuoteMeta(kind) + `\s*\(`)
+	for _, loc := range re.FindAllStringIndex(content, -1) {
+		start := loc[1]
+		depth := 1
+		inString := false
+		end := len(content)
+		for i := start; i < len(content) && depth > 0; i++ {
+			switch c := content[i]; {
+			case c == '\\' && inString:
+				i++
+			case c == '"':
+				inString = !inString
+			case c == '(' && !inString:
+				depth++
+			case c == ')' && !inString:
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		call := ruleCall{
+			line: strings.Count(content[:loc[0]], "\n") + 1,
+			body: content[start:end],
+		}
+		if m := cmdAttr.FindStringSubmatch(call.body); m != nil {
+			call.cmd = m[2] + m[3]
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// changedBuildFiles returns the BUILD and BUILD.bazel files in worktreePath
+// that are modified or untracked relative to HEAD.
+func changedBuildFiles(git GitManager, worktreePath string) ([]string, error) {
+	changed, err := git.ChangedFiles(worktreePath)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, path := range changed {
+		if base := filepath.Base(path); base == "BUILD" || base == "BUILD.bazel" {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// lintChangedBuildFiles runs lintHermeticity over every changed BUILD file in
+// worktreePath.
+func lintChangedBuildFiles(git GitManager, worktreePath string) ([]string, error) {
+	files, err := changedBuildFiles(git, worktreePath)
+	if err != nil {
+		return nil, err
+	}
+	var findings []string
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(worktreePath, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // deleted
+			}
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		findings = append(findings, lintHermeticity(file, string(content))...)
+	}
+	return findings, nil
+}
@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLintHermeticity(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "labels",
+			content: "rust_library(\n    name = \"grep\",\n    srcs = glob([\"src/**/*.rs\"]),\n    deps = [\"//crates/matcher:grep_matcher\", \"@crates//:regex\"],\n)\n",
+		},
+		{
+			name:    "absolute path",
+			content: "cc_library(\n    name = \"zlib\",\n    hdrs = [\"/usr/include/zlib.h\"],\n)\n",
+			want:    []string{`BUILD.bazel:3: absolute path "/usr/include/zlib.h"`},
+		},
+		{
+			name:    "home path",
+			content: "rust_library(name = \"grep\", srcs = [\"~/src/grep/lib.rs\"])\n",
+			want:    []string{`BUILD.bazel:1: absolute path "~/src/grep/lib.rs"`},
+		},
+		{
+			name:    "absolute glob",
+			content: "rust_library(\n    name = \"grep\",\n    srcs = glob([\"/opt/ripgrep/src/**/*.rs\"]),\n)\n",
+			want:    []string{"BUILD.bazel:3: glob over an absolute path"},
+		},
+		{
+			name:    "genrule runs host tool",
+			content: "genrule(\n    name = \"gen\",\n    outs = [\"version.rs\"],\n    cmd = \"python3 gen.py > $@\",\n)\n",
+			want:    []string{`BUILD.bazel:1: genrule cmd runs host tool "python3" without tools or toolchains`},
+		},
+		{
+			name:    "genrule multiline cmd",
+			content: "genrule(\n    name = \"gen\",\n    outs = [\"out.txt\"],\n    cmd = \"\"\"\n        git describe > $@\n    \"\"\",\n)\n",
+			want:    []string{`BUILD.bazel:1: genrule cmd runs host tool "git" without tools or toolchains`},
+		},
+		{
+			name:    "genrule with tools",
+			content: "genrule(\n    name = \"gen\",\n    outs = [\"version.rs\"],\n    tools = [\"gen.py\"],\n    cmd = \"python3 $(location gen.py) > $@\",\n)\n",
+		},
+		{
+			name:    "genrule shell builtins",
+			content: "genrule(\n    name = \"gen\",\n    outs = [\"out.txt\"],\n    cmd = \"echo hi > $@\",\n)\n",
+		},
+		{
+			name:    "path in comment",
+			content: "# Was \"/usr/include/zlib.h\" before the migration.\ncc_library(name = \"zlib\")  # see \"/usr/lib\"\n",
+		},
+		{
+			name:    "hash inside string",
+			content: "cc_library(name = \"zlib#1\", hdrs = [\"/usr/include/zlib.h\"])\n",
+			want:    []string{`BUILD.bazel:1: absolute path "/usr/include/zlib.h"`},
+		},
+		{
+			name:    "hash inside single-quoted string",
+			content: "cc_library(name = 'zlib#1', srcs = glob([\"/usr/src/zlib/*.c\"]))\n",
+			want:    []string{"BUILD.bazel:1: glob over an absolute path"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lintHermeticity("BUILD.bazel", tt.content)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lintHermeticity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package migrate
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ParseTargetPackage splits a label such as //crates/cli:grep_cli into its
+// package and target name. The package of //:name is "", and a label without
+// a name, such as //crates/cli, names the target after the package's last
+// component.
+func ParseTargetPackage(target string) (pkg, name string, err error) {
+	rest, ok := strings.CutPrefix(target, "//")
+	if !ok {
+		return "", "", fmt.Errorf("malformed label %q: must start with //", target)
+	}
+	pkg, name, hasName := strings.Cut(rest, ":")
+	if !hasName {
+		name = pkg[strings.LastIndex(pkg, "/")+1:]
+	}
+	if pkg != "" {
+		for _, component := range strings.Split(pkg, "/") {
+			if component == "" || component == "." || component == ".." {
+				return "", "", fmt.Errorf("malformed label %q: invalid package %q", target, pkg)
+			}
+		}
+	}
+	if name == "" || strings.Contains(name, ":") || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return "", "", fmt.Errorf("malformed label %q: invalid target name %q", target, name)
+	}
+	return pkg, name, nil
+}
+
+// CanonicalLabel spells target as bazel query prints it, with an explicit
+// target name, or returns target unchanged if it is malformed.
+func CanonicalLabel(target string) string {
+	pkg, name, err := ParseTargetPackage(target)
+	if err != nil {
+		return target
+	}
+	return "//" + pkg + ":" + name
+}
+
+// builtTargetLabels returns the canonical labels of succeededTargets, without
+// duplicates and without target itself, for Run.BuiltTargets.
+func builtTargetLabels(target string, succeededTargets []string) []string {
+	var labels []string
+	for _, built := range succeededTargets {
+		label := CanonicalLabel(built)
+		if label == CanonicalLabel(target) || slices.Contains(labels, label) {
+			continue
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
@@ -0,0 +1,83 @@
+package migrate
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTargetPackage(t *testing.T) {
+	for _, tc := range []struct {
+		target   string
+		wantPkg  string
+		wantName string
+	}{
+		{target: "//:ripgrep", wantPkg: "", wantName: "ripgrep"},
+		{target: "//crates/cli:grep_cli", wantPkg: "crates/cli", wantName: "grep_cli"},
+		{target: "//crates/matcher:grep_matcher", wantPkg: "crates/matcher", wantName: "grep_matcher"},
+		{target: "//crates/pcre2:grep_pcre2", wantPkg: "crates/pcre2", wantName: "grep_pcre2"},
+		{target: "//crates/cli", wantPkg: "crates/cli", wantName: "cli"},
+		{target: "//crates", wantPkg: "crates", wantName: "crates"},
+		{target: "//crates/grep-regex:grep-regex", wantPkg: "crates/grep-regex", wantName: "grep-regex"},
+		{target: "//crates/grep-regex", wantPkg: "crates/grep-regex", wantName: "grep-regex"},
+		{target: "//third_party/pcre2.10:lib", wantPkg: "third_party/pcre2.10", wantName: "lib"},
+		{target: "//a.b/c-d/e_f", wantPkg: "a.b/c-d/e_f", wantName: "e_f"},
+		{target: "//crates/core:main.rs", wantPkg: "crates/core", wantName: "main.rs"},
+		{target: "//crates/core:src/main.rs", wantPkg: "crates/core", wantName: "src/main.rs"},
+		{target: "//:BUILD.bazel", wantPkg: "", wantName: "BUILD.bazel"},
+		{target: "//.github/workflows:ci", wantPkg: ".github/workflows", wantName: "ci"},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			pkg, name, err := ParseTargetPackage(tc.target)
+			if err != nil {
+				t.Fatalf("ParseTargetPackage(%q) returned error: %s", tc.target, err)
+			}
+			if pkg != tc.wantPkg || name != tc.wantName {
+				t.Fatalf("ParseTargetPackage(%q) = %q, %q, want %q, %q", tc.target, pkg, name, tc.wantPkg, tc.wantName)
+			}
+		})
+	}
+
+	for _, target := range []string{
+		"",
+		"//",
+		"//:",
+		"//crates/cli:",
+		":grep_cli",
+		"crates/cli:grep_cli",
+		"/crates/cli:grep_cli",
+		"@rules_rust//rust:defs",
+		"//crates//cli:grep_cli",
+		"//crates/cli/:grep_cli",
+		"///crates:cli",
+		"//crates/../cli:grep_cli",
+		"//./crates:cli",
+		"//crates/cli:grep:cli",
+		"//crates/cli:/grep_cli",
+	} {
+		t.Run("malformed "+target, func(t *testing.T) {
+			if pkg, name, err := ParseTargetPackage(target); err == nil {
+				t.Fatalf("ParseTargetPackage(%q) = %q, %q, want error", target, pkg, name)
+			}
+		})
+	}
+}
+
+func TestCanonicalLabel(t *testing.T) {
+	for target, want := range map[string]string{
+		"//crates/grep":      "//crates/grep:grep",
+		"//crates/grep:grep": "//crates/grep:grep",
+		"//:ripgrep":         "//:ripgrep",
+		"not-a-label":        "not-a-label",
+	} {
+		if got := CanonicalLabel(target); got != want {
+			t.Errorf("CanonicalLabel(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestBuiltTargetLabels(t *testing.T) {
+	got := builtTargetLabels("//crates/grep", []string{"//crates/matcher:grep_matcher", "//crates/globset", "//crates/grep:grep", "//crates/globset:globset"})
+	if want := []string{"//crates/matcher:grep_matcher", "//crates/globset:globset"}; !slices.Equal(got, want) {
+		t.Errorf("builtTargetLabels = %q, want %q", got, want)
+	}
+}
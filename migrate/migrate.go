@@ -0,0 +1,54 @@
+// Package migrate holds the parts of bld that do not depend on its command
+// line, so that other tools can import them: the build-edit loop, in which a
+// Migrator has a model edit BUILD files until a target builds; the run around
+// it, in which MigrateRepo gives each model its own branch and worktree and
+// has it migrate every target; and the git helpers both use.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// ErrGitNotFound is wrapped by the error of any git command run when git is
+// not on PATH, so callers can tell a missing git from a failing one.
+var ErrGitNotFound = errors.New("git not found on PATH")
+
+// CommandError returns err, the result of running cmd, wrapping
+// ErrGitNotFound if cmd is git and git could not be found.
+func CommandError(cmd *exec.Cmd, err error) error {
+	if err != nil && len(cmd.Args) > 0 && filepath.Base(cmd.Args[0]) == "git" && errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("%w: %w", ErrGitNotFound, err)
+	}
+	return err
+}
+
+// CommandRunner runs the git commands behind the package's functions.
+type CommandRunner interface {
+	Output(cmd *exec.Cmd) ([]byte, error)
+	CombinedOutput(cmd *exec.Cmd) ([]byte, error)
+	Run(cmd *exec.Cmd) error
+}
+
+// Commands runs every command the package executes. bld replaces it with a
+// runner that records each command to its -audit-log.
+var Commands CommandRunner = execRunner{}
+
+// execRunner is a CommandRunner running commands directly.
+type execRunner struct{}
+
+func (execRunner) Output(cmd *exec.Cmd) ([]byte, error) {
+	out, err := cmd.Output()
+	return out, CommandError(cmd, err)
+}
+
+func (execRunner) CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	out, err := cmd.CombinedOutput()
+	return out, CommandError(cmd, err)
+}
+
+func (execRunner) Run(cmd *exec.Cmd) error {
+	return CommandError(cmd, cmd.Run())
+}
@@ -0,0 +1,214 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+func TestBazelCleanPerModel(t *testing.T) {
+	build := &migratetest.RecordingBuildRunner{BuildRunner: &migratetest.FakeBuildRunner{}}
+	m := migrate.New(migratetest.NewFakeGitManager(), build, &migratetest.FakeLLMRunner{}, migrate.Options{WorktreeDir: t.TempDir(), LogDir: t.TempDir()})
+	if _, err := m.MigrateModel(context.Background(), t.TempDir(), "main", "test/model", 0, nil, migrate.NewAttemptTracker()); err != nil {
+		t.Fatalf("MigrateModel: %v", err)
+	}
+	if len(build.Calls) == 0 || build.Calls[0] != "clean" {
+		t.Errorf("bazel calls = %q, want a clean when the worktree is set up", build.Calls)
+	}
+}
+
+// failTargetBuildRunner is a migratetest.FakeBuildRunner whose builds of
+// target always fail.
+type failTargetBuildRunner struct {
+	*migratetest.FakeBuildRunner
+	target string
+}
+
+func (b failTargetBuildRunner) Build(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	if target == b.target {
+		return []byte("ERROR: build failed"), errors.New("exit status 1")
+	}
+	return b.FakeBuildRunner.Build(ctx, worktreePath, targetLog, target)
+}
+
+func TestCommitOnPartial(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	// Keep the failed attempts in the worktree for the partial commit.
+	opts := migrate.Options{WorktreeDir: t.TempDir(), LogDir: t.TempDir(), CommitOnPartial: true, NoStash: true}
+	m := migrate.New(git, failTargetBuildRunner{FakeBuildRunner: &migratetest.FakeBuildRunner{}, target: "//:ripgrep"}, &migratetest.FakeLLMRunner{Git: git}, opts)
+
+	results, err := m.MigrateModel(context.Background(), t.TempDir(), "main", "test/model", 0, []string{"//crates/cli", "//:ripgrep"}, migrate.NewAttemptTracker())
+	if err != nil {
+		t.Fatalf("MigrateModel: %v", err)
+	}
+	if migrate.CountSucceeded(results) != 1 {
+		t.Fatalf("results = %+v, want only //crates/cli built", results)
+	}
+	var worktreePath string
+	for path := range git.Worktrees {
+		worktreePath = path
+	}
+	commits := git.Commits[worktreePath]
+	if len(commits) == 0 || commits[len(commits)-1].Message != "partial: test/model, 1/2 targets built" {
+		t.Fatalf("commits = %+v, want a final partial commit", commits)
+	}
+	if !slices.Contains(commits[len(commits)-1].Files, "BUILD.bazel") {
+		t.Errorf("partial commit files = %q, want the failed target's BUILD.bazel", commits[len(commits)-1].Files)
+	}
+	if changed, _ := git.ChangedFiles(worktreePath); len(changed) != 0 {
+		t.Errorf("worktree left dirty: %q", changed)
+	}
+}
+
+func TestEscalateTarget(t *testing.T) {
+	errQuery := errors.New("ERROR: no such target")
+	errBuild := errors.New("ERROR: build failed")
+	tests := []struct {
+		name              string
+		buildErrs         []error
+		wantSuccess       bool
+		wantModel         string
+		wantEscalatedFrom []string
+	}{
+		{
+			name:        "cheapest model solves it",
+			wantSuccess: true,
+			wantModel:   "openrouter/cheap/model",
+		},
+		{
+			name:              "escalates once",
+			buildErrs:         slices.Repeat([]error{errBuild}, migrate.MaxAttempts),
+			wantSuccess:       true,
+			wantModel:         "openrouter/pricey/model",
+			wantEscalatedFrom: []string{"openrouter/cheap/model"},
+		},
+		{
+			name:              "no model solves it",
+			buildErrs:         slices.Repeat([]error{errBuild}, 2*migrate.MaxAttempts),
+			wantModel:         "openrouter/pricey/model",
+			wantEscalatedFrom: []string{"openrouter/cheap/model"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := migratetest.NewFakeGitManager()
+			build := &migratetest.FakeBuildRunner{BuildErrs: tt.buildErrs, QueryErrs: []error{errQuery, errQuery}}
+			m := migrate.New(git, build, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{LogDir: t.TempDir()})
+			result, err := m.EscalateTarget(context.Background(), t.TempDir(), "", "//crates/matcher:grep_matcher", []string{"cheap/model", "pricey/model"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Success != tt.wantSuccess || result.Model != tt.wantModel {
+				t.Errorf("Success, Model = %v, %q, want %v, %q", result.Success, result.Model, tt.wantSuccess, tt.wantModel)
+			}
+			if !slices.Equal(result.EscalatedFrom, tt.wantEscalatedFrom) {
+				t.Errorf("EscalatedFrom = %q, want %q", result.EscalatedFrom, tt.wantEscalatedFrom)
+			}
+		})
+	}
+}
+
+// failModelBuildRunner is a migratetest.FakeBuildRunner whose builds fail in
+// the worktrees of model.
+type failModelBuildRunner struct {
+	*migratetest.FakeBuildRunner
+	model string
+}
+
+func (b failModelBuildRunner) Build(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	if strings.Contains(filepath.Base(worktreePath), b.model) {
+		return []byte("ERROR: build failed"), errors.New("exit status 1")
+	}
+	return b.FakeBuildRunner.Build(ctx, worktreePath, targetLog, target)
+}
+
+func TestMigrateRepoSelectBest(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	opts := migrate.Options{WorktreeDir: t.TempDir(), LogDir: t.TempDir(), SelectBest: true, Concurrency: 1}
+	m := migrate.New(git, failModelBuildRunner{FakeBuildRunner: &migratetest.FakeBuildRunner{}, model: "model-a"}, &migratetest.FakeLLMRunner{Git: git}, opts)
+
+	result, err := m.MigrateRepo(context.Background(), t.TempDir(), "main", []string{"test/model-a", "test/model-b", "test/model-c"}, []string{"//crates/cli", "//crates/core", "//:ripgrep"})
+	if err != nil {
+		t.Fatalf("MigrateRepo: %v", err)
+	}
+	results, planned := result.Results, result.Planned
+	if planned != 5 {
+		t.Errorf("planned = %d, want 3 racing models plus 2 remaining targets", planned)
+	}
+	var got []string
+	for _, r := range results {
+		status := "failed"
+		if r.Success {
+			status = "ok"
+		} else if r.Skipped {
+			status = "skipped"
+		}
+		got = append(got, r.Model+" "+r.Target+" "+status)
+	}
+	want := []string{
+		"openrouter/test/model-a //crates/cli failed",
+		"openrouter/test/model-b //crates/cli ok",
+		"openrouter/test/model-c //crates/cli skipped",
+		"openrouter/test/model-b //crates/core ok",
+		"openrouter/test/model-b //:ripgrep ok",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("results = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyModels(t *testing.T) {
+	errBuild := errors.New("ERROR: version conflict in MODULE.bazel")
+	tests := []struct {
+		name     string
+		build    *migratetest.FakeBuildRunner
+		runTests bool
+		want     []bool
+	}{
+		{name: "all build", build: &migratetest.FakeBuildRunner{}, want: []bool{true, true}},
+		{name: "first model skewed", build: &migratetest.FakeBuildRunner{BuildErrs: []error{errBuild}}, want: []bool{false, true}},
+		{name: "tests fail", build: &migratetest.FakeBuildRunner{TestErr: errors.New("FAILED")}, runTests: true, want: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := migrate.NewAttemptTracker()
+			tracker.AddModel("openrouter/a/model", t.TempDir(), "")
+			tracker.AddModel("openrouter/b/model", t.TempDir(), "")
+
+			m := migrate.New(migratetest.NewFakeGitManager(), tt.build, &migratetest.FakeLLMRunner{}, migrate.Options{LogDir: t.TempDir(), RunTests: tt.runTests})
+			verifications, err := m.VerifyModels(context.Background(), tracker)
+			if err != nil {
+				t.Fatalf("VerifyModels: %v", err)
+			}
+			if len(verifications) != len(tt.want) {
+				t.Fatalf("got %d verifications, want %d", len(verifications), len(tt.want))
+			}
+			for i, v := range verifications {
+				if v.FullBuildOK != tt.want[i] || v.Tested != tt.runTests {
+					t.Errorf("%s: FullBuildOK = %v, Tested = %v; want %v, %v", v.Model, v.FullBuildOK, v.Tested, tt.want[i], tt.runTests)
+				}
+			}
+		})
+	}
+}
+
+func TestTrackExistingModels(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	git.Branches["main-openrouter-a-model"] = true
+	m := migrate.New(git, &migratetest.FakeBuildRunner{}, &migratetest.FakeLLMRunner{}, migrate.Options{WorktreeDir: t.TempDir(), Repeat: 1})
+
+	tracker, err := m.TrackExistingModels("repo", "main", []string{"a/model", "b/model"})
+	if err != nil {
+		t.Fatalf("TrackExistingModels: %v", err)
+	}
+	if got := tracker.Models(); len(got) != 1 || got[0] != "openrouter/a/model" {
+		t.Errorf("Models() = %q, want only openrouter/a/model", got)
+	}
+}
@@ -0,0 +1,480 @@
+// Package migratetest provides in-memory fakes of the git, bazel and aider
+// dependencies of a migrate.Migrator, so the build-edit loop can be tested
+// without running any of them.
+package migratetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// FakeCommit is a commit recorded by FakeGitManager.
+type FakeCommit struct {
+	SHA     string
+	Message string
+	Files   []string
+}
+
+// FakeGitManager is an in-memory migrate.GitManager. Branches, worktrees, dirty files,
+// stash entries and commit history live in maps keyed by name or worktree
+// path, so tests can drive the build-edit loop without a git binary.
+type FakeGitManager struct {
+	Branches  map[string]bool
+	Worktrees map[string]string // worktree path -> branch
+	// Unhealthy worktree paths fail HealthCheck until they are added again.
+	Unhealthy map[string]bool
+	Dirty     map[string][]string
+	// Lines is what ChangedLines reports for a dirty worktree.
+	Lines   map[string]int
+	Stashes map[string][][]string
+	Commits map[string][]FakeCommit
+	nextSHA int
+}
+
+// NewFakeGitManager returns an empty FakeGitManager.
+func NewFakeGitManager() *FakeGitManager {
+	return &FakeGitManager{
+		Branches:  make(map[string]bool),
+		Worktrees: make(map[string]string),
+		Unhealthy: make(map[string]bool),
+		Dirty:     make(map[string][]string),
+		Lines:     make(map[string]int),
+		Stashes:   make(map[string][][]string),
+		Commits:   make(map[string][]FakeCommit),
+	}
+}
+
+// Touch marks path as modified in worktreePath, as if an editor had changed it.
+func (g *FakeGitManager) Touch(worktreePath, path string) {
+	if !slices.Contains(g.Dirty[worktreePath], path) {
+		g.Dirty[worktreePath] = append(g.Dirty[worktreePath], path)
+	}
+}
+
+func (g *FakeGitManager) BranchExists(dir, branchName string) (bool, error) {
+	return g.Branches[branchName], nil
+}
+
+func (g *FakeGitManager) CreateBranch(dir, branchName string) error {
+	if g.Branches[branchName] {
+		return fmt.Errorf("branch %s already exists", branchName)
+	}
+	g.Branches[branchName] = true
+	return nil
+}
+
+// AddWorktree records the worktree and creates its directory, without running
+// git.
+func (g *FakeGitManager) WorktreeBranch(repoDir, worktreePath string) (string, bool, error) {
+	branch, ok := g.Worktrees[worktreePath]
+	return branch, ok, nil
+}
+
+// PruneWorktrees forgets worktrees whose directories no longer exist.
+func (g *FakeGitManager) PruneWorktrees(repoDir string) error {
+	for path := range g.Worktrees {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(g.Worktrees, path)
+		}
+	}
+	return nil
+}
+
+func (g *FakeGitManager) AddWorktree(repoDir, worktreePath, branchName string) error {
+	if !g.Branches[branchName] {
+		return fmt.Errorf("branch %s does not exist", branchName)
+	}
+	if _, ok := g.Worktrees[worktreePath]; ok {
+		return fmt.Errorf("worktree %s already exists", worktreePath)
+	}
+	if err := os.MkdirAll(worktreePath, 0755); err != nil {
+		return err
+	}
+	g.Worktrees[worktreePath] = branchName
+	delete(g.Unhealthy, worktreePath)
+	return nil
+}
+
+func (g *FakeGitManager) HealthCheck(repoDir, worktreePath, branchName string) error {
+	if g.Unhealthy[worktreePath] {
+		return fmt.Errorf("worktree %s is unhealthy", worktreePath)
+	}
+	if branch := g.Worktrees[worktreePath]; branch != branchName {
+		return fmt.Errorf("worktree %s has %q checked out, want %s", worktreePath, branch, branchName)
+	}
+	return nil
+}
+
+func (g *FakeGitManager) ChangedFiles(worktreePath string) ([]string, error) {
+	return slices.Clone(g.Dirty[worktreePath]), nil
+}
+
+func (g *FakeGitManager) ChangedLines(worktreePath string) (int, error) {
+	if len(g.Dirty[worktreePath]) == 0 {
+		return 0, nil
+	}
+	return g.Lines[worktreePath], nil
+}
+
+func (g *FakeGitManager) StashAll(worktreePath string) (bool, error) {
+	if len(g.Dirty[worktreePath]) == 0 {
+		return false, nil
+	}
+	g.Stashes[worktreePath] = append(g.Stashes[worktreePath], g.Dirty[worktreePath])
+	delete(g.Dirty, worktreePath)
+	return true, nil
+}
+
+// StashDiff returns a stand-in patch naming the files in the latest stash.
+func (g *FakeGitManager) StashDiff(worktreePath string) (string, error) {
+	stashes := g.Stashes[worktreePath]
+	if len(stashes) == 0 {
+		return "", fmt.Errorf("no stash entries in %s", worktreePath)
+	}
+	var b strings.Builder
+	for _, path := range stashes[len(stashes)-1] {
+		fmt.Fprintf(&b, "diff --git a/%s b/%s\n+changed\n", path, path)
+	}
+	return b.String(), nil
+}
+
+func (g *FakeGitManager) StashPop(worktreePath string) error {
+	stashes := g.Stashes[worktreePath]
+	if len(stashes) == 0 {
+		return fmt.Errorf("no stash entries in %s", worktreePath)
+	}
+	for _, path := range stashes[len(stashes)-1] {
+		g.Touch(worktreePath, path)
+	}
+	g.Stashes[worktreePath] = stashes[:len(stashes)-1]
+	return nil
+}
+
+func (g *FakeGitManager) StashDrop(worktreePath string, index int) error {
+	stashes := g.Stashes[worktreePath]
+	if index < 0 || index >= len(stashes) {
+		return fmt.Errorf("no stash entry %d in %s", index, worktreePath)
+	}
+	g.Stashes[worktreePath] = slices.Delete(stashes, len(stashes)-1-index, len(stashes)-index)
+	return nil
+}
+
+func (g *FakeGitManager) StageAll(worktreePath string) (bool, error) {
+	return len(g.Dirty[worktreePath]) > 0, nil
+}
+
+func (g *FakeGitManager) DiffStat(worktreePath string) (string, error) {
+	var b strings.Builder
+	for _, path := range g.Dirty[worktreePath] {
+		fmt.Fprintf(&b, " %s | 1 +\n", path)
+	}
+	return b.String(), nil
+}
+
+func (g *FakeGitManager) Commit(worktreePath, message string) error {
+	if len(g.Dirty[worktreePath]) == 0 {
+		return fmt.Errorf("nothing to commit in %s", worktreePath)
+	}
+	g.nextSHA++
+	g.Commits[worktreePath] = append(g.Commits[worktreePath], FakeCommit{
+		SHA:     fmt.Sprintf("%040x", g.nextSHA),
+		Message: message,
+		Files:   g.Dirty[worktreePath],
+	})
+	delete(g.Dirty, worktreePath)
+	return nil
+}
+
+// RevertHead records a commit undoing the last one, touching the same files.
+func (g *FakeGitManager) RevertHead(worktreePath string) error {
+	commits := g.Commits[worktreePath]
+	if len(commits) == 0 {
+		return fmt.Errorf("no commits in %s", worktreePath)
+	}
+	head := commits[len(commits)-1]
+	g.nextSHA++
+	g.Commits[worktreePath] = append(commits, FakeCommit{
+		SHA:     fmt.Sprintf("%040x", g.nextSHA),
+		Message: "Revert \"" + strings.SplitN(head.Message, "\n", 2)[0] + "\"",
+		Files:   head.Files,
+	})
+	return nil
+}
+
+// ResetSoft drops the commits after commit, marking their files as modified
+// again.
+func (g *FakeGitManager) ResetSoft(worktreePath, commit string) error {
+	commits := g.Commits[worktreePath]
+	i := slices.IndexFunc(commits, func(c FakeCommit) bool { return c.SHA == commit })
+	if i == -1 {
+		return fmt.Errorf("no commit %s in %s", commit, worktreePath)
+	}
+	for _, c := range commits[i+1:] {
+		for _, path := range c.Files {
+			g.Touch(worktreePath, path)
+		}
+	}
+	g.Commits[worktreePath] = commits[:i+1]
+	return nil
+}
+
+// SquashOldest replaces the oldest commits after base with a single commit
+// touching all their files, so that at most maxCommits remain.
+func (g *FakeGitManager) SquashOldest(worktreePath, base string, maxCommits int) error {
+	commits := g.Commits[worktreePath]
+	i := slices.IndexFunc(commits, func(c FakeCommit) bool { return c.SHA == base })
+	if i == -1 {
+		return fmt.Errorf("no commit %s in %s", base, worktreePath)
+	}
+	since := commits[i+1:]
+	if len(since) <= maxCommits {
+		return nil
+	}
+	squashCount := len(since) - maxCommits + 1
+	var files []string
+	var subjects strings.Builder
+	for _, c := range since[:squashCount] {
+		for _, f := range c.Files {
+			if !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		fmt.Fprintf(&subjects, "- %s\n", subject)
+	}
+	g.nextSHA++
+	squashed := FakeCommit{
+		SHA:     fmt.Sprintf("%040x", g.nextSHA),
+		Message: fmt.Sprintf("aider: squash %d earlier commits\n\n%s", squashCount, subjects.String()),
+		Files:   files,
+	}
+	g.Commits[worktreePath] = append(append(commits[:i+1:i+1], squashed), since[squashCount:]...)
+	return nil
+}
+
+func (g *FakeGitManager) HeadSHA(dir string) (string, error) {
+	commits := g.Commits[dir]
+	if len(commits) == 0 {
+		return "", fmt.Errorf("no commits in %s", dir)
+	}
+	return commits[len(commits)-1].SHA, nil
+}
+
+func (g *FakeGitManager) Revert(worktreePath string, paths []string) error {
+	g.Dirty[worktreePath] = slices.DeleteFunc(g.Dirty[worktreePath], func(p string) bool {
+		return slices.Contains(paths, p)
+	})
+	return nil
+}
+
+// DiffNames returns the files of the commits after from, up to and including
+// to.
+func (g *FakeGitManager) DiffNames(dir, from, to string) ([]string, error) {
+	var files []string
+	in := false
+	for _, c := range g.Commits[dir] {
+		if in {
+			for _, f := range c.Files {
+				if !slices.Contains(files, f) {
+					files = append(files, f)
+				}
+			}
+		}
+		if c.SHA == from {
+			in = true
+		}
+		if c.SHA == to {
+			return files, nil
+		}
+	}
+	return nil, fmt.Errorf("no commits %s..%s in %s", from, to, dir)
+}
+
+// FakeBuildRunner is a migrate.BuildRunner whose builds and queries fail with
+// BuildErrs and QueryErrs in order and succeed once they are used up. Tests
+// fail with TestErr; CheckSyntax and Buildozer call CheckSyntaxFunc and
+// BuildozerFunc if they are set.
+type FakeBuildRunner struct {
+	BuildErrs []error
+	QueryErrs []error
+	// CleanBuildErrs are returned, in turn, by CleanBuild.
+	CleanBuildErrs  []error
+	Builds          int
+	CleanBuilds     int
+	TestErr         error
+	CheckSyntaxFunc func(name, content string) error
+	BuildozerFunc   func(worktreePath string, commands []string, target string) error
+	// Kind is returned by RuleKind; it defaults to rust_library.
+	Kind string
+}
+
+func (b *FakeBuildRunner) Query(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	if len(b.QueryErrs) == 0 {
+		return nil, nil
+	}
+	err := b.QueryErrs[0]
+	b.QueryErrs = b.QueryErrs[1:]
+	return []byte(err.Error()), err
+}
+
+func (b *FakeBuildRunner) Clean(worktreePath string, expunge bool) error {
+	return nil
+}
+
+func (b *FakeBuildRunner) Shutdown(worktreePath string) error {
+	return nil
+}
+
+func (b *FakeBuildRunner) Sync(worktreePath string) error {
+	return nil
+}
+
+func (b *FakeBuildRunner) Build(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	b.Builds++
+	if len(b.BuildErrs) == 0 {
+		return nil, nil
+	}
+	err := b.BuildErrs[0]
+	b.BuildErrs = b.BuildErrs[1:]
+	return []byte(err.Error()), err
+}
+
+func (b *FakeBuildRunner) CleanBuild(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	b.CleanBuilds++
+	if len(b.CleanBuildErrs) == 0 {
+		return nil, nil
+	}
+	err := b.CleanBuildErrs[0]
+	b.CleanBuildErrs = b.CleanBuildErrs[1:]
+	return []byte(err.Error()), err
+}
+
+func (b *FakeBuildRunner) Test(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	if b.TestErr != nil {
+		return []byte(b.TestErr.Error()), b.TestErr
+	}
+	return nil, nil
+}
+
+func (b *FakeBuildRunner) RuleKind(worktreePath, target string) (string, error) {
+	if b.Kind != "" {
+		return b.Kind, nil
+	}
+	return "rust_library", nil
+}
+
+func (b *FakeBuildRunner) CheckSyntax(name, content string) error {
+	if b.CheckSyntaxFunc == nil {
+		return nil
+	}
+	return b.CheckSyntaxFunc(name, content)
+}
+
+func (b *FakeBuildRunner) Buildozer(ctx context.Context, worktreePath string, targetLog io.Writer, commands []string, target string) error {
+	if b.BuildozerFunc == nil {
+		return nil
+	}
+	return b.BuildozerFunc(worktreePath, commands, target)
+}
+
+// RecordingBuildRunner wraps a migrate.BuildRunner and records each bazel command it
+// is asked to run, e.g. "query //:ripgrep" or "clean --expunge".
+type RecordingBuildRunner struct {
+	migrate.BuildRunner
+	Calls []string
+}
+
+func (r *RecordingBuildRunner) record(call string) {
+	r.Calls = append(r.Calls, call)
+}
+
+func (r *RecordingBuildRunner) Query(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	r.record("query " + target)
+	return r.BuildRunner.Query(ctx, worktreePath, targetLog, target)
+}
+
+func (r *RecordingBuildRunner) Build(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	r.record("build " + target)
+	return r.BuildRunner.Build(ctx, worktreePath, targetLog, target)
+}
+
+func (r *RecordingBuildRunner) CleanBuild(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	r.record("clean build " + target)
+	return r.BuildRunner.CleanBuild(ctx, worktreePath, targetLog, target)
+}
+
+func (r *RecordingBuildRunner) Test(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error) {
+	r.record("test " + target)
+	return r.BuildRunner.Test(ctx, worktreePath, targetLog, target)
+}
+
+func (r *RecordingBuildRunner) Clean(worktreePath string, expunge bool) error {
+	if expunge {
+		r.record("clean --expunge")
+	} else {
+		r.record("clean")
+	}
+	return r.BuildRunner.Clean(worktreePath, expunge)
+}
+
+func (r *RecordingBuildRunner) Shutdown(worktreePath string) error {
+	r.record("shutdown")
+	return r.BuildRunner.Shutdown(worktreePath)
+}
+
+func (r *RecordingBuildRunner) Sync(worktreePath string) error {
+	r.record("sync")
+	return r.BuildRunner.Sync(worktreePath)
+}
+
+// FakeLLMRunner is a migrate.LLMRunner that marks run.BuildFile as changed in
+// Git instead of invoking aider. If Edit is set it is called first, e.g. to
+// write the file to disk.
+type FakeLLMRunner struct {
+	Git         *FakeGitManager
+	Edit        func(run migrate.Run) error
+	Calls       int
+	EditFormats []string
+	// CommitMessage, if set, is the message CommitAll commits with; if
+	// empty, CommitAll fails as if aider were unavailable.
+	CommitMessage string
+	// FailOutputs are returned, with an error, by the first calls to
+	// RunAider, as if the provider had failed.
+	FailOutputs []string
+	// AutoCommit commits each edit, as aider does unless told not to.
+	AutoCommit bool
+}
+
+func (l *FakeLLMRunner) RunAider(ctx context.Context, run migrate.Run) (string, error) {
+	l.Calls++
+	if len(l.FailOutputs) > 0 {
+		output := l.FailOutputs[0]
+		l.FailOutputs = l.FailOutputs[1:]
+		return output, errors.New("exit status 1")
+	}
+	l.EditFormats = append(l.EditFormats, run.EditFormat)
+	if l.Edit != nil {
+		if err := l.Edit(run); err != nil {
+			return "", err
+		}
+	}
+	l.Git.Touch(run.WorktreePath, run.BuildFile)
+	if l.AutoCommit {
+		return "", l.Git.Commit(run.WorktreePath, "aider: edit "+run.BuildFile)
+	}
+	return "", nil
+}
+
+func (l *FakeLLMRunner) CommitAll(worktreePath, model string) error {
+	if l.CommitMessage == "" {
+		return errors.New("aider not available")
+	}
+	return l.Git.Commit(worktreePath, l.CommitMessage)
+}
@@ -0,0 +1,929 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxAttempts is the number of aider/bazel rounds spent on a target
+	// whose Run does not set its own limit.
+	MaxAttempts = 5
+	// maxTransientRetries is how many times a single attempt is retried when
+	// aider fails because of the model provider rather than the build.
+	maxTransientRetries = 3
+	// transientRetryDelay is the default Options.TransientRetryDelay.
+	transientRetryDelay = 30 * time.Second
+)
+
+// ErrProviderUnavailable is returned when aider keeps failing with transient
+// provider errors (rate limits, 5xx responses) for a model.
+var ErrProviderUnavailable = errors.New("model provider unavailable")
+
+// WorktreeError is returned when git or the file system fails the build-edit
+// loop part way through an attempt, leaving the worktree in a state the loop
+// cannot recover from. Op describes what the loop was doing.
+type WorktreeError struct {
+	Op           string
+	WorktreePath string
+	Err          error
+}
+
+func (e *WorktreeError) Error() string {
+	return fmt.Sprintf("%s in %s: %v", e.Op, e.WorktreePath, e.Err)
+}
+
+func (e *WorktreeError) Unwrap() error {
+	return e.Err
+}
+
+// Result records the outcome of migrating one target with one model.
+type Result struct {
+	// Repo identifies the repository when the run migrates several, and is
+	// empty for the repository in the current directory.
+	Repo     string `json:"repo,omitempty"`
+	Model    string `json:"model"`
+	Target   string `json:"target"`
+	Success  bool   `json:"success"`
+	Attempts int    `json:"attempts"`
+	// FallbackModel is set when the primary model was unavailable and the
+	// target was handed to bld's -fallback-model instead.
+	FallbackModel string `json:"fallbackModel,omitempty"`
+	// Skipped is set when the target was never attempted because the model's
+	// circuit breaker had tripped.
+	Skipped bool `json:"skipped,omitempty"`
+	// CommitSHA is the commit that landed the working BUILD changes, if any
+	// changes were needed.
+	CommitSHA string `json:"commitSHA,omitempty"`
+	// EditFormat is the aider edit format of the last attempt, if aider ran.
+	EditFormat string `json:"editFormat,omitempty"`
+	// ChangedFiles lists the paths the model changed to build the target.
+	ChangedFiles []string `json:"changedFiles,omitempty"`
+	// OutsidePackage lists the ChangedFiles outside the target's package,
+	// which may mean the model overreached.
+	OutsidePackage []string `json:"outsidePackage,omitempty"`
+	// EscalatedFrom lists, with bld's -escalate, the models that failed the
+	// target before Model was tried.
+	EscalatedFrom []string `json:"escalatedFrom,omitempty"`
+	// Kind is the rule kind of the built target, and WrongKind is set when
+	// it is not the kind configured for the target. A wrong kind does not fail
+	// the target.
+	Kind      string `json:"kind,omitempty"`
+	WrongKind bool   `json:"wrongKind,omitempty"`
+	// Repetition is the 1-based repetition number when running with
+	// bld's -repeat, and zero otherwise.
+	Repetition int `json:"repetition,omitempty"`
+	// OversizedAttempts counts the attempts rejected for changing more than
+	// Options.MaxDiffLines lines.
+	OversizedAttempts int `json:"oversizedAttempts,omitempty"`
+	// HermeticFindings lists constructs in the changed BUILD files that
+	// depend on the host machine.
+	HermeticFindings []string `json:"hermeticFindings,omitempty"`
+	// Duration is how long the target took, encoded in nanoseconds.
+	Duration time.Duration `json:"duration,omitempty"`
+	// AiderDuration and BazelDuration are the parts of Duration spent in
+	// aider and in the build-edit loop's bazel queries and builds.
+	AiderDuration time.Duration `json:"aiderDuration,omitempty"`
+	BazelDuration time.Duration `json:"bazelDuration,omitempty"`
+}
+
+// GitManager is the set of git operations the build-edit loop performs on the
+// repository and its worktrees. bld runs real git commands; tests substitute
+// the in-memory fake in package migratetest.
+type GitManager interface {
+	BranchExists(dir, branchName string) (bool, error)
+	CreateBranch(dir, branchName string) error
+	AddWorktree(repoDir, worktreePath, branchName string) error
+	// WorktreeBranch reports whether worktreePath is registered as a
+	// worktree of the repo at repoDir and, if so, the branch it has checked
+	// out, or "" if its HEAD is detached.
+	WorktreeBranch(repoDir, worktreePath string) (branch string, registered bool, err error)
+	// PruneWorktrees forgets worktrees whose directories have been removed.
+	PruneWorktrees(repoDir string) error
+	// HealthCheck returns an error if the worktree at worktreePath is not
+	// usable with branchName checked out.
+	HealthCheck(repoDir, worktreePath, branchName string) error
+	// ChangedFiles returns the paths in worktreePath that are modified or
+	// untracked relative to HEAD.
+	ChangedFiles(worktreePath string) ([]string, error)
+	// ChangedLines returns how many lines in worktreePath differ from HEAD,
+	// untracked files included.
+	ChangedLines(worktreePath string) (int, error)
+	// StashAll stashes tracked and untracked changes, leaving the worktree
+	// clean, and reports whether there was anything to stash.
+	StashAll(worktreePath string) (bool, error)
+	// StashPop restores the most recently stashed changes.
+	StashPop(worktreePath string) error
+	// StashDrop deletes the stash entry at index, 0 being the most recent.
+	StashDrop(worktreePath string, index int) error
+	// StashDiff returns the most recently stashed changes as a patch.
+	StashDiff(worktreePath string) (string, error)
+	// StageAll stages every change and reports whether anything is staged.
+	StageAll(worktreePath string) (bool, error)
+	// DiffStat returns a diffstat of the staged changes.
+	DiffStat(worktreePath string) (string, error)
+	Commit(worktreePath, message string) error
+	// RevertHead commits the inverse of HEAD, restoring the tree before it.
+	RevertHead(worktreePath string) error
+	// ResetSoft moves HEAD back to commit, leaving the changes of the
+	// commits after it staged.
+	ResetSoft(worktreePath, commit string) error
+	// SquashOldest squashes the oldest commits in base..HEAD into one so
+	// that at most maxCommits remain, replaying the newer ones on top of it.
+	SquashOldest(worktreePath, base string, maxCommits int) error
+	HeadSHA(dir string) (string, error)
+	// DiffNames returns the paths that differ between commits from and to.
+	DiffNames(dir, from, to string) ([]string, error)
+	// Revert discards changes to paths, restoring the files in HEAD from it
+	// and deleting the others, staged or not.
+	Revert(worktreePath string, paths []string) error
+}
+
+// BuildRunner runs the bazel commands the build-edit loop depends on.
+type BuildRunner interface {
+	Query(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error)
+	Build(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error)
+	// CleanBuild builds target from source: after a bazel clean, and
+	// without accepting remote or disk cache hits.
+	CleanBuild(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error)
+	RuleKind(worktreePath, target string) (string, error)
+	// CheckSyntax reports whether content, the BUILD file at name, parses.
+	CheckSyntax(name, content string) error
+	// Buildozer applies buildozer commands to target.
+	Buildozer(ctx context.Context, worktreePath string, targetLog io.Writer, commands []string, target string) error
+	Test(ctx context.Context, worktreePath string, targetLog io.Writer, target string) ([]byte, error)
+	// Clean discards bazel's outputs, and with expunge its whole output
+	// base.
+	Clean(worktreePath string, expunge bool) error
+	// Shutdown stops the bazel server.
+	Shutdown(worktreePath string) error
+	// Sync fetches external dependencies and refreshes the lockfile.
+	Sync(worktreePath string) error
+}
+
+// Run holds what the build-edit loop needs to migrate one target with one
+// model in that model's worktree.
+type Run struct {
+	WorktreePath string
+	Model        string
+	Target       string
+	// BuildFile is the target's BUILD.bazel path relative to WorktreePath.
+	BuildFile string
+	// BaseCommit is the commit the model branch was forked from.
+	BaseCommit string
+	// Log receives aider and bazel output for this model/target.
+	Log io.Writer
+	// EditFormat is the aider --edit-format to use.
+	EditFormat string
+	// ReadFiles are extra files passed to aider as read-only context.
+	ReadFiles []string
+	// Feedback, when set, is appended to the aider message to explain why
+	// the previous attempt was rejected.
+	Feedback string
+	// PreviousAttempt, with Options.IncludeStashInContext, is the stashed
+	// diff of the attempt before this one.
+	PreviousAttempt string
+	// Examples are the BUILD files of targets that already built in the
+	// worktree, for the prompt.
+	Examples string
+	// BuiltTargets are the labels of the targets that already built in the
+	// worktree, for the prompt.
+	BuiltTargets []string
+	// ChatHistoryFile, when set, is the model's aider chat history, restored
+	// at the start of each invocation.
+	ChatHistoryFile string
+	// MaxAttempts, when set, overrides the package MaxAttempts for this
+	// target.
+	MaxAttempts int
+}
+
+// attemptLimit returns the number of build-edit attempts run may use.
+func (run Run) attemptLimit() int {
+	if run.MaxAttempts > 0 {
+		return run.MaxAttempts
+	}
+	return MaxAttempts
+}
+
+// LLMRunner invokes the coding assistant for one build-edit attempt and
+// returns its output.
+type LLMRunner interface {
+	RunAider(ctx context.Context, run Run) (string, error)
+	// CommitAll commits every pending change in worktreePath with a message
+	// written by model.
+	CommitAll(worktreePath, model string) error
+}
+
+// Options configures the optional checks and policies of a Migrator. The zero
+// value accepts any attempt that builds and stashes the ones that do not.
+type Options struct {
+	// MaxDiffLines, if positive, rejects attempts that change more lines.
+	MaxDiffLines int
+	// StrictBazelOnly reverts changes to files other than BUILD.bazel,
+	// MODULE.bazel and MODULE.bazel.lock before building.
+	StrictBazelOnly bool
+	// VerifyCleanBuild rejects attempts that do not also build after a
+	// bazel clean.
+	VerifyCleanBuild bool
+	// RequireHermetic rejects attempts whose BUILD files depend on the host
+	// machine, rather than only reporting them.
+	RequireHermetic bool
+	// BuildozerCommands are applied to each target once it builds.
+	BuildozerCommands []string
+	// CommitEveryAttempt commits each failed attempt and then reverts it,
+	// instead of stashing it.
+	CommitEveryAttempt bool
+	// NoStash leaves failed attempts in the worktree.
+	NoStash bool
+	// IncludeStashInContext passes the diff of each stashed attempt to the
+	// next one in Run.PreviousAttempt.
+	IncludeStashInContext bool
+	// CommitLockfile keeps bazel's changes to MODULE.bazel.lock files in
+	// commits.
+	CommitLockfile bool
+	// MaxCommits, if positive, squashes the oldest commits since
+	// Run.BaseCommit so that no more than MaxCommits remain.
+	MaxCommits int
+	// BazelExpungeOnCrash expunges bazel's output base, as well as
+	// restarting its server, when the server crashes.
+	BazelExpungeOnCrash bool
+	// RateLimitMaxWait is how long, in total, an attempt waits out the
+	// provider's rate limits before giving up.
+	RateLimitMaxWait time.Duration
+	// TransientRetryDelay is the delay before the first retry of an attempt
+	// that hit a transient provider error; each further retry waits that
+	// much longer. Zero means transientRetryDelay.
+	TransientRetryDelay time.Duration
+	// PastDeadline, if set, is asked before each attempt, target and model
+	// whether the run should stop starting new work.
+	PastDeadline func() bool
+	// Emit, if set, is sent the attempt, bazel_build and commit events of
+	// the build-edit loop and, from MigrateRepo, the model_start,
+	// target_start, target_done and model_done events.
+	Emit func(Event)
+	// AiderOutput, if set, is called with the output of every aider run,
+	// e.g. to count the tokens it used.
+	AiderOutput func(run Run, output string)
+
+	// The options below configure MigrateRepo and the steps it takes around
+	// the build-edit loop.
+
+	// Repo namespaces the branches, logs and results of the repository
+	// being migrated when a run migrates several, and is empty otherwise.
+	Repo string
+	// WorktreeDir is the directory the model worktrees are checked out in.
+	WorktreeDir string
+	// LogDir is the directory the model/target logs are written under, in
+	// a subdirectory for Repo.
+	LogDir string
+	// BranchPrefix goes before the model in the name of each model branch.
+	BranchPrefix string
+	// EditFormat, if set, returns the aider edit format for a model, which
+	// is otherwise diff.
+	EditFormat func(model string) string
+	// FallbackModel, if set, is given a target whose model's provider is
+	// unavailable.
+	FallbackModel string
+	// NoChatHistory starts each aider invocation without the model's chat
+	// history from earlier targets.
+	NoChatHistory bool
+	// NoBuildExamples leaves the BUILD files of the targets that already
+	// built out of the prompt.
+	NoBuildExamples bool
+	// BazelCleanOnQueryFail cleans bazel's outputs when a target's pre-check
+	// query fails.
+	BazelCleanOnQueryFail bool
+	// MaxAttemptsFor, if set, returns the Run.MaxAttempts for target.
+	MaxAttemptsFor func(worktreePath, target string) int
+	// Cache, if set, is tried for a BUILD file before Seeds, and is given
+	// every BUILD file the build-edit loop gets to build.
+	Cache BuildFileCache
+	// Seeds are tried in order before the build-edit loop; the first BUILD
+	// file that builds is committed without running aider. A seed returns
+	// nil if it has nothing for the target in package pkg.
+	Seeds []func(run Run, pkg string) (*Seed, error)
+	// ReadFiles, if set, returns the Run.ReadFiles for run, in package pkg.
+	ReadFiles func(run Run, pkg string) ([]string, error)
+	// ExpectedKind, if set, returns the rule kind target should build as,
+	// or "" for any. A target of another kind is flagged in its Result.
+	ExpectedKind func(target string) string
+	// OverBudget, if set, is asked before each target and model whether the
+	// run has spent its budget.
+	OverBudget func() bool
+	// Interrupted, if set, reports whether the run was interrupted, in
+	// which case the changes the current target left are stashed.
+	Interrupted func() bool
+	// MinFreeBytes, if positive, is the disk space a worktree needs before
+	// it is set up; below twice that, each target logs a warning.
+	MinFreeBytes int64
+	// MaxBazelCacheBytes, if positive, bounds the bazel output of the
+	// worktrees: the least recently used are removed before each model to
+	// stay under it.
+	MaxBazelCacheBytes int64
+	// CircuitBreakerThreshold, if positive, skips a model's remaining
+	// targets after that many consecutive failures.
+	CircuitBreakerThreshold int
+	// KeepGoing moves on to a model's next target after one fails.
+	KeepGoing bool
+	// CommitOnPartial commits what a model left behind once its targets
+	// ran.
+	CommitOnPartial bool
+	// SquashCommits squashes the branch of a model that built every target
+	// into one commit.
+	SquashCommits bool
+	// Repeat, if above one, runs each model that many times, each
+	// repetition on its own branch.
+	Repeat int
+	// BestOfN runs every model on the first target and only the best
+	// BestOfNKeep of them on the rest.
+	BestOfN     bool
+	BestOfNKeep int
+	// Escalate gives each target to the models in turn, in a single
+	// worktree, until one builds it.
+	Escalate bool
+	// SelectBest races the models on the first target, Concurrency at a
+	// time, and runs only the winner on the rest.
+	SelectBest  bool
+	Concurrency int
+	// CherryPickFromBest copies each target's first successful commit onto
+	// the branches of the models that did not build it.
+	CherryPickFromBest bool
+	// RunTests also runs bazel test //... when each model's worktree is
+	// built as a whole.
+	RunTests bool
+}
+
+// Migrator drives the build-edit loop, and runs it over the models and
+// targets of a repository. Its git, bazel and aider dependencies are
+// interfaces so tests can run it against fakes.
+type Migrator struct {
+	git   GitManager
+	build BuildRunner
+	llm   LLMRunner
+	opts  Options
+	// stashed records, per worktree path, whether the latest stash entry
+	// holds a failed attempt at the target being migrated there.
+	stashed map[string]bool
+	// succeeded lists, per worktree path, the targets that built there, in
+	// order.
+	succeeded map[string][]string
+}
+
+// New returns a Migrator using the given dependencies and options.
+func New(git GitManager, build BuildRunner, llm LLMRunner, opts Options) *Migrator {
+	return &Migrator{git: git, build: build, llm: llm, opts: opts, stashed: make(map[string]bool), succeeded: make(map[string][]string)}
+}
+
+// emit sends ev to Options.Emit, if set.
+func (m *Migrator) emit(ev Event) {
+	if m.opts.Emit != nil {
+		m.opts.Emit(ev)
+	}
+}
+
+// pastDeadline reports whether Options.PastDeadline says to stop.
+func (m *Migrator) pastDeadline() bool {
+	return m.opts.PastDeadline != nil && m.opts.PastDeadline()
+}
+
+// runAiderWithRetries runs aider, retrying with a growing delay when it fails
+// with a transient provider error. Rate limits are waited out for as long as
+// the response asks, up to Options.RateLimitMaxWait in total, without using up a
+// retry. It returns an error wrapping ErrProviderUnavailable once the retries
+// or the wait are used up.
+func (m *Migrator) runAiderWithRetries(ctx context.Context, run Run) error {
+	var rateLimitWait time.Duration
+	for retry := 0; ; {
+		output, err := m.llm.RunAider(ctx, run)
+		if m.opts.AiderOutput != nil {
+			m.opts.AiderOutput(run, output)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("aider interrupted for model %s target %s: %w", run.Model, run.Target, ctx.Err())
+		}
+		if limited, wait := detectRateLimit([]byte(output)); limited {
+			if rateLimitWait+wait > m.opts.RateLimitMaxWait {
+				return fmt.Errorf("aider rate limited for model %s target %s after waiting %v: %w: %w", run.Model, run.Target, rateLimitWait, ErrProviderUnavailable, err)
+			}
+			rateLimitWait += wait
+			slog.Warn("Rate limited by provider, waiting", "model", run.Model, "target", run.Target, "wait", wait, "totalWait", rateLimitWait, "maxWait", m.opts.RateLimitMaxWait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return fmt.Errorf("aider interrupted for model %s target %s: %w", run.Model, run.Target, ctx.Err())
+			}
+			continue
+		}
+		// A hung aider is usually stuck on the provider, so a timeout is
+		// retried like a provider error.
+		if !isTransientProviderError(output) && !errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("aider failed for model %s target %s: %w", run.Model, run.Target, err)
+		}
+		if retry >= maxTransientRetries {
+			return fmt.Errorf("aider failed for model %s target %s after %d retries: %w: %w", run.Model, run.Target, retry, ErrProviderUnavailable, err)
+		}
+		retry++
+		delay := transientRetryDelay
+		if m.opts.TransientRetryDelay > 0 {
+			delay = m.opts.TransientRetryDelay
+		}
+		delay *= time.Duration(retry)
+		slog.Warn("Transient provider error, retrying", "model", run.Model, "target", run.Target, "delay", delay, "retry", retry, "maxRetries", maxTransientRetries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("aider interrupted for model %s target %s: %w", run.Model, run.Target, ctx.Err())
+		}
+	}
+}
+
+// runAttempt runs aider for one attempt and turns any commits it made back
+// into staged changes. aider is told not to commit, but the checks after an
+// attempt, and setting it aside when it fails, see only uncommitted changes,
+// so an attempt aider committed anyway would slip past them.
+func (m *Migrator) runAttempt(ctx context.Context, run Run) error {
+	base, baseErr := m.git.HeadSHA(run.WorktreePath)
+	if err := m.runAiderWithRetries(ctx, run); err != nil {
+		return err
+	}
+	if baseErr != nil {
+		// There is no commit to go back to, as in a repository without any.
+		return nil
+	}
+	head, err := m.git.HeadSHA(run.WorktreePath)
+	if err != nil {
+		return &WorktreeError{Op: "reading HEAD after aider", WorktreePath: run.WorktreePath, Err: err}
+	}
+	if head == base {
+		return nil
+	}
+	slog.Warn("aider committed its changes; uncommitting them", "model", run.Model, "target", run.Target, "base", base, "head", head)
+	if err := m.git.ResetSoft(run.WorktreePath, base); err != nil {
+		return &WorktreeError{Op: "uncommitting aider's changes", WorktreePath: run.WorktreePath, Err: err}
+	}
+	return nil
+}
+
+// buildCommitMessage describes a successful migration of target: a short
+// subject line, then the model, rule kind, attempts used and a diffstat of the
+// staged changes in worktreePath.
+func (m *Migrator) buildCommitMessage(model, target string, attempts int, worktreePath string) (string, error) {
+	kind, err := m.build.RuleKind(worktreePath, target)
+	if err != nil {
+		slog.Warn("Could not determine rule kind", "target", target, "err", err)
+		kind = "unknown"
+	}
+	stat, err := m.git.DiffStat(worktreePath)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "aider: build %s\n\n", target)
+	fmt.Fprintf(&b, "Model: %s\n", model)
+	fmt.Fprintf(&b, "Rule kind: %s\n", kind)
+	fmt.Fprintf(&b, "Attempts: %d\n\n", attempts)
+	b.WriteString(stat)
+	return b.String(), nil
+}
+
+// CommitTarget stages and commits everything in the worktree after run.Target
+// builds, returning the new commit SHA, or "" if there was nothing to commit.
+// The commit message is written by the model via LLMRunner.CommitAll; if that
+// fails, or with Options.CommitEveryAttempt so the final commit stands apart
+// from the failed attempts, the changes are committed with a message from
+// buildCommitMessage. Lockfile changes are discarded first unless
+// Options.CommitLockfile is set.
+func (m *Migrator) CommitTarget(run Run, attempts int) (string, error) {
+	worktreePath := run.WorktreePath
+	if err := m.DiscardLockfileChanges(worktreePath); err != nil {
+		return "", err
+	}
+	staged, err := m.git.StageAll(worktreePath)
+	if err != nil {
+		return "", err
+	}
+	if !staged {
+		slog.Info("No changes to commit", "worktree", worktreePath, "model", run.Model, "target", run.Target)
+		return "", nil
+	}
+
+	committedByAider := false
+	if !m.opts.CommitEveryAttempt {
+		if err := m.llm.CommitAll(worktreePath, run.Model); err != nil {
+			slog.Warn("aider commit failed; committing with git", "worktree", worktreePath, "err", err)
+		} else {
+			committedByAider = true
+		}
+	}
+	if !committedByAider {
+		commitMsg, err := m.buildCommitMessage(run.Model, run.Target, attempts, worktreePath)
+		if err != nil {
+			return "", err
+		}
+		if err := m.git.Commit(worktreePath, commitMsg); err != nil {
+			return "", err
+		}
+		subject, _, _ := strings.Cut(commitMsg, "\n")
+		slog.Info("Committed changes", "worktree", worktreePath, "message", subject)
+	} else {
+		slog.Info("Committed changes with aider", "worktree", worktreePath, "model", run.Model, "target", run.Target)
+	}
+
+	if m.opts.MaxCommits > 0 {
+		if err := m.git.SquashOldest(worktreePath, run.BaseCommit, m.opts.MaxCommits); err != nil {
+			return "", err
+		}
+	}
+	sha, err := m.git.HeadSHA(worktreePath)
+	if err != nil {
+		return "", err
+	}
+	m.emit(Event{Type: EventCommit, Model: run.Model, Target: run.Target, CommitSHA: sha})
+	return sha, nil
+}
+
+// MigrateTarget runs the aider/bazel build-edit loop for run.Target,
+// committing the worktree once the target builds. An error wrapping
+// ErrProviderUnavailable means the provider kept failing and another model may
+// still succeed; a *WorktreeError means the worktree should not be used
+// further.
+func (m *Migrator) MigrateTarget(ctx context.Context, run Run) (Result, error) {
+	llmModel, target, worktreePath := run.Model, run.Target, run.WorktreePath
+	result := Result{Model: llmModel, Target: target}
+	// Time aider and bazel separately to show where the run spends its time.
+	timedAider := func(run Run) error {
+		start := time.Now()
+		defer func() { result.AiderDuration += time.Since(start) }()
+		return m.runAttempt(ctx, run)
+	}
+	timedBazel := func(step func() ([]byte, error)) ([]byte, error) {
+		start := time.Now()
+		defer func() { result.BazelDuration += time.Since(start) }()
+		return m.WithBazelRestart(worktreePath, step)
+	}
+	// Stash entries left by earlier targets are not this target's to drop.
+	m.stashed[worktreePath] = false
+	// Try up to N attempts per model/target using aider to produce Bazel changes.
+	maxAttempts := run.attemptLimit()
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if m.pastDeadline() {
+			slog.Warn("Deadline reached; not starting another attempt", "model", llmModel, "target", target, "attempts", result.Attempts)
+			return result, nil
+		}
+		result.Attempts = attempt
+		result.EditFormat = run.EditFormat
+		m.emit(Event{Type: EventAttempt, Model: llmModel, Target: target, Attempt: attempt})
+		if err := timedAider(run); err != nil {
+			return result, err
+		}
+		slog.Debug("aider completed", "model", llmModel, "target", target, "attempt", attempt, "maxAttempts", maxAttempts)
+		run.Feedback = ""
+		run.PreviousAttempt = ""
+
+		// Minimal changes are the point; a model rewriting the tree has lost
+		// its way, so make it start over rather than build on the rewrite.
+		if m.opts.MaxDiffLines > 0 {
+			lines, err := m.git.ChangedLines(worktreePath)
+			if err != nil {
+				return result, &WorktreeError{Op: "measuring attempt", WorktreePath: worktreePath, Err: err}
+			}
+			if lines > m.opts.MaxDiffLines {
+				slog.Warn("Attempt changed too many lines; rejecting it", "model", llmModel, "target", target, "attempt", attempt, "lines", lines, "maxDiffLines", m.opts.MaxDiffLines)
+				result.OversizedAttempts++
+				if run.PreviousAttempt, err = m.discardAttempt(run, attempt, fmt.Sprintf("changed %d lines", lines)); err != nil {
+					return result, err
+				}
+				run.Feedback = fmt.Sprintf("The previous attempt changed %d lines, more than the %d allowed, and was discarded. Make only the minimal BUILD.bazel and MODULE.bazel changes needed to build the target; do not rewrite or reformat other files.", lines, m.opts.MaxDiffLines)
+				continue
+			}
+		}
+
+		// Catch syntax errors before spending a bazel invocation on them.
+		err := m.validateChangedBuildFiles(worktreePath)
+		if err != nil && run.EditFormat == "diff" {
+			// Models that cannot produce a clean diff often do better
+			// rewriting the whole file, so give this attempt a second try.
+			slog.Info("diff edit produced an invalid BUILD file; retrying with whole edit format", "model", llmModel, "target", target, "attempt", attempt)
+			wholeRun := run
+			previous, discardErr := m.discardAttempt(run, attempt, "diff edit produced an invalid BUILD file")
+			if discardErr != nil {
+				return result, discardErr
+			}
+			wholeRun.PreviousAttempt = previous
+			wholeRun.EditFormat = "whole"
+			result.EditFormat = wholeRun.EditFormat
+			wholeRun.Feedback = "The previous attempt produced an invalid BUILD file:\n" + err.Error()
+			if err := timedAider(wholeRun); err != nil {
+				return result, err
+			}
+			err = m.validateChangedBuildFiles(worktreePath)
+		}
+		if err != nil {
+			slog.Debug("BUILD file validation failed", "model", llmModel, "target", target, "err", err)
+			run.Feedback = "The previous attempt produced an invalid BUILD file:\n" + err.Error()
+			if run.PreviousAttempt, err = m.discardAttempt(run, attempt, "invalid BUILD file"); err != nil {
+				return result, err
+			}
+			slog.Debug("Re-invoking aider after invalid BUILD file", "model", llmModel, "target", target, "attempt", attempt, "maxAttempts", maxAttempts)
+			continue
+		}
+
+		if m.opts.StrictBazelOnly {
+			if err := m.revertStrayEdits(run); err != nil {
+				return result, &WorktreeError{Op: "reverting non-Bazel edits", WorktreePath: worktreePath, Err: err}
+			}
+		}
+
+		// After aider, first run 'bazel query' to check target visibility/resolution.
+		queryOut, queryErr := timedBazel(func() ([]byte, error) {
+			return m.build.Query(ctx, worktreePath, run.Log, target)
+		})
+		if queryErr != nil {
+			slog.Debug("bazel query failed", "model", llmModel, "target", target, "err", queryErr, "output", string(queryOut))
+			// Stash any untracked or dirty files and retry with aider.
+			if run.PreviousAttempt, err = m.discardAttempt(run, attempt, "bazel query failed"); err != nil {
+				return result, err
+			}
+			slog.Debug("Re-invoking aider after failed bazel query", "model", llmModel, "target", target, "attempt", attempt, "maxAttempts", maxAttempts)
+			continue
+		}
+
+		// Query succeeded; attempt to build the target.
+		bazelOut, bazelErr := timedBazel(func() ([]byte, error) {
+			return m.build.Build(ctx, worktreePath, run.Log, target)
+		})
+		buildEvent := Event{Type: EventBazelBuild, Model: llmModel, Target: target, Attempt: attempt, Status: "succeeded"}
+		if bazelErr != nil {
+			buildEvent.Status, buildEvent.Error = "failed", bazelErr.Error()
+		}
+		m.emit(buildEvent)
+		if bazelErr != nil {
+			slog.Debug("bazel build failed", "model", llmModel, "target", target, "err", bazelErr, "output", string(bazelOut))
+			// Stash any untracked or dirty files and retry with aider.
+			if run.PreviousAttempt, err = m.discardAttempt(run, attempt, "bazel build failed"); err != nil {
+				return result, err
+			}
+			slog.Debug("Re-invoking aider after failed bazel build", "model", llmModel, "target", target, "attempt", attempt, "maxAttempts", maxAttempts)
+			continue
+		}
+
+		// Attempts share the worktree, so the build may have passed on
+		// outputs an earlier attempt left in bazel's caches.
+		if m.opts.VerifyCleanBuild {
+			cleanOut, cleanErr := timedBazel(func() ([]byte, error) {
+				return m.build.CleanBuild(ctx, worktreePath, run.Log, target)
+			})
+			if cleanErr != nil {
+				slog.Warn("Build passed but failed from a clean slate; rejecting the attempt", "model", llmModel, "target", target, "attempt", attempt, "err", cleanErr)
+				slog.Debug("clean bazel build failed", "model", llmModel, "target", target, "output", string(cleanOut))
+				if run.PreviousAttempt, err = m.discardAttempt(run, attempt, "clean bazel build failed"); err != nil {
+					return result, err
+				}
+				run.Feedback = "The previous attempt built only with outputs cached by earlier attempts; building the target from a clean slate failed, so it was discarded."
+				continue
+			}
+		}
+
+		// The build passed; make sure it did not get there by depending on
+		// the host machine.
+		findings, err := lintChangedBuildFiles(m.git, worktreePath)
+		if err != nil {
+			return result, &WorktreeError{Op: "linting BUILD files", WorktreePath: worktreePath, Err: err}
+		}
+		if len(findings) > 0 {
+			slog.Warn("Non-hermetic BUILD files", "model", llmModel, "target", target, "findings", findings)
+			if m.opts.RequireHermetic {
+				if run.PreviousAttempt, err = m.discardAttempt(run, attempt, "BUILD files are not hermetic"); err != nil {
+					return result, err
+				}
+				run.Feedback = "The previous attempt built, but its BUILD files were not hermetic:\n" + strings.Join(findings, "\n") + "\nDo not reference absolute paths or host tools."
+				slog.Debug("Re-invoking aider after non-hermetic BUILD files", "model", llmModel, "target", target, "attempt", attempt, "maxAttempts", maxAttempts)
+				continue
+			}
+			result.HermeticFindings = findings
+		}
+
+		if len(m.opts.BuildozerCommands) > 0 {
+			if err := m.normalizeTarget(ctx, run); err != nil {
+				return result, &WorktreeError{Op: "normalizing target", WorktreePath: worktreePath, Err: err}
+			}
+		}
+
+		// Bazel build succeeded. Commit any untracked or dirty files and move on.
+		sha, err := m.CommitTarget(run, attempt)
+		if err != nil {
+			return result, &WorktreeError{Op: "committing", WorktreePath: worktreePath, Err: err}
+		}
+		result.CommitSHA = sha
+		m.dropAttemptStash(worktreePath)
+
+		slog.Info("bazel build succeeded", "model", llmModel, "target", target, "attempts", attempt)
+		result.Success = true
+		return result, nil
+	}
+	slog.Info("Maximum attempts reached; moving on to next target/worktree", "model", llmModel, "target", target, "maxAttempts", maxAttempts)
+	return result, nil
+}
+
+// discardAttempt sets a failed attempt aside so the next aider round starts
+// from a clean worktree. With Options.CommitEveryAttempt the attempt is
+// committed, tagged as failed with reason, and then reverted, leaving a trail
+// of every attempt on the branch; otherwise it is stashed. Options.NoStash
+// keeps the changes in the worktree either way. With
+// Options.IncludeStashInContext it returns the stashed diff, cut to
+// maxStashContextBytes, for the next prompt.
+func (m *Migrator) discardAttempt(run Run, attempt int, reason string) (string, error) {
+	if !m.opts.CommitEveryAttempt {
+		stashed, err := m.stashAttempt(run.WorktreePath)
+		if err != nil || !stashed || !m.opts.IncludeStashInContext {
+			return "", err
+		}
+		diff, err := m.git.StashDiff(run.WorktreePath)
+		if err != nil {
+			slog.Warn("Could not read stashed attempt", "worktree", run.WorktreePath, "err", err)
+			return "", nil
+		}
+		if len(diff) > maxStashContextBytes {
+			diff = diff[:maxStashContextBytes] + "\n[... diff truncated ...]"
+		}
+		return diff, nil
+	}
+	if err := m.DiscardLockfileChanges(run.WorktreePath); err != nil {
+		return "", &WorktreeError{Op: "discarding lockfile changes", WorktreePath: run.WorktreePath, Err: err}
+	}
+	staged, err := m.git.StageAll(run.WorktreePath)
+	if err != nil {
+		return "", &WorktreeError{Op: "staging failed attempt", WorktreePath: run.WorktreePath, Err: err}
+	}
+	if !staged {
+		slog.Debug("Failed attempt changed nothing; not committing", "model", run.Model, "target", run.Target, "attempt", attempt)
+		return "", nil
+	}
+	message := fmt.Sprintf("aider: FAILED attempt %d at %s\n\nModel: %s\nReason: %s\n", attempt, run.Target, run.Model, reason)
+	if err := m.git.Commit(run.WorktreePath, message); err != nil {
+		return "", &WorktreeError{Op: "committing failed attempt", WorktreePath: run.WorktreePath, Err: err}
+	}
+	if m.opts.NoStash {
+		return "", nil
+	}
+	if err := m.git.RevertHead(run.WorktreePath); err != nil {
+		return "", &WorktreeError{Op: "reverting failed attempt", WorktreePath: run.WorktreePath, Err: err}
+	}
+	return "", nil
+}
+
+// maxStashContextBytes caps the stashed diff Options.IncludeStashInContext
+// puts in the prompt.
+const maxStashContextBytes = 2000
+
+// stashAttempt stashes a failed attempt's changes so the next aider round
+// starts from a clean worktree, unless Options.NoStash is set, and reports
+// whether there was anything to stash. Only the latest failed attempt at a
+// target is kept: the stash of the attempt before it is dropped.
+func (m *Migrator) stashAttempt(worktreePath string) (bool, error) {
+	if m.opts.NoStash {
+		return false, nil
+	}
+	stashed, err := m.git.StashAll(worktreePath)
+	if err != nil {
+		return false, &WorktreeError{Op: "stashing failed attempt", WorktreePath: worktreePath, Err: err}
+	}
+	if !stashed {
+		slog.Debug("Worktree already clean; nothing to stash", "worktree", worktreePath)
+		return false, nil
+	}
+	slog.Debug("Stashed failed attempt", "worktree", worktreePath)
+	if m.stashed[worktreePath] {
+		if err := m.git.StashDrop(worktreePath, 1); err != nil {
+			slog.Warn("Could not drop the stash of an earlier attempt", "worktree", worktreePath, "err", err)
+		}
+	}
+	m.stashed[worktreePath] = true
+	return true, nil
+}
+
+// dropAttemptStash drops the stash of the last failed attempt at the target
+// just migrated in worktreePath, once the target has built and it is of no
+// more use.
+func (m *Migrator) dropAttemptStash(worktreePath string) {
+	if !m.stashed[worktreePath] {
+		return
+	}
+	m.stashed[worktreePath] = false
+	if err := m.git.StashDrop(worktreePath, 0); err != nil {
+		slog.Warn("Could not drop the stash of a failed attempt", "worktree", worktreePath, "err", err)
+	}
+}
+
+// normalizeTarget applies Options.BuildozerCommands to run.Target and rebuilds
+// it. If buildozer fails or the target stops building, run.BuildFile is put
+// back so the pre-normalization version gets committed instead.
+func (m *Migrator) normalizeTarget(ctx context.Context, run Run) error {
+	buildPath := filepath.Join(run.WorktreePath, run.BuildFile)
+	original, err := os.ReadFile(buildPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", buildPath, err)
+	}
+	revert := func() error {
+		if err := os.WriteFile(buildPath, original, 0644); err != nil {
+			return fmt.Errorf("failed to revert %s: %w", buildPath, err)
+		}
+		return nil
+	}
+	if err := m.build.Buildozer(ctx, run.WorktreePath, run.Log, m.opts.BuildozerCommands, run.Target); err != nil {
+		slog.Warn("buildozer normalization failed; reverting", "model", run.Model, "target", run.Target, "err", err)
+		return revert()
+	}
+	if out, err := m.build.Build(ctx, run.WorktreePath, run.Log, run.Target); err != nil {
+		slog.Warn("Target no longer builds after buildozer normalization; reverting", "model", run.Model, "target", run.Target, "err", err)
+		slog.Debug("Normalized bazel build failed", "target", run.Target, "output", string(out))
+		return revert()
+	}
+	slog.Info("Normalized target with buildozer", "model", run.Model, "target", run.Target, "commands", len(m.opts.BuildozerCommands))
+	return nil
+}
+
+// WithBazelRestart runs a bazel command. If it fails because the bazel server
+// crashed, the server is shut down (and with Options.BazelExpungeOnCrash its
+// output base expunged) and the command is run once more, so a crash is not
+// blamed on the BUILD file and does not cost an aider round.
+func (m *Migrator) WithBazelRestart(worktreePath string, run func() ([]byte, error)) ([]byte, error) {
+	out, err := run()
+	if err == nil || !isBazelInfraError(out) {
+		return out, err
+	}
+	slog.Warn("bazel server crashed; restarting it and retrying", "worktree", worktreePath, "err", err)
+	if err := m.build.Shutdown(worktreePath); err != nil {
+		slog.Warn("bazel shutdown failed", "worktree", worktreePath, "err", err)
+	}
+	if m.opts.BazelExpungeOnCrash {
+		if err := m.build.Clean(worktreePath, true); err != nil {
+			slog.Warn("bazel clean --expunge failed", "worktree", worktreePath, "err", err)
+		}
+	}
+	return run()
+}
+
+// moduleLockfile is the file bazel rewrites as it resolves MODULE.bazel.
+const moduleLockfile = "MODULE.bazel.lock"
+
+// DiscardLockfileChanges reverts bazel's changes to MODULE.bazel.lock files in
+// worktreePath, unless Options.CommitLockfile is set, so that lockfile churn
+// does not show up in commits or in the files a model is said to have changed.
+func (m *Migrator) DiscardLockfileChanges(worktreePath string) error {
+	if m.opts.CommitLockfile {
+		return nil
+	}
+	changed, err := m.git.ChangedFiles(worktreePath)
+	if err != nil {
+		return err
+	}
+	var lockfiles []string
+	for _, path := range changed {
+		if filepath.Base(path) == moduleLockfile {
+			lockfiles = append(lockfiles, path)
+		}
+	}
+	if len(lockfiles) == 0 {
+		return nil
+	}
+	slog.Debug("Discarding lockfile changes", "worktree", worktreePath, "files", lockfiles)
+	return m.git.Revert(worktreePath, lockfiles)
+}
+
+// bazelOnlyFiles are the file names the model is allowed to change under
+// Options.StrictBazelOnly. MODULE.bazel.lock is included because bazel rewrites it
+// when aider runs the build.
+var bazelOnlyFiles = []string{"BUILD.bazel", "MODULE.bazel", moduleLockfile}
+
+// revertStrayEdits reverts every changed file in run's worktree other than
+// BUILD.bazel and MODULE.bazel files, logging what the model tried to change.
+func (m *Migrator) revertStrayEdits(run Run) error {
+	changed, err := m.git.ChangedFiles(run.WorktreePath)
+	if err != nil {
+		return err
+	}
+	var stray []string
+	for _, path := range changed {
+		if !slices.Contains(bazelOnlyFiles, filepath.Base(path)) {
+			stray = append(stray, path)
+		}
+	}
+	if len(stray) == 0 {
+		return nil
+	}
+	slog.Warn("Reverting changes to non-Bazel files", "model", run.Model, "target", run.Target, "files", stray)
+	fmt.Fprintf(run.Log, "Reverted changes to non-Bazel files: %s\n", strings.Join(stray, " "))
+	return m.git.Revert(run.WorktreePath, stray)
+}
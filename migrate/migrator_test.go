@@ -0,0 +1,566 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+func TestNormalizeTarget(t *testing.T) {
+	commands := []string{"set visibility //visibility:public"}
+	const (
+		before     = "rust_library(name = \"grep_matcher\")\n"
+		normalized = "rust_library(\n    name = \"grep_matcher\",\n    visibility = [\"//visibility:public\"],\n)\n"
+	)
+	tests := []struct {
+		name         string
+		buildozerErr error
+		buildErrs    []error
+		want         string
+	}{
+		{name: "kept", want: normalized},
+		{name: "buildozer fails", buildozerErr: errors.New("buildozer: rule not found"), want: before},
+		{name: "build breaks", buildErrs: []error{errors.New("ERROR: build failed")}, want: before},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worktreePath := t.TempDir()
+			buildPath := filepath.Join(worktreePath, "crates/matcher/BUILD.bazel")
+			if err := os.MkdirAll(filepath.Dir(buildPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(buildPath, []byte(before), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var gotCommands []string
+			build := &migratetest.FakeBuildRunner{
+				BuildErrs: tt.buildErrs,
+				BuildozerFunc: func(worktreePath string, commands []string, target string) error {
+					gotCommands = commands
+					if tt.buildozerErr != nil {
+						return tt.buildozerErr
+					}
+					return os.WriteFile(buildPath, []byte(normalized), 0644)
+				},
+			}
+			git := migratetest.NewFakeGitManager()
+			m := migrate.New(git, build, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{BuildozerCommands: commands})
+			run := migrate.Run{
+				WorktreePath: worktreePath,
+				Model:        "openrouter/test/model",
+				Target:       "//crates/matcher:grep_matcher",
+				BuildFile:    "crates/matcher/BUILD.bazel",
+				Log:          io.Discard,
+			}
+			if err := m.NormalizeTarget(context.Background(), run); err != nil {
+				t.Fatalf("NormalizeTarget: %v", err)
+			}
+			if !slices.Equal(gotCommands, commands) {
+				t.Errorf("buildozer commands = %q, want %q", gotCommands, commands)
+			}
+			content, err := os.ReadFile(buildPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("BUILD.bazel = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	const limited = "Error code: 429 Too Many Requests\nRetry-After: 0"
+	tests := []struct {
+		name        string
+		maxWait     time.Duration
+		failOutputs []string
+		wantErr     bool
+		wantCalls   int
+	}{
+		// More rate limits than maxTransientRetries, but none count as one.
+		{name: "waits out rate limits", maxWait: time.Second, failOutputs: []string{limited, limited, limited, limited, limited}, wantCalls: 6},
+		{name: "gives up past max wait", failOutputs: []string{"Error code: 429"}, wantErr: true, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := migratetest.NewFakeGitManager()
+			llm := &migratetest.FakeLLMRunner{Git: git, FailOutputs: tt.failOutputs}
+			m := migrate.New(git, &migratetest.FakeBuildRunner{}, llm, migrate.Options{RateLimitMaxWait: tt.maxWait})
+
+			err := m.RunAiderWithRetries(context.Background(), migrate.Run{WorktreePath: t.TempDir(), Model: "openrouter/test/model", Target: "//:ripgrep"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunAiderWithRetries error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, migrate.ErrProviderUnavailable) {
+				t.Errorf("error %v does not wrap ErrProviderUnavailable", err)
+			}
+			if llm.Calls != tt.wantCalls {
+				t.Errorf("aider calls = %d, want %d", llm.Calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRevertStrayEdits(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	m := migrate.New(git, &migratetest.FakeBuildRunner{}, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{})
+	const wt = "worktree"
+	for _, path := range []string{"crates/cli/BUILD.bazel", "crates/cli/Cargo.toml", "MODULE.bazel", "crates/cli/src/lib.rs"} {
+		git.Touch(wt, path)
+	}
+	var log strings.Builder
+
+	if err := m.RevertStrayEdits(migrate.Run{WorktreePath: wt, Target: "//crates/cli:cli", Log: &log}); err != nil {
+		t.Fatalf("RevertStrayEdits: %v", err)
+	}
+	changed, _ := git.ChangedFiles(wt)
+	if want := []string{"crates/cli/BUILD.bazel", "MODULE.bazel"}; !slices.Equal(changed, want) {
+		t.Errorf("changed files after revert = %q, want %q", changed, want)
+	}
+	if !strings.Contains(log.String(), "crates/cli/Cargo.toml crates/cli/src/lib.rs") {
+		t.Errorf("target log does not list the reverted files:\n%s", log.String())
+	}
+}
+
+func TestMigrateTargetUncommitsAider(t *testing.T) {
+	const wt = "worktree"
+	git := migratetest.NewFakeGitManager()
+	git.Touch(wt, "Cargo.toml")
+	if err := git.Commit(wt, "base"); err != nil {
+		t.Fatal(err)
+	}
+	// aider commits a non-Bazel edit along with the BUILD file.
+	llm := &migratetest.FakeLLMRunner{Git: git, Edit: func(run migrate.Run) error {
+		git.Touch(run.WorktreePath, "README.md")
+		git.Touch(run.WorktreePath, run.BuildFile)
+		return git.Commit(run.WorktreePath, "aider: edit README.md")
+	}}
+	m := migrate.New(git, &migratetest.FakeBuildRunner{}, llm, migrate.Options{StrictBazelOnly: true})
+	run := migrate.Run{WorktreePath: wt, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+	result, err := m.MigrateTarget(context.Background(), run)
+	if err != nil || !result.Success {
+		t.Fatalf("MigrateTarget = %+v, %v; want success", result, err)
+	}
+	commits := git.Commits[wt]
+	if len(commits) != 2 || commits[0].Message != "base" {
+		t.Fatalf("commits = %+v, want base and the target's commit", commits)
+	}
+	if want := []string{"BUILD.bazel"}; !slices.Equal(commits[1].Files, want) {
+		t.Errorf("target commit has files %q, want %q: aider's commit of README.md was kept", commits[1].Files, want)
+	}
+}
+
+func TestMigrateTargetValidatesCommittedBuildFiles(t *testing.T) {
+	wt := t.TempDir()
+	git := migratetest.NewFakeGitManager()
+	git.Touch(wt, "Cargo.toml")
+	if err := git.Commit(wt, "base"); err != nil {
+		t.Fatal(err)
+	}
+	const valid = "rust_library(name = \"grep_matcher\")\n"
+	build := &migratetest.FakeBuildRunner{CheckSyntaxFunc: func(name, content string) error {
+		if content != valid {
+			return errors.New(name + ":1:1: syntax error")
+		}
+		return nil
+	}}
+	// aider commits an unbalanced BUILD file first, then a valid one.
+	var feedback []string
+	llm := &migratetest.FakeLLMRunner{Git: git, AutoCommit: true, Edit: func(run migrate.Run) error {
+		feedback = append(feedback, run.Feedback)
+		content := "rust_library(name = \"grep_matcher\"\n"
+		if len(feedback) > 1 {
+			content = valid
+		}
+		return os.WriteFile(filepath.Join(run.WorktreePath, run.BuildFile), []byte(content), 0644)
+	}}
+	m := migrate.New(git, build, llm, migrate.Options{})
+	run := migrate.Run{WorktreePath: wt, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+	result, err := m.MigrateTarget(context.Background(), run)
+	if err != nil || !result.Success {
+		t.Fatalf("MigrateTarget = %+v, %v; want success", result, err)
+	}
+	if llm.Calls != 2 {
+		t.Fatalf("aider called %d times, want 2: the committed invalid BUILD file was not rejected", llm.Calls)
+	}
+	if !strings.Contains(feedback[1], "invalid BUILD file") {
+		t.Errorf("second attempt's feedback = %q, want it to report the invalid BUILD file", feedback[1])
+	}
+}
+
+func TestMigrateTargetLintsCommittedBuildFiles(t *testing.T) {
+	wt := t.TempDir()
+	git := migratetest.NewFakeGitManager()
+	git.Touch(wt, "Cargo.toml")
+	if err := git.Commit(wt, "base"); err != nil {
+		t.Fatal(err)
+	}
+	// aider commits a BUILD file that reaches into the host first, then a
+	// hermetic one.
+	var feedback []string
+	llm := &migratetest.FakeLLMRunner{Git: git, AutoCommit: true, Edit: func(run migrate.Run) error {
+		feedback = append(feedback, run.Feedback)
+		content := "rust_library(name = \"grep\", srcs = [\"/home/user/ripgrep/src/lib.rs\"])\n"
+		if len(feedback) > 1 {
+			content = "rust_library(name = \"grep\", srcs = [\"src/lib.rs\"])\n"
+		}
+		return os.WriteFile(filepath.Join(run.WorktreePath, run.BuildFile), []byte(content), 0644)
+	}}
+	m := migrate.New(git, &migratetest.FakeBuildRunner{}, llm, migrate.Options{RequireHermetic: true})
+	run := migrate.Run{WorktreePath: wt, Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+	result, err := m.MigrateTarget(context.Background(), run)
+	if err != nil || !result.Success {
+		t.Fatalf("MigrateTarget = %+v, %v; want success", result, err)
+	}
+	if llm.Calls != 2 {
+		t.Fatalf("aider called %d times, want 2: the committed non-hermetic BUILD file was not rejected", llm.Calls)
+	}
+	if !strings.Contains(feedback[1], `absolute path "/home/user/ripgrep/src/lib.rs"`) {
+		t.Errorf("second attempt's feedback = %q, want it to name the absolute path", feedback[1])
+	}
+}
+
+func TestTransientRetry(t *testing.T) {
+	const unavailable = "litellm.InternalServerError: OpenrouterException - Error code: 503 Service Unavailable"
+	tests := []struct {
+		name            string
+		failOutputs     []string
+		wantCalls       int
+		wantUnavailable bool
+		wantErr         bool
+	}{
+		{name: "retries the same attempt", failOutputs: []string{unavailable, unavailable}, wantCalls: 3},
+		{name: "gives up after max retries", failOutputs: []string{unavailable, unavailable, unavailable, unavailable}, wantCalls: 4, wantErr: true, wantUnavailable: true},
+		{name: "other errors are not retried", failOutputs: []string{"Error: aider could not parse --model"}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := migratetest.NewFakeGitManager()
+			llm := &migratetest.FakeLLMRunner{Git: git, FailOutputs: tt.failOutputs}
+			m := migrate.New(git, &migratetest.FakeBuildRunner{}, llm, migrate.Options{TransientRetryDelay: time.Millisecond})
+			run := migrate.Run{WorktreePath: t.TempDir(), Model: "openrouter/test/model", Target: "//:ripgrep", BuildFile: "BUILD.bazel", Log: io.Discard}
+
+			result, err := m.MigrateTarget(context.Background(), run)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MigrateTarget error = %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, migrate.ErrProviderUnavailable) != tt.wantUnavailable {
+				t.Errorf("error %v wraps ErrProviderUnavailable = %v, want %v", err, !tt.wantUnavailable, tt.wantUnavailable)
+			}
+			if llm.Calls != tt.wantCalls {
+				t.Errorf("aider calls = %d, want %d", llm.Calls, tt.wantCalls)
+			}
+			if !tt.wantErr && (!result.Success || result.Attempts != 1) {
+				t.Errorf("result = %+v, want success on attempt 1", result)
+			}
+		})
+	}
+}
+
+func TestBazelCleanOnQueryFail(t *testing.T) {
+	errQuery := errors.New("ERROR: no such target '//:ripgrep'")
+	tests := []struct {
+		name      string
+		clean     bool
+		queryErrs []error
+		wantCalls []string
+		wantBuilt bool
+	}{
+		{name: "query fails", queryErrs: []error{errQuery}, wantCalls: []string{"query //:ripgrep"}},
+		{name: "query fails with clean", clean: true, queryErrs: []error{errQuery}, wantCalls: []string{"query //:ripgrep", "clean"}},
+		{name: "query succeeds with clean", clean: true, wantCalls: []string{"query //:ripgrep", "build //:ripgrep"}, wantBuilt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			build := &migratetest.RecordingBuildRunner{BuildRunner: &migratetest.FakeBuildRunner{QueryErrs: tt.queryErrs}}
+			m := migrate.New(migratetest.NewFakeGitManager(), build, &migratetest.FakeLLMRunner{}, migrate.Options{BazelCleanOnQueryFail: tt.clean})
+
+			if built := m.PreCheck(context.Background(), t.TempDir(), "openrouter/test/model", "//:ripgrep", io.Discard); built != tt.wantBuilt {
+				t.Errorf("PreCheck = %v, want %v", built, tt.wantBuilt)
+			}
+			if !slices.Equal(build.Calls, tt.wantCalls) {
+				t.Errorf("bazel calls = %q, want %q", build.Calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBazelCrashRestart(t *testing.T) {
+	errCrash := errors.New("Server terminated abruptly (error code: 14, error message: 'Socket closed')")
+	errBuild := errors.New("ERROR: no such package '@crates//'")
+	tests := []struct {
+		name      string
+		expunge   bool
+		buildErrs []error
+		wantCalls []string
+		wantBuilt bool
+	}{
+		{name: "crash then success", buildErrs: []error{errCrash}, wantCalls: []string{"query //:ripgrep", "build //:ripgrep", "shutdown", "build //:ripgrep"}, wantBuilt: true},
+		{name: "crash with expunge", expunge: true, buildErrs: []error{errCrash}, wantCalls: []string{"query //:ripgrep", "build //:ripgrep", "shutdown", "clean --expunge", "build //:ripgrep"}, wantBuilt: true},
+		{name: "build error is not retried", buildErrs: []error{errBuild}, wantCalls: []string{"query //:ripgrep", "build //:ripgrep"}},
+		{name: "crash retried once", buildErrs: []error{errCrash, errCrash}, wantCalls: []string{"query //:ripgrep", "build //:ripgrep", "shutdown", "build //:ripgrep"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			build := &migratetest.RecordingBuildRunner{BuildRunner: &migratetest.FakeBuildRunner{BuildErrs: tt.buildErrs}}
+			m := migrate.New(migratetest.NewFakeGitManager(), build, &migratetest.FakeLLMRunner{}, migrate.Options{BazelExpungeOnCrash: tt.expunge})
+
+			if built := m.PreCheck(context.Background(), t.TempDir(), "openrouter/test/model", "//:ripgrep", io.Discard); built != tt.wantBuilt {
+				t.Errorf("PreCheck = %v, want %v", built, tt.wantBuilt)
+			}
+			if !slices.Equal(build.Calls, tt.wantCalls) {
+				t.Errorf("bazel calls = %q, want %q", build.Calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestProcessTargetFallbackModel(t *testing.T) {
+	const unavailable = "litellm.ServiceUnavailableError: OpenrouterException - Error code: 503"
+	tests := []struct {
+		name         string
+		failOutputs  []string
+		wantModels   []string
+		wantFallback string
+	}{
+		{
+			name:        "transient error retries the same model",
+			failOutputs: []string{unavailable},
+			wantModels:  []string{"openrouter/test/model"},
+		},
+		{
+			name:         "falls back once retries run out",
+			failOutputs:  slices.Repeat([]string{unavailable}, 4),
+			wantModels:   []string{"openrouter/test/fallback"},
+			wantFallback: "openrouter/test/fallback",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := migratetest.NewFakeGitManager()
+			var models []string
+			llm := &migratetest.FakeLLMRunner{Git: git, FailOutputs: tt.failOutputs, Edit: func(run migrate.Run) error {
+				models = append(models, run.Model)
+				return nil
+			}}
+			build := &migratetest.FakeBuildRunner{QueryErrs: []error{errors.New("no such package")}}
+			m := migrate.New(git, build, llm, migrate.Options{LogDir: t.TempDir(), FallbackModel: "openrouter/test/fallback", TransientRetryDelay: time.Millisecond})
+
+			result, err := m.ProcessTarget(context.Background(), t.TempDir(), "openrouter/test/model", "", "//crates/cli:grep_cli")
+			if err != nil {
+				t.Fatalf("ProcessTarget: %v", err)
+			}
+			if !result.Success || result.Attempts != 1 {
+				t.Errorf("result = %+v, want success on attempt 1", result)
+			}
+			if llm.Calls != len(tt.failOutputs)+1 {
+				t.Errorf("aider calls = %d, want %d", llm.Calls, len(tt.failOutputs)+1)
+			}
+			if !slices.Equal(models, tt.wantModels) {
+				t.Errorf("edits by %q, want %q", models, tt.wantModels)
+			}
+			if result.Model != "openrouter/test/model" || result.FallbackModel != tt.wantFallback {
+				t.Errorf("Model, FallbackModel = %q, %q; want %q, %q", result.Model, result.FallbackModel, "openrouter/test/model", tt.wantFallback)
+			}
+		})
+	}
+}
+
+func TestRecordChangedFiles(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	m := migrate.New(git, &migratetest.FakeBuildRunner{}, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{})
+	const wt = "worktree"
+	git.Touch(wt, "README.md")
+	git.Commit(wt, "base")
+	before, _ := git.HeadSHA(wt)
+	git.Touch(wt, "crates/cli/BUILD.bazel")
+	git.Touch(wt, "MODULE.bazel")
+	git.Commit(wt, "aider: build //crates/cli:cli")
+	after, _ := git.HeadSHA(wt)
+
+	result := migrate.Result{Model: "openrouter/test/model", Target: "//crates/cli:cli", Success: true, CommitSHA: after}
+	if err := m.RecordChangedFiles(&result, wt, before); err != nil {
+		t.Fatalf("RecordChangedFiles: %v", err)
+	}
+	if want := []string{"crates/cli/BUILD.bazel", "MODULE.bazel"}; !slices.Equal(result.ChangedFiles, want) {
+		t.Errorf("ChangedFiles = %q, want %q", result.ChangedFiles, want)
+	}
+	if want := []string{"MODULE.bazel"}; !slices.Equal(result.OutsidePackage, want) {
+		t.Errorf("OutsidePackage = %q, want %q", result.OutsidePackage, want)
+	}
+}
+
+func TestCheckRuleKind(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        string
+		kind          string
+		wantWrongKind bool
+	}{
+		{name: "library", target: "//crates/grep:grep", kind: "rust_library"},
+		{name: "binary", target: "//:ripgrep", kind: "rust_binary"},
+		{name: "binary built as library", target: "//:ripgrep", kind: "rust_library", wantWrongKind: true},
+		{name: "library built as binary", target: "//crates/grep:grep", kind: "rust_binary", wantWrongKind: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := migratetest.NewFakeGitManager()
+			expectedKind := func(target string) string {
+				if target == "//:ripgrep" {
+					return "rust_binary"
+				}
+				return "rust_library"
+			}
+			m := migrate.New(git, &migratetest.FakeBuildRunner{Kind: tt.kind}, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{ExpectedKind: expectedKind})
+			result := migrate.Result{Model: "m", Target: tt.target, Success: true}
+			if err := m.CheckRuleKind(&result, "wt"); err != nil {
+				t.Fatal(err)
+			}
+			if result.Kind != tt.kind || result.WrongKind != tt.wantWrongKind {
+				t.Errorf("Kind, WrongKind = %q, %v, want %q, %v", result.Kind, result.WrongKind, tt.kind, tt.wantWrongKind)
+			}
+			if !result.Success {
+				t.Error("wrong kind failed the target")
+			}
+		})
+	}
+}
+
+func TestSaveInterruptedWork(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	m := migrate.New(git, &migratetest.FakeBuildRunner{}, &migratetest.FakeLLMRunner{}, migrate.Options{})
+	const wt = "worktree"
+
+	m.SaveInterruptedWork(wt, "openrouter/test/model", "//:ripgrep")
+	if n := len(git.Stashes[wt]); n != 0 {
+		t.Errorf("stash entries for a clean worktree = %d, want 0", n)
+	}
+	git.Touch(wt, "BUILD.bazel")
+	m.SaveInterruptedWork(wt, "openrouter/test/model", "//:ripgrep")
+	if n := len(git.Stashes[wt]); n != 1 {
+		t.Errorf("stash entries = %d, want 1", n)
+	}
+	if changed, _ := git.ChangedFiles(wt); len(changed) != 0 {
+		t.Errorf("worktree left dirty: %q", changed)
+	}
+}
+
+// mapCache is a migrate.BuildFileCache in memory, keyed by package.
+type mapCache map[string][]byte
+
+func (c mapCache) Key(worktreePath, pkg string) (string, error) { return pkg, nil }
+func (c mapCache) Get(key string) ([]byte, error)               { return c[key], nil }
+func (c mapCache) Put(key string, content []byte) error         { c[key] = content; return nil }
+
+func TestBuildFromCache(t *testing.T) {
+	cached := "rust_library(name = \"grep_matcher\")\n"
+	cache := mapCache{"abc": []byte(cached)}
+
+	tests := []struct {
+		name      string
+		hash      string
+		buildErrs []error
+		wantOK    bool
+		wantFile  string
+	}{
+		{name: "hit", hash: "abc", wantOK: true, wantFile: cached},
+		{name: "miss", hash: "def", wantFile: migrate.PlaceholderBuildFile},
+		{name: "stale", hash: "abc", buildErrs: []error{errors.New("ERROR: build failed")}, wantFile: migrate.PlaceholderBuildFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worktreePath := t.TempDir()
+			buildPath := filepath.Join(worktreePath, "crates", "matcher", "BUILD.bazel")
+			writeFile(t, buildPath, migrate.PlaceholderBuildFile)
+			git := migratetest.NewFakeGitManager()
+			m := migrate.New(git, &migratetest.FakeBuildRunner{BuildErrs: tt.buildErrs}, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{Cache: cache})
+			run := migrate.Run{
+				WorktreePath: worktreePath,
+				Model:        "openrouter/test/model",
+				Target:       "//crates/matcher:grep_matcher",
+				BuildFile:    "crates/matcher/BUILD.bazel",
+				Log:          io.Discard,
+			}
+			// The fake git manager does not see files on disk.
+			if tt.wantOK {
+				git.Touch(worktreePath, run.BuildFile)
+			}
+
+			sha, ok, err := m.BuildFromCache(context.Background(), run, tt.hash)
+			if err != nil {
+				t.Fatalf("BuildFromCache: %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if tt.wantOK && (sha == "" || len(git.Commits[worktreePath]) != 1) {
+				t.Errorf("cache hit was not committed: sha %q, commits %v", sha, git.Commits[worktreePath])
+			}
+			content, err := os.ReadFile(buildPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.wantFile {
+				t.Errorf("BUILD.bazel = %q, want %q", content, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestBuildFromSeed(t *testing.T) {
+	const generated = "rust_library(name = \"grep_matcher\")\n"
+	tests := []struct {
+		name      string
+		original  string
+		buildErrs []error
+		wantOK    bool
+		wantFile  string
+	}{
+		{name: "builds", original: migrate.PlaceholderBuildFile, wantOK: true, wantFile: generated},
+		{name: "starting point", original: migrate.PlaceholderBuildFile, buildErrs: []error{errors.New("ERROR")}, wantFile: generated},
+		{name: "keeps existing rules", original: "rust_test(name = \"t\")\n", buildErrs: []error{errors.New("ERROR")}, wantFile: "rust_test(name = \"t\")\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			worktreePath := t.TempDir()
+			buildPath := filepath.Join(worktreePath, "crates/matcher/BUILD.bazel")
+			writeFile(t, buildPath, tt.original)
+			git := migratetest.NewFakeGitManager()
+			git.Touch(worktreePath, "crates/matcher/BUILD.bazel")
+			m := migrate.New(git, &migratetest.FakeBuildRunner{BuildErrs: tt.buildErrs}, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{})
+			run := migrate.Run{
+				WorktreePath: worktreePath,
+				Model:        "openrouter/test/model",
+				Target:       "//crates/matcher:grep_matcher",
+				BuildFile:    "crates/matcher/BUILD.bazel",
+				Log:          io.Discard,
+			}
+			seed := func(migrate.Run, string) (*migrate.Seed, error) {
+				return &migrate.Seed{Content: []byte(generated), Source: "test", Start: true}, nil
+			}
+			_, ok, err := m.BuildFromSeed(context.Background(), run, "crates/matcher", seed)
+			if err != nil {
+				t.Fatalf("BuildFromSeed: %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if content, _ := os.ReadFile(buildPath); string(content) != tt.wantFile {
+				t.Errorf("BUILD.bazel = %q, want %q", content, tt.wantFile)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// unsafePathChars matches runs of characters SanitizePath replaces.
+var unsafePathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// consecutiveHyphens and consecutiveDots match runs SanitizePath collapses.
+var (
+	consecutiveHyphens = regexp.MustCompile(`-{2,}`)
+	consecutiveDots    = regexp.MustCompile(`\.{2,}`)
+)
+
+// maxSanitizedLen caps SanitizePath's output below the usual 255-byte file
+// name limit, leaving room for suffixes such as ".docs.md".
+const maxSanitizedLen = 200
+
+// sanitizedPlaceholder is what SanitizePath returns when nothing usable is
+// left of its input.
+const sanitizedPlaceholder = "unnamed"
+
+// SanitizePath makes s usable as a single file name or branch component: every
+// character other than ASCII letters, digits, '.', '_' and '-' becomes a
+// hyphen, runs of hyphens or dots collapse to one, leading and trailing
+// hyphens and dots are trimmed, and the result is cut to maxSanitizedLen
+// bytes. A trailing ".lock", which git refuses in ref names, becomes "-lock".
+// If nothing is left, it returns sanitizedPlaceholder.
+func SanitizePath(s string) string {
+	s = unsafePathChars.ReplaceAllString(s, "-")
+	s = consecutiveDots.ReplaceAllString(s, ".")
+	s = consecutiveHyphens.ReplaceAllString(s, "-")
+	s = strings.Trim(s, "-.")
+	if len(s) > maxSanitizedLen {
+		s = strings.TrimRight(s[:maxSanitizedLen], "-.")
+	}
+	if base, ok := strings.CutSuffix(s, ".lock"); ok {
+		s = base + "-lock"
+	}
+	if s == "" {
+		return sanitizedPlaceholder
+	}
+	return s
+}
+
+// TargetLogPath returns <dir>/<model>/<target>.log, the log file of a
+// model/target pair.
+func TargetLogPath(dir, llmModel, target string) string {
+	return filepath.Join(dir, SanitizePath(llmModel), SanitizePath(strings.TrimPrefix(target, "//"))+".log")
+}
+
+// OpenTargetLog opens (appending) the log file for a model/target pair at
+// TargetLogPath, creating directories as needed.
+func OpenTargetLog(dir, llmModel, target string) (*os.File, error) {
+	logPath := TargetLogPath(dir, llmModel, target)
+	modelDir := filepath.Dir(logPath)
+	if err := os.MkdirAll(modelDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log dir %s: %w", modelDir, err)
+	}
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file %s: %w", logPath, err)
+	}
+	return f, nil
+}
+
+// chatHistoryPath returns the aider chat history file for the model worktree
+// at worktreePath. It sits beside the worktree rather than in it so that
+// committing a target's changes does not pick it up.
+func chatHistoryPath(worktreePath string) string {
+	return worktreePath + ".aider.chat.history.md"
+}
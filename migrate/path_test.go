@@ -0,0 +1,176 @@
+package migrate
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// testModels are model names as found on OpenRouter.
+var testModels = []string{
+	"x-ai/grok-code-fast-1",
+	"anthropic/claude-sonnet-4",
+	"openai/gpt-4.1-mini",
+	"qwen/qwen3-coder",
+	"openrouter/sonoma-sky-alpha",
+	"deepseek/deepseek-chat-v3.1",
+}
+
+func TestSanitizePath(t *testing.T) {
+	long := strings.Repeat("a", maxSanitizedLen+50)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "model", in: "openrouter/openai/gpt-5-mini", want: "openrouter-openai-gpt-5-mini"},
+		{name: "target", in: "crates/matcher:grep_matcher", want: "crates-matcher-grep_matcher"},
+		{name: "root target", in: ":ripgrep", want: "ripgrep"},
+		{name: "dots", in: "openrouter/openai/gpt-4.1-mini", want: "openrouter-openai-gpt-4.1-mini"},
+		{name: "spaces", in: "my model  v2", want: "my-model-v2"},
+		{name: "parentheses", in: "model (preview)", want: "model-preview"},
+		{name: "angle brackets", in: "<model>", want: "model"},
+		{name: "null byte", in: "a\x00b", want: "a-b"},
+		{name: "newline", in: "a\nb\r\n", want: "a-b"},
+		{name: "unicode", in: "acme/gpt-α", want: "acme-gpt"},
+		{name: "unicode inside", in: "acme/gpt-αβ-2", want: "acme-gpt-2"},
+		{name: "backslash", in: `C:\\models\\x`, want: "C-models-x"},
+		{name: "leading and trailing hyphens", in: "--model--", want: "model"},
+		{name: "consecutive hyphens", in: "a---b//c", want: "a-b-c"},
+		{name: "only unsafe", in: "///", want: sanitizedPlaceholder},
+		{name: "empty", in: "", want: sanitizedPlaceholder},
+		{name: "dot", in: ".", want: sanitizedPlaceholder},
+		{name: "dot dot", in: "/../", want: sanitizedPlaceholder},
+		{name: "traversal", in: "../../etc/passwd", want: "etc-passwd"},
+		{name: "consecutive dots", in: "acme/gpt..5", want: "acme-gpt.5"},
+		{name: "trailing dot", in: "model.", want: "model"},
+		{name: "leading dot", in: ".model", want: "model"},
+		{name: "lock suffix", in: "acme/model.lock", want: "acme-model-lock"},
+		{name: "long", in: long, want: long[:maxSanitizedLen]},
+		{name: "long cut at hyphen", in: strings.Repeat("a", maxSanitizedLen-1) + "/b", want: strings.Repeat("a", maxSanitizedLen-1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizePath(tt.in); got != tt.want {
+				t.Errorf("SanitizePath(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizePathBranchNames(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	inputs := []string{
+		"../../etc/passwd",
+		"model.lock",
+		"a..b",
+		".hidden/model.",
+		"refs/heads/main@{1}",
+		"x~1^2:path?*[abc]\\",
+		"-leading-hyphen",
+		"@",
+		"",
+	}
+	for _, model := range testModels {
+		inputs = append(inputs, model, "openrouter/"+model)
+	}
+	for _, in := range inputs {
+		got := SanitizePath(in)
+		if strings.ContainsAny(got, "/:") {
+			t.Errorf("SanitizePath(%q) = %q, which contains / or :", in, got)
+		}
+		branch := "main-" + got
+		if err := validateBranchName(branch); err != nil {
+			t.Errorf("SanitizePath(%q): %s", in, err)
+		}
+		if out, err := exec.Command("git", "check-ref-format", "--branch", branch).CombinedOutput(); err != nil {
+			t.Errorf("SanitizePath(%q): git check-ref-format --branch %q failed: %s", in, branch, out)
+		}
+	}
+}
+
+func FuzzSanitizePath(f *testing.F) {
+	for _, model := range testModels {
+		f.Add(model)
+		f.Add("openrouter/" + model)
+	}
+	f.Add("a\x00b")
+	f.Add(strings.Repeat("model/", 200))
+	f.Add("acme/gpt-αβ-2 🚀")
+	f.Add("$(rm -rf ~); `id` | cat > /dev/null & echo *?")
+	f.Add("../../etc/passwd")
+	f.Add("..")
+	f.Fuzz(func(t *testing.T, s string) {
+		got := SanitizePath(s)
+		if got == "" || got == "." || got == ".." {
+			t.Fatalf("SanitizePath(%q) = %q, want a usable name", s, got)
+		}
+		if len(got) > maxSanitizedLen {
+			t.Fatalf("SanitizePath(%q) is %d bytes, want at most %d", s, len(got), maxSanitizedLen)
+		}
+		if unsafePathChars.MatchString(got) {
+			t.Fatalf("SanitizePath(%q) = %q, which contains unsafe characters", s, got)
+		}
+		if err := validateBranchName(got); err != nil {
+			t.Fatalf("SanitizePath(%q) is not a valid branch component: %s", s, err)
+		}
+		if again := SanitizePath(got); again != got {
+			t.Fatalf("SanitizePath(%q) = %q, but sanitizing that gives %q", s, got, again)
+		}
+	})
+}
+
+func TestModelBranchName(t *testing.T) {
+	tests := []struct {
+		repo       string
+		prefix     string
+		repetition int
+		want       string
+	}{
+		{want: "main-openrouter-openai-gpt-5"},
+		{repetition: 2, want: "main-openrouter-openai-gpt-5-rep2"},
+		{repo: "dan-stowell-ripgrep", want: "main-dan-stowell-ripgrep-openrouter-openai-gpt-5"},
+		{prefix: "bazel/", want: "main-bazel-openrouter-openai-gpt-5"},
+		{repo: "dan-stowell-ripgrep", prefix: "migrate/", repetition: 1, want: "main-dan-stowell-ripgrep-migrate-openrouter-openai-gpt-5-rep1"},
+	}
+	for _, tt := range tests {
+		got := modelBranchName("main", tt.repo, tt.prefix, "openai/gpt-5", tt.repetition)
+		if got != tt.want {
+			t.Errorf("modelBranchName(repo=%q, prefix=%q, repetition=%d) = %q, want %q", tt.repo, tt.prefix, tt.repetition, got, tt.want)
+		}
+		if err := validateBranchName(got); err != nil {
+			t.Errorf("validateBranchName(%q) = %v", got, err)
+		}
+	}
+}
+
+func TestValidateBranchName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "main-openrouter-openai-gpt-4.1-mini"},
+		{name: "feature/bazel-migration"},
+		{name: "", wantErr: true},
+		{name: "@", wantErr: true},
+		{name: "-main", wantErr: true},
+		{name: "main/", wantErr: true},
+		{name: "a//b", wantErr: true},
+		{name: "main.", wantErr: true},
+		{name: "a..b", wantErr: true},
+		{name: "a@{b", wantErr: true},
+		{name: "a b", wantErr: true},
+		{name: "a~1", wantErr: true},
+		{name: "a:b", wantErr: true},
+		{name: "a\x00b", wantErr: true},
+		{name: "feature/.hidden", wantErr: true},
+		{name: "main.lock", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateBranchName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validateBranchName(%q) = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// RepoResult is the outcome of MigrateRepo.
+type RepoResult struct {
+	Results []Result
+	// Planned is how many model/target pairs the run set out to migrate.
+	// Pairs never started, because of the deadline or budget, are in
+	// Planned but not Results.
+	Planned int
+	// Verifications records whether each model's worktree builds as a
+	// whole. It is empty if the deadline passed first.
+	Verifications []ModelVerification
+}
+
+// overBudget reports whether Options.OverBudget says the run's spend is used
+// up.
+func (m *Migrator) overBudget() bool {
+	return m.opts.OverBudget != nil && m.opts.OverBudget()
+}
+
+// MigrateRepo has every one of models, named without the openrouter/ prefix,
+// migrate targets in the repository at repoDir, each in its own worktree on a
+// branch off of branch. With Options.BestOfN, every model first tries only
+// the first target and just the best Options.BestOfNKeep models go on to the
+// rest; with Options.Escalate, the models take turns on each target instead,
+// cheapest first as given, and with Options.SelectBest only the winner of a
+// race on the first target runs the rest. Afterwards the successful commits
+// are cherry-picked with Options.CherryPickFromBest, and each worktree is
+// built as a whole. An error means a worktree could not be set up or was
+// left unusable, and the run cannot go on.
+func (m *Migrator) MigrateRepo(ctx context.Context, repoDir, branch string, models, targets []string) (RepoResult, error) {
+	var (
+		result  RepoResult
+		tracker *AttemptTracker
+		err     error
+	)
+	switch {
+	case m.opts.Escalate:
+		result.Results, result.Planned, tracker, err = m.escalateRepo(ctx, repoDir, branch, models, targets)
+	case m.opts.SelectBest:
+		result.Results, result.Planned, tracker, err = m.selectBestRepo(ctx, repoDir, branch, models, targets)
+	default:
+		result.Results, result.Planned, tracker, err = m.compareRepo(ctx, repoDir, branch, models, targets)
+	}
+	if err != nil {
+		return result, err
+	}
+	if m.opts.CherryPickFromBest {
+		cherryPickFromBest(tracker, targets)
+	}
+	// Targets are built one at a time, so check each model's migration also
+	// builds as a whole.
+	if m.pastDeadline() {
+		slog.Warn("Deadline reached; not verifying full builds", "repo", m.opts.Repo)
+	} else if result.Verifications, err = m.VerifyModels(ctx, tracker); err != nil {
+		slog.Error("Error verifying models", "repo", m.opts.Repo, "err", err)
+	}
+	return result, nil
+}
+
+// compareRepo runs every model, and with Options.Repeat every repetition of
+// it, over targets. It returns the results, how many model/target pairs were
+// planned, and the tracker the models were recorded on.
+func (m *Migrator) compareRepo(ctx context.Context, repoDir, branch string, models, targets []string) ([]Result, int, *AttemptTracker, error) {
+	var results []Result
+	tracker := NewAttemptTracker()
+	mainModels, mainTargets := models, targets
+	planned := len(models) * max(m.opts.Repeat, 1) * len(targets)
+	if m.opts.BestOfN && len(targets) > 1 {
+		// Probe every model on the first target, then spend the rest of
+		// the run on the ones that did best.
+		var probe []attemptResult
+		for _, model := range models {
+			if m.pastDeadline() || m.overBudget() {
+				break
+			}
+			modelResults, err := m.migrateModel(ctx, repoDir, branch, model, 0, targets[:1], tracker)
+			results = append(results, modelResults...)
+			if err != nil {
+				return results, planned, tracker, err
+			}
+			probe = append(probe, probeResult(model, modelResults))
+		}
+		mainModels, mainTargets = selectTopModels(probe, m.opts.BestOfNKeep), targets[1:]
+		slog.Info("Best-of-n models selected", "repo", m.opts.Repo, "probeTarget", targets[0], "models", mainModels)
+		planned = len(models) + len(mainModels)*len(mainTargets)
+	}
+	for _, model := range mainModels {
+		if m.pastDeadline() {
+			slog.Warn("Deadline reached; not starting remaining models", "next", model)
+			break
+		}
+		if m.overBudget() {
+			slog.Warn("Budget exceeded; not starting remaining models", "next", model)
+			break
+		}
+		if m.opts.Repeat <= 1 {
+			modelResults, err := m.migrateModel(ctx, repoDir, branch, model, 0, mainTargets, tracker)
+			results = append(results, modelResults...)
+			if err != nil {
+				return results, planned, tracker, err
+			}
+			continue
+		}
+		// Each repetition gets its own branch and worktree so runs are
+		// independent samples of the model's behavior.
+		for repetition := 1; repetition <= m.opts.Repeat && !m.pastDeadline() && !m.overBudget(); repetition++ {
+			modelResults, err := m.migrateModel(ctx, repoDir, branch, model, repetition, mainTargets, tracker)
+			results = append(results, modelResults...)
+			if err != nil {
+				return results, planned, tracker, err
+			}
+		}
+	}
+	return results, planned, tracker, nil
+}
+
+// migrateModel sets up the branch and worktree for model (and repetition,
+// with Options.Repeat) off of branch, then runs every target in it. Results
+// are also recorded on tracker.
+func (m *Migrator) migrateModel(ctx context.Context, repoDir, branch, model string, repetition int, targets []string, tracker *AttemptTracker) ([]Result, error) {
+	m.evictWorktrees(repoDir)
+	worktreePath, err := m.openWorktree(repoDir, m.modelBranch(branch, model, repetition))
+	if err != nil {
+		return nil, err
+	}
+
+	// For each target, invoke aider in the worktree so the model can make
+	// minimal Bazel changes to build the target.
+	llmModel := "openrouter/" + model
+	baseCommit, err := MergeBase(worktreePath, branch, "HEAD")
+	if err != nil {
+		slog.Warn("Error finding base commit", "model", llmModel, "err", err)
+	}
+	m.emit(Event{Type: EventModelStart, Repo: m.opts.Repo, Model: RunKey(llmModel, repetition), Targets: targets})
+	breaker := NewCircuitBreaker(m.opts.CircuitBreakerThreshold)
+	modelResults, err := m.migrateTargets(llmModel, targets, breaker, func(target string) (Result, error) {
+		return m.runTarget(ctx, worktreePath, model, baseCommit, target)
+	})
+	for i := range modelResults {
+		modelResults[i].Repo = m.opts.Repo
+		modelResults[i].Repetition = repetition
+	}
+	if err != nil {
+		return modelResults, fmt.Errorf("failed to migrate targets with %s: %w", llmModel, err)
+	}
+
+	m.emit(Event{Type: EventModelDone, Repo: m.opts.Repo, Model: RunKey(llmModel, repetition), Succeeded: CountSucceeded(modelResults), Total: len(targets)})
+
+	if m.opts.CommitOnPartial {
+		if err := m.commitPartial(worktreePath, model, CountSucceeded(modelResults), len(targets)); err != nil {
+			slog.Warn("Could not commit partial work", "model", llmModel, "err", err)
+		}
+	}
+	if m.opts.SquashCommits && len(targets) > 0 && CountSucceeded(modelResults) == len(targets) {
+		if err := SquashCommits(worktreePath, baseCommit, "bazel: migrate all targets using "+llmModel); err != nil {
+			slog.Warn("Could not squash model branch", "model", llmModel, "err", err)
+		}
+	}
+
+	if early, late, ok := attemptTrend(modelResults); ok {
+		slog.Info("Attempts per successful target", "model", llmModel, "firstHalf", round2(early), "secondHalf", round2(late), "chatHistory", !m.opts.NoChatHistory)
+	}
+
+	tracker.AddModel(RunKey(llmModel, repetition), worktreePath, baseCommit)
+	for _, r := range modelResults {
+		tracker.Record(r)
+	}
+	return modelResults, nil
+}
+
+// migrateTargets runs run for each target in order, recording each outcome
+// on breaker. Unless Options.KeepGoing is set it stops at the first target
+// that fails. Once breaker trips, the remaining targets are skipped with a
+// warning instead of spending more attempts on the model.
+func (m *Migrator) migrateTargets(llmModel string, targets []string, breaker *CircuitBreaker, run func(target string) (Result, error)) ([]Result, error) {
+	var results []Result
+	for _, target := range targets {
+		if m.pastDeadline() {
+			slog.Warn("Deadline reached; not starting remaining targets", "model", llmModel, "next", target)
+			break
+		}
+		if m.overBudget() {
+			slog.Warn("Budget exceeded; not starting remaining targets", "model", llmModel, "next", target)
+			break
+		}
+		if breaker.Tripped() {
+			slog.Warn("Circuit breaker open; skipping target", "model", llmModel, "target", target, "consecutiveFailures", breaker.ConsecutiveFailures())
+			results = append(results, Result{Model: llmModel, Target: target, Skipped: true})
+			m.emit(Event{Type: EventTargetDone, Repo: m.opts.Repo, Model: llmModel, Target: target, Status: "skipped"})
+			continue
+		}
+		result, err := run(target)
+		if err != nil {
+			return results, err
+		}
+		breaker.Record(result.Success)
+		results = append(results, result)
+		if !result.Success && !m.opts.KeepGoing {
+			slog.Warn("Target failed; not starting remaining targets", "model", llmModel, "target", target)
+			break
+		}
+	}
+	return results, nil
+}
+
+// commitPartial commits every change left in worktreePath after model's
+// targets ran, noting that built of total targets built. Targets that built
+// are already committed, so this keeps what the failed ones left behind.
+func (m *Migrator) commitPartial(worktreePath, model string, built, total int) error {
+	if err := m.DiscardLockfileChanges(worktreePath); err != nil {
+		return err
+	}
+	staged, err := m.git.StageAll(worktreePath)
+	if err != nil {
+		return err
+	}
+	if !staged {
+		slog.Debug("No partial work to commit", "worktree", worktreePath, "model", model)
+		return nil
+	}
+	message := fmt.Sprintf("partial: %s, %d/%d targets built", model, built, total)
+	if err := m.git.Commit(worktreePath, message); err != nil {
+		return err
+	}
+	slog.Info("Committed partial work", "worktree", worktreePath, "message", message)
+	return nil
+}
+
+// attemptTrend returns the mean attempts of the successful targets in the
+// first and second halves of a model's run, in run order, to show whether
+// later targets need fewer attempts. ok is false with fewer than two
+// successes.
+func attemptTrend(results []Result) (early, late float64, ok bool) {
+	var attempts []int
+	for _, r := range results {
+		if r.Success {
+			attempts = append(attempts, r.Attempts)
+		}
+	}
+	if len(attempts) < 2 {
+		return 0, 0, false
+	}
+	mean := func(xs []int) float64 {
+		sum := 0
+		for _, x := range xs {
+			sum += x
+		}
+		return float64(sum) / float64(len(xs))
+	}
+	half := len(attempts) / 2
+	return mean(attempts[:half]), mean(attempts[half:]), true
+}
+
+// resultStatus is the Status of a target_done event for r.
+func resultStatus(r Result) string {
+	switch {
+	case r.Skipped:
+		return "skipped"
+	case r.Success:
+		return "succeeded"
+	default:
+		return "failed"
+	}
+}
+
+// CountSucceeded returns how many of results succeeded.
+func CountSucceeded(results []Result) int {
+	n := 0
+	for _, r := range results {
+		if r.Success {
+			n++
+		}
+	}
+	return n
+}
+
+// round2 rounds x to two decimal places for logging.
+func round2(x float64) float64 {
+	return float64(int(x*100+0.5)) / 100
+}
@@ -0,0 +1,64 @@
+package migrate
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAttemptTrend(t *testing.T) {
+	results := []Result{
+		{Target: "//a:a", Success: true, Attempts: 4},
+		{Target: "//b:b", Success: false, Attempts: 5},
+		{Target: "//c:c", Success: true, Attempts: 2},
+		{Target: "//d:d", Success: true, Attempts: 1},
+		{Target: "//e:e", Success: true, Attempts: 1},
+	}
+	early, late, ok := attemptTrend(results)
+	if !ok || early != 3 || late != 1 {
+		t.Errorf("attemptTrend = %v, %v, %v; want 3, 1, true", early, late, ok)
+	}
+	if _, _, ok := attemptTrend(results[:2]); ok {
+		t.Error("attemptTrend with one success reported a trend")
+	}
+}
+
+func TestMigrateTargetsKeepGoing(t *testing.T) {
+	targets := []string{"//a:a", "//b:b", "//c:c"}
+	tests := []struct {
+		keepGoing bool
+		want      []string
+	}{
+		{keepGoing: false, want: []string{"//a:a", "//b:b"}},
+		{keepGoing: true, want: targets},
+	}
+	for _, tt := range tests {
+		m := &Migrator{opts: Options{KeepGoing: tt.keepGoing}}
+		var migrated []string
+		results, err := m.migrateTargets("model", targets, NewCircuitBreaker(0), func(target string) (Result, error) {
+			migrated = append(migrated, target)
+			return Result{Model: "model", Target: target, Success: target != "//b:b"}, nil
+		})
+		if err != nil {
+			t.Fatalf("migrateTargets: %v", err)
+		}
+		if !slices.Equal(migrated, tt.want) || len(results) != len(tt.want) {
+			t.Errorf("keepGoing=%v: migrated %q with %d results, want %q", tt.keepGoing, migrated, len(results), tt.want)
+		}
+	}
+}
+
+func TestMigrateTargetsStopsOverBudget(t *testing.T) {
+	targets := []string{"//a:a", "//b:b", "//c:c", "//d:d"}
+	var migrated []string
+	m := &Migrator{opts: Options{KeepGoing: true, OverBudget: func() bool { return len(migrated) >= 2 }}}
+	results, err := m.migrateTargets("example/model", targets, NewCircuitBreaker(0), func(target string) (Result, error) {
+		migrated = append(migrated, target)
+		return Result{Model: "example/model", Target: target, Success: true}, nil
+	})
+	if err != nil {
+		t.Fatalf("migrateTargets: %v", err)
+	}
+	if len(migrated) != 2 || len(results) != 2 {
+		t.Errorf("migrated %q with %d results, want the first 2 targets before the budget ran out", migrated, len(results))
+	}
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bazelInfraMarkers are lowercase substrings of bazel output that indicate
+// the bazel server or its JVM died, rather than the build itself failing.
+var bazelInfraMarkers = []string{
+	"server terminated abruptly",
+	"server crashed during startup",
+	"crashed due to an internal error",
+	"ran out of memory and crashed",
+	"java.lang.outofmemoryerror",
+	"a fatal error has been detected by the java runtime environment",
+	"error: could not connect to server",
+	"lost connection to the bazel server",
+}
+
+// isBazelInfraError reports whether bazel output shows a server or JVM crash,
+// which a restart fixes and a BUILD file edit cannot.
+func isBazelInfraError(output []byte) bool {
+	lower := strings.ToLower(string(output))
+	for _, marker := range bazelInfraMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// transientErrorMarkers are lowercase substrings of aider output that indicate
+// the model provider failed (rate limiting, 5xx, dropped connections) rather
+// than aider or the request itself being broken.
+var transientErrorMarkers = []string{
+	"ratelimiterror",
+	"rate limit",
+	"internalservererror",
+	"serviceunavailableerror",
+	"apiconnectionerror",
+	"litellm.timeout",
+	"overloaded",
+	"error code: 429",
+	"error code: 500",
+	"error code: 502",
+	"error code: 503",
+	"error code: 504",
+}
+
+// isTransientProviderError reports whether aider output looks like a
+// temporary provider-side failure that is worth retrying.
+func isTransientProviderError(output string) bool {
+	lower := strings.ToLower(output)
+	for _, marker := range transientErrorMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimited matches the provider error aider reports when a request was
+// refused for exceeding the rate limit. It deliberately ignores a bare 429 or
+// "rate limit", which also turn up in bazel output aider echoes, such as line
+// numbers and failed downloads.
+var rateLimited = regexp.MustCompile(`(?i)RateLimitError|\berror code:\s*429\b`)
+
+// retryAfter matches a Retry-After header value, in seconds, as aider
+// sometimes echoes it from the provider's response.
+var retryAfter = regexp.MustCompile(`(?i)retry[-_]after["']?\s*[:=]\s*["']?(\d+(?:\.\d+)?)`)
+
+// defaultRateLimitWait is how long to wait out a rate limit whose response
+// gave no Retry-After.
+const defaultRateLimitWait = 60 * time.Second
+
+// detectRateLimit reports whether aider's output shows the provider rate
+// limited it, and how long to wait before trying again.
+func detectRateLimit(stderr []byte) (bool, time.Duration) {
+	if !rateLimited.Match(stderr) {
+		return false, 0
+	}
+	if m := retryAfter.FindSubmatch(stderr); m != nil {
+		if seconds, err := strconv.ParseFloat(string(m[1]), 64); err == nil {
+			return true, time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return true, defaultRateLimitWait
+}
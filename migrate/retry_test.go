@@ -0,0 +1,52 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsBazelInfraError(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{output: "Server terminated abruptly (error code: 14, error message: 'Socket closed', log file: '/root/.cache/bazel/java.log')", want: true},
+		{output: "Starting local Bazel server and connecting to it...\nServer crashed during startup. Now printing /root/.cache/bazel/server/jvm.out", want: true},
+		{output: "FATAL: bazel crashed due to an internal error. Printing stack trace:", want: true},
+		{output: "FATAL: bazel ran out of memory and crashed. Printing stack trace:", want: true},
+		{output: "Exception in thread \"main\" java.lang.OutOfMemoryError: Java heap space", want: true},
+		{output: "# A fatal error has been detected by the Java Runtime Environment:\n#  SIGSEGV (0xb)", want: true},
+		{output: "ERROR: /work/BUILD.bazel:3:13: no such package '@crates//': The repository '@crates' could not be resolved", want: false},
+		{output: "ERROR: Build did NOT complete successfully", want: false},
+		{output: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := isBazelInfraError([]byte(tt.output)); got != tt.want {
+			t.Errorf("isBazelInfraError(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestDetectRateLimit(t *testing.T) {
+	tests := []struct {
+		output  string
+		limited bool
+		wait    time.Duration
+	}{
+		{output: "Model openrouter/x-ai/grok-code-fast-1 has hit a token limit!"},
+		{output: "litellm.RateLimitError: OpenrouterException - Rate limit exceeded", limited: true, wait: defaultRateLimitWait},
+		{output: "Error code: 429 - {'error': {'message': 'Too Many Requests'}}\nRetry-After: 12", limited: true, wait: 12 * time.Second},
+		{output: "litellm.RateLimitError: AnthropicException - 429 Too Many Requests, headers: {'retry-after': '2.5'}", limited: true, wait: 2500 * time.Millisecond},
+		{output: "HTTP 4290 is not a status code"},
+		// bazel output aider echoed back.
+		{output: "error[E0425]: cannot find value `matcher` in this scope\n   --> crates/core/main.rs:429:5"},
+		{output: "ERROR: An error occurred during the fetch of repository 'crates': GET returned 429 Too Many Requests"},
+		{output: "WARNING: Download from https://api.github.com/repos/BurntSushi/ripgrep/tarball failed: API rate limit exceeded"},
+	}
+	for _, tt := range tests {
+		limited, wait := detectRateLimit([]byte(tt.output))
+		if limited != tt.limited || wait != tt.wait {
+			t.Errorf("detectRateLimit(%q) = %v, %v; want %v, %v", tt.output, limited, wait, tt.limited, tt.wait)
+		}
+	}
+}
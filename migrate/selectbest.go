@@ -0,0 +1,167 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// race runs run for each of models on target, up to concurrency at a time in
+// model order, and returns the first model whose run builds target. No
+// further models are started once one has won, but runs still going are left
+// to the caller: cancel stops them and waits for them to return. err is set,
+// with everything already stopped, if no model built target.
+func race(ctx context.Context, models []string, target string, concurrency int, run func(ctx context.Context, model string) Result) (winner string, cancel func(), err error) {
+	ctx, cancelRuns := context.WithCancel(ctx)
+	var (
+		elect    sync.Once
+		won      = make(chan struct{})
+		result   Result
+		finished = make(chan struct{})
+	)
+	go func() {
+		defer close(finished)
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, max(concurrency, 1))
+	dispatch:
+		for _, model := range models {
+			select {
+			case slots <- struct{}{}:
+			case <-won:
+				break dispatch
+			}
+			select {
+			case <-won:
+				break dispatch
+			default:
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if r := run(ctx, model); r.Success {
+					elect.Do(func() {
+						winner, result = model, r
+						close(won)
+					})
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	cancel = func() {
+		cancelRuns()
+		<-finished
+	}
+	select {
+	case <-won:
+	case <-finished:
+		// The last run may have won just before finishing.
+		select {
+		case <-won:
+		default:
+			cancelRuns()
+			return "", func() {}, fmt.Errorf("no model built %s", target)
+		}
+	}
+	reason := "fastest to build the target"
+	if concurrency <= 1 {
+		reason = "first in model order to build the target"
+	}
+	slog.Info("Model won the race", "model", winner, "target", target, "reason", reason, "attempts", result.Attempts, "duration", result.Duration)
+	return winner, cancel, nil
+}
+
+// selectBestRepo races models on the first of targets and runs only the
+// winner, the first to build it, on the remaining targets. Every worktree is
+// set up before the race, since git does not support concurrent branch and
+// worktree changes in one repository. Runs cut short once a model has won,
+// or never started, are reported as skipped. It returns the results, how
+// many model/target pairs were planned, and the tracker the models were
+// recorded on.
+func (m *Migrator) selectBestRepo(ctx context.Context, repoDir, branch string, models, targets []string) ([]Result, int, *AttemptTracker, error) {
+	tracker := NewAttemptTracker()
+	if len(targets) == 0 || len(models) == 0 {
+		return nil, 0, tracker, nil
+	}
+	target := targets[0]
+	planned := len(models) + len(targets) - 1
+
+	// Each racing model gets its own Migrator, whose per-worktree state is
+	// then not shared between goroutines.
+	type entrant struct {
+		migrator     *Migrator
+		worktreePath string
+		baseCommit   string
+		result       Result
+		err          error
+	}
+	entrants := make(map[string]*entrant, len(models))
+	for _, model := range models {
+		racer := New(m.git, m.build, m.llm, m.opts)
+		worktreePath, err := racer.openWorktree(repoDir, m.modelBranch(branch, model, 0))
+		if err != nil {
+			return nil, planned, tracker, err
+		}
+		baseCommit, err := MergeBase(worktreePath, branch, "HEAD")
+		if err != nil {
+			slog.Warn("Error finding base commit", "model", model, "err", err)
+		}
+		entrants[model] = &entrant{migrator: racer, worktreePath: worktreePath, baseCommit: baseCommit}
+		tracker.AddModel("openrouter/"+model, worktreePath, baseCommit)
+	}
+
+	slog.Info("Racing models on the first target", "repo", m.opts.Repo, "target", target, "models", models, "concurrency", m.opts.Concurrency)
+	winner, stop, err := race(ctx, models, target, m.opts.Concurrency, func(ctx context.Context, model string) Result {
+		e := entrants[model]
+		if m.pastDeadline() || m.overBudget() {
+			return Result{}
+		}
+		result, err := e.migrator.runTarget(ctx, e.worktreePath, model, e.baseCommit, target)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Error racing model", "model", model, "target", target, "err", err)
+			}
+			e.err = err
+			return Result{}
+		}
+		e.result = result
+		return result
+	})
+	if err != nil {
+		slog.Warn("No model won the race; not running the remaining targets", "repo", m.opts.Repo, "err", err)
+	} else {
+		stop()
+	}
+
+	var results []Result
+	for _, model := range models {
+		result := entrants[model].result
+		if result.Target == "" {
+			result = Result{Model: "openrouter/" + model, Target: target, Skipped: true}
+		}
+		result.Repo = m.opts.Repo
+		tracker.Record(result)
+		results = append(results, result)
+	}
+	// A worktree left unusable would fail the rest of the run too.
+	for _, model := range models {
+		var worktreeErr *WorktreeError
+		if errors.As(entrants[model].err, &worktreeErr) {
+			return results, planned, tracker, entrants[model].err
+		}
+	}
+	if err != nil {
+		return results, planned, tracker, nil
+	}
+
+	// The winner carries on in its worktree, where the first target is
+	// already committed.
+	e := entrants[winner]
+	m.succeeded[e.worktreePath] = e.migrator.succeeded[e.worktreePath]
+	winnerResults, err := m.migrateModel(ctx, repoDir, branch, winner, 0, targets[1:], tracker)
+	return append(results, winnerResults...), planned, tracker, err
+}
@@ -0,0 +1,66 @@
+package migrate
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRace(t *testing.T) {
+
+	// Model b builds the target on its first attempt; a and c are still
+	// working on it when b wins.
+	var mu sync.Mutex
+	var cancelled []string
+	running := make(chan struct{}, 2)
+	run := func(ctx context.Context, model string) Result {
+		if model == "b" {
+			// Win only once a and c are both under way.
+			<-running
+			<-running
+			return Result{Model: "openrouter/b", Target: "//:ripgrep", Success: true, Attempts: 1}
+		}
+		running <- struct{}{}
+		<-ctx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		cancelled = append(cancelled, model)
+		return Result{}
+	}
+	winner, cancel, err := race(context.Background(), []string{"a", "b", "c"}, "//:ripgrep", 3, run)
+	if err != nil {
+		t.Fatalf("race: %v", err)
+	}
+	if winner != "b" {
+		t.Errorf("winner = %q, want b", winner)
+	}
+	cancel()
+	slices.Sort(cancelled)
+	if !slices.Equal(cancelled, []string{"a", "c"}) {
+		t.Errorf("cancelled = %q, want the losing runs a and c", cancelled)
+	}
+}
+
+func TestRaceInModelOrder(t *testing.T) {
+
+	var ran []string
+	run := func(ctx context.Context, model string) Result {
+		ran = append(ran, model)
+		return Result{Success: model == "b", Attempts: 1}
+	}
+	winner, cancel, err := race(context.Background(), []string{"a", "b", "c"}, "//:ripgrep", 1, run)
+	if err != nil {
+		t.Fatalf("race: %v", err)
+	}
+	cancel()
+	if winner != "b" || !slices.Equal(ran, []string{"a", "b"}) {
+		t.Errorf("winner = %q after running %q, want b without starting c", winner, ran)
+	}
+
+	_, _, err = race(context.Background(), []string{"a", "c"}, "//:ripgrep", 1, run)
+	if err == nil || !strings.Contains(err.Error(), "no model built //:ripgrep") {
+		t.Errorf("race with no winner = %v, want an error", err)
+	}
+}
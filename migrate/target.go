@@ -0,0 +1,417 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PlaceholderBuildFile is what a package that has no BUILD.bazel yet is given
+// before its target is migrated.
+const PlaceholderBuildFile = "# created by bld.go\n"
+
+// Seed is a BUILD file to try for a target before running the build-edit
+// loop, from one of Options.Seeds.
+type Seed struct {
+	Content []byte
+	// Source describes where Content came from, for logging.
+	Source string
+	// Start leaves Content in place as the build-edit loop's starting point
+	// if it does not build and the package had no BUILD file of its own.
+	Start bool
+}
+
+// BuildFileCache stores the BUILD files that built, keyed by the contents of
+// the crate they were written for, so an unchanged crate can reuse one.
+type BuildFileCache interface {
+	// Key identifies the crate in package pkg of worktreePath.
+	Key(worktreePath, pkg string) (string, error)
+	// Get returns the BUILD file stored for key, or nil if there is none.
+	Get(key string) ([]byte, error)
+	// Put stores content as the BUILD file for key.
+	Put(key string, content []byte) error
+}
+
+func ensureBuildBazelExists(worktreePath, target string) error {
+	pkg, _, err := ParseTargetPackage(target)
+	if err != nil {
+		return err
+	}
+	buildPath := filepath.Join(worktreePath, pkg, "BUILD.bazel")
+	if _, err := os.Stat(buildPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat %s: %w", buildPath, err)
+	}
+	dir := filepath.Dir(buildPath)
+	if dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create dir %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(buildPath, []byte(PlaceholderBuildFile), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", buildPath, err)
+	}
+	slog.Info("Created BUILD.bazel", "path", buildPath)
+	return nil
+}
+
+// preCheck reports whether target already queries and builds in
+// worktreePath, so no changes are needed. With Options.BazelCleanOnQueryFail,
+// a failed query cleans bazel's outputs before the build-edit loop starts.
+func (m *Migrator) preCheck(ctx context.Context, worktreePath, llmModel, target string, targetLog io.Writer) bool {
+	queryOut, queryErr := m.WithBazelRestart(worktreePath, func() ([]byte, error) {
+		return m.build.Query(ctx, worktreePath, targetLog, target)
+	})
+	if queryErr != nil {
+		slog.Debug("Pre-check bazel query failed", "model", llmModel, "target", target, "err", queryErr, "output", string(queryOut))
+		if m.opts.BazelCleanOnQueryFail {
+			if err := m.build.Clean(worktreePath, false); err != nil {
+				slog.Warn("bazel clean failed", "worktree", worktreePath, "err", err)
+			}
+		}
+		return false
+	}
+	bazelOut, bazelErr := m.WithBazelRestart(worktreePath, func() ([]byte, error) {
+		return m.build.Build(ctx, worktreePath, targetLog, target)
+	})
+	if bazelErr != nil {
+		slog.Debug("Pre-check bazel build failed", "model", llmModel, "target", target, "err", bazelErr, "output", string(bazelOut))
+		return false
+	}
+	slog.Info("bazel query and build succeeded; skipping aider", "model", llmModel, "target", target)
+	return true
+}
+
+// editFormat returns the aider edit format for llmModel.
+func (m *Migrator) editFormat(llmModel string) string {
+	if m.opts.EditFormat == nil {
+		return "diff"
+	}
+	return m.opts.EditFormat(llmModel)
+}
+
+// processTarget prepares the BUILD.bazel for target in worktreePath and, unless
+// the target already builds or a cached or seeded BUILD file builds it, runs
+// the build-edit loop with llmModel (falling back to Options.FallbackModel if
+// the provider is unavailable).
+func (m *Migrator) processTarget(ctx context.Context, worktreePath, llmModel, baseCommit, target string) (Result, error) {
+	if err := ensureBuildBazelExists(worktreePath, target); err != nil {
+		return Result{}, fmt.Errorf("error ensuring BUILD.bazel for target %s: %w", target, err)
+	}
+	targetLog, err := OpenTargetLog(filepath.Join(m.opts.LogDir, m.opts.Repo), llmModel, target)
+	if err != nil {
+		return Result{}, err
+	}
+	defer targetLog.Close()
+
+	// determine the BUILD.bazel path for the target to pass to aider
+	pkg, _, err := ParseTargetPackage(target)
+	if err != nil {
+		return Result{}, err
+	}
+	buildArg := filepath.Join(pkg, "BUILD.bazel")
+	// Pre-check: If bazel query then bazel build succeed without changes, skip aider.
+	if m.preCheck(ctx, worktreePath, llmModel, target, targetLog) {
+		return Result{Model: llmModel, Target: target, Success: true}, nil
+	}
+
+	run := Run{
+		WorktreePath: worktreePath,
+		Model:        llmModel,
+		Target:       target,
+		BuildFile:    buildArg,
+		EditFormat:   m.editFormat(llmModel),
+		BaseCommit:   baseCommit,
+		Log:          targetLog,
+	}
+	if !m.opts.NoChatHistory {
+		run.ChatHistoryFile = chatHistoryPath(worktreePath)
+	}
+	if m.opts.MaxAttemptsFor != nil {
+		run.MaxAttempts = m.opts.MaxAttemptsFor(worktreePath, target)
+	}
+	var cacheKey string
+	if m.opts.Cache != nil {
+		cacheKey, err = m.opts.Cache.Key(worktreePath, pkg)
+		if err != nil {
+			slog.Warn("Could not hash crate; not using the BUILD file cache", "target", target, "err", err)
+		}
+	}
+	if cacheKey != "" {
+		sha, ok, err := m.buildFromCache(ctx, run, cacheKey)
+		if err != nil {
+			return Result{}, err
+		}
+		if ok {
+			return Result{Model: llmModel, Target: target, Success: true, CommitSHA: sha}, nil
+		}
+	}
+	for _, seed := range m.opts.Seeds {
+		sha, ok, err := m.buildFromSeed(ctx, run, pkg, seed)
+		if err != nil {
+			return Result{}, err
+		}
+		if ok {
+			return Result{Model: llmModel, Target: target, Success: true, CommitSHA: sha}, nil
+		}
+	}
+	if m.opts.ReadFiles != nil {
+		run.ReadFiles, err = m.opts.ReadFiles(run, pkg)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	run.BuiltTargets = builtTargetLabels(target, m.succeeded[worktreePath])
+	if !m.opts.NoBuildExamples {
+		run.Examples, err = extractSuccessfulBuildFileExamples(worktreePath, m.succeeded[worktreePath])
+		if err != nil {
+			slog.Warn("Could not collect BUILD file examples", "target", target, "err", err)
+		}
+	}
+	result, err := m.MigrateTarget(ctx, run)
+	if errors.Is(err, ErrProviderUnavailable) && m.opts.FallbackModel != "" {
+		fallbackRun := run
+		fallbackRun.Model = m.opts.FallbackModel
+		slog.Warn("Model unavailable; falling back", "model", llmModel, "target", target, "err", err, "fallbackModel", fallbackRun.Model)
+		result, err = m.MigrateTarget(ctx, fallbackRun)
+		result.Model = llmModel
+		result.FallbackModel = fallbackRun.Model
+	}
+	if err == nil && result.Success && cacheKey != "" {
+		content, readErr := os.ReadFile(filepath.Join(worktreePath, buildArg))
+		if readErr == nil {
+			readErr = m.opts.Cache.Put(cacheKey, content)
+		}
+		if readErr != nil {
+			slog.Warn("Could not cache BUILD file", "target", target, "err", readErr)
+		}
+	}
+	if errors.Is(err, ErrProviderUnavailable) {
+		slog.Error("Giving up on target", "model", llmModel, "target", target, "err", err)
+		return result, nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Deadline grace period expired during target", "model", llmModel, "target", target)
+		return result, nil
+	}
+	if m.opts.Interrupted != nil && m.opts.Interrupted() {
+		m.saveInterruptedWork(worktreePath, llmModel, target)
+		return result, nil
+	}
+	return result, err
+}
+
+// buildFromCache drops in the cached BUILD.bazel for key and keeps it if
+// run.Target then builds, returning the commit SHA. It reports false, with the
+// original BUILD.bazel restored, on a cache miss or failed build.
+func (m *Migrator) buildFromCache(ctx context.Context, run Run, key string) (string, bool, error) {
+	cached, err := m.opts.Cache.Get(key)
+	if err != nil || cached == nil {
+		return "", false, err
+	}
+	return m.tryBuildFile(ctx, run, cached, "cache "+key)
+}
+
+// buildFromSeed tries the BUILD file seed returns for run.Target in package
+// pkg, returning the commit SHA if it builds as is. A seed that fails is
+// logged and skipped. If the BUILD file does not build but Seed.Start is set
+// and the package has no BUILD file of its own yet, it is left in place as
+// the build-edit loop's starting point.
+func (m *Migrator) buildFromSeed(ctx context.Context, run Run, pkg string, seed func(run Run, pkg string) (*Seed, error)) (string, bool, error) {
+	s, err := seed(run, pkg)
+	if err != nil {
+		slog.Warn("Could not seed BUILD.bazel", "target", run.Target, "err", err)
+		return "", false, nil
+	}
+	if s == nil {
+		return "", false, nil
+	}
+	sha, ok, err := m.tryBuildFile(ctx, run, s.Content, s.Source)
+	if err != nil || ok || !s.Start {
+		return sha, ok, err
+	}
+	buildPath := filepath.Join(run.WorktreePath, run.BuildFile)
+	current, err := os.ReadFile(buildPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", buildPath, err)
+	}
+	if string(current) == PlaceholderBuildFile {
+		if err := os.WriteFile(buildPath, s.Content, 0644); err != nil {
+			return "", false, fmt.Errorf("failed to write %s: %w", buildPath, err)
+		}
+		slog.Info("Starting aider from seeded BUILD.bazel", "model", run.Model, "target", run.Target, "source", s.Source)
+	}
+	return "", false, nil
+}
+
+// tryBuildFile writes content to run.BuildFile and commits it if run.Target
+// then builds, returning the commit SHA. Otherwise the original BUILD.bazel
+// is restored and it reports false. source describes where content came from
+// for logging.
+func (m *Migrator) tryBuildFile(ctx context.Context, run Run, content []byte, source string) (string, bool, error) {
+	buildPath := filepath.Join(run.WorktreePath, run.BuildFile)
+	original, err := os.ReadFile(buildPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", buildPath, err)
+	}
+	if err := os.WriteFile(buildPath, content, 0644); err != nil {
+		return "", false, fmt.Errorf("failed to write %s: %w", buildPath, err)
+	}
+	out, err := m.build.Build(ctx, run.WorktreePath, run.Log, run.Target)
+	if err != nil {
+		slog.Info("BUILD.bazel did not build; falling back to aider", "model", run.Model, "target", run.Target, "source", source)
+		slog.Debug("bazel build failed", "target", run.Target, "source", source, "err", err, "output", string(out))
+		if err := os.WriteFile(buildPath, original, 0644); err != nil {
+			return "", false, fmt.Errorf("failed to restore %s: %w", buildPath, err)
+		}
+		return "", false, nil
+	}
+	sha, err := m.CommitTarget(run, 0)
+	if err != nil {
+		return "", false, err
+	}
+	slog.Info("Built without aider", "model", run.Model, "target", run.Target, "source", source)
+	return sha, true, nil
+}
+
+// outsidePackage returns the files that are not in pkg or one of its
+// subdirectories.
+func outsidePackage(pkg string, files []string) []string {
+	var outside []string
+	for _, f := range files {
+		if pkg != "" && !strings.HasPrefix(f, pkg+"/") {
+			outside = append(outside, f)
+		}
+	}
+	return outside
+}
+
+// recordChangedFiles sets the files result's target changed since the
+// worktree was at commit before, flagging any outside the target's package.
+func (m *Migrator) recordChangedFiles(result *Result, worktreePath, before string) error {
+	if !result.Success || result.CommitSHA == "" {
+		return nil
+	}
+	files, err := m.git.DiffNames(worktreePath, before, result.CommitSHA)
+	if err != nil {
+		return err
+	}
+	result.ChangedFiles = files
+	pkg, _, err := ParseTargetPackage(result.Target)
+	if err != nil {
+		return err
+	}
+	result.OutsidePackage = outsidePackage(pkg, files)
+	if len(result.OutsidePackage) > 0 {
+		slog.Warn("Model changed files outside the target's package", "model", result.Model, "target", result.Target, "files", result.OutsidePackage)
+	}
+	return nil
+}
+
+// checkRuleKind sets the rule kind of result's target, which must have built,
+// and flags it if it is not the kind Options.ExpectedKind expects.
+func (m *Migrator) checkRuleKind(result *Result, worktreePath string) error {
+	kind, err := m.build.RuleKind(worktreePath, result.Target)
+	if err != nil {
+		return err
+	}
+	result.Kind = kind
+	if m.opts.ExpectedKind == nil {
+		return nil
+	}
+	if want := m.opts.ExpectedKind(result.Target); want != "" && kind != want {
+		result.WrongKind = true
+		slog.Warn("Target built with the wrong rule kind", "model", result.Model, "target", result.Target, "kind", kind, "want", want)
+	}
+	return nil
+}
+
+// saveInterruptedWork stashes whatever an interrupted target left in
+// worktreePath, so the worktree is clean for a later run and the partial
+// changes can be recovered with git stash pop.
+func (m *Migrator) saveInterruptedWork(worktreePath, llmModel, target string) {
+	stashed, err := m.git.StashAll(worktreePath)
+	switch {
+	case err != nil:
+		slog.Error("Could not stash interrupted work", "model", llmModel, "target", target, "worktree", worktreePath, "err", err)
+	case stashed:
+		slog.Warn("Stashed interrupted work", "model", llmModel, "target", target, "worktree", worktreePath)
+	}
+}
+
+// runTarget has model build target in worktreePath, emitting the
+// target_start and target_done events and recording what the model changed.
+func (m *Migrator) runTarget(ctx context.Context, worktreePath, model, baseCommit, target string) (Result, error) {
+	llmModel := "openrouter/" + model
+	warnLowDiskSpace(worktreePath, m.opts.MinFreeBytes)
+	m.emit(Event{Type: EventTargetStart, Repo: m.opts.Repo, Model: llmModel, Target: target})
+	before, headErr := m.git.HeadSHA(worktreePath)
+	start := time.Now()
+	result, err := m.processTarget(ctx, worktreePath, llmModel, baseCommit, target)
+	result.Duration = time.Since(start)
+	if err == nil && headErr == nil {
+		if err := m.recordChangedFiles(&result, worktreePath, before); err != nil {
+			slog.Warn("Could not list changed files", "model", llmModel, "target", target, "err", err)
+		}
+	}
+	if err == nil && result.Success {
+		m.succeeded[worktreePath] = append(m.succeeded[worktreePath], target)
+		if err := m.checkRuleKind(&result, worktreePath); err != nil {
+			slog.Warn("Could not check rule kind", "model", llmModel, "target", target, "err", err)
+		}
+	}
+	done := Event{Type: EventTargetDone, Repo: m.opts.Repo, Model: llmModel, Target: target, Status: resultStatus(result), CommitSHA: result.CommitSHA, Attempt: result.Attempts}
+	if err != nil {
+		done.Status, done.Error = "failed", err.Error()
+	}
+	m.emit(done)
+	return result, err
+}
+
+// maxExampleBytes caps the BUILD file examples put in each prompt.
+const maxExampleBytes = 3000
+
+// extractSuccessfulBuildFileExamples returns the BUILD.bazel files of
+// succeededTargets in worktreePath, formatted as working examples for the
+// prompt, or "" if there are none. Each package's file is shown once, most
+// recently built first, and files that would take the section past
+// maxExampleBytes are left out.
+func extractSuccessfulBuildFileExamples(worktreePath string, succeededTargets []string) (string, error) {
+	var b strings.Builder
+	var seen []string
+	for _, target := range slices.Backward(succeededTargets) {
+		pkg, _, err := ParseTargetPackage(target)
+		if err != nil {
+			return "", err
+		}
+		buildFile := filepath.Join(pkg, "BUILD.bazel")
+		if slices.Contains(seen, buildFile) {
+			continue
+		}
+		seen = append(seen, buildFile)
+		content, err := os.ReadFile(filepath.Join(worktreePath, buildFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read example %s: %w", buildFile, err)
+		}
+		example := fmt.Sprintf("%s:\n```\n%s\n```\n", buildFile, strings.TrimSpace(string(content)))
+		if b.Len()+len(example) > maxExampleBytes {
+			continue
+		}
+		b.WriteString(example)
+	}
+	if b.Len() == 0 {
+		return "", nil
+	}
+	return "Here are working BUILD.bazel files from this repo that already build:\n\n" + strings.TrimSuffix(b.String(), "\n"), nil
+}
@@ -0,0 +1,92 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnsureBuildBazelExists(t *testing.T) {
+	wt := t.TempDir()
+	writeFile(t, filepath.Join(wt, "crates/cli/BUILD.bazel"), "rust_library(name = \"grep_cli\")\n")
+	if err := os.MkdirAll(filepath.Join(wt, "crates/matcher"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, target, path, want string
+	}{
+		{name: "existing file is kept", target: "//crates/cli:grep_cli", path: "crates/cli/BUILD.bazel", want: "rust_library(name = \"grep_cli\")\n"},
+		{name: "root package", target: "//:ripgrep", path: "BUILD.bazel", want: PlaceholderBuildFile},
+		{name: "nested package", target: "//crates/matcher:grep_matcher", path: "crates/matcher/BUILD.bazel", want: PlaceholderBuildFile},
+		{name: "missing directory is created", target: "//crates/new", path: "crates/new/BUILD.bazel", want: PlaceholderBuildFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ensureBuildBazelExists(wt, tt.target); err != nil {
+				t.Fatalf("ensureBuildBazelExists(%s): %v", tt.target, err)
+			}
+			got, err := os.ReadFile(filepath.Join(wt, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("%s = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("malformed label", func(t *testing.T) {
+		if err := ensureBuildBazelExists(wt, "crates/cli"); err == nil {
+			t.Error("ensureBuildBazelExists of a label without // succeeded, want error")
+		}
+	})
+
+	t.Run("read-only directory", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root ignores directory permissions")
+		}
+		dir := filepath.Join(wt, "crates/readonly")
+		if err := os.MkdirAll(dir, 0555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(dir, 0755) })
+		err := ensureBuildBazelExists(wt, "//crates/readonly")
+		if !errors.Is(err, os.ErrPermission) {
+			t.Errorf("ensureBuildBazelExists in a read-only directory = %v, want a wrapped permission error", err)
+		}
+	})
+}
+
+func TestOutsidePackage(t *testing.T) {
+	if got := outsidePackage("", []string{"BUILD.bazel", "MODULE.bazel"}); got != nil {
+		t.Errorf("outsidePackage for the root package = %q, want none", got)
+	}
+	if got := outsidePackage("crates/core", []string{"crates/core/BUILD.bazel", "crates/core_extra/BUILD.bazel"}); !slices.Equal(got, []string{"crates/core_extra/BUILD.bazel"}) {
+		t.Errorf("outsidePackage = %q, want the sibling directory's file", got)
+	}
+}
+
+func TestExtractSuccessfulBuildFileExamples(t *testing.T) {
+	wt := t.TempDir()
+	writeFile(t, filepath.Join(wt, "crates/matcher/BUILD.bazel"), "rust_library(name = \"grep_matcher\")\n")
+	writeFile(t, filepath.Join(wt, "crates/globset/BUILD.bazel"), "rust_library(name = \"globset\")\n")
+	writeFile(t, filepath.Join(wt, "BUILD.bazel"), "# "+strings.Repeat("x", maxExampleBytes)+"\n")
+
+	if got, err := extractSuccessfulBuildFileExamples(wt, nil); err != nil || got != "" {
+		t.Errorf("extractSuccessfulBuildFileExamples with no targets = %q, %v; want empty", got, err)
+	}
+	got, err := extractSuccessfulBuildFileExamples(wt, []string{"//crates/matcher:grep_matcher", "//:ripgrep", "//crates/globset", "//crates/matcher:grep_matcher", "//crates/cli:grep_cli"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Here are working BUILD.bazel files from this repo that already build:\n\n" +
+		"crates/matcher/BUILD.bazel:\n```\nrust_library(name = \"grep_matcher\")\n```\n" +
+		"crates/globset/BUILD.bazel:\n```\nrust_library(name = \"globset\")\n```"
+	if got != want {
+		t.Errorf("extractSuccessfulBuildFileExamples = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+package migrate
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// RunKey identifies a model's branch within a run: the model itself, or the
+// model and repetition number when running with Options.Repeat.
+func RunKey(model string, repetition int) string {
+	if repetition == 0 {
+		return model
+	}
+	return fmt.Sprintf("%s#%d", model, repetition)
+}
+
+// modelCommit identifies the commit a model produced for a target.
+type modelCommit struct {
+	Model string
+	SHA   string
+}
+
+// AttemptTracker collects the outcome of every model on every target across a
+// run, including the commit each successful model landed, so results from one
+// model's branch can be shared with the others.
+type AttemptTracker struct {
+	models      []string
+	worktrees   map[string]string
+	baseCommits map[string]string
+	// commits holds, per target, the successful commits in model run order.
+	commits   map[string][]modelCommit
+	succeeded map[string]map[string]bool
+}
+
+// NewAttemptTracker returns an empty tracker.
+func NewAttemptTracker() *AttemptTracker {
+	return &AttemptTracker{
+		worktrees:   make(map[string]string),
+		baseCommits: make(map[string]string),
+		commits:     make(map[string][]modelCommit),
+		succeeded:   make(map[string]map[string]bool),
+	}
+}
+
+// AddModel registers a model (keyed by RunKey) along with its worktree and the
+// commit its branch was forked from.
+func (t *AttemptTracker) AddModel(model, worktreePath, baseCommit string) {
+	if _, ok := t.worktrees[model]; !ok {
+		t.models = append(t.models, model)
+	}
+	t.worktrees[model] = worktreePath
+	t.baseCommits[model] = baseCommit
+}
+
+// Models returns the registered models in the order they were added.
+func (t *AttemptTracker) Models() []string {
+	return t.models
+}
+
+// Worktree returns the worktree path registered for model.
+func (t *AttemptTracker) Worktree(model string) string {
+	return t.worktrees[model]
+}
+
+// Record stores the outcome of a single model/target result.
+func (t *AttemptTracker) Record(r Result) {
+	if !r.Success {
+		return
+	}
+	key := RunKey(r.Model, r.Repetition)
+	if t.succeeded[r.Target] == nil {
+		t.succeeded[r.Target] = make(map[string]bool)
+	}
+	t.succeeded[r.Target][key] = true
+	if r.CommitSHA != "" {
+		t.commits[r.Target] = append(t.commits[r.Target], modelCommit{Model: key, SHA: r.CommitSHA})
+	}
+}
+
+// BestCommit returns the commit of the first model that built target.
+func (t *AttemptTracker) BestCommit(target string) (modelCommit, bool) {
+	commits := t.commits[target]
+	if len(commits) == 0 {
+		return modelCommit{}, false
+	}
+	return commits[0], true
+}
+
+// Stuck returns the models, in run order, that did not build target.
+func (t *AttemptTracker) Stuck(target string) []string {
+	var stuck []string
+	for _, model := range t.models {
+		if !t.succeeded[target][model] {
+			stuck = append(stuck, model)
+		}
+	}
+	return stuck
+}
+
+// cherryPickFromBest copies, for each target, the first successful
+// model's commit onto every model branch that is still stuck on that target.
+// Branches forked from a different base commit are left alone since the
+// commit may not apply to their history.
+func cherryPickFromBest(t *AttemptTracker, targets []string) {
+	for _, target := range targets {
+		best, ok := t.BestCommit(target)
+		if !ok {
+			continue
+		}
+		bestBase := t.baseCommits[best.Model]
+		for _, model := range t.Stuck(target) {
+			if bestBase == "" || t.baseCommits[model] != bestBase {
+				slog.Warn("Not cherry-picking: branch is not based on the same commit", "commit", best.SHA, "from", best.Model, "into", model, "target", target)
+				continue
+			}
+			if err := CherryPick(t.worktrees[model], best.SHA); err != nil {
+				slog.Error("Could not cherry-pick", "commit", best.SHA, "from", best.Model, "into", model, "target", target, "err", err)
+				continue
+			}
+			slog.Info("Cherry-picked", "commit", best.SHA, "from", best.Model, "into", model, "target", target)
+		}
+	}
+}
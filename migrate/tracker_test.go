@@ -0,0 +1,64 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCherryPickFromBest(t *testing.T) {
+	dir, git := newTestRepo(t)
+	writeFile(t, filepath.Join(dir, "Cargo.toml"), "")
+	git("add", "-A")
+	git("commit", "-q", "-m", "base")
+	base := git("rev-parse", "HEAD")
+
+	tracker := NewAttemptTracker()
+	worktrees := make(map[string]string)
+	for _, model := range []string{"best", "stuck", "rebased", "conflicting"} {
+		worktrees[model] = filepath.Join(t.TempDir(), model)
+		git("worktree", "add", "-q", "-b", model, worktrees[model], base)
+	}
+	commit := func(model, content, message string) string {
+		writeFile(t, filepath.Join(worktrees[model], "crates/cli/BUILD.bazel"), content)
+		git("-C", worktrees[model], "add", "-A")
+		git("-C", worktrees[model], "commit", "-q", "-m", message)
+		return git("-C", worktrees[model], "rev-parse", "HEAD")
+	}
+	const built = "rust_library(name = \"grep_cli\")\n"
+	bestSHA := commit("best", built, "aider: build //crates/cli")
+	// rebased's branch was forked from a later commit than the others.
+	writeFile(t, filepath.Join(worktrees["rebased"], "README.md"), "")
+	git("-C", worktrees["rebased"], "add", "-A")
+	git("-C", worktrees["rebased"], "commit", "-q", "-m", "later base")
+	rebasedBase := git("-C", worktrees["rebased"], "rev-parse", "HEAD")
+	// conflicting kept its own broken BUILD file for the target.
+	conflictingHead := commit("conflicting", "rust_library(name = \"cli\", srcs = [\"/src\"])\n", "aider: FAILED attempt 1 at //crates/cli")
+
+	tracker.AddModel("best", worktrees["best"], base)
+	tracker.AddModel("stuck", worktrees["stuck"], base)
+	tracker.AddModel("rebased", worktrees["rebased"], rebasedBase)
+	tracker.AddModel("conflicting", worktrees["conflicting"], base)
+	tracker.Record(Result{Model: "best", Target: "//crates/cli", Success: true, CommitSHA: bestSHA})
+
+	cherryPickFromBest(tracker, []string{"//crates/cli", "//:ripgrep"})
+
+	if got := git("-C", worktrees["stuck"], "log", "-1", "--format=%s"); got != "aider: build //crates/cli" {
+		t.Errorf("stuck branch HEAD = %q, want the best model's commit cherry-picked", got)
+	}
+	if content, err := os.ReadFile(filepath.Join(worktrees["stuck"], "crates/cli/BUILD.bazel")); err != nil || string(content) != built {
+		t.Errorf("stuck branch BUILD file = %q, %v; want %q", content, err, built)
+	}
+	if got := git("-C", worktrees["rebased"], "rev-parse", "HEAD"); got != rebasedBase {
+		t.Errorf("branch with a different base moved to %s, want it left at %s", got, rebasedBase)
+	}
+	if got := git("-C", worktrees["conflicting"], "rev-parse", "HEAD"); got != conflictingHead {
+		t.Errorf("conflicting branch moved to %s, want it left at %s", got, conflictingHead)
+	}
+	if status := git("-C", worktrees["conflicting"], "status", "--porcelain"); status != "" {
+		t.Errorf("conflicting worktree is not clean after the aborted cherry-pick:\n%s", status)
+	}
+	if got := git("-C", worktrees["best"], "rev-parse", "HEAD"); got != bestSHA {
+		t.Errorf("best branch moved to %s, want %s", got, bestSHA)
+	}
+}
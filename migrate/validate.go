@@ -0,0 +1,29 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// validateChangedBuildFiles checks the syntax of every changed BUILD file in
+// worktreePath, returning the first failure.
+func (m *Migrator) validateChangedBuildFiles(worktreePath string) error {
+	files, err := changedBuildFiles(m.git, worktreePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(worktreePath, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // deleted
+			}
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if err := m.build.CheckSyntax(file, string(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
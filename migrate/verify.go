@@ -0,0 +1,104 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// ModelVerification records whether a model's worktree builds as a whole,
+// as opposed to only target by target.
+type ModelVerification struct {
+	Repo     string `json:"repo,omitempty"`
+	Model    string `json:"model"`
+	Worktree string `json:"worktree"`
+	// FullBuildOK is set when bazel build //... succeeded in the worktree,
+	// and bazel test //... too if Tested is set.
+	FullBuildOK bool `json:"fullBuildOK"`
+	Tested      bool `json:"tested,omitempty"`
+}
+
+// verifyWorktree runs bazel build //..., then with Options.RunTests bazel
+// test //..., in the worktree of model (a RunKey). Output goes to the model's
+// "..." log.
+func (m *Migrator) verifyWorktree(ctx context.Context, model, worktreePath string) (ModelVerification, error) {
+	runTests := m.opts.RunTests
+	v := ModelVerification{Repo: m.opts.Repo, Model: model, Worktree: worktreePath, Tested: runTests}
+	verifyLog, err := OpenTargetLog(filepath.Join(m.opts.LogDir, m.opts.Repo), model, "//...")
+	if err != nil {
+		return v, err
+	}
+	defer verifyLog.Close()
+	if _, err := m.build.Build(ctx, worktreePath, verifyLog, "//..."); err != nil {
+		slog.Warn("Full build failed", "model", model, "worktree", worktreePath, "log", verifyLog.Name(), "err", err)
+		return v, nil
+	}
+	if runTests {
+		if _, err := m.build.Test(ctx, worktreePath, verifyLog, "//..."); err != nil {
+			slog.Warn("Full test failed", "model", model, "worktree", worktreePath, "log", verifyLog.Name(), "err", err)
+			return v, nil
+		}
+	}
+	v.FullBuildOK = true
+	return v, nil
+}
+
+// VerifyModels checks every model worktree recorded on tracker, logging
+// which models produced a migration that builds as a whole and which are only
+// green target by target.
+func (m *Migrator) VerifyModels(ctx context.Context, tracker *AttemptTracker) ([]ModelVerification, error) {
+	var verifications []ModelVerification
+	for _, model := range tracker.Models() {
+		if _, err := os.Stat(tracker.Worktree(model)); os.IsNotExist(err) {
+			slog.Warn("Worktree was evicted; not verifying it", "model", model, "worktree", tracker.Worktree(model))
+			continue
+		}
+		v, err := m.verifyWorktree(ctx, model, tracker.Worktree(model))
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify %s: %w", model, err)
+		}
+		if v.FullBuildOK {
+			slog.Info("Migration is globally consistent", "model", model, "tested", v.Tested)
+		} else {
+			slog.Warn("Migration is only piecemeal green", "model", model, "tested", v.Tested)
+		}
+		verifications = append(verifications, v)
+	}
+	return verifications, nil
+}
+
+// TrackExistingModels registers the worktree of every model branch off of
+// branch, in the repository at repoDir, that already exists, with a worktree
+// per repetition if Options.Repeat is set. Models without a branch are
+// skipped with a warning.
+func (m *Migrator) TrackExistingModels(repoDir, branch string, models []string) (*AttemptTracker, error) {
+	tracker := NewAttemptTracker()
+	repetitions := []int{0}
+	if m.opts.Repeat > 1 {
+		repetitions = nil
+		for repetition := 1; repetition <= m.opts.Repeat; repetition++ {
+			repetitions = append(repetitions, repetition)
+		}
+	}
+	for _, model := range models {
+		for _, repetition := range repetitions {
+			modelBranch := m.modelBranch(branch, model, repetition)
+			exists, err := m.git.BranchExists(repoDir, modelBranch)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				slog.Warn("No branch to verify", "model", model, "branch", modelBranch)
+				continue
+			}
+			worktreePath, err := m.SetupWorktree(repoDir, modelBranch)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set up worktree for %s: %w", modelBranch, err)
+			}
+			tracker.AddModel(RunKey("openrouter/"+model, repetition), worktreePath, "")
+		}
+	}
+	return tracker, nil
+}
@@ -0,0 +1,208 @@
+package migrate
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// createGitBranchIfNotExists ensures the given branch exists in the repo at dir.
+// If the branch does not exist it will be created. The function logs progress
+// similarly to the previous inline behavior.
+func createGitBranchIfNotExists(git GitManager, dir, branchName string) error {
+	exists, err := git.BranchExists(dir, branchName)
+	if err != nil {
+		return fmt.Errorf("failed to check if branch %s exists: %w", branchName, err)
+	}
+	if exists {
+		slog.Info("Branch already exists", "branch", branchName)
+		return nil
+	}
+
+	slog.Info("Branch does not exist, creating", "branch", branchName)
+	if err := git.CreateBranch(dir, branchName); err != nil {
+		return fmt.Errorf("failed to create branch %s: %w", branchName, err)
+	}
+	slog.Info("Branch created", "branch", branchName)
+	return nil
+}
+
+// createGitWorktreeIfNotExists ensures the given worktree exists at worktreePath
+// with branchName checked out. If the worktree does not exist it will be
+// created. A directory left behind by a crashed run that git does not know
+// as a worktree, or that has another branch or a detached HEAD checked out,
+// is removed and the worktree added afresh, as is a worktree whose directory
+// was deleted but which git still has registered.
+func createGitWorktreeIfNotExists(git GitManager, repoDir, worktreePath, branchName string) error {
+	exists, err := WorktreeExists(worktreePath)
+	if err != nil {
+		return fmt.Errorf("failed to check if worktree %s exists: %w", worktreePath, err)
+	}
+	if exists {
+		branch, registered, err := git.WorktreeBranch(repoDir, worktreePath)
+		if err != nil {
+			return fmt.Errorf("failed to check worktree %s: %w", worktreePath, err)
+		}
+		if registered && branch == branchName {
+			slog.Info("Worktree already exists", "path", worktreePath)
+			return nil
+		}
+		slog.Warn("Repairing worktree", "path", worktreePath, "registered", registered, "branch", branch, "want", branchName)
+		if err := removeGitWorktree(git, repoDir, worktreePath); err != nil {
+			return err
+		}
+	} else {
+		slog.Info("Worktree does not exist, creating", "path", worktreePath)
+		// git refuses to add a worktree at a path it still has registered
+		// because its directory was deleted.
+		if err := git.PruneWorktrees(repoDir); err != nil {
+			return err
+		}
+	}
+	if err := git.AddWorktree(repoDir, worktreePath, branchName); err != nil {
+		return fmt.Errorf("failed to add worktree at %s for branch %s: %w", worktreePath, branchName, err)
+	}
+	slog.Info("Worktree created", "path", worktreePath, "repaired", exists)
+	return nil
+}
+
+// removeGitWorktree deletes the worktree directory at worktreePath and has git
+// forget it, along with any other worktrees whose directories are gone.
+func removeGitWorktree(git GitManager, repoDir, worktreePath string) error {
+	if err := os.RemoveAll(worktreePath); err != nil {
+		return fmt.Errorf("failed to remove worktree %s: %w", worktreePath, err)
+	}
+	return git.PruneWorktrees(repoDir)
+}
+
+// SetupWorktree ensures branch exists in the repo at repoDir and is checked
+// out in a worktree under Options.WorktreeDir, returning the worktree path. A
+// worktree that fails its health check is recreated.
+func (m *Migrator) SetupWorktree(repoDir, branch string) (string, error) {
+	if err := validateBranchName(branch); err != nil {
+		return "", err
+	}
+	worktreePath := filepath.Join(m.opts.WorktreeDir, branch)
+	if err := checkDiskSpace(m.opts.WorktreeDir, m.opts.MinFreeBytes); err != nil {
+		return "", err
+	}
+	if err := createGitBranchIfNotExists(m.git, repoDir, branch); err != nil {
+		return "", err
+	}
+	if err := createGitWorktreeIfNotExists(m.git, repoDir, worktreePath, branch); err != nil {
+		return "", err
+	}
+	if err := m.git.HealthCheck(repoDir, worktreePath, branch); err != nil {
+		slog.Warn("Worktree failed health check; recreating it", "path", worktreePath, "err", err)
+		if err := removeGitWorktree(m.git, repoDir, worktreePath); err != nil {
+			return "", err
+		}
+		if err := m.git.AddWorktree(repoDir, worktreePath, branch); err != nil {
+			return "", fmt.Errorf("failed to recreate worktree at %s for branch %s: %w", worktreePath, branch, err)
+		}
+		if err := m.git.HealthCheck(repoDir, worktreePath, branch); err != nil {
+			return "", fmt.Errorf("worktree %s is unusable even after recreating it: %w", worktreePath, err)
+		}
+	}
+	return worktreePath, nil
+}
+
+// validateBranchName applies git's ref name rules (see git-check-ref-format)
+// to a branch name, so a bad Options.BranchPrefix or base branch fails with a
+// clear error rather than partway through git branch.
+func validateBranchName(name string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid branch name %q: %s", name, reason)
+	}
+	switch {
+	case name == "" || name == "@":
+		return invalid("empty or @")
+	case strings.HasPrefix(name, "-"):
+		return invalid("starts with -")
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.Contains(name, "//"):
+		return invalid("empty path component")
+	case strings.HasSuffix(name, "."):
+		return invalid("ends with .")
+	case strings.Contains(name, ".."):
+		return invalid("contains ..")
+	case strings.Contains(name, "@{"):
+		return invalid("contains @{")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return invalid(fmt.Sprintf("contains %q", r))
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return invalid("a component starts with . or ends with .lock")
+		}
+	}
+	return nil
+}
+
+// modelBranchName returns the branch model's migration (and repetition, with
+// Options.Repeat) of repo is committed to, off of branch. repo is empty for a
+// run that migrates a single repository. prefix goes before the model.
+func modelBranchName(branch, repo, prefix, model string, repetition int) string {
+	modelBranch := branch + "-"
+	if repo != "" {
+		modelBranch += repo + "-"
+	}
+	modelBranch += SanitizePath(prefix + "openrouter/" + model)
+	if repetition > 0 {
+		modelBranch += fmt.Sprintf("-rep%d", repetition)
+	}
+	return modelBranch
+}
+
+// modelBranch returns modelBranchName for the Migrator's repository and
+// Options.BranchPrefix.
+func (m *Migrator) modelBranch(branch, model string, repetition int) string {
+	return modelBranchName(branch, m.opts.Repo, m.opts.BranchPrefix, model, repetition)
+}
+
+// evictWorktrees removes the worktrees under Options.WorktreeDir that
+// monitorWorktreeDiskUsage picks to bring their bazel output under
+// Options.MaxBazelCacheBytes, expunging each one's output base first. Model
+// branches are kept. Failures are logged, as the run can go on without the
+// space.
+func (m *Migrator) evictWorktrees(repoDir string) {
+	evict, err := monitorWorktreeDiskUsage(m.opts.WorktreeDir, m.opts.MaxBazelCacheBytes)
+	if err != nil {
+		slog.Warn("Could not measure worktree disk usage", "dir", m.opts.WorktreeDir, "err", err)
+		return
+	}
+	for _, worktreePath := range evict {
+		slog.Info("Evicting worktree to bound bazel disk usage", "worktree", worktreePath, "maxBazelCacheGB", round2(float64(m.opts.MaxBazelCacheBytes)/bytesPerGB))
+		if err := m.build.Clean(worktreePath, true); err != nil {
+			slog.Warn("bazel clean --expunge failed", "worktree", worktreePath, "err", err)
+		}
+		if err := removeGitWorktree(m.git, repoDir, worktreePath); err != nil {
+			slog.Warn("Could not remove worktree", "worktree", worktreePath, "err", err)
+		}
+	}
+}
+
+// openWorktree sets up branch and its worktree, ready for a model to work in,
+// and returns the worktree path.
+func (m *Migrator) openWorktree(repoDir, branch string) (string, error) {
+	worktreePath, err := m.SetupWorktree(repoDir, branch)
+	if err != nil {
+		return "", fmt.Errorf("failed to set up worktree for branch %s: %w", branch, err)
+	}
+
+	// Start each model from a clean analysis cache.
+	if err := m.build.Clean(worktreePath, false); err != nil {
+		slog.Warn("bazel clean failed", "worktree", worktreePath, "err", err)
+	}
+
+	// Fetch dependencies up front; real dependency problems still surface in
+	// the per-target loop, so a failure here is not fatal.
+	if err := m.build.Sync(worktreePath); err != nil {
+		slog.Warn("Error syncing bazel dependencies", "worktree", worktreePath, "err", err)
+	}
+	return worktreePath, nil
+}
@@ -0,0 +1,120 @@
+package migrate_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateGitBranchIfNotExists(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	for i := 0; i < 2; i++ {
+		if err := migrate.CreateGitBranchIfNotExists(git, "repo", "main-model"); err != nil {
+			t.Fatalf("call %d: createGitBranchIfNotExists: %v", i+1, err)
+		}
+	}
+	if !git.Branches["main-model"] {
+		t.Errorf("branch main-model was not created; branches = %v", git.Branches)
+	}
+}
+
+func TestCreateGitWorktreeIfNotExists(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	git.Branches["main-model"] = true
+	worktreePath := filepath.Join(t.TempDir(), "main-model")
+	for i := 0; i < 2; i++ {
+		if err := migrate.CreateGitWorktreeIfNotExists(git, "repo", worktreePath, "main-model"); err != nil {
+			t.Fatalf("call %d: createGitWorktreeIfNotExists: %v", i+1, err)
+		}
+	}
+	if got := git.Worktrees[worktreePath]; got != "main-model" {
+		t.Errorf("worktree branch = %q, want main-model", got)
+	}
+	if _, err := os.Stat(worktreePath); err != nil {
+		t.Errorf("worktree directory was not created: %v", err)
+	}
+}
+
+func TestCreateGitWorktreeRepairs(t *testing.T) {
+	tests := []struct {
+		name     string
+		branch   string
+		register bool
+	}{
+		{name: "unregistered directory"},
+		{name: "other branch", branch: "main-other", register: true},
+		{name: "detached HEAD", register: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := migratetest.NewFakeGitManager()
+			git.Branches["main-model"] = true
+			worktreePath := filepath.Join(t.TempDir(), "main-model")
+			writeFile(t, filepath.Join(worktreePath, "leftover"), "")
+			if tt.register {
+				git.Worktrees[worktreePath] = tt.branch
+			}
+			if err := migrate.CreateGitWorktreeIfNotExists(git, "repo", worktreePath, "main-model"); err != nil {
+				t.Fatalf("createGitWorktreeIfNotExists: %v", err)
+			}
+			if got := git.Worktrees[worktreePath]; got != "main-model" {
+				t.Errorf("worktree branch = %q, want main-model", got)
+			}
+			if _, err := os.Stat(filepath.Join(worktreePath, "leftover")); !os.IsNotExist(err) {
+				t.Errorf("leftover file survived the repair: %v", err)
+			}
+		})
+	}
+}
+
+func TestSetupWorktreeRepairsUnhealthy(t *testing.T) {
+	git := migratetest.NewFakeGitManager()
+	m := migrate.New(git, &migratetest.FakeBuildRunner{}, &migratetest.FakeLLMRunner{Git: git}, migrate.Options{WorktreeDir: t.TempDir()})
+	worktreePath, err := m.SetupWorktree("repo", "main-model")
+	if err != nil {
+		t.Fatalf("SetupWorktree: %v", err)
+	}
+	writeFile(t, filepath.Join(worktreePath, "leftover"), "")
+	git.Unhealthy[worktreePath] = true
+
+	if _, err := m.SetupWorktree("repo", "main-model"); err != nil {
+		t.Fatalf("SetupWorktree of an unhealthy worktree: %v", err)
+	}
+	if git.Unhealthy[worktreePath] || git.Worktrees[worktreePath] != "main-model" {
+		t.Errorf("worktree was not recreated: unhealthy %t, branch %q", git.Unhealthy[worktreePath], git.Worktrees[worktreePath])
+	}
+	if _, err := os.Stat(filepath.Join(worktreePath, "leftover")); !os.IsNotExist(err) {
+		t.Errorf("leftover file survived the repair: %v", err)
+	}
+}
+
+func TestEvictWorktrees(t *testing.T) {
+	base := t.TempDir()
+	worktree := filepath.Join(base, "main-model")
+	writeFile(t, filepath.Join(worktree, ".git"), "gitdir: elsewhere\n")
+	writeFile(t, filepath.Join(worktree, "bazel-out/bin/lib.rlib"), "output")
+	build := &migratetest.RecordingBuildRunner{BuildRunner: &migratetest.FakeBuildRunner{}}
+	m := migrate.New(migratetest.NewFakeGitManager(), build, &migratetest.FakeLLMRunner{}, migrate.Options{WorktreeDir: base, MaxBazelCacheBytes: 1})
+
+	m.EvictWorktrees(t.TempDir())
+	if !slices.Equal(build.Calls, []string{"clean --expunge"}) {
+		t.Errorf("bazel calls = %q, want an expunge before removal", build.Calls)
+	}
+	if _, err := os.Stat(worktree); !os.IsNotExist(err) {
+		t.Errorf("evicted worktree still exists: %v", err)
+	}
+}
@@ -1,9 +1,10 @@
-package main_test
+package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"net/url"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,11 +14,10 @@ import (
 	"time"
 
 	"github.com/bazelbuild/rules_go/go/runfiles"
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
 )
 
-var (
-	attempts = flag.Int("attempts", 3, "number of attempts to build a target")
-)
+var testModels = flag.String("test-models", "openai/gpt-5-mini", "comma-separated models TestMigrateRipgrep migrates ripgrep with, or \"all\" for every model in the models list")
 
 func runCombined(dir, name string, args ...string) ([]byte, error) {
 	cmd := exec.Command(name, args...)
@@ -29,20 +29,7 @@ func runCombined(dir, name string, args ...string) ([]byte, error) {
 
 func gitClone(t *testing.T, repoURL, dest string) {
 	t.Logf("cloning %q", repoURL)
-	u, err := url.Parse(repoURL)
-	if err != nil {
-		t.Fatalf("Could not parse url %q: %s", repoURL, err)
-	}
-	username, ok := os.LookupEnv("GITHUB_USERNAME")
-	if !ok {
-		t.Fatal("Did not find GITHUB_USERNAME in env")
-	}
-	token, ok := os.LookupEnv("GITHUB_TOKEN")
-	if !ok {
-		t.Fatal("Did not find GITHUB_TOKEN in env")
-	}
-	u.User = url.UserPassword(username, token)
-	if _, err := runCombined("", "git", "clone", "--depth", "1", "--single-branch", u.String(), dest); err != nil {
+	if err := cloneRepo(context.Background(), repoURL, dest, *repoRef, authFromEnv()); err != nil {
 		t.Fatalf("Failed to clone repo %q to %q: %s", repoURL, dest, err)
 	}
 	t.Logf("successfully cloned %q", repoURL)
@@ -82,11 +69,11 @@ func gitPush(t *testing.T, dir, branch string) {
 
 func mkdirTemp(t *testing.T, pattern string) string {
 	t.Logf("making temp dir for %q", pattern)
-	temp, err := os.MkdirTemp("", pattern)
+	temp, cleanup, err := newTempDir(pattern, *keepWorktrees)
 	if err != nil {
 		t.Fatalf("Failed to create temp dir for pattern %q: %s", pattern, err)
 	}
-	t.Cleanup(func() { os.RemoveAll(temp) })
+	t.Cleanup(cleanup)
 	t.Logf("successfully made temp dir for %q", pattern)
 	return temp
 }
@@ -105,18 +92,20 @@ func setupAider(t *testing.T) (string, string) {
 	return aider, aiderTemp
 }
 
-func runAider(t *testing.T, dir, aider, aiderHome, model, prompt, buildFile string) ([]byte, error) {
+func invokeAider(t *testing.T, dir, aider, aiderHome, model, prompt, buildFile string) ([]byte, error) {
 	t.Logf("running aider with model %q", model)
 	cmd := exec.Command(
 		aider,
 		"--no-check-update",
 		"--no-show-release-notes",
 		"--model", model,
-		"--edit-format", "diff",
+		"--edit-format", resolveEditFormat(*aiderEditFormat, model),
 		"--yes-always",
 		"--disable-playwright",
 		"--file", buildFile,
 		"--read", "MODULE.bazel",
+		"--chat-history-file", filepath.Join(aiderHome, ".aider.chat.history.md"),
+		"--restore-chat-history",
 		"--message", prompt,
 	)
 	cmd.Dir = dir
@@ -126,31 +115,23 @@ func runAider(t *testing.T, dir, aider, aiderHome, model, prompt, buildFile stri
 
 func aiderCommit(t *testing.T, dir, aider, aiderHome, model string) {
 	t.Logf("committing code using aider and model %q", model)
-	cmd := exec.Command(
-		aider,
-		"--commit",
-		"--model", model,
-	)
-	cmd.Dir = dir
-	cmd.Env = append(os.Environ(), fmt.Sprintf("HOME=%q", aiderHome))
-	if _, err := cmd.CombinedOutput(); err != nil {
+	if err := aiderCommitAll(dir, aider, aiderHome, model); err != nil {
 		t.Fatalf("Could not commit with aider: %s", err)
 	}
 	t.Logf("successfully commited code using aider and model %q", model)
 }
 
-func relDirForTarget(target string) string {
-	return strings.TrimPrefix(strings.Split(target, ":")[0], "//")
-}
-
-func ensureBuildBazelExists(t *testing.T, dir, target string) string {
+func ensureBuildFileForTarget(t *testing.T, dir, target string) string {
 	t.Logf("ensuring BUILD.bazel exists for target %q", target)
-	targetDir := relDirForTarget(target)
+	targetDir, _, err := migrate.ParseTargetPackage(target)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if _, err := os.Stat(filepath.Join(dir, targetDir)); err != nil {
 		t.Fatalf("Directory %s for target %q does not exist: %s", targetDir, target, err)
 	}
 	buildBazelPath := filepath.Join(dir, targetDir, "BUILD.bazel")
-	_, err := os.Stat(buildBazelPath)
+	_, err = os.Stat(buildBazelPath)
 	if err == nil {
 		return filepath.Join(targetDir, "BUILD.bazel")
 	}
@@ -165,81 +146,58 @@ func ensureBuildBazelExists(t *testing.T, dir, target string) string {
 	return filepath.Join(targetDir, "BUILD.bazel")
 }
 
-func buildEditLoop(t *testing.T, repoTemp, target, aider, aiderTemp, model, buildBazelPath, branch string) bool {
-	for attempt := 0; attempt < *attempts; attempt++ {
-		beforeSha := commitSha(t, repoTemp)
-		t.Logf("building target %q, sha %s", target, beforeSha)
-		bazelBuildOutput, err := runCombined(repoTemp, "bazel", "build", target)
-		if err == nil {
-			t.Logf("bazel build %q succeeded, continuing to next target", target)
-			return true
-		}
-		t.Logf("bazel build %q did not succeed, invoking aider", target)
-		prompt := fmt.Sprintf(`
-			I would like to migrate this repo to build with Bazel.
-			I am working target-by-target.
-			Right now I am trying to get the %q target to build.
-			Can you make the minimal changes to %q necessary to get this target to build?
-			Here is the output from the latest 'bazel build %s':
-
-			%s`,
-			target, buildBazelPath, target, bazelBuildOutput,
-		)
-		if aiderOutput, err := runAider(t, repoTemp, aider, aiderTemp, model, prompt, buildBazelPath); err != nil {
-			t.Fatalf("Error running aider (%s):\n%s", err, aiderOutput)
-		}
-		afterSha := commitSha(t, repoTemp)
-		t.Logf("successfully ran aider, sha %s", afterSha)
-		if beforeSha == afterSha {
-			t.Log("aider committed no changes")
-		}
-		t.Logf("changes made by aider:\n%s", diff(t, repoTemp, beforeSha, afterSha))
-		gitPush(t, repoTemp, branch)
-	}
-
-	bazelBuildOutput, err := runCombined(repoTemp, "bazel", "build", target)
-	if err == nil {
-		t.Logf("bazel build %q succeeded, continuing to next target", target)
-		return true
-	}
-	t.Logf("last bazel build %q failed, output:\n%s", target, bazelBuildOutput)
-	return false
+// testAider is the migrate.LLMRunner of the end-to-end tests: it runs the
+// aider from runfiles with run.Feedback as the whole message, then logs and
+// pushes whatever aider committed.
+type testAider struct {
+	t         *testing.T
+	aider     string
+	aiderHome string
+	branch    string
 }
 
-func commitSha(t *testing.T, dir string) string {
-	cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
-	cmd.Dir = dir
-	output, err := cmd.CombinedOutput()
+func (a testAider) RunAider(ctx context.Context, run migrate.Run) (string, error) {
+	beforeSha := commitSha(a.t, run.WorktreePath)
+	aiderOutput, err := invokeAider(a.t, run.WorktreePath, a.aider, a.aiderHome, run.Model, run.Feedback, run.BuildFile)
 	if err != nil {
-		t.Fatalf("Could not find commit sha: %s", err)
+		return string(aiderOutput), err
+	}
+	afterSha := commitSha(a.t, run.WorktreePath)
+	a.t.Logf("successfully ran aider, sha %s", afterSha)
+	if beforeSha == afterSha {
+		a.t.Log("aider committed no changes")
 	}
-	return strings.TrimSpace(string(output))
+	a.t.Logf("changes made by aider:\n%s", diff(a.t, run.WorktreePath, beforeSha, afterSha))
+	gitPush(a.t, run.WorktreePath, a.branch)
+	return string(aiderOutput), nil
 }
 
-func diff(t *testing.T, dir, left, right string) []byte {
-	cmd := exec.Command("git", "diff", left, right)
-	cmd.Dir = dir
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		t.Fatalf("Error during git diff %q %q: %s", left, right, err)
-	}
-	return output
+func (a testAider) CommitAll(worktreePath, model string) error {
+	return aiderCommitAll(worktreePath, a.aider, a.aiderHome, model)
 }
 
-func isRepoClean(t *testing.T, dir string) bool {
-	t.Log("checking if repo is clean")
-	cmd := exec.Command("git", "status", "--porcelain")
-	cmd.Dir = dir
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		t.Fatalf("Error during git status check (%s):\n%s", err, output)
+// setupMigrateTest routes logging through t and applies the flags every
+// testMigrateRepo depends on. It sets globals, so it runs once per test
+// rather than in parallel subtests.
+func setupMigrateTest(t *testing.T) {
+	useTestLogger(t)
+	if err := validateBazelFlags(bazelFlags()); err != nil {
+		t.Fatalf("Invalid -bazel-flags: %s", err)
+	}
+	if err := setPromptTemplate(*promptTemplatePath); err != nil {
+		t.Fatal(err)
 	}
-	isClean := len(output) == 0
-	t.Logf("checked if repo is clean: %t", isClean)
-	return isClean
 }
 
 func testMigrateRepo(t *testing.T, repoURL, model string, targets []string) {
+	pattern, err := targetPattern(*targetRegex, *targetFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err = filterByRegex(targets, pattern)
+	if err != nil {
+		t.Fatalf("Could not filter targets: %s", err)
+	}
 	aider, aiderTemp := setupAider(t)
 	repoTemp := mkdirTemp(t, regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(repoURL, "-"))
 	gitClone(t, repoURL, repoTemp)
@@ -248,8 +206,9 @@ func testMigrateRepo(t *testing.T, repoURL, model string, targets []string) {
 	for _, target := range targets {
 		t.Logf("Migrating %q in %q with model %q", target, repoURL, model)
 		beforeSha := commitSha(t, repoTemp)
-		buildBazelPath := ensureBuildBazelExists(t, repoTemp, target)
-		buildSucceeded := buildEditLoop(t, repoTemp, target, aider, aiderTemp, model, buildBazelPath, branch)
+		buildBazelPath := ensureBuildFileForTarget(t, repoTemp, target)
+		run := migrate.Run{WorktreePath: repoTemp, Model: model, Target: target, BuildFile: buildBazelPath, Log: io.Discard}
+		buildSucceeded, _ := buildEditLoop(t, execBuildRunner{}, testAider{t: t, aider: aider, aiderHome: aiderTemp, branch: branch}, run)
 		if !isRepoClean(t, repoTemp) {
 			aiderCommit(t, repoTemp, aider, aiderTemp, model)
 			gitPush(t, repoTemp, branch)
@@ -261,7 +220,10 @@ func testMigrateRepo(t *testing.T, repoURL, model string, targets []string) {
 			t.Logf("Changes made in the build-edit loop:\n%s", diff(t, repoTemp, beforeSha, afterSha))
 		}
 		if !buildSucceeded {
-			t.Fatalf("Could not build %q successfully", target)
+			if !*keepGoing {
+				t.Fatalf("Could not build %q successfully", target)
+			}
+			t.Errorf("Could not build %q successfully; continuing because of -keep-going", target)
 		}
 	}
 }
@@ -285,6 +247,22 @@ func testMigrateRipgrep(t *testing.T, model string) {
 	testMigrateRepo(t, repoURL, model, targets)
 }
 
-func TestGPT5Mini(t *testing.T) {
-	testMigrateRipgrep(t, "openrouter/openai/gpt-5-mini")
+// TestMigrateRipgrep migrates ripgrep with each of the -test-models, in
+// parallel subtests. Each model works in its own clone and branch. It clones
+// from GitHub and pays for model calls, so it only runs with BLD_E2E set.
+func TestMigrateRipgrep(t *testing.T) {
+	if os.Getenv("BLD_E2E") == "" {
+		t.Skip("set BLD_E2E=1 to migrate ripgrep with real models")
+	}
+	setupMigrateTest(t)
+	testModelList := strings.Split(*testModels, ",")
+	if *testModels == "all" {
+		testModelList = models
+	}
+	for _, model := range testModelList {
+		t.Run(model, func(t *testing.T) {
+			t.Parallel()
+			testMigrateRipgrep(t, "openrouter/"+model)
+		})
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// notifyTimeout bounds how long the end-of-run notification may take.
+const notifyTimeout = 30 * time.Second
+
+// RunSummary is what a Notifier is told when a run completes: overall counts
+// and the per-model totals printed by printSummary.
+type RunSummary struct {
+	Succeeded int `json:"succeeded"`
+	// Planned counts every model/target pair the run set out to do,
+	// including those never started because of the deadline or budget.
+	Planned          int            `json:"planned"`
+	ExitCode         int            `json:"exitCode"`
+	PastDeadline     bool           `json:"pastDeadline,omitempty"`
+	OverBudget       bool           `json:"overBudget,omitempty"`
+	EstimatedCostUSD float64        `json:"estimatedCostUSD"`
+	Models           []modelSummary `json:"models"`
+}
+
+// newRunSummary summarizes a finished run for Notify.
+func newRunSummary(results []Result, planned, exitCode int) RunSummary {
+	return RunSummary{
+		Succeeded:        migrate.CountSucceeded(results),
+		Planned:          planned,
+		ExitCode:         exitCode,
+		PastDeadline:     pastDeadline(),
+		OverBudget:       overBudget(),
+		EstimatedCostUSD: round2(costs.TotalCost()),
+		Models:           summarizeModels(results),
+	}
+}
+
+// Notifier tells someone a run has completed. A failed notification is
+// logged and does not affect the run's exit code.
+type Notifier interface {
+	Notify(ctx context.Context, summary RunSummary) error
+}
+
+// newNotifier returns a webhookNotifier for webhookURL, or a no-op Notifier
+// if it is empty.
+func newNotifier(webhookURL string) (Notifier, error) {
+	if webhookURL == "" {
+		return noopNotifier{}, nil
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q: want an http or https URL", webhookURL)
+	}
+	return webhookNotifier{url: webhookURL, client: http.DefaultClient}, nil
+}
+
+// noopNotifier is the Notifier used when no notification is configured.
+type noopNotifier struct{}
+
+func (noopNotifier) Notify(context.Context, RunSummary) error { return nil }
+
+// webhookNotifier POSTs the summary as JSON to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, summary RunSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to encode run summary: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
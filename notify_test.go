@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var got RunSummary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	notifier, err := newNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := RunSummary{Succeeded: 1, Planned: 2, ExitCode: exitFailure, Models: []modelSummary{{Model: "a", Attempted: 2, Succeeded: 1, Attempts: 4}}}
+	if err := notifier.Notify(context.Background(), summary); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got.Succeeded != 1 || got.Planned != 2 || got.ExitCode != exitFailure || len(got.Models) != 1 || got.Models[0] != summary.Models[0] {
+		t.Errorf("webhook got %+v, want %+v", got, summary)
+	}
+}
+
+func TestWebhookNotifierError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such hook", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	notifier, err := newNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = notifier.Notify(context.Background(), RunSummary{})
+	if err == nil || !strings.Contains(err.Error(), "no such hook") {
+		t.Errorf("Notify = %v, want an error with the response body", err)
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	if n, err := newNotifier(""); err != nil || n != (noopNotifier{}) {
+		t.Errorf(`newNotifier("") = %v, %v; want noopNotifier`, n, err)
+	}
+	for _, bad := range []string{"hooks.example.com/x", "ftp://example.com/x", "https://"} {
+		if _, err := newNotifier(bad); err == nil {
+			t.Errorf("newNotifier(%q) succeeded, want an error", bad)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// prefixWriter tags each line written to it with a prefix before passing it
+// on, so output from concurrent runs stays attributable. Partial lines are
+// buffered until their newline arrives or Flush is called.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// newPrefixWriter returns a prefixWriter writing to w.
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+// Write forwards every complete line in p, with the prefix, to the underlying
+// writer in a single call.
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.buf = append(pw.buf, p...)
+	var out []byte
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		out = append(out, pw.prefix...)
+		out = append(out, pw.buf[:i+1]...)
+		pw.buf = pw.buf[i+1:]
+	}
+	if len(out) > 0 {
+		if _, err := pw.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any buffered partial line, terminated with a newline.
+func (pw *prefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	out := append(append(append([]byte{}, pw.prefix...), pw.buf...), '\n')
+	pw.buf = nil
+	_, err := pw.w.Write(out)
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{name: "whole lines", writes: []string{"one\ntwo\n"}, want: "[m t] one\n[m t] two\n"},
+		{name: "split across writes", writes: []string{"on", "e\ntw", "o", "\n"}, want: "[m t] one\n[m t] two\n"},
+		{name: "byte at a time", writes: []string{"a", "\n", "b", "c", "\n"}, want: "[m t] a\n[m t] bc\n"},
+		{name: "empty lines", writes: []string{"\n\nx\n"}, want: "[m t] \n[m t] \n[m t] x\n"},
+		{name: "unterminated tail", writes: []string{"done\npartial"}, want: "[m t] done\n[m t] partial\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		pw := newPrefixWriter(&out, "[m t] ")
+		for _, w := range tt.writes {
+			n, err := pw.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Fatalf("%s: Write(%q) = %d, %v", tt.name, w, n, err)
+			}
+		}
+		if err := pw.Flush(); err != nil {
+			t.Fatalf("%s: Flush: %v", tt.name, err)
+		}
+		if got := out.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixWriterHoldsPartialLine(t *testing.T) {
+	var out bytes.Buffer
+	pw := newPrefixWriter(&out, "> ")
+	pw.Write([]byte("no newline yet"))
+	if out.Len() != 0 {
+		t.Errorf("partial line written before its newline: %q", out.String())
+	}
+	pw.Write([]byte("\n"))
+	if got, want := out.String(), "> no newline yet\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
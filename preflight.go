@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+)
+
+// preflightTool describes an external command the run depends on.
+type preflightTool struct {
+	name        string
+	versionArgs []string
+	// required tools abort the run when missing; optional ones only
+	// disable the feature that uses them.
+	required bool
+}
+
+var preflightTools = []preflightTool{
+	{name: "git", versionArgs: []string{"--version"}, required: true},
+	{name: "bazel", versionArgs: []string{"version"}, required: true},
+	{name: "aider", versionArgs: []string{"--version"}, required: true},
+	{name: "buildifier", versionArgs: []string{"--version"}},
+	{name: "buildozer", versionArgs: []string{"-version"}},
+	{name: "files-to-prompt", versionArgs: []string{"--version"}},
+	{name: "llm", versionArgs: []string{"--version"}},
+}
+
+// preflight checks that every tool the run shells out to is on PATH and logs
+// its version, so a missing dependency fails at startup instead of deep
+// inside the model loop.
+func preflight() error {
+	var missing []string
+	for _, tool := range preflightTools {
+		path, err := exec.LookPath(tool.name)
+		if err != nil {
+			if tool.required {
+				missing = append(missing, tool.name)
+				continue
+			}
+			slog.Warn("Optional tool not found on PATH", "tool", tool.name)
+			continue
+		}
+		out, err := auditCombinedOutput(exec.Command(path, tool.versionArgs...))
+		if err != nil {
+			return fmt.Errorf("%s %s failed: %v\n%s", tool.name, strings.Join(tool.versionArgs, " "), err, string(out))
+		}
+		version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		slog.Info("Found tool", "tool", tool.name, "path", path, "version", version)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required tools not found on PATH: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
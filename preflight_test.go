@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	all := []string{"git", "bazel", "aider", "buildifier", "buildozer", "files-to-prompt", "llm"}
+	tests := []struct {
+		name     string
+		tools    []string
+		failing  string
+		wantErr  string
+		wantWarn []string
+	}{
+		{name: "all present", tools: all},
+		{name: "missing optional tools", tools: []string{"git", "bazel", "aider"}, wantWarn: []string{"buildifier", "buildozer", "files-to-prompt", "llm"}},
+		{name: "missing aider", tools: []string{"git", "bazel", "buildifier", "buildozer", "files-to-prompt", "llm"}, wantErr: "required tools not found on PATH: aider"},
+		{name: "missing aider and optional tools", tools: []string{"git", "bazel"}, wantErr: "required tools not found on PATH: aider", wantWarn: []string{"buildifier"}},
+		{name: "version check fails", tools: all, failing: "bazel", wantErr: "bazel version failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, tool := range tt.tools {
+				script := "#!/bin/sh\necho '" + tool + " 1.0'\n"
+				if tool == tt.failing {
+					script = "#!/bin/sh\necho 'no server' >&2\nexit 2\n"
+				}
+				if err := os.WriteFile(filepath.Join(dir, tool), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", dir)
+			var logs bytes.Buffer
+			prev := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+			t.Cleanup(func() { slog.SetDefault(prev) })
+
+			err := preflight()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("preflight: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("preflight error = %v, want %q", err, tt.wantErr)
+			}
+			for _, tool := range tt.wantWarn {
+				if want := `level=WARN msg="Optional tool not found on PATH" tool=` + tool; !strings.Contains(logs.String(), want) {
+					t.Errorf("logs lack %q:\n%s", want, logs.String())
+				}
+			}
+			if len(tt.wantWarn) == 0 && strings.Contains(logs.String(), "level=WARN") {
+				t.Errorf("unexpected warnings:\n%s", logs.String())
+			}
+		})
+	}
+}
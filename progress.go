@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// cellState is the progress of one model/target pair.
+type cellState int
+
+const (
+	cellNotStarted cellState = iota
+	cellInProgress
+	cellBuilt
+	cellFailed
+)
+
+func (s cellState) String() string {
+	switch s {
+	case cellInProgress:
+		return "→"
+	case cellBuilt:
+		return "✓"
+	case cellFailed:
+		return "✗"
+	default:
+		return "·"
+	}
+}
+
+// ProgressDisplay renders a model × target status matrix to a terminal,
+// redrawing it in place with ANSI escapes after every state change.
+type ProgressDisplay struct {
+	mu      sync.Mutex
+	w       io.Writer
+	models  []string
+	targets []string
+	cells   map[[2]string]cellState
+	// lines is how many lines the last render printed, so the next one can
+	// move the cursor back over them.
+	lines int
+}
+
+// NewProgressDisplay returns a display of models × targets writing to w.
+func NewProgressDisplay(w io.Writer, models, targets []string) *ProgressDisplay {
+	return &ProgressDisplay{
+		w:       w,
+		models:  models,
+		targets: targets,
+		cells:   make(map[[2]string]cellState),
+	}
+}
+
+// progress is the active display, or nil when output is a plain log stream.
+var progress *ProgressDisplay
+
+// consoleOut and consoleErr receive the console echo of aider and git. They
+// are discarded while the progress display is drawn.
+var (
+	consoleOut io.Writer = os.Stdout
+	consoleErr io.Writer = os.Stderr
+)
+
+// startProgressDisplay draws the matrix on stdout. The matrix is redrawn in
+// place, so logs and console echo would scroll it away: until the returned
+// stop func is called, logs go to run.log in -log-dir and aider and git
+// output only to the per-target logs.
+func startProgressDisplay(models, targets []string) (stop func(), err error) {
+	if err := os.MkdirAll(*logDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	logPath := filepath.Join(*logDir, "run.log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", logPath, err)
+	}
+	logger, err := newLogger(logFile, *logFormat, *logLevel)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Logging to %s\n", logPath)
+	prevLogger := slog.Default()
+	slog.SetDefault(logger)
+	consoleOut, consoleErr = io.Discard, io.Discard
+	progress = NewProgressDisplay(os.Stdout, models, targets)
+	progress.Render()
+	return func() {
+		progress = nil
+		consoleOut, consoleErr = os.Stdout, os.Stderr
+		slog.SetDefault(prevLogger)
+		logFile.Close()
+	}, nil
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Start marks model/target as in progress. It is a no-op on a nil display, as
+// are the other methods.
+func (p *ProgressDisplay) Start(model, target string) {
+	p.set(model, target, cellInProgress)
+}
+
+// Finish marks model/target as built or failed.
+func (p *ProgressDisplay) Finish(model, target string, success bool) {
+	state := cellFailed
+	if success {
+		state = cellBuilt
+	}
+	p.set(model, target, state)
+}
+
+// showProgress marks the pair a target_start or target_done event is about on
+// the active display.
+func showProgress(ev migrate.Event) {
+	model := strings.TrimPrefix(ev.Model, "openrouter/")
+	switch ev.Type {
+	case migrate.EventTargetStart:
+		progress.Start(model, repoTarget(ev.Repo, ev.Target))
+	case migrate.EventTargetDone:
+		if ev.Status != "skipped" {
+			progress.Finish(model, repoTarget(ev.Repo, ev.Target), ev.Status == "succeeded")
+		}
+	}
+}
+
+func (p *ProgressDisplay) set(model, target string, state cellState) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cells[[2]string{model, target}] = state
+	p.render()
+}
+
+// Render draws the matrix.
+func (p *ProgressDisplay) Render() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.render()
+}
+
+func (p *ProgressDisplay) render() {
+	var b strings.Builder
+	if p.lines > 0 {
+		// Move to the start of the previous render and clear to the end
+		// of the screen.
+		fmt.Fprintf(&b, "\x1b[%dF\x1b[J", p.lines)
+	}
+	width := 0
+	for _, m := range p.models {
+		width = max(width, len(m))
+	}
+	lines := 0
+	fmt.Fprintf(&b, "%-*s", width, "")
+	for i := range p.targets {
+		fmt.Fprintf(&b, " %2d", i+1)
+	}
+	b.WriteString("\n")
+	lines++
+	for _, m := range p.models {
+		fmt.Fprintf(&b, "%-*s", width, m)
+		for _, t := range p.targets {
+			fmt.Fprintf(&b, "  %s", p.cells[[2]string{m, t}])
+		}
+		b.WriteString("\n")
+		lines++
+	}
+	for i, t := range p.targets {
+		fmt.Fprintf(&b, "%2d %s\n", i+1, t)
+		lines++
+	}
+	io.WriteString(p.w, b.String())
+	p.lines = lines
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProgressDisplay(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewProgressDisplay(&buf, []string{"openai/gpt-5", "x-ai/grok"}, []string{"//:ripgrep", "//crates/cli:cli"})
+
+	p.Render()
+	first := buf.String()
+	if strings.Contains(first, "\x1b[") {
+		t.Errorf("first render moves the cursor:\n%q", first)
+	}
+	want := "              1  2\n" +
+		"openai/gpt-5  ·  ·\n" +
+		"x-ai/grok     ·  ·\n" +
+		" 1 //:ripgrep\n" +
+		" 2 //crates/cli:cli\n"
+	if first != want {
+		t.Errorf("first render =\n%s\nwant\n%s", first, want)
+	}
+
+	buf.Reset()
+	p.Start("openai/gpt-5", "//:ripgrep")
+	p.Finish("x-ai/grok", "//crates/cli:cli", false)
+	p.Finish("openai/gpt-5", "//crates/cli:cli", true)
+	got := buf.String()
+	// Each update redraws over the previous five lines.
+	if n := strings.Count(got, "\x1b[5F\x1b[J"); n != 3 {
+		t.Errorf("got %d redraws, want 3:\n%q", n, got)
+	}
+	last := got[strings.LastIndex(got, "\x1b[J")+len("\x1b[J"):]
+	for _, row := range []string{"openai/gpt-5  →  ✓\n", "x-ai/grok     ·  ✗\n"} {
+		if !strings.Contains(last, row) {
+			t.Errorf("last render missing row %q:\n%s", row, last)
+		}
+	}
+}
+
+func TestNilProgressDisplay(t *testing.T) {
+	var p *ProgressDisplay
+	p.Start("openai/gpt-5", "//:ripgrep")
+	p.Finish("openai/gpt-5", "//:ripgrep", true)
+	p.Render()
+}
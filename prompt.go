@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// PromptData is what a -prompt-template can refer to.
+type PromptData struct {
+	Target         string
+	BuildBazelPath string
+	// BazelOutput is the output of the latest failed bazel build, if the
+	// caller passes it; with aider's --auto-test the model sees it anyway.
+	BazelOutput string
+	// Feedback explains why the previous attempt was rejected, if it was.
+	Feedback string
+	// PreviousAttempt is the diff of the previous, failed attempt, with
+	// -include-stash-in-context.
+	PreviousAttempt string
+	// Examples shows BUILD files that already build in the worktree, from
+	// migrate.Run.Examples.
+	Examples string
+	// BuiltTargets are the labels of the targets that already built in the
+	// worktree this run, so the model can depend on them by name.
+	BuiltTargets []string
+}
+
+// defaultPromptTemplate is the aider message used without -prompt-template.
+const defaultPromptTemplate = `
+{{- if .Examples}}{{.Examples}}
+
+{{end}}Please make the minimal Bazel file changes necessary to build {{.Target}}. Do not touch non-Bazel files.
+{{- if .BuiltTargets}}
+
+These targets already build; depend on them by these labels instead of defining them again:
+{{- range .BuiltTargets}}
+- {{.}}
+{{- end}}
+{{- end}}
+{{- if .BazelOutput}}
+
+Here is the output from the latest 'bazel build {{.Target}}':
+
+{{.BazelOutput}}
+{{- end}}
+{{- if .Feedback}}
+
+{{.Feedback}}
+{{- end}}
+{{- if .PreviousAttempt}}
+
+Previous attempt that did not produce a working build:
+
+{{.PreviousAttempt}}
+{{- end}}`
+
+// promptTemplate renders every aider message; setPromptTemplate replaces it.
+var promptTemplate = template.Must(template.New("prompt").Option("missingkey=error").Parse(defaultPromptTemplate))
+
+// setPromptTemplate loads the -prompt-template file at path, if one is given,
+// and checks that it renders.
+func setPromptTemplate(path string) error {
+	if path == "" {
+		return nil
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read prompt template: %w", err)
+	}
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return fmt.Errorf("failed to parse prompt template %s: %w", path, err)
+	}
+	sample := PromptData{Target: "//:ripgrep", BuildBazelPath: "BUILD.bazel", BazelOutput: "ERROR", Feedback: "feedback", PreviousAttempt: "diff", Examples: "examples", BuiltTargets: []string{"//crates/cli:grep_cli"}}
+	if err := tmpl.Execute(new(strings.Builder), sample); err != nil {
+		return fmt.Errorf("prompt template %s does not render: %w", path, err)
+	}
+	promptTemplate = tmpl
+	return nil
+}
+
+// renderPrompt returns the aider message for data.
+func renderPrompt(data PromptData) (string, error) {
+	var b strings.Builder
+	if err := promptTemplate.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt for %s: %w", data.Target, err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		data PromptData
+		want string
+	}{
+		{
+			name: "first attempt",
+			data: PromptData{Target: "//:ripgrep", BuildBazelPath: "BUILD.bazel"},
+			want: "Please make the minimal Bazel file changes necessary to build //:ripgrep. Do not touch non-Bazel files.",
+		},
+		{
+			name: "feedback",
+			data: PromptData{Target: "//:ripgrep", Feedback: "The previous attempt produced an invalid BUILD file."},
+			want: "Please make the minimal Bazel file changes necessary to build //:ripgrep. Do not touch non-Bazel files.\n\nThe previous attempt produced an invalid BUILD file.",
+		},
+		{
+			name: "bazel output",
+			data: PromptData{Target: "//:ripgrep", BazelOutput: "ERROR: no such package"},
+			want: "Please make the minimal Bazel file changes necessary to build //:ripgrep. Do not touch non-Bazel files.\n\nHere is the output from the latest 'bazel build //:ripgrep':\n\nERROR: no such package",
+		},
+		{
+			name: "built targets",
+			data: PromptData{Target: "//:ripgrep", BuiltTargets: []string{"//crates/matcher:grep_matcher", "//crates/regex:grep_regex"}},
+			want: "Please make the minimal Bazel file changes necessary to build //:ripgrep. Do not touch non-Bazel files.\n\nThese targets already build; depend on them by these labels instead of defining them again:\n- //crates/matcher:grep_matcher\n- //crates/regex:grep_regex",
+		},
+		{
+			name: "examples",
+			data: PromptData{Target: "//:ripgrep", Examples: "Here are working BUILD.bazel files"},
+			want: "Here are working BUILD.bazel files\n\nPlease make the minimal Bazel file changes necessary to build //:ripgrep. Do not touch non-Bazel files.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderPrompt(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("renderPrompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetPromptTemplate(t *testing.T) {
+	prev := promptTemplate
+	t.Cleanup(func() { promptTemplate = prev })
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.tmpl")
+	writeFile(t, good, "Build {{.Target}} by editing {{.BuildBazelPath}}.")
+	if err := setPromptTemplate(good); err != nil {
+		t.Fatalf("setPromptTemplate: %v", err)
+	}
+	got, err := renderPrompt(PromptData{Target: "//crates/cli:grep_cli", BuildBazelPath: "crates/cli/BUILD.bazel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Build //crates/cli:grep_cli by editing crates/cli/BUILD.bazel."; got != want {
+		t.Errorf("renderPrompt = %q, want %q", got, want)
+	}
+
+	for name, text := range map[string]string{
+		"unparsable.tmpl":    "Build {{.Target",
+		"unknown-field.tmpl": "Build {{.Crate}}",
+	} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, text)
+		if err := setPromptTemplate(path); err == nil {
+			t.Errorf("setPromptTemplate(%s) succeeded, want an error", name)
+		}
+	}
+	if err := setPromptTemplate(filepath.Join(dir, "missing.tmpl")); err == nil || !strings.Contains(err.Error(), "failed to read") {
+		t.Errorf("setPromptTemplate(missing) = %v, want a read error", err)
+	}
+	if promptTemplate.Tree.Root.String() != template.Must(template.New("").Parse("Build {{.Target}} by editing {{.BuildBazelPath}}.")).Tree.Root.String() {
+		t.Error("a failed setPromptTemplate replaced the loaded template")
+	}
+}
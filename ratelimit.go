@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by every aider invocation, so that
+// models run in parallel against one OpenRouter key stay under the account's
+// request ceiling. The bucket holds one token, so requests are spread evenly
+// rather than sent in bursts. A nil *RateLimiter does not limit.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// next is when the next request may start.
+	next time.Time
+}
+
+// NewRateLimiter returns a limiter allowing requestsPerMinute requests a
+// minute, or nil if requestsPerMinute is not positive.
+func NewRateLimiter(requestsPerMinute int) *RateLimiter {
+	if requestsPerMinute <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Minute / time.Duration(requestsPerMinute)}
+}
+
+// aiderLimiter throttles aider invocations; it is set from
+// -requests-per-minute.
+var aiderLimiter *RateLimiter
+
+// reserve claims the next request slot at or after now and returns how long
+// the caller must wait for it.
+func (l *RateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	return start.Sub(now)
+}
+
+// Wait blocks until a request may be made or ctx is done. what describes the
+// request in the log when it has to wait.
+func (l *RateLimiter) Wait(ctx context.Context, what ...any) error {
+	if l == nil {
+		return nil
+	}
+	wait := l.reserve(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	slog.Info("Rate limited; waiting", append([]any{"wait", wait.Round(time.Millisecond)}, what...)...)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := NewRateLimiter(60)
+	start := time.Now()
+	for i, tt := range []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		{at: 0, want: 0},
+		{at: 0, want: time.Second},
+		{at: 500 * time.Millisecond, want: 1500 * time.Millisecond},
+		// Idle time does not bank requests for a later burst.
+		{at: 10 * time.Second, want: 0},
+		{at: 10 * time.Second, want: time.Second},
+	} {
+		if got := l.reserve(start.Add(tt.at)); got != tt.want {
+			t.Errorf("request %d at +%v waits %v, want %v", i, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	useTestLogger(t)
+	l := NewRateLimiter(6000) // one request every 10ms
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Wait(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("5 requests at 6000/min took %v, want at least 40ms", elapsed)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if l := NewRateLimiter(0); l != nil {
+		t.Fatalf("NewRateLimiter(0) = %v, want nil", l)
+	}
+	var l *RateLimiter
+	if err := l.Wait(context.Background()); err != nil {
+		t.Errorf("nil limiter Wait: %v", err)
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	useTestLogger(t)
+	l := NewRateLimiter(1)
+	l.reserve(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(ctx); err == nil {
+		t.Error("Wait with canceled context succeeded")
+	}
+}
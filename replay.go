@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// replayKey identifies the aider invocations for one model/target pair.
+type replayKey struct {
+	model  string
+	target string
+}
+
+// replayResponse is the recorded result of one aider invocation.
+type replayResponse struct {
+	output   string
+	exitCode int
+	// diff is the patch of the files aider changed, if it was recorded.
+	diff string
+}
+
+// ReplayLLMRunner is a migrate.LLMRunner that answers with the aider outputs
+// recorded in an -audit-log instead of calling the model, so a past run can
+// be reproduced without spending money. Each model/target pair gets its
+// recorded outputs back in order, and the recorded changes to its files
+// applied to the worktree, so bazel builds what the recorded run built.
+type ReplayLLMRunner struct {
+	git       migrate.GitManager
+	mu        sync.Mutex
+	responses map[replayKey][]replayResponse
+}
+
+// NewReplayLLMRunner builds a ReplayLLMRunner from the aider invocations in
+// the audit log at auditLogPath. git commits the changes the recorded run had
+// aider commit.
+func NewReplayLLMRunner(auditLogPath string, git migrate.GitManager) (migrate.LLMRunner, error) {
+	entries, err := readAuditLog(auditLogPath)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReplayLLMRunner{git: git, responses: make(map[replayKey][]replayResponse)}
+	// The attempt diff of an aider run is the next one recorded in its
+	// worktree; each worktree runs one aider at a time.
+	type pending struct {
+		key   replayKey
+		index int
+	}
+	awaitingDiff := make(map[string]pending)
+	for _, entry := range entries {
+		if isAttemptDiff(entry) {
+			if p, ok := awaitingDiff[entry.Dir]; ok && entry.ExitCode == 0 {
+				r.responses[p.key][p.index].diff = entry.Output
+			}
+			delete(awaitingDiff, entry.Dir)
+			continue
+		}
+		key, ok := aiderInvocation(entry)
+		if !ok {
+			continue
+		}
+		r.responses[key] = append(r.responses[key], replayResponse{output: entry.Output, exitCode: entry.ExitCode})
+		awaitingDiff[entry.Dir] = pending{key: key, index: len(r.responses[key]) - 1}
+	}
+	if len(r.responses) == 0 {
+		return nil, fmt.Errorf("audit log %s records no aider invocations", auditLogPath)
+	}
+	return r, nil
+}
+
+// aiderInvocation returns the model and target of an audit entry for a
+// build-edit aider run, as built by runAiderWithContext.
+func aiderInvocation(entry AuditEntry) (replayKey, bool) {
+	if filepath.Base(entry.Command) != "aider" || slices.Contains(entry.Args, "--commit") {
+		return replayKey{}, false
+	}
+	var key replayKey
+	for i := 0; i+1 < len(entry.Args); i++ {
+		switch entry.Args[i] {
+		case "--model":
+			key.model = entry.Args[i+1]
+		case "--test-cmd":
+			// The target follows any -bazel-flags and --lockfile_mode.
+			if fields := strings.Fields(entry.Args[i+1]); len(fields) > 2 && fields[0] == "bazel" && fields[1] == "build" {
+				key.target = fields[len(fields)-1]
+			}
+		}
+	}
+	return key, key.model != "" && key.target != ""
+}
+
+// isAttemptDiff reports whether entry holds the changes an aider run made, as
+// recorded by recordAttemptDiff.
+func isAttemptDiff(entry AuditEntry) bool {
+	return entry.Command == attemptDiffCommand
+}
+
+func (r *ReplayLLMRunner) RunAider(ctx context.Context, run migrate.Run) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := replayKey{model: run.Model, target: run.Target}
+	responses := r.responses[key]
+	if len(responses) == 0 {
+		return "", fmt.Errorf("no recorded aider output left for model %s target %s", run.Model, run.Target)
+	}
+	r.responses[key] = responses[1:]
+	if diff := responses[0].diff; diff != "" {
+		if err := applyDiff(run.WorktreePath, diff); err != nil {
+			return responses[0].output, fmt.Errorf("failed to replay aider's changes for model %s target %s: %w", run.Model, run.Target, err)
+		}
+	}
+	if code := responses[0].exitCode; code != 0 {
+		return responses[0].output, fmt.Errorf("recorded aider run exited with code %d", code)
+	}
+	return responses[0].output, nil
+}
+
+// CommitAll commits the pending changes with git, since the message aider
+// wrote is not recorded and a new one would need a model call.
+func (r *ReplayLLMRunner) CommitAll(worktreePath, model string) error {
+	return r.git.Commit(worktreePath, "aider: replayed changes by "+model)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+	"github.com/dan-stowell/migrate_ripgrep/migrate/migratetest"
+)
+
+func TestReplayLLMRunner(t *testing.T) {
+	entries := []AuditEntry{
+		{Command: "/usr/bin/git", Args: []string{"status"}},
+		{Command: "/usr/local/bin/aider", Args: []string{"--model", "openrouter/a/model", "--test-cmd", "bazel build //:ripgrep", "--message", "m"}, ExitCode: 1, Output: "Error code: 429"},
+		{Command: "/usr/local/bin/aider", Args: []string{"--model", "openrouter/b/model", "--test-cmd", "bazel build //:ripgrep"}, Output: "b first"},
+		{Command: "/usr/local/bin/aider", Args: []string{"--model", "openrouter/a/model", "--test-cmd", "bazel build //:ripgrep"}, Output: "Tokens: 2k sent, 100 received."},
+		{Command: "/usr/local/bin/aider", Args: []string{"--commit", "--model", "openrouter/a/model"}, Output: "Commit abc123"},
+	}
+	var lines []string
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	writeFile(t, path, strings.Join(lines, "\n")+"\n")
+
+	git := migratetest.NewFakeGitManager()
+	llm, err := NewReplayLLMRunner(path, git)
+	if err != nil {
+		t.Fatalf("NewReplayLLMRunner: %v", err)
+	}
+	run := migrate.Run{Model: "openrouter/a/model", Target: "//:ripgrep"}
+	ctx := context.Background()
+	if out, err := llm.RunAider(ctx, run); err == nil || out != "Error code: 429" {
+		t.Errorf("first replay = %q, %v; want the recorded 429 and an error", out, err)
+	}
+	if out, err := llm.RunAider(ctx, run); err != nil || out != "Tokens: 2k sent, 100 received." {
+		t.Errorf("second replay = %q, %v; want the recorded success", out, err)
+	}
+	if _, err := llm.RunAider(ctx, run); err == nil {
+		t.Error("replay past the recorded invocations succeeded")
+	}
+	if out, err := llm.RunAider(ctx, migrate.Run{Model: "openrouter/b/model", Target: "//:ripgrep"}); err != nil || out != "b first" {
+		t.Errorf("model b replay = %q, %v", out, err)
+	}
+	git.Touch("worktree", "BUILD.bazel")
+	if err := llm.CommitAll("worktree", "openrouter/a/model"); err != nil {
+		t.Errorf("CommitAll: %v", err)
+	}
+	if commits := git.Commits["worktree"]; len(commits) != 1 {
+		t.Errorf("CommitAll made commits %+v, want one", commits)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.jsonl")
+	writeFile(t, empty, lines[0]+"\n")
+	if _, err := NewReplayLLMRunner(empty, git); err == nil {
+		t.Error("NewReplayLLMRunner of a log without aider runs succeeded")
+	}
+}
+
+func TestAiderInvocation(t *testing.T) {
+	prev := bazelFlagValues
+	t.Cleanup(func() { bazelFlagValues = prev })
+	bazelFlagValues = stringsFlag{"--config=remote -k"}
+
+	opts, err := aiderOptions(migrate.Run{Model: "openrouter/a/model", Target: "//crates/cli:grep_cli", BuildFile: "crates/cli/BUILD.bazel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := AuditEntry{Command: "/usr/local/bin/aider", Args: aiderArgs(opts)}
+	key, ok := aiderInvocation(entry)
+	if want := (replayKey{model: "openrouter/a/model", target: "//crates/cli:grep_cli"}); !ok || key != want {
+		t.Errorf("aiderInvocation of %q = %+v, %t; want %+v", entry.Args, key, ok, want)
+	}
+}
+
+func TestReplayAppliesRecordedChanges(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("config", "user.email", "test@example.com")
+	git("config", "user.name", "test")
+	writeFile(t, filepath.Join(dir, "BUILD.bazel"), "rust_library(\n    name = \"old\",\n)\n")
+	git("add", "-A")
+	git("commit", "-q", "-m", "first")
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prev := commandAudit
+	commandAudit = NewAuditLogger(f)
+	t.Cleanup(func() { commandAudit = prev })
+
+	// Record an aider run, with output past auditOutputLimit, that edits
+	// BUILD.bazel and adds a file, as execLLMRunner does.
+	before, err := snapshotWorktree(dir)
+	if err != nil {
+		t.Fatalf("snapshotWorktree: %v", err)
+	}
+	aider := exec.Command("aider", "--model", "openrouter/a/model", "--test-cmd", "bazel build //:ripgrep")
+	aider.Dir = dir
+	output := strings.Repeat("x", 2*auditOutputLimit)
+	if err := commandAudit.Record(aider, time.Now(), []byte(output), nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "BUILD.bazel"), "rust_library(\n    name = \"new\",\n)\n")
+	writeFile(t, filepath.Join(dir, "MODULE.bazel"), "module(name = \"ripgrep\")\n")
+	if err := recordAttemptDiff(dir, before); err != nil {
+		t.Fatalf("recordAttemptDiff: %v", err)
+	}
+	if status := git("status", "--porcelain"); status != "M BUILD.bazel\n?? MODULE.bazel" {
+		t.Errorf("snapshots changed the index; git status = %q", status)
+	}
+	git("checkout", "-q", "--", ".")
+	git("clean", "-q", "-f")
+
+	llm, err := NewReplayLLMRunner(path, execGitManager{})
+	if err != nil {
+		t.Fatalf("NewReplayLLMRunner: %v", err)
+	}
+	got, err := llm.RunAider(context.Background(), migrate.Run{WorktreePath: dir, Model: "openrouter/a/model", Target: "//:ripgrep"})
+	if err != nil || got != output {
+		t.Fatalf("RunAider = %d bytes, %v; want the %d bytes recorded", len(got), err, len(output))
+	}
+	for name, want := range map[string]string{"BUILD.bazel": "rust_library(\n    name = \"new\",\n)\n", "MODULE.bazel": "module(name = \"ripgrep\")\n"} {
+		if content, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(content) != want {
+			t.Errorf("replayed %s = %q, %v; want %q", name, content, err, want)
+		}
+	}
+}
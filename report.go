@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// Report is the JSON document written by -report.
+type Report struct {
+	// Repos records the commit each repo was migrated from, so that the
+	// run can be reproduced.
+	Repos   []RepoRevision `json:"repos,omitempty"`
+	Results []Result       `json:"results"`
+	// Repetitions summarizes each model/target across repetitions when the
+	// run used -repeat.
+	Repetitions []RepetitionSummary `json:"repetitions,omitempty"`
+	// Models records, per model worktree, whether the migration builds as
+	// a whole.
+	Models []migrate.ModelVerification `json:"models,omitempty"`
+	// ModelTimings and TargetTimings total aider and bazel time per model
+	// and per target.
+	ModelTimings  []TimingSummary `json:"modelTimings,omitempty"`
+	TargetTimings []TimingSummary `json:"targetTimings,omitempty"`
+	// EstimatedCostUSD is what the run's aider calls cost, as estimated from
+	// the token counts aider printed.
+	EstimatedCostUSD float64 `json:"estimatedCostUSD,omitempty"`
+}
+
+// RepoRevision is the commit a repo was migrated from. Repo is empty for the
+// repository in the current directory, and Ref is the -repo-ref, if any,
+// that resolved to SHA.
+type RepoRevision struct {
+	Repo string `json:"repo,omitempty"`
+	Ref  string `json:"ref,omitempty"`
+	SHA  string `json:"sha"`
+}
+
+// TimingSummary totals the time results spent in aider and bazel, in
+// nanoseconds like Result's durations. Exactly one of Model and Target is set.
+type TimingSummary struct {
+	Model string `json:"model,omitempty"`
+	// Target is qualified with the repo, as by repoTarget.
+	Target        string        `json:"target,omitempty"`
+	AiderDuration time.Duration `json:"aiderDuration"`
+	BazelDuration time.Duration `json:"bazelDuration"`
+}
+
+// summarizeTimings totals aider and bazel time per model and per target, each
+// in the order they first appear.
+func summarizeTimings(results []Result) (byModel, byTarget []TimingSummary) {
+	modelIndex := make(map[string]int)
+	targetIndex := make(map[string]int)
+	for _, r := range results {
+		i, ok := modelIndex[r.Model]
+		if !ok {
+			i = len(byModel)
+			modelIndex[r.Model] = i
+			byModel = append(byModel, TimingSummary{Model: r.Model})
+		}
+		byModel[i].AiderDuration += r.AiderDuration
+		byModel[i].BazelDuration += r.BazelDuration
+
+		target := repoTarget(r.Repo, r.Target)
+		j, ok := targetIndex[target]
+		if !ok {
+			j = len(byTarget)
+			targetIndex[target] = j
+			byTarget = append(byTarget, TimingSummary{Target: target})
+		}
+		byTarget[j].AiderDuration += r.AiderDuration
+		byTarget[j].BazelDuration += r.BazelDuration
+	}
+	return byModel, byTarget
+}
+
+// RepetitionSummary aggregates the repetitions of one model/target pair.
+type RepetitionSummary struct {
+	Repo        string `json:"repo,omitempty"`
+	Model       string `json:"model"`
+	Target      string `json:"target"`
+	Successes   int    `json:"successes"`
+	Repetitions int    `json:"repetitions"`
+	// Attempts lists the attempts used by each repetition, in order.
+	Attempts []int `json:"attempts"`
+}
+
+// summarizeRepetitions groups results from repeated runs by repo, model and
+// target, in the order they first appear. Results without a repetition are ignored.
+func summarizeRepetitions(results []Result) []RepetitionSummary {
+	var summaries []RepetitionSummary
+	index := make(map[cellKey]int)
+	for _, r := range results {
+		if r.Repetition == 0 {
+			continue
+		}
+		key := cellKey{repo: r.Repo, model: r.Model, target: r.Target}
+		i, ok := index[key]
+		if !ok {
+			i = len(summaries)
+			index[key] = i
+			summaries = append(summaries, RepetitionSummary{Repo: r.Repo, Model: r.Model, Target: r.Target})
+		}
+		s := &summaries[i]
+		s.Repetitions++
+		if r.Success {
+			s.Successes++
+		}
+		s.Attempts = append(s.Attempts, r.Attempts)
+	}
+	return summaries
+}
+
+// logRepetitionSummaries logs the success rate and attempt distribution for
+// each model/target pair.
+func logRepetitionSummaries(summaries []RepetitionSummary) {
+	for _, s := range summaries {
+		slog.Info("Repetition summary", "model", s.Model, "target", repoTarget(s.Repo, s.Target), "successRate", fmt.Sprintf("%d/%d", s.Successes, s.Repetitions), "attempts", s.Attempts)
+	}
+}
+
+// modelSummary totals one model's results for printSummary and RunSummary.
+type modelSummary struct {
+	Model     string        `json:"model"`
+	Attempted int           `json:"attempted"`
+	Succeeded int           `json:"succeeded"`
+	Attempts  int           `json:"attempts"`
+	Duration  time.Duration `json:"duration"`
+	Aider     time.Duration `json:"aiderDuration"`
+	Bazel     time.Duration `json:"bazelDuration"`
+}
+
+// summarizeModels totals results per model, most successes first. Targets
+// skipped by the circuit breaker do not count as attempted.
+func summarizeModels(results []Result) []modelSummary {
+	var summaries []modelSummary
+	index := make(map[string]int)
+	for _, r := range results {
+		i, ok := index[r.Model]
+		if !ok {
+			i = len(summaries)
+			index[r.Model] = i
+			summaries = append(summaries, modelSummary{Model: r.Model})
+		}
+		s := &summaries[i]
+		s.Duration += r.Duration
+		s.Aider += r.AiderDuration
+		s.Bazel += r.BazelDuration
+		if r.Skipped {
+			continue
+		}
+		s.Attempted++
+		if r.Success {
+			s.Succeeded++
+		}
+		s.Attempts += r.Attempts
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Succeeded > summaries[j].Succeeded
+	})
+	return summaries
+}
+
+// printSummary writes a table of per-model totals followed by a line of
+// overall totals.
+func printSummary(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tATTEMPTED\tSUCCEEDED\tFAILED\tATTEMPTS\tDURATION\tAIDER\tBAZEL")
+	row := func(name string, s modelSummary) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", name, s.Attempted, s.Succeeded, s.Attempted-s.Succeeded, s.Attempts,
+			s.Duration.Round(time.Second), s.Aider.Round(time.Second), s.Bazel.Round(time.Second))
+	}
+	var total modelSummary
+	for _, s := range summarizeModels(results) {
+		row(s.Model, s)
+		total.Attempted += s.Attempted
+		total.Succeeded += s.Succeeded
+		total.Attempts += s.Attempts
+		total.Duration += s.Duration
+		total.Aider += s.Aider
+		total.Bazel += s.Bazel
+	}
+	row("total", total)
+	return tw.Flush()
+}
+
+// writeReport writes results, model verifications, the revisions of the repos
+// they came from and the run's estimated cost as an indented JSON Report to
+// path.
+func writeReport(path string, results []Result, verifications []migrate.ModelVerification, repos []RepoRevision) error {
+	report := Report{Repos: repos, Results: results, Repetitions: summarizeRepetitions(results), Models: verifications, EstimatedCostUSD: round2(costs.TotalCost())}
+	report.ModelTimings, report.TargetTimings = summarizeTimings(results)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	return nil
+}
+
+// readReport loads a Report previously written by writeReport.
+func readReport(path string) (Report, error) {
+	var report Report
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to read report %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, fmt.Errorf("failed to parse report %s: %w", path, err)
+	}
+	return report, nil
+}
+
+// Transition names how a model/target cell changed between two reports.
+type Transition string
+
+const (
+	NewlyPassed  Transition = "newly passed"
+	NewlyFailed  Transition = "newly failed"
+	StillPassing Transition = "still passing"
+	StillFailing Transition = "still failing"
+	OnlyInOld    Transition = "only in old"
+	OnlyInNew    Transition = "only in new"
+)
+
+// cellDiff compares one model/target cell across two reports. Target is
+// qualified with the repo, as by repoTarget.
+type cellDiff struct {
+	Model      string
+	Target     string
+	Transition Transition
+	// OldAttempts and NewAttempts are zero when the cell is missing from
+	// that report.
+	OldAttempts int
+	NewAttempts int
+}
+
+type cellKey struct {
+	repo       string
+	model      string
+	target     string
+	repetition int
+}
+
+// diffReports classifies every repo/model/target cell present in either
+// report, sorted by model then target.
+func diffReports(oldReport, newReport Report) []cellDiff {
+	oldCells := make(map[cellKey]Result)
+	for _, r := range oldReport.Results {
+		oldCells[cellKey{r.Repo, r.Model, r.Target, r.Repetition}] = r
+	}
+	newCells := make(map[cellKey]Result)
+	for _, r := range newReport.Results {
+		newCells[cellKey{r.Repo, r.Model, r.Target, r.Repetition}] = r
+	}
+
+	var diffs []cellDiff
+	for key, o := range oldCells {
+		n, ok := newCells[key]
+		d := cellDiff{Model: migrate.RunKey(key.model, key.repetition), Target: repoTarget(key.repo, key.target), OldAttempts: o.Attempts}
+		switch {
+		case !ok:
+			d.Transition = OnlyInOld
+		case !o.Success && n.Success:
+			d.Transition = NewlyPassed
+		case o.Success && !n.Success:
+			d.Transition = NewlyFailed
+		case o.Success:
+			d.Transition = StillPassing
+		default:
+			d.Transition = StillFailing
+		}
+		if ok {
+			d.NewAttempts = n.Attempts
+		}
+		diffs = append(diffs, d)
+	}
+	for key, n := range newCells {
+		if _, ok := oldCells[key]; ok {
+			continue
+		}
+		diffs = append(diffs, cellDiff{Model: migrate.RunKey(key.model, key.repetition), Target: repoTarget(key.repo, key.target), Transition: OnlyInNew, NewAttempts: n.Attempts})
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Model != diffs[j].Model {
+			return diffs[i].Model < diffs[j].Model
+		}
+		return diffs[i].Target < diffs[j].Target
+	})
+	return diffs
+}
+
+// printReportDiff writes a table of cell transitions followed by per-transition
+// counts and the total change in attempts and in the estimated cost, from
+// oldCost to newCost.
+func printReportDiff(w io.Writer, diffs []cellDiff, oldCost, newCost float64) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tTARGET\tCHANGE\tATTEMPTS")
+	counts := make(map[Transition]int)
+	var oldAttempts, newAttempts int
+	for _, d := range diffs {
+		counts[d.Transition]++
+		oldAttempts += d.OldAttempts
+		newAttempts += d.NewAttempts
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d -> %d (%+d)\n", d.Model, d.Target, d.Transition, d.OldAttempts, d.NewAttempts, d.NewAttempts-d.OldAttempts)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	for _, t := range []Transition{NewlyPassed, NewlyFailed, StillPassing, StillFailing, OnlyInOld, OnlyInNew} {
+		fmt.Fprintf(w, "%s: %d\n", t, counts[t])
+	}
+	fmt.Fprintf(w, "total attempts: %d -> %d (%+d)\n", oldAttempts, newAttempts, newAttempts-oldAttempts)
+	_, err := fmt.Fprintf(w, "estimated cost: $%.2f -> $%.2f (%+.2f)\n", oldCost, newCost, newCost-oldCost)
+	return err
+}
+
+// runDiffReports implements the diff-reports subcommand.
+func runDiffReports(w io.Writer, oldPath, newPath string) error {
+	oldReport, err := readReport(oldPath)
+	if err != nil {
+		return err
+	}
+	newReport, err := readReport(newPath)
+	if err != nil {
+		return err
+	}
+	return printReportDiff(w, diffReports(oldReport, newReport), oldReport.EstimatedCostUSD, newReport.EstimatedCostUSD)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunDiffReports(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.json")
+	newPath := filepath.Join(dir, "new.json")
+	if err := os.WriteFile(oldPath, []byte(`{
+  "results": [
+    {"model": "openrouter/a", "target": "//crates/cli", "success": true, "attempts": 2},
+    {"model": "openrouter/a", "target": "//crates/matcher", "success": false, "attempts": 5},
+    {"model": "openrouter/a", "target": "//:ripgrep", "success": true, "attempts": 1},
+    {"model": "openrouter/b", "target": "//crates/cli", "success": false, "attempts": 5},
+    {"model": "openrouter/b", "target": "//crates/regex", "success": true, "attempts": 3}
+  ],
+  "estimatedCostUSD": 1.5
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newPath, []byte(`{
+  "results": [
+    {"model": "openrouter/a", "target": "//crates/cli", "success": false, "attempts": 5},
+    {"model": "openrouter/a", "target": "//crates/matcher", "success": true, "attempts": 3},
+    {"model": "openrouter/a", "target": "//:ripgrep", "success": true, "attempts": 1},
+    {"model": "openrouter/b", "target": "//crates/cli", "success": false, "attempts": 4},
+    {"model": "openrouter/b", "target": "//crates/ignore", "success": true, "attempts": 2}
+  ],
+  "estimatedCostUSD": 1.25
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runDiffReports(&out, oldPath, newPath); err != nil {
+		t.Fatalf("runDiffReports: %v", err)
+	}
+	want := `MODEL         TARGET            CHANGE         ATTEMPTS
+openrouter/a  //:ripgrep        still passing  1 -> 1 (+0)
+openrouter/a  //crates/cli      newly failed   2 -> 5 (+3)
+openrouter/a  //crates/matcher  newly passed   5 -> 3 (-2)
+openrouter/b  //crates/cli      still failing  5 -> 4 (-1)
+openrouter/b  //crates/ignore   only in new    0 -> 2 (+2)
+openrouter/b  //crates/regex    only in old    3 -> 0 (-3)
+
+newly passed: 1
+newly failed: 1
+still passing: 1
+still failing: 1
+only in old: 1
+only in new: 1
+total attempts: 16 -> 15 (-1)
+estimated cost: $1.50 -> $1.25 (-0.25)
+`
+	if got := out.String(); got != want {
+		t.Errorf("runDiffReports output:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := runDiffReports(&out, oldPath, filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("runDiffReports with a missing report succeeded")
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	results := []Result{
+		{Model: "openrouter/a", Target: "//crates/cli", Attempts: 5, Duration: 90 * time.Second, AiderDuration: 60 * time.Second, BazelDuration: 25 * time.Second},
+		{Model: "openrouter/a", Target: "//:ripgrep", Success: true, Attempts: 2, Duration: 30*time.Second + 400*time.Millisecond, AiderDuration: 20 * time.Second, BazelDuration: 8 * time.Second},
+		{Model: "openrouter/b", Target: "//crates/cli", Success: true, Attempts: 1, Duration: 20 * time.Second, AiderDuration: 12 * time.Second, BazelDuration: 6 * time.Second},
+		{Model: "openrouter/b", Target: "//:ripgrep", Success: true, Attempts: 3, Duration: 45 * time.Second, AiderDuration: 30 * time.Second, BazelDuration: 10 * time.Second},
+		// Skipped by the circuit breaker: not attempted.
+		{Model: "openrouter/c", Target: "//crates/cli", Skipped: true},
+	}
+	var out bytes.Buffer
+	if err := printSummary(&out, results); err != nil {
+		t.Fatalf("printSummary: %v", err)
+	}
+	want := `MODEL         ATTEMPTED  SUCCEEDED  FAILED  ATTEMPTS  DURATION  AIDER  BAZEL
+openrouter/b  2          2          0       4         1m5s      42s    16s
+openrouter/a  2          1          1       7         2m0s      1m20s  33s
+openrouter/c  0          0          0       0         0s        0s     0s
+total         4          3          1       11        3m5s      2m2s   49s
+`
+	if got := out.String(); got != want {
+		t.Errorf("printSummary output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSummarizeRepetitions(t *testing.T) {
+	results := []Result{
+		{Model: "openrouter/a", Target: "//crates/cli", Success: true, Attempts: 2, Repetition: 1},
+		{Model: "openrouter/a", Target: "//:ripgrep", Attempts: 5, Repetition: 1},
+		{Model: "openrouter/b", Target: "//crates/cli", Success: true, Attempts: 1, Repetition: 1},
+		{Model: "openrouter/a", Target: "//crates/cli", Attempts: 5, Repetition: 2},
+		{Model: "openrouter/a", Target: "//:ripgrep", Success: true, Attempts: 4, Repetition: 2},
+		{Model: "openrouter/b", Target: "//crates/cli", Success: true, Attempts: 3, Repetition: 2},
+		{Model: "openrouter/a", Target: "//crates/cli", Success: true, Attempts: 1, Repetition: 3},
+		// The same model and target in another repo is summarized apart.
+		{Repo: "fd", Model: "openrouter/a", Target: "//crates/cli", Success: true, Attempts: 1, Repetition: 1},
+		// Results outside -repeat are ignored.
+		{Model: "openrouter/c", Target: "//crates/cli", Success: true, Attempts: 1},
+	}
+	got := summarizeRepetitions(results)
+	want := []RepetitionSummary{
+		{Model: "openrouter/a", Target: "//crates/cli", Successes: 2, Repetitions: 3, Attempts: []int{2, 5, 1}},
+		{Model: "openrouter/a", Target: "//:ripgrep", Successes: 1, Repetitions: 2, Attempts: []int{5, 4}},
+		{Model: "openrouter/b", Target: "//crates/cli", Successes: 2, Repetitions: 2, Attempts: []int{1, 3}},
+		{Repo: "fd", Model: "openrouter/a", Target: "//crates/cli", Successes: 1, Repetitions: 1, Attempts: []int{1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summarizeRepetitions =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := summarizeRepetitions(results[len(results)-1:]); got != nil {
+		t.Errorf("summarizeRepetitions without repetitions = %+v, want none", got)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// repoRun is one repository a run migrates: a clone of a config.Repos entry,
+// or the repository in the current directory.
+type repoRun struct {
+	// ID namespaces the repository's model branches, worktrees, logs and
+	// results. It is empty for the repository in the current directory.
+	ID     string
+	Dir    string
+	Branch string
+	// Ref is the -repo-ref checked out, if any, and SHA the commit the run
+	// started from.
+	Ref     string
+	SHA     string
+	Targets []string
+}
+
+// repoID derives a repoRun.ID from the owner and name at the end of repoURL,
+// e.g. "dan-stowell-ripgrep" for https://github.com/dan-stowell/ripgrep.git
+// or git@github.com:dan-stowell/ripgrep.git.
+func repoID(repoURL string) string {
+	path := strings.TrimSuffix(strings.TrimSuffix(repoURL, "/"), ".git")
+	path = strings.ReplaceAll(path, ":", "/")
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) > 2 {
+		parts = parts[len(parts)-2:]
+	}
+	return migrate.SanitizePath(strings.Join(parts, "-"))
+}
+
+// repoTarget qualifies target with repo, in the style of an external Bazel
+// label, when repo is set.
+func repoTarget(repo, target string) string {
+	if repo == "" {
+		return target
+	}
+	return "@" + repo + target
+}
+
+// prepareRepos clones each of repos into its own directory under dir, reusing
+// a clone left by an earlier run, checks out ref if it is set, and keeps the
+// targets that match pattern.
+func prepareRepos(ctx context.Context, repos []RepoConfig, dir, pattern, ref string) ([]repoRun, error) {
+	// Check every name before cloning anything.
+	seen := make(map[string]string)
+	for _, rc := range repos {
+		id := repoID(rc.URL)
+		if id == "" {
+			return nil, fmt.Errorf("cannot derive a name from repo URL %q", rc.URL)
+		}
+		if other, ok := seen[id]; ok {
+			return nil, fmt.Errorf("repos %s and %s would share the name %s", other, rc.URL, id)
+		}
+		seen[id] = rc.URL
+	}
+	var runs []repoRun
+	for _, rc := range repos {
+		id := repoID(rc.URL)
+		targets, err := filterByRegex(rc.Targets, pattern)
+		if err != nil {
+			return nil, err
+		}
+		cloneDir, err := filepath.Abs(filepath.Join(dir, id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve clone directory for %s: %w", rc.URL, err)
+		}
+		if _, err := os.Stat(filepath.Join(cloneDir, ".git")); err == nil {
+			slog.Info("Reusing existing clone", "repo", rc.URL, "dir", cloneDir)
+			if err := checkoutRef(ctx, cloneDir, ref); err != nil {
+				return nil, err
+			}
+		} else {
+			slog.Info("Cloning repo", "repo", rc.URL, "dir", cloneDir)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create repos directory: %w", err)
+			}
+			if err := cloneRepo(ctx, rc.URL, cloneDir, ref, authFromEnv()); err != nil {
+				return nil, err
+			}
+		}
+		branch, err := migrate.Branch(cloneDir)
+		if err != nil {
+			return nil, err
+		}
+		sha, err := migrate.HeadSHA(cloneDir)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Prepared repo", "repo", rc.URL, "branch", branch, "sha", sha)
+		runs = append(runs, repoRun{ID: id, Dir: cloneDir, Branch: branch, Ref: ref, SHA: sha, Targets: targets})
+	}
+	return runs, nil
+}
+
+// repoRevisions records the commit each of repos started from, for the
+// report.
+func repoRevisions(repos []repoRun) []RepoRevision {
+	var revisions []RepoRevision
+	for _, repo := range repos {
+		revisions = append(revisions, RepoRevision{Repo: repo.ID, Ref: repo.Ref, SHA: repo.SHA})
+	}
+	return revisions
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRepoID(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://github.com/dan-stowell/ripgrep", want: "dan-stowell-ripgrep"},
+		{url: "https://github.com/dan-stowell/ripgrep.git", want: "dan-stowell-ripgrep"},
+		{url: "https://github.com/dan-stowell/ripgrep/", want: "dan-stowell-ripgrep"},
+		{url: "git@github.com:BurntSushi/ripgrep.git", want: "BurntSushi-ripgrep"},
+		{url: "ssh://git@example.com/team/tool", want: "team-tool"},
+		{url: "/srv/git/tool", want: "git-tool"},
+		{url: "tool", want: "tool"},
+	}
+	for _, tt := range tests {
+		if got := repoID(tt.url); got != tt.want {
+			t.Errorf("repoID(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRepoTarget(t *testing.T) {
+	if got := repoTarget("", "//:ripgrep"); got != "//:ripgrep" {
+		t.Errorf("repoTarget without repo = %q, want //:ripgrep", got)
+	}
+	if got := repoTarget("dan-stowell-ripgrep", "//:ripgrep"); got != "@dan-stowell-ripgrep//:ripgrep" {
+		t.Errorf("repoTarget = %q, want @dan-stowell-ripgrep//:ripgrep", got)
+	}
+}
+
+func TestPrepareReposRejectsCollisions(t *testing.T) {
+	repos := []RepoConfig{
+		{URL: "https://github.com/a/tool"},
+		{URL: "https://gitlab.com/a/tool.git"},
+	}
+	_, err := prepareRepos(context.Background(), repos, t.TempDir(), "", "")
+	if err == nil || !strings.Contains(err.Error(), "share the name a-tool") {
+		t.Errorf("prepareRepos error = %v, want a name collision", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// crateShape is what seeding compares crates by: the rules a crate needs and
+// how many dependencies it has.
+type crateShape struct {
+	name      string
+	ruleKinds []string
+	deps      int
+}
+
+// cargoPackageName matches the name key of a Cargo.toml [package] table.
+var cargoPackageName = regexp.MustCompile(`^name\s*=\s*"([^"]+)"`)
+
+// cargoPackageInfo returns the package name and number of [dependencies]
+// entries declared in a Cargo.toml.
+func cargoPackageInfo(cargoToml string) (name string, deps int) {
+	section := ""
+	for _, line := range strings.Split(cargoToml, "\n") {
+		line = strings.TrimSpace(line)
+		if m := cargoSection.FindStringSubmatch(line); m != nil {
+			section = m[1]
+			if strings.HasPrefix(section, "dependencies.") {
+				deps++
+			}
+			continue
+		}
+		switch {
+		case section == "package" && name == "":
+			if m := cargoPackageName.FindStringSubmatch(line); m != nil {
+				name = m[1]
+			}
+		case section == "dependencies" && strings.Contains(line, "=") && !strings.HasPrefix(line, "#"):
+			deps++
+		}
+	}
+	return name, deps
+}
+
+// cargoRuleKinds returns the rules_rust rules the crate in dir needs, judging
+// by its standard source layout.
+func cargoRuleKinds(dir string) []string {
+	var kinds []string
+	for _, rule := range []struct{ path, kind string }{
+		{"src/lib.rs", "rust_library"},
+		{"src/main.rs", "rust_binary"},
+		{"tests", "rust_test"},
+	} {
+		if _, err := os.Stat(filepath.Join(dir, rule.path)); err == nil {
+			kinds = append(kinds, rule.kind)
+		}
+	}
+	return kinds
+}
+
+// buildRuleKind matches a rules_rust rule call at the start of a line.
+var buildRuleKind = regexp.MustCompile(`(?m)^(rust_\w+)\(`)
+
+// buildRuleKinds returns the distinct rules_rust rules called in a BUILD
+// file, sorted.
+func buildRuleKinds(content string) []string {
+	var kinds []string
+	for _, m := range buildRuleKind.FindAllStringSubmatch(content, -1) {
+		if !slices.Contains(kinds, m[1]) {
+			kinds = append(kinds, m[1])
+		}
+	}
+	slices.Sort(kinds)
+	return kinds
+}
+
+// shapeDistance scores how different two crates are; lower is more similar.
+// A differing set of rule kinds outweighs any difference in dependency count.
+func shapeDistance(a, b crateShape) int {
+	d := a.deps - b.deps
+	if d < 0 {
+		d = -d
+	}
+	for _, k := range a.ruleKinds {
+		if !slices.Contains(b.ruleKinds, k) {
+			d += 100
+		}
+	}
+	for _, k := range b.ruleKinds {
+		if !slices.Contains(a.ruleKinds, k) {
+			d += 100
+		}
+	}
+	return d
+}
+
+// substituteCrateName rewrites the crate name from to to in a BUILD file, in
+// both its Cargo (hyphenated) and Bazel (underscored) spellings.
+func substituteCrateName(content, from, to string) string {
+	underscore := func(s string) string { return strings.ReplaceAll(s, "-", "_") }
+	content = strings.ReplaceAll(content, underscore(from), underscore(to))
+	return strings.ReplaceAll(content, from, to)
+}
+
+// siblingSeedFor is the -seed-from-siblings seed for run.Target, in package
+// pkg: the BUILD.bazel of the most similar crate that already has rust rules,
+// adapted to pkg's crate.
+func siblingSeedFor(run migrate.Run, pkg string) (*migrate.Seed, error) {
+	content, sibling, err := siblingSeed(run.WorktreePath, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seed from a sibling crate: %w", err)
+	}
+	if content == nil {
+		return nil, nil
+	}
+	return &migrate.Seed{Content: content, Source: "sibling " + sibling}, nil
+}
+
+// siblingSeed returns a BUILD.bazel for the crate in pkg adapted from the
+// most similar crate in worktreePath that already has rust rules, and the
+// package it came from. It returns nil if there is no such crate.
+func siblingSeed(worktreePath, pkg string) ([]byte, string, error) {
+	cargo, err := os.ReadFile(filepath.Join(worktreePath, pkg, "Cargo.toml"))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read Cargo.toml for %s: %w", pkg, err)
+	}
+	name, deps := cargoPackageInfo(string(cargo))
+	if name == "" {
+		return nil, "", nil
+	}
+	want := crateShape{name: name, deps: deps, ruleKinds: cargoRuleKinds(filepath.Join(worktreePath, pkg))}
+	slices.Sort(want.ruleKinds)
+
+	var best []byte
+	var bestPkg string
+	bestDistance := -1
+	err = filepath.WalkDir(worktreePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if n := d.Name(); path != worktreePath && (n == ".git" || n == "target" || strings.HasPrefix(n, "bazel-")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "BUILD.bazel" {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		sibling, err := filepath.Rel(worktreePath, dir)
+		if err != nil {
+			return err
+		}
+		if sibling == "." {
+			sibling = ""
+		}
+		if sibling == pkg {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		kinds := buildRuleKinds(string(content))
+		if len(kinds) == 0 {
+			return nil
+		}
+		siblingCargo, err := os.ReadFile(filepath.Join(dir, "Cargo.toml"))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		siblingName, siblingDeps := cargoPackageInfo(string(siblingCargo))
+		if siblingName == "" {
+			return nil
+		}
+		distance := shapeDistance(want, crateShape{name: siblingName, deps: siblingDeps, ruleKinds: kinds})
+		if bestDistance < 0 || distance < bestDistance {
+			best = []byte(substituteCrateName(string(content), siblingName, name))
+			bestPkg = sibling
+			bestDistance = distance
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to search for sibling crates: %w", err)
+	}
+	return best, bestPkg, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCargoPackageInfo(t *testing.T) {
+	cargo := `[package]
+name = "grep-searcher"
+version = "0.1.14"
+
+[dependencies]
+bstr = { version = "1.6.2", default-features = false }
+grep-matcher = { version = "0.1.7", path = "../matcher" }
+# log = "0.4"
+memmap = { package = "memmap2", version = "0.9.0" }
+
+[dependencies.encoding_rs]
+version = "0.8.33"
+
+[dev-dependencies]
+regex = "1.9.5"
+`
+	name, deps := cargoPackageInfo(cargo)
+	if name != "grep-searcher" || deps != 4 {
+		t.Errorf("cargoPackageInfo = %q, %d; want grep-searcher, 4", name, deps)
+	}
+}
+
+func TestBuildRuleKinds(t *testing.T) {
+	content := `load("@rules_rust//rust:defs.bzl", "rust_library", "rust_test")
+
+rust_test(
+    name = "integration_test",
+)
+
+rust_library(
+    name = "grep_matcher",
+)
+
+rust_test(
+    name = "unit_test",
+)
+`
+	if got, want := buildRuleKinds(content), []string{"rust_library", "rust_test"}; !slices.Equal(got, want) {
+		t.Errorf("buildRuleKinds = %q, want %q", got, want)
+	}
+}
+
+func TestSiblingSeed(t *testing.T) {
+	root := t.TempDir()
+	// A library crate to migrate.
+	writeFile(t, filepath.Join(root, "crates/regex/Cargo.toml"), "[package]\nname = \"grep-regex\"\n\n[dependencies]\nregex = \"1\"\ngrep-matcher = { path = \"../matcher\" }\n")
+	writeFile(t, filepath.Join(root, "crates/regex/src/lib.rs"), "")
+	writeFile(t, filepath.Join(root, "crates/regex/BUILD.bazel"), "# created by bld.go\n")
+	// A migrated library crate with a similar dependency count.
+	writeFile(t, filepath.Join(root, "crates/matcher/Cargo.toml"), "[package]\nname = \"grep-matcher\"\n\n[dependencies]\nmemchr = \"2\"\n")
+	writeFile(t, filepath.Join(root, "crates/matcher/src/lib.rs"), "")
+	writeFile(t, filepath.Join(root, "crates/matcher/BUILD.bazel"), `rust_library(
+    name = "grep_matcher",
+    crate_name = "grep_matcher",
+    srcs = glob(["src/**/*.rs"]),
+    deps = ["@crates//:memchr"],
+)
+`)
+	// A migrated binary crate, which is the wrong shape.
+	writeFile(t, filepath.Join(root, "crates/cli/Cargo.toml"), "[package]\nname = \"grep-cli\"\n\n[dependencies]\nregex = \"1\"\nlog = \"0.4\"\n")
+	writeFile(t, filepath.Join(root, "crates/cli/BUILD.bazel"), "rust_binary(\n    name = \"grep_cli\",\n)\n")
+
+	seed, sibling, err := siblingSeed(root, "crates/regex")
+	if err != nil {
+		t.Fatalf("siblingSeed: %v", err)
+	}
+	if sibling != "crates/matcher" {
+		t.Errorf("sibling = %q, want crates/matcher", sibling)
+	}
+	if !strings.Contains(string(seed), `name = "grep_regex"`) || strings.Contains(string(seed), "grep_matcher") {
+		t.Errorf("crate name not substituted in seed:\n%s", seed)
+	}
+
+	if seed, _, err := siblingSeed(root, "crates/matcher"); err != nil || !strings.Contains(string(seed), "rust_binary") {
+		t.Errorf("siblingSeed for the only library = %q, %v; want the remaining binary crate", seed, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// interrupted is set once the run receives SIGINT or SIGTERM. Like a passed
+// -deadline, it stops new work from starting.
+var interrupted atomic.Bool
+
+// handleSignals makes the first SIGINT or SIGTERM stop the run gracefully:
+// no new work starts, cancel kills the running aider or bazel command, and the
+// interrupted target's changes are stashed before the partial report is
+// written. A second signal exits immediately. The returned func stops
+// handling signals.
+func handleSignals(cancel context.CancelFunc) (stop func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("Interrupted; stopping the current step, saving work and writing the report (signal again to force exit)", "signal", sig)
+			interrupted.Store(true)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s again; exiting without saving work\n", sig)
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	useTestLogger(t)
+	t.Cleanup(func() { interrupted.Store(false) })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := handleSignals(cancel)
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled after SIGTERM")
+	}
+	if !interrupted.Load() || !pastDeadline() {
+		t.Error("run not marked interrupted after SIGTERM")
+	}
+}
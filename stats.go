@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ModelStats accumulates a model's results across runs in the -model-stats
+// file. Attempts counts aider attempts; Successes and Failures count targets.
+type ModelStats struct {
+	Attempts        int   `json:"attempts"`
+	Successes       int   `json:"successes"`
+	Failures        int   `json:"failures"`
+	TotalDurationNs int64 `json:"totalDurationNs"`
+}
+
+// SuccessRate returns the fraction of targets the model built, or zero if it
+// has none.
+func (s ModelStats) SuccessRate() float64 {
+	if s.Successes+s.Failures == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(s.Successes+s.Failures)
+}
+
+// loadModelStats reads the -model-stats file at path, keyed by model name as
+// in the models list. A missing file is an empty history.
+func loadModelStats(path string) (map[string]ModelStats, error) {
+	stats := make(map[string]ModelStats)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model stats %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse model stats %s: %w", path, err)
+	}
+	return stats, nil
+}
+
+// saveModelStats writes stats to path as indented JSON.
+func saveModelStats(path string, stats map[string]ModelStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode model stats: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write model stats %s: %w", path, err)
+	}
+	return nil
+}
+
+// updateModelStats adds results to stats. Targets skipped by the circuit
+// breaker are not counted.
+func updateModelStats(stats map[string]ModelStats, results []Result) {
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+		model := strings.TrimPrefix(r.Model, "openrouter/")
+		s := stats[model]
+		s.Attempts += r.Attempts
+		if r.Success {
+			s.Successes++
+		} else {
+			s.Failures++
+		}
+		s.TotalDurationNs += int64(r.Duration)
+		stats[model] = s
+	}
+}
+
+// orderModelsByHistoricalSuccess returns models sorted by descending
+// historical success rate, so the likeliest to succeed run first. Models with
+// no history go last; ties keep their original order.
+func orderModelsByHistoricalSuccess(models []string, stats map[string]ModelStats) []string {
+	ordered := append([]string(nil), models...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		si, iok := stats[ordered[i]]
+		sj, jok := stats[ordered[j]]
+		if iok != jok {
+			return iok
+		}
+		return si.SuccessRate() > sj.SuccessRate()
+	})
+	return ordered
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOrderModelsByHistoricalSuccess(t *testing.T) {
+	stats := map[string]ModelStats{
+		"openai/gpt-5":              {Attempts: 12, Successes: 9, Failures: 1},
+		"qwen/qwen3-coder":          {Attempts: 30, Successes: 2, Failures: 8},
+		"anthropic/claude-sonnet-4": {Attempts: 10, Successes: 10},
+		"x-ai/grok-4":               {Attempts: 20, Successes: 5, Failures: 5},
+		"google/gemini-2.5-flash":   {},
+	}
+	models := []string{"new/model", "qwen/qwen3-coder", "x-ai/grok-4", "google/gemini-2.5-flash", "openai/gpt-5", "other/new-model", "anthropic/claude-sonnet-4"}
+	got := orderModelsByHistoricalSuccess(models, stats)
+	want := []string{"anthropic/claude-sonnet-4", "openai/gpt-5", "x-ai/grok-4", "qwen/qwen3-coder", "google/gemini-2.5-flash", "new/model", "other/new-model"}
+	if !slices.Equal(got, want) {
+		t.Errorf("orderModelsByHistoricalSuccess = %q, want %q", got, want)
+	}
+	if models[0] != "new/model" {
+		t.Errorf("orderModelsByHistoricalSuccess reordered its argument: %q", models)
+	}
+}
+
+func TestModelStatsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "modelStats.json")
+	stats, err := loadModelStats(path)
+	if err != nil || len(stats) != 0 {
+		t.Fatalf("loadModelStats of a missing file = %v, %v; want empty, nil", stats, err)
+	}
+	stats["openai/gpt-5"] = ModelStats{Attempts: 2, Successes: 1, TotalDurationNs: int64(time.Minute)}
+	updateModelStats(stats, []Result{
+		{Model: "openrouter/openai/gpt-5", Success: true, Attempts: 1, Duration: time.Second},
+		{Model: "openrouter/openai/gpt-5", Attempts: 3, Duration: time.Second},
+		{Model: "openrouter/openai/gpt-5", Skipped: true},
+		{Model: "openrouter/x-ai/grok-4", Success: true, Attempts: 2},
+	})
+	if err := saveModelStats(path, stats); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadModelStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ModelStats{
+		"openai/gpt-5": {Attempts: 6, Successes: 2, Failures: 1, TotalDurationNs: int64(time.Minute + 2*time.Second)},
+		"x-ai/grok-4":  {Attempts: 2, Successes: 1},
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("model stats after update = %+v, want %+v", got, want)
+	}
+}
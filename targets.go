@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/dan-stowell/migrate_ripgrep/migrate"
+)
+
+// parseTargetsFile reads Bazel target labels, one per line. Blank lines and
+// anything after a '#' are ignored. Labels must start with "//" or ":"; the
+// latter are taken relative to the root package. Duplicate labels and files
+// with no labels are errors.
+func parseTargetsFile(r io.Reader) ([]string, error) {
+	var targets []string
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		label := strings.TrimSpace(line)
+		if label == "" {
+			continue
+		}
+		if strings.ContainsAny(label, " \t") {
+			return nil, fmt.Errorf("line %d: %q is not a single Bazel label", lineNum, label)
+		}
+		switch {
+		case strings.HasPrefix(label, "//"):
+		case strings.HasPrefix(label, ":"):
+			label = "//" + label
+		default:
+			return nil, fmt.Errorf("line %d: %q is not a Bazel label (must start with // or :)", lineNum, label)
+		}
+		if first, ok := seen[label]; ok {
+			return nil, fmt.Errorf("line %d: duplicate target %s (first seen on line %d)", lineNum, label, first)
+		}
+		seen[label] = lineNum
+		targets = append(targets, label)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read targets: %w", err)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets found")
+	}
+	return targets, nil
+}
+
+// loadTargetsFile parses the targets file at path.
+func loadTargetsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open targets file: %w", err)
+	}
+	defer f.Close()
+	targets, err := parseTargetsFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return targets, nil
+}
+
+// rustTargetsQuery matches every Rust rule in the repo.
+const rustTargetsQuery = `kind("rust_.* rule", //...)`
+
+// bazelQueryRustTargets returns the Rust targets bazel query finds in repoDir,
+// in the order bazel prints them. The query needs a working MODULE.bazel, so
+// it fails in a repo that is not set up for bazel yet; finding no targets is
+// an error too.
+func bazelQueryRustTargets(repoDir string) ([]string, error) {
+	cmd := exec.Command("bazel", bazelCommand("query", "--output=label", rustTargetsQuery)...)
+	cmd.Dir = repoDir
+	out, err := wrapCommandWithTimeout(cmd, *bazelTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("bazel query %s failed: %w\n%s", rustTargetsQuery, err, out)
+	}
+	targets := parseQueryLabels(out)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("bazel query %s found no targets", rustTargetsQuery)
+	}
+	return targets, nil
+}
+
+// parseQueryLabels returns the labels in the output of bazel query
+// --output=label, skipping bazel's progress messages and duplicates.
+func parseQueryLabels(out []byte) []string {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		label := strings.TrimSpace(line)
+		if _, _, err := migrate.ParseTargetPackage(label); err != nil || strings.ContainsAny(label, " \t") || seen[label] {
+			continue
+		}
+		seen[label] = true
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// bazelQueryDependencyOrder orders targets so that each comes after the other
+// targets it depends on, as reported by bazel query in repoDir. If a query
+// fails, typically because BUILD files are still missing, it returns targets
+// in their original order along with the error.
+func bazelQueryDependencyOrder(repoDir string, targets []string) ([]string, error) {
+	byLabel := make(map[string]string, len(targets))
+	for _, target := range targets {
+		byLabel[migrate.CanonicalLabel(target)] = target
+	}
+	set := "set(" + strings.Join(targets, " ") + ")"
+	deps := make(map[string][]string, len(targets))
+	for _, target := range targets {
+		cmd := exec.Command("bazel", bazelCommand("query", "--output=label", fmt.Sprintf("deps(%s) intersect %s", target, set))...)
+		cmd.Dir = repoDir
+		out, err := wrapCommandWithTimeout(cmd, *bazelTimeout)
+		if err != nil {
+			return targets, fmt.Errorf("bazel query for the dependencies of %s failed: %w\n%s", target, err, out)
+		}
+		// Labels go to stdout, among bazel's progress messages on stderr.
+		for _, line := range strings.Split(string(out), "\n") {
+			dep, ok := byLabel[strings.TrimSpace(line)]
+			if ok && dep != target {
+				deps[target] = append(deps[target], dep)
+			}
+		}
+	}
+	return sortTargetsByDeps(targets, deps), nil
+}
+
+// sortTargetsByDeps returns targets in an order where each comes after its
+// deps, keeping the original order wherever the dependencies allow. Targets
+// on a dependency cycle keep their original order after everything else.
+func sortTargetsByDeps(targets []string, deps map[string][]string) []string {
+	done := make(map[string]bool, len(targets))
+	ready := func(target string) bool {
+		for _, dep := range deps[target] {
+			if !done[dep] {
+				return false
+			}
+		}
+		return true
+	}
+	var sorted []string
+	for len(sorted) < len(targets) {
+		progressed := false
+		for _, target := range targets {
+			if !done[target] && ready(target) {
+				done[target] = true
+				sorted = append(sorted, target)
+				progressed = true
+				break
+			}
+		}
+		if !progressed {
+			break
+		}
+	}
+	for _, target := range targets {
+		if !done[target] {
+			sorted = append(sorted, target)
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTargetsFile(t *testing.T) {
+	input := `# ripgrep crates, leaves first
+//crates/matcher:grep_matcher
+//crates/globset:globset   # trailing comment
+
+:ripgrep
+`
+	got, err := parseTargetsFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseTargetsFile returned error: %s", err)
+	}
+	want := []string{"//crates/matcher:grep_matcher", "//crates/globset:globset", "//:ripgrep"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseTargetsFile = %q, want %q", got, want)
+	}
+}
+
+func TestParseTargetsFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "empty", input: "", wantErr: "no targets"},
+		{name: "only comments", input: "# nothing here\n\n   # still nothing\n", wantErr: "no targets"},
+		{name: "missing slashes", input: "crates/matcher:grep_matcher\n", wantErr: "line 1"},
+		{name: "single slash", input: "//ok:ok\n/crates/cli:grep_cli\n", wantErr: "line 2"},
+		{name: "repo label", input: "@rules_rust//rust:defs\n", wantErr: "not a Bazel label"},
+		{name: "two labels on a line", input: "//a:a //b:b\n", wantErr: "single Bazel label"},
+		{name: "duplicate", input: "//a:a\n//b:b\n//a:a\n", wantErr: "duplicate target //a:a"},
+		{name: "duplicate after normalizing", input: "//:ripgrep\n:ripgrep\n", wantErr: "duplicate target //:ripgrep"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseTargetsFile(strings.NewReader(tc.input))
+			if err == nil {
+				t.Fatalf("parseTargetsFile(%q) succeeded, want error containing %q", tc.input, tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("parseTargetsFile(%q) error = %q, want it to contain %q", tc.input, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSortTargetsByDeps(t *testing.T) {
+	targets := []string{"//:ripgrep", "//crates/grep:grep", "//crates/cli:grep_cli", "//crates/matcher:grep_matcher", "//crates/globset:globset", "//crates/regex:grep_regex"}
+	tests := []struct {
+		name string
+		deps map[string][]string
+		want []string
+	}{
+		{
+			name: "no deps keeps order",
+			want: targets,
+		},
+		{
+			name: "ripgrep crates",
+			deps: map[string][]string{
+				"//:ripgrep":                {"//crates/grep:grep", "//crates/cli:grep_cli", "//crates/matcher:grep_matcher", "//crates/globset:globset", "//crates/regex:grep_regex"},
+				"//crates/grep:grep":        {"//crates/cli:grep_cli", "//crates/matcher:grep_matcher", "//crates/regex:grep_regex"},
+				"//crates/cli:grep_cli":     {"//crates/globset:globset"},
+				"//crates/regex:grep_regex": {"//crates/matcher:grep_matcher"},
+			},
+			want: []string{"//crates/matcher:grep_matcher", "//crates/globset:globset", "//crates/cli:grep_cli", "//crates/regex:grep_regex", "//crates/grep:grep", "//:ripgrep"},
+		},
+		{
+			name: "cycle goes last in original order",
+			deps: map[string][]string{
+				"//:ripgrep":            {"//crates/cli:grep_cli"},
+				"//crates/cli:grep_cli": {"//:ripgrep"},
+			},
+			want: []string{"//crates/grep:grep", "//crates/matcher:grep_matcher", "//crates/globset:globset", "//crates/regex:grep_regex", "//:ripgrep", "//crates/cli:grep_cli"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortTargetsByDeps(targets, tt.deps)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sortTargetsByDeps = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBazelQueryRustTargets(t *testing.T) {
+	useTestLogger(t)
+	fakeBazel(t, `echo "Loading: 0 packages loaded" >&2
+echo "//:ripgrep"
+echo "//crates/matcher:grep_matcher"
+echo "//:ripgrep"
+`)
+	got, err := bazelQueryRustTargets(t.TempDir())
+	if err != nil {
+		t.Fatalf("bazelQueryRustTargets: %v", err)
+	}
+	if want := []string{"//:ripgrep", "//crates/matcher:grep_matcher"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bazelQueryRustTargets = %q, want %q", got, want)
+	}
+
+	fakeBazel(t, `echo "ERROR: MODULE.bazel not found" >&2; exit 2`)
+	if got, err := bazelQueryRustTargets(t.TempDir()); err == nil {
+		t.Errorf("bazelQueryRustTargets with a failing query = %q, want error", got)
+	}
+	fakeBazel(t, `echo "Loading: 0 packages loaded" >&2`)
+	if got, err := bazelQueryRustTargets(t.TempDir()); err == nil {
+		t.Errorf("bazelQueryRustTargets with no targets = %q, want error", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// commandTimeoutGrace is how long a timed-out command has to exit after
+// SIGTERM before it is killed, and how long its output may then take to
+// drain.
+const commandTimeoutGrace = 10 * time.Second
+
+// wrapCommandWithTimeout runs cmd, recorded to the audit log, and returns its
+// combined output, which is also still written to cmd.Stdout and cmd.Stderr if
+// they are set. If cmd runs longer than timeout it is sent SIGTERM, then
+// SIGKILL after commandTimeoutGrace, and the returned error wraps
+// context.DeadlineExceeded. A timeout of zero or less waits indefinitely.
+func wrapCommandWithTimeout(cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	var output syncBuffer
+	cmd.Stdout = teeTo(cmd.Stdout, &output)
+	cmd.Stderr = teeTo(cmd.Stderr, &output)
+	// A killed command's children can hold its output pipes open.
+	cmd.WaitDelay = commandTimeoutGrace
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		record(cmd, start, nil, err)
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-expired:
+		timedOut = true
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case err = <-done:
+		case <-time.After(commandTimeoutGrace):
+			cmd.Process.Kill()
+			err = <-done
+		}
+	}
+	out := output.Bytes()
+	record(cmd, start, out, err)
+	if timedOut {
+		return out, fmt.Errorf("%s timed out after %v: %w", filepath.Base(cmd.Path), timeout, context.DeadlineExceeded)
+	}
+	return out, err
+}
+
+// teeTo returns a writer copying to both w, if set, and buf.
+func teeTo(w io.Writer, buf *syncBuffer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(w, buf)
+}
+
+// syncBuffer is a bytes.Buffer safe for a command's stdout and stderr to
+// write concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrapCommandWithTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not installed")
+	}
+
+	t.Run("completes", func(t *testing.T) {
+		var stdout bytes.Buffer
+		cmd := exec.Command("sh", "-c", "echo out; echo err >&2")
+		cmd.Stdout = &stdout
+		out, err := wrapCommandWithTimeout(cmd, time.Minute)
+		if err != nil {
+			t.Fatalf("wrapCommandWithTimeout: %v", err)
+		}
+		if !strings.Contains(string(out), "out") || !strings.Contains(string(out), "err") {
+			t.Errorf("output = %q, want stdout and stderr", out)
+		}
+		if stdout.String() != "out\n" {
+			t.Errorf("cmd.Stdout got %q, want %q", stdout.String(), "out\n")
+		}
+	})
+
+	t.Run("fails", func(t *testing.T) {
+		_, err := wrapCommandWithTimeout(exec.Command("sh", "-c", "exit 3"), time.Minute)
+		if exitCodeOf(err) != 3 || errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want exit status 3", err)
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		start := time.Now()
+		out, err := wrapCommandWithTimeout(exec.Command("sh", "-c", "echo started; exec sleep 60"), 200*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want context.DeadlineExceeded", err)
+		}
+		if elapsed := time.Since(start); elapsed > commandTimeoutGrace {
+			t.Errorf("took %v, want SIGTERM to stop the command promptly", elapsed)
+		}
+		if !strings.Contains(string(out), "started") {
+			t.Errorf("output = %q, want the output before the timeout", out)
+		}
+	})
+}
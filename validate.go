@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// warnNoBuildifier logs once that Starlark validation is being skipped.
+var warnNoBuildifier sync.Once
+
+// validateStarlark checks that content parses as a Starlark BUILD file by
+// running it through buildifier. name is only used in error messages. If
+// buildifier is not installed, validation is skipped.
+func validateStarlark(name, content string) error {
+	if _, err := exec.LookPath("buildifier"); err != nil {
+		warnNoBuildifier.Do(func() {
+			slog.Warn("buildifier not found on PATH; skipping Starlark validation")
+		})
+		return nil
+	}
+	cmd := exec.Command("buildifier", "--mode=check", "--lint=warn", "--type=build", "--path="+name)
+	cmd.Stdin = strings.NewReader(content)
+	out, err := auditCombinedOutput(cmd)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		// Exit code 1 means the input has syntax errors.
+		return fmt.Errorf("%s is not valid Starlark:\n%s", name, strings.TrimSpace(string(out)))
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 4:
+		// Exit code 4 means the file parsed but needs reformatting or has
+		// lint warnings, neither of which should block a build attempt.
+		slog.Debug("buildifier warnings", "file", name, "output", strings.TrimSpace(string(out)))
+		return nil
+	default:
+		return fmt.Errorf("buildifier failed on %s: %v\n%s", name, err, string(out))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateStarlark(t *testing.T) {
+	if _, err := exec.LookPath("buildifier"); err != nil {
+		t.Skip("buildifier not installed")
+	}
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "empty", content: ""},
+		{name: "rule", content: "rust_library(\n    name = \"grep_matcher\",\n    srcs = glob([\"src/**/*.rs\"]),\n)\n"},
+		{name: "load and list", content: "load(\"@rules_rust//rust:defs.bzl\", \"rust_binary\")\n\nrust_binary(name = \"rg\", deps = [\":grep\"])\n"},
+		{name: "unformatted", content: "rust_library(name=\"grep_matcher\",srcs=[\"lib.rs\"])\n"},
+		{name: "unclosed paren", content: "rust_library(name = \"grep_matcher\"\n", wantErr: true},
+		{name: "unterminated string", content: "rust_library(name = \"grep_matcher)\n", wantErr: true},
+		{name: "missing comma", content: "rust_library(name = \"a\" srcs = [])\n", wantErr: true},
+		{name: "stray diff marker", content: "<<<<<<< SEARCH\nrust_library(name = \"a\")\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStarlark("BUILD.bazel", tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateStarlark(%q) = %v, wantErr %v", tt.content, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateStarlarkExitCodes(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	tests := []struct {
+		name    string
+		script  string
+		wantErr bool
+	}{
+		{name: "formatted", script: "exit 0\n"},
+		{name: "syntax error", script: "echo 'BUILD.bazel:1:30: syntax error near )' >&2; exit 1\n", wantErr: true},
+		{name: "lint warnings", script: "echo 'BUILD.bazel:1: name-conventions' >&2; exit 4\n"},
+		{name: "bad flags", script: "echo 'unknown flag' >&2; exit 2\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "buildifier"), []byte("#!/bin/sh\n"+tt.script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+			err := validateStarlark("BUILD.bazel", "rust_library(name = \"grep_matcher\")\n")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateStarlark = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}